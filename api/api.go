@@ -13,5 +13,7 @@ type API interface {
 	Describe() ClientInfo
 	GetNodeRule() (ruleList *[]DetectRule, err error)
 	ReportIllegal(detectResultList *[]DetectResult) (err error)
+	ReportNodeInfoChange(change *NodeInfoChange) (err error) // Embed NoNodeInfoChange if the panel does not take it
+	ReportUserLastSeen(lastSeen *[]UserLastSeen) (err error) // Embed NoUserLastSeen if the panel does not take it
 	Debug()
 }
@@ -2,26 +2,57 @@ package api
 
 // API config
 type Config struct {
-	APIHost     string `mapstructure:"ApiHost"`
-	NodeID      int    `mapstructure:"NodeID"`
-	Key         string `mapstructure:"ApiKey"`
-	NodeType    string `mapstructure:"NodeType"`
-	EnableVless bool   `mapstructure:"EnableVless"`
-	EnableXTLS  bool   `mapstructure:"EnableXTLS"`
+	APIHost          string      `mapstructure:"ApiHost"`
+	SecondaryAPIHost string      `mapstructure:"SecondaryApiHost"` // Standby panel to fetch from while the primary is unavailable
+	NodeID           int         `mapstructure:"NodeID"`
+	Key              string      `mapstructure:"ApiKey"`
+	NodeType         string      `mapstructure:"NodeType"`
+	EnableVless      bool        `mapstructure:"EnableVless"`
+	EnableXTLS       bool        `mapstructure:"EnableXTLS"`
+	SignConfig       *SignConfig `mapstructure:"SignConfig"`    // Sign each request besides the ApiKey, nil means only the ApiKey
+	GzipThreshold    int         `mapstructure:"GzipThreshold"` // Gzip the traffic and online user reports larger than this many bytes, the panel must accept it. 0 means no compression
+	PageConfig       *PageConfig `mapstructure:"PageConfig"`    // Fetch the user list page by page, nil means the panel returns all the users at once
+}
+
+// PageConfig is the pagination of the user list of the panels that cap the users of a response
+type PageConfig struct {
+	Mode     string `mapstructure:"Mode"`     // page (default): the page and page_size params, the last page has fewer users. cursor: the cursor and page_size params, the response has the next_cursor until the last page
+	PageSize int    `mapstructure:"PageSize"` // Users of each page, default 500
+	MaxPages int    `mapstructure:"MaxPages"` // Fail the fetch after this many pages of a misbehaving panel, default 1000
 }
 
 // Node status
 type NodeStatus struct {
 	CPU    float64
-	Mem    float64
+	Mem    float64 // Used percent, based on the available memory
 	Disk   float64
 	Uptime int
+	// Memory in bytes, limited to the cgroup of the container
+	MemTotal     uint64
+	MemUsed      uint64
+	MemAvailable uint64
+	// The online devices at the report, and the most of them sampled since the last report
+	OnlineUsers     int
+	PeakOnlineUsers int
+	// The traffic through the outbound of the node since the last report, including the connections routed to it from the other nodes
+	OutboundUpload   int64
+	OutboundDownload int64
+	// Disk throughput in bytes per second since the last report, of the root filesystem device or the configured one
+	DiskRead  uint64
+	DiskWrite uint64
+	// The versions the node runs, and the seconds since its controller started, unlike Uptime of the system
+	Version          string
+	CoreVersion      string
+	ControllerUptime int
+	// The failed dispatches of the connections since the last report by the category, like dial or rule_reject. Only set with ReportFailures
+	DispatchFailures map[string]int64
 }
 
 type NodeInfo struct {
-	NodeType          string // Must be V2ray, Trojan, and Shadowsocks
+	NodeType          string // Must be V2ray, Trojan, Shadowsocks and Hysteria2
 	NodeID            int
 	Port              int
+	ExtraPorts        string // Additional ports or port ranges to listen on, e.g. 8443,10000-10100
 	SpeedLimit        uint64 // Bps
 	AlterID           int
 	TransportProtocol string
@@ -30,27 +61,82 @@ type NodeInfo struct {
 	EnableTLS         bool
 	TLSType           string
 	EnableVless       bool
+	WSConfig          *WSConfig
+	KCPConfig         *KCPConfig
+	GRPCConfig        *GRPCConfig
+	Hysteria2Config   *Hysteria2Config
+	SSPluginConfig    *SSPluginConfig
+	Method            string // The cipher all the users of a single-port Shadowsocks node must use, empty means each user uses its own
+}
+
+// WSConfig is the extra websocket settings of a node, the zero values leave them off
+type WSConfig struct {
+	MaxEarlyData        uint32            // Max bytes of the early data sent in the handshake, 0 means off
+	EarlyDataHeaderName string            // Request header carrying the early data, Sec-WebSocket-Protocol if empty
+	Headers             map[string]string // Extra request headers, e.g. the headers forwarded by the browser dialer
+}
+
+// GRPCConfig is the gRPC transport settings of a node
+type GRPCConfig struct {
+	ServiceName string
+	MultiMode   bool
+}
+
+// Hysteria2Config is the settings of a Hysteria2 node
+type Hysteria2Config struct {
+	UpMbps       int    // Max bandwidth from the server to a client, 0 means unlimited
+	DownMbps     int    // Max bandwidth from a client to the server, 0 means unlimited
+	ObfsPassword string // Password of the salamander obfuscation, empty means no obfuscation
+}
+
+// SSPluginConfig is the SIP003 plugin of a Shadowsocks node, which is served by the transport of the inbound
+type SSPluginConfig struct {
+	Plugin string // obfs (simple-obfs) or v2ray-plugin
+	Mode   string // http for obfs, websocket for v2ray-plugin
+	Host   string // The obfs host, or the websocket host of v2ray-plugin
+	Path   string // The path of the obfs HTTP request or the websocket
+}
+
+// KCPConfig is the mKCP settings of a node, the zero values mean the xray-core defaults
+type KCPConfig struct {
+	HeaderType string // none, srtp, utp, wechat-video, dtls, wireguard
+	Seed       string
+	MTU        uint32
+	TTI        uint32
 }
 
 type UserInfo struct {
-	UID           int
-	EmailTag      string
-	Email         string
-	Passwd        string
-	Port          int
-	Method        string
-	SpeedLimit    uint64 // Bps
-	DeviceLimit   int
-	Protocol      string
-	ProtocolParam string
-	Obfs          string
-	ObfsParam     string
-	UUID          string
+	UID                int
+	EmailTag           string
+	Email              string
+	Passwd             string
+	Port               int
+	Method             string
+	SpeedLimit         uint64 // Bps, the lower of it and the node limit applies. 0 means the node one
+	DeviceLimit        int
+	IPSpeedLimit       uint64   // Bps of each source IP, overrides the IPSpeedLimit of the node. 0 means the node one
+	UploadSpeedLimit   uint64   // Bps of the upload, overrides the UploadSpeedLimit of the node. 0 means the node one
+	DownloadSpeedLimit uint64   // Bps of the download, overrides the DownloadSpeedLimit of the node. 0 means the node one
+	ConnLimit          int      // Max connections across all the IPs, overrides the ConnLimit of the node. 0 means the node one
+	BurstMultiplier    float64  // Bucket size in seconds of the speed limit, overrides the BurstMultiplier of the node. 0 means the node one
+	DeviceWhitelist    string   // Comma separated IPs or CIDRs that do not count against the device limit
+	UnlimitedDevices   bool     // Not device limited at all, like the service accounts connecting from many IPs. Still reported online
+	TrafficMultiplier  *float64 // Factor of the reported traffic, e.g. 0.5 or 2. 0 means not counted, nil means 1
+	DataLimit          uint64   // Bytes the user may transfer, its new connections are refused once used up. 0 means unlimited
+	DataUsed           uint64   // Bytes the user has transferred as counted by the panel, the traffic reported since adds to it
+	Level              int
+	Protocol           string
+	ProtocolParam      string
+	Obfs               string
+	ObfsParam          string
+	UUID               string
 }
 
 type OnlineUser struct {
-	UID int
-	IP  string
+	UID     int
+	IP      string
+	Country string `json:",omitempty"` // Country code of the IP, only set with OnlineIPLocation
+	ASN     string `json:",omitempty"` // Autonomous system of the IP, only set with OnlineIPLocation and an AS<number> list in geoip.dat
 }
 
 type UserTraffic struct {
@@ -58,6 +144,14 @@ type UserTraffic struct {
 	Email    string
 	Upload   int64
 	Download int64
+	SNI      []string // The sniffed TLS server names the user connected to, only if the node reports them
+	// The parts of the Upload and Download over TCP and UDP
+	TCPUpload   int64
+	TCPDownload int64
+	UDPUpload   int64
+	UDPDownload int64
+	// The bytes left of the DataLimit of the user after this traffic, nil if the user has no data limit
+	DataRemaining *uint64
 }
 
 type ClientInfo struct {
@@ -68,8 +162,17 @@ type ClientInfo struct {
 }
 
 type DetectRule struct {
-	ID      int
-	Pattern string
+	ID       int
+	Pattern  string
+	Schedule *RuleSchedule // The time window the rule is active in, nil means always
+}
+
+// RuleSchedule is the time window of a detect rule, the rule is inert outside it
+type RuleSchedule struct {
+	Days     []int  // Days of the week the window starts on, 0 is Sunday. Empty means every day
+	Start    string // Start of the window, e.g. 08:00
+	End      string // End of the window, e.g. 17:30. An end before the start spans midnight, and equal to the start means all day
+	Timezone string // IANA time zone, e.g. Asia/Shanghai. Empty means the local time zone
 }
 
 type DetectResult struct {
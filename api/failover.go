@@ -0,0 +1,247 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxPendingReports is the max reports queued while the primary panel is unavailable, the oldest one is dropped
+const maxPendingReports = 100
+
+// UnavailableError marks the errors of a panel which can not be reached or fails on the server side,
+// the same request may succeed on the other backend
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// IsUnavailable reports whether the error is caused by an unavailable panel
+func IsUnavailable(err error) bool {
+	var unavailable *UnavailableError
+	return errors.As(err, &unavailable)
+}
+
+// Failover wraps the clients of the primary panel and its standby. The fetches go to the standby while the primary
+// is unavailable, and back to the primary once it recovers. The primary is tried again every failoverRetryInterval
+// while failed over, so the fetches in between do not wait for its timeouts. The reports only go to the primary,
+// the illegal and the last seen reports are queued while it is unavailable and sent in order when it is reachable
+// again. The traffic reports fail instead, the controller reports the traffic again.
+type Failover struct {
+	primary     API
+	secondary   API
+	Now         func() time.Time // Clock of the retries of the primary, can be replaced in tests
+	access      sync.Mutex       // Guards the state below, it is not held during the requests
+	onSecondary bool
+	retryAt     time.Time // The primary is tried again from then on while failed over
+	pending     []func(API) error
+	flushing    bool
+	sending     sync.Mutex // Keeps the reports to the primary in order, the pending only changes while it is held
+}
+
+// failoverRetryInterval is how long the primary is skipped after it was found unavailable
+const failoverRetryInterval = time.Minute
+
+func NewFailover(primary API, secondary API) *Failover {
+	return &Failover{
+		primary:   primary,
+		secondary: secondary,
+		Now:       time.Now,
+	}
+}
+
+// fetch tries the primary first, and the secondary if the primary is unavailable
+func (f *Failover) fetch(do func(API) error) error {
+	f.access.Lock()
+	skip := f.skipPrimary()
+	f.access.Unlock()
+	if skip {
+		return do(f.secondary)
+	}
+	err := do(f.primary)
+	if IsUnavailable(err) {
+		f.failOver(err)
+		return do(f.secondary)
+	}
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.onSecondary {
+		log.Printf("Primary panel %s recovered, fail back to it", f.primary.Describe().APIHost)
+		f.onSecondary = false
+	}
+	// The queued reports are sent apart, the fetch does not wait for them
+	if err == nil && len(f.pending) > 0 && !f.flushing {
+		f.flushing = true
+		go func() {
+			f.sending.Lock()
+			defer f.sending.Unlock()
+			f.flush()
+			f.access.Lock()
+			f.flushing = false
+			f.access.Unlock()
+		}()
+	}
+	return err
+}
+
+// skipPrimary reports whether the primary failed within the retry interval, the access must be held
+func (f *Failover) skipPrimary() bool {
+	return f.onSecondary && f.Now().Before(f.retryAt)
+}
+
+// failOver sends the fetches to the secondary until the retry interval passes
+func (f *Failover) failOver(err error) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	if !f.onSecondary {
+		log.Printf("Primary panel %s is unavailable, fail over to %s: %s", f.primary.Describe().APIHost, f.secondary.Describe().APIHost, err)
+		f.onSecondary = true
+	}
+	f.retryAt = f.Now().Add(failoverRetryInterval)
+}
+
+// report sends the queued reports and then this one to the primary, the report is queued if the primary is unavailable
+func (f *Failover) report(do func(API) error) error {
+	f.sending.Lock()
+	defer f.sending.Unlock()
+	f.flush()
+	f.access.Lock()
+	queued := len(f.pending) > 0 || f.skipPrimary()
+	if queued {
+		f.queue(do)
+	}
+	f.access.Unlock()
+	if queued {
+		return nil
+	}
+	err := do(f.primary)
+	if IsUnavailable(err) {
+		log.Printf("Queue the report until the primary panel is available: %s", err)
+		f.failOver(err)
+		f.access.Lock()
+		f.queue(do)
+		f.access.Unlock()
+		return nil
+	}
+	return err
+}
+
+// queue adds the report to the pending ones, the sending and the access must be held
+func (f *Failover) queue(do func(API) error) {
+	if len(f.pending) >= maxPendingReports {
+		log.Printf("Drop the oldest queued report, %d reports are queued", len(f.pending))
+		f.pending = f.pending[1:]
+	}
+	f.pending = append(f.pending, do)
+}
+
+// flush sends the queued reports in order, until the primary is unavailable again. The sending must be held
+func (f *Failover) flush() {
+	for {
+		f.access.Lock()
+		if len(f.pending) == 0 || f.skipPrimary() {
+			f.access.Unlock()
+			return
+		}
+		do := f.pending[0]
+		f.access.Unlock()
+		err := do(f.primary)
+		if IsUnavailable(err) {
+			f.failOver(err)
+			return
+		}
+		if err != nil {
+			log.Printf("Drop the queued report: %s", err)
+		}
+		f.access.Lock()
+		f.pending = f.pending[1:]
+		f.access.Unlock()
+	}
+}
+
+func (f *Failover) GetNodeInfo() (nodeInfo *NodeInfo, err error) {
+	err = f.fetch(func(client API) (err error) {
+		nodeInfo, err = client.GetNodeInfo()
+		return err
+	})
+	return nodeInfo, err
+}
+
+func (f *Failover) GetUserList() (userList *[]UserInfo, err error) {
+	err = f.fetch(func(client API) (err error) {
+		userList, err = client.GetUserList()
+		return err
+	})
+	return userList, err
+}
+
+func (f *Failover) GetNodeRule() (ruleList *[]DetectRule, err error) {
+	err = f.fetch(func(client API) (err error) {
+		ruleList, err = client.GetNodeRule()
+		return err
+	})
+	return ruleList, err
+}
+
+// ReportNodeStatus is not queued, the status is out of date by the time the primary recovers
+func (f *Failover) ReportNodeStatus(nodeStatus *NodeStatus) (err error) {
+	return f.primary.ReportNodeStatus(nodeStatus)
+}
+
+// ReportNodeOnlineUsers is not queued, the online users are out of date by the time the primary recovers
+func (f *Failover) ReportNodeOnlineUsers(onlineUser *[]OnlineUser) (err error) {
+	return f.primary.ReportNodeOnlineUsers(onlineUser)
+}
+
+// ReportUserTraffic is not queued, the failed traffic is returned to the controller, which reports it again and keeps
+// it in its buffer across restarts. While failed over it fails at once, without waiting for the primary
+func (f *Failover) ReportUserTraffic(userTraffic *[]UserTraffic) (err error) {
+	f.access.Lock()
+	skip := f.skipPrimary()
+	f.access.Unlock()
+	if skip {
+		return &UnavailableError{Err: fmt.Errorf("primary panel %s is unavailable", f.primary.Describe().APIHost)}
+	}
+	if err = f.primary.ReportUserTraffic(userTraffic); IsUnavailable(err) {
+		f.failOver(err)
+	}
+	return err
+}
+
+func (f *Failover) ReportIllegal(detectResultList *[]DetectResult) (err error) {
+	detectResults := append([]DetectResult(nil), *detectResultList...)
+	return f.report(func(client API) error {
+		return client.ReportIllegal(&detectResults)
+	})
+}
+
+func (f *Failover) ReportUserLastSeen(lastSeen *[]UserLastSeen) (err error) {
+	userLastSeen := append([]UserLastSeen(nil), *lastSeen...)
+	return f.report(func(client API) error {
+		return client.ReportUserLastSeen(&userLastSeen)
+	})
+}
+
+// ReportNodeInfoChange is not queued, the primary gets the node info of the change when it recovers
+func (f *Failover) ReportNodeInfoChange(change *NodeInfoChange) (err error) {
+	return f.primary.ReportNodeInfoChange(change)
+}
+
+// Describe returns the description of the primary client
+func (f *Failover) Describe() ClientInfo {
+	return f.primary.Describe()
+}
+
+func (f *Failover) Debug() {
+	f.primary.Debug()
+	f.secondary.Debug()
+}
@@ -0,0 +1,207 @@
+package api_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// testAPI is a panel which fails with the error, and records the reported traffic and illegal users
+type testAPI struct {
+	api.NoNodeInfoChange
+	api.NoUserLastSeen
+	host    string
+	err     error
+	fetches int
+	access  sync.Mutex // The queued reports are sent apart from the fetches
+	traffic [][]api.UserTraffic
+	illegal [][]api.DetectResult
+	block   chan struct{} // The reports wait for it to be closed if set
+}
+
+func (a *testAPI) GetNodeInfo() (*api.NodeInfo, error) {
+	a.fetches++
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &api.NodeInfo{NodeType: a.host}, nil
+}
+
+func (a *testAPI) GetUserList() (*[]api.UserInfo, error)         { return &[]api.UserInfo{}, a.err }
+func (a *testAPI) ReportNodeStatus(*api.NodeStatus) error        { return a.err }
+func (a *testAPI) ReportNodeOnlineUsers(*[]api.OnlineUser) error { return a.err }
+func (a *testAPI) Describe() api.ClientInfo                      { return api.ClientInfo{APIHost: a.host} }
+func (a *testAPI) GetNodeRule() (*[]api.DetectRule, error)       { return &[]api.DetectRule{}, a.err }
+func (a *testAPI) Debug()                                        {}
+func (a *testAPI) ReportUserTraffic(traffic *[]api.UserTraffic) error {
+	if a.block != nil {
+		<-a.block
+	}
+	if a.err != nil {
+		return a.err
+	}
+	a.access.Lock()
+	defer a.access.Unlock()
+	a.traffic = append(a.traffic, *traffic)
+	return nil
+}
+
+func (a *testAPI) ReportIllegal(detectResults *[]api.DetectResult) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.access.Lock()
+	defer a.access.Unlock()
+	a.illegal = append(a.illegal, *detectResults)
+	return nil
+}
+
+func (a *testAPI) reported() [][]api.UserTraffic {
+	a.access.Lock()
+	defer a.access.Unlock()
+	return append([][]api.UserTraffic(nil), a.traffic...)
+}
+
+func (a *testAPI) reportedIllegal() [][]api.DetectResult {
+	a.access.Lock()
+	defer a.access.Unlock()
+	return append([][]api.DetectResult(nil), a.illegal...)
+}
+
+// newTestFailover returns the failover of the panels, and a function which moves its clock forward
+func newTestFailover(primary, secondary api.API) (*api.Failover, func(time.Duration)) {
+	client := api.NewFailover(primary, secondary)
+	var access sync.Mutex
+	now := time.Now()
+	client.Now = func() time.Time {
+		access.Lock()
+		defer access.Unlock()
+		return now
+	}
+	return client, func(d time.Duration) {
+		access.Lock()
+		defer access.Unlock()
+		now = now.Add(d)
+	}
+}
+
+var errUnavailable = &api.UnavailableError{Err: errors.New("connection refused")}
+
+func TestFailoverFetch(t *testing.T) {
+	primary, secondary := &testAPI{host: "primary"}, &testAPI{host: "secondary"}
+	client, advance := newTestFailover(primary, secondary)
+	fetch := func() string {
+		nodeInfo, err := client.GetNodeInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nodeInfo.NodeType
+	}
+	if got := fetch(); got != "primary" {
+		t.Fatalf("the primary should be fetched first, got %s", got)
+	}
+	primary.err = errUnavailable
+	if got := fetch(); got != "secondary" {
+		t.Fatalf("the secondary should be fetched while the primary is unavailable, got %s", got)
+	}
+	// The fetches within the retry interval do not wait for the primary
+	primary.err = nil
+	if got := fetch(); got != "secondary" || primary.fetches != 2 {
+		t.Fatalf("the primary should not be tried again within the retry interval, got %s after %d fetches", got, primary.fetches)
+	}
+	advance(2 * time.Minute)
+	if got := fetch(); got != "primary" {
+		t.Fatalf("the primary should be fetched again once it recovers, got %s", got)
+	}
+}
+
+func TestFailoverFetchError(t *testing.T) {
+	primary, secondary := &testAPI{host: "primary", err: errors.New("Ret invalid")}, &testAPI{host: "secondary"}
+	client := api.NewFailover(primary, secondary)
+	if _, err := client.GetNodeInfo(); err == nil {
+		t.Fatal("the error of the primary should be returned")
+	}
+	if secondary.fetches != 0 {
+		t.Error("the secondary should not be fetched if the primary answers")
+	}
+}
+
+func TestFailoverQueueReport(t *testing.T) {
+	primary, secondary := &testAPI{host: "primary", err: errUnavailable}, &testAPI{host: "secondary"}
+	client, advance := newTestFailover(primary, secondary)
+	for uid := 1; uid <= 2; uid++ {
+		if err := client.ReportIllegal(&[]api.DetectResult{{UID: uid, RuleID: 1}}); err != nil {
+			t.Fatalf("the report should be queued, got %s", err)
+		}
+	}
+	if len(secondary.reportedIllegal()) != 0 {
+		t.Fatal("the illegal users should not be reported to the secondary")
+	}
+	primary.err = nil
+	advance(2 * time.Minute)
+	if _, err := client.GetNodeInfo(); err != nil {
+		t.Fatal(err)
+	}
+	// The queued reports are sent apart from the fetch
+	var illegal [][]api.DetectResult
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if illegal = primary.reportedIllegal(); len(illegal) == 2 {
+			break
+		}
+	}
+	if len(illegal) != 2 || illegal[0][0].UID != 1 || illegal[1][0].UID != 2 {
+		t.Errorf("the queued reports should be sent in order once the primary recovers, got %v", illegal)
+	}
+}
+
+func TestFailoverReportTraffic(t *testing.T) {
+	primary, secondary := &testAPI{host: "primary", err: errUnavailable}, &testAPI{host: "secondary"}
+	client, advance := newTestFailover(primary, secondary)
+	// The traffic is not queued, the caller reports it again
+	if err := client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1}}); !api.IsUnavailable(err) {
+		t.Fatalf("the report to the unavailable primary should fail, got %v", err)
+	}
+	primary.err = nil
+	if err := client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1}}); !api.IsUnavailable(err) {
+		t.Fatalf("the report within the retry interval should fail at once, got %v", err)
+	}
+	if len(primary.reported()) != 0 || len(secondary.reported()) != 0 {
+		t.Fatal("the traffic should not be reported while failed over")
+	}
+	advance(2 * time.Minute)
+	if err := client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.reported()) != 1 {
+		t.Errorf("the traffic should be reported to the primary once it is tried again, got %v", primary.reported())
+	}
+}
+
+func TestFailoverFetchDuringReport(t *testing.T) {
+	primary, secondary := &testAPI{host: "primary", block: make(chan struct{})}, &testAPI{host: "secondary"}
+	client, _ := newTestFailover(primary, secondary)
+	reported := make(chan error)
+	go func() {
+		reported <- client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1}})
+	}()
+	fetched := make(chan error)
+	go func() {
+		_, err := client.GetNodeInfo()
+		fetched <- err
+	}()
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch should not wait for the report to the primary")
+	}
+	close(primary.block)
+	if err := <-reported; err != nil {
+		t.Fatal(err)
+	}
+}
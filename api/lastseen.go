@@ -0,0 +1,15 @@
+package api
+
+// UserLastSeen is the last time the user had traffic or was online on the node
+type UserLastSeen struct {
+	UID      int
+	LastSeen int64 // Unix time in seconds
+}
+
+// NoUserLastSeen is the ReportUserLastSeen of the panels which do not take the last seen time of the users,
+// embed it to implement the method as a no-op
+type NoUserLastSeen struct{}
+
+func (NoUserLastSeen) ReportUserLastSeen(lastSeen *[]UserLastSeen) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// NodeInfoChange is a change of the node info applied by the node
+type NodeInfoChange struct {
+	Old     *NodeInfo
+	New     *NodeInfo
+	Summary string // The changed fields, e.g. Port: 443 -> 8443, TransportProtocol: ws -> grpc
+}
+
+// NoNodeInfoChange is the ReportNodeInfoChange of the panels which do not take the node info changes,
+// embed it to implement the method as a no-op
+type NoNodeInfoChange struct{}
+
+func (NoNodeInfoChange) ReportNodeInfoChange(change *NodeInfoChange) error {
+	return nil
+}
+
+// nodeInfoChangeValues are the fields of the node info whose values are safe to show in the summary, which goes
+// to the panel, the webhook and the logs
+var nodeInfoChangeValues = map[string]bool{
+	"NodeType":          true,
+	"NodeID":            true,
+	"Port":              true,
+	"ExtraPorts":        true,
+	"SpeedLimit":        true,
+	"TransportProtocol": true,
+	"EnableTLS":         true,
+	"TLSType":           true,
+	"EnableVless":       true,
+}
+
+// NewNodeInfoChange returns the change between the node infos. Only the fields of nodeInfoChangeValues show their
+// values in the summary, the others like Host, Path or Hysteria2Config are only marked as changed, so the hidden
+// hosts, paths and keys do not leak into it.
+func NewNodeInfoChange(oldInfo *NodeInfo, newInfo *NodeInfo) *NodeInfoChange {
+	change := &NodeInfoChange{Old: oldInfo, New: newInfo}
+	if oldInfo == nil || newInfo == nil {
+		change.Summary = "node info loaded"
+		return change
+	}
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(oldInfo).Elem(), reflect.ValueOf(newInfo).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		oldField, newField := oldValue.Field(i), newValue.Field(i)
+		if reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			continue
+		}
+		if !nodeInfoChangeValues[name] {
+			changed = append(changed, name+" changed")
+			continue
+		}
+		changed = append(changed, fmt.Sprintf("%s: %v -> %v", name, oldField.Interface(), newField.Interface()))
+	}
+	change.Summary = strings.Join(changed, ", ")
+	return change
+}
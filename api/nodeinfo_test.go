@@ -0,0 +1,20 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestNewNodeInfoChange(t *testing.T) {
+	oldInfo := &api.NodeInfo{NodeType: "V2ray", Port: 443, TransportProtocol: "ws", Host: "old.example.com", Path: "/old", Hysteria2Config: &api.Hysteria2Config{ObfsPassword: "old"}}
+	newInfo := &api.NodeInfo{NodeType: "V2ray", Port: 8443, TransportProtocol: "grpc", Host: "new.example.com", Path: "/new", Hysteria2Config: &api.Hysteria2Config{ObfsPassword: "new"}}
+	change := api.NewNodeInfoChange(oldInfo, newInfo)
+	// The host, path and settings are only named, their values stay out of the summary
+	if want := "Port: 443 -> 8443, TransportProtocol: ws -> grpc, Host changed, Path changed, Hysteria2Config changed"; change.Summary != want {
+		t.Errorf("want the summary %q, but got %q", want, change.Summary)
+	}
+	if change.Old != oldInfo || change.New != newInfo {
+		t.Error("the change should keep the node infos")
+	}
+}
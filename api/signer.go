@@ -0,0 +1,70 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"time"
+)
+
+// SignConfig is the request signing of the panels that require more than the static ApiKey
+type SignConfig struct {
+	Secret          string `mapstructure:"Secret"`
+	Header          string `mapstructure:"Header"`          // Header of the signature, default X-Signature
+	TimestampHeader string `mapstructure:"TimestampHeader"` // Header of the unix timestamp, default X-Timestamp
+	Scheme          string `mapstructure:"Scheme"`          // hmac-sha256 (default), hmac-sha1 or hmac-sha512
+}
+
+// Signer signs a request with the hex HMAC of its path followed by the unix timestamp
+type Signer struct {
+	Now             func() time.Time // Clock of the timestamp, can be replaced in tests
+	secret          []byte
+	header          string
+	timestampHeader string
+	hash            func() hash.Hash
+}
+
+func NewSigner(config *SignConfig) (*Signer, error) {
+	if config.Secret == "" {
+		return nil, fmt.Errorf("SignConfig requires Secret")
+	}
+	s := &Signer{
+		Now:             time.Now,
+		secret:          []byte(config.Secret),
+		header:          config.Header,
+		timestampHeader: config.TimestampHeader,
+	}
+	if s.header == "" {
+		s.header = "X-Signature"
+	}
+	if s.timestampHeader == "" {
+		s.timestampHeader = "X-Timestamp"
+	}
+	switch config.Scheme {
+	case "", "hmac-sha256":
+		s.hash = sha256.New
+	case "hmac-sha1":
+		s.hash = sha1.New
+	case "hmac-sha512":
+		s.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("Unsupported sign scheme: %s, Only support: hmac-sha256, hmac-sha1 and hmac-sha512", config.Scheme)
+	}
+	return s, nil
+}
+
+// Sign returns the headers to add to the request of the path
+func (s *Signer) Sign(path string) map[string]string {
+	timestamp := strconv.FormatInt(s.Now().Unix(), 10)
+	mac := hmac.New(s.hash, s.secret)
+	mac.Write([]byte(path + timestamp))
+	return map[string]string{
+		s.timestampHeader: timestamp,
+		s.header:          hex.EncodeToString(mac.Sum(nil)),
+	}
+}
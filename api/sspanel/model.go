@@ -16,26 +16,34 @@ type NodeInfoResponse struct {
 
 // UserResponse is the response of user
 type UserResponse struct {
-	ID            int    `json:"id"`
-	Email         string `json:"email"`
-	Passwd        string `json:"passwd"`
-	Port          int    `json:"port"`
-	Method        string `json:"method"`
-	SpeedLimit    uint64 `json:"node_speedlimit"`
-	DeviceLimit   int    `json:"node_connector"`
-	Protocol      string `json:"protocol"`
-	ProtocolParam string `json:"protocol_param"`
-	Obfs          string `json:"obfs"`
-	ObfsParam     string `json:"obfs_param"`
-	ForbiddenIP   string `json:"forbidden_ip"`
-	ForbiddenPort string `json:"forbidden_port"`
-	UUID          string `json:"uuid"`
+	ID                 int    `json:"id"`
+	Email              string `json:"email"`
+	Passwd             string `json:"passwd"`
+	Port               int    `json:"port"`
+	Method             string `json:"method"`
+	SpeedLimit         uint64 `json:"node_speedlimit"`
+	UploadSpeedLimit   uint64 `json:"node_upload_speedlimit,omitempty"`   // Mbps, 0 means the speed limit
+	DownloadSpeedLimit uint64 `json:"node_download_speedlimit,omitempty"` // Mbps, 0 means the speed limit
+	DeviceLimit        int    `json:"node_connector"`
+	UnlimitedDevices   bool   `json:"node_unlimited_devices,omitempty"` // Not device limited, overrides node_connector
+	TransferEnable     uint64 `json:"transfer_enable,omitempty"`        // Bytes the user may transfer, 0 means unlimited
+	Upload             uint64 `json:"u,omitempty"`                      // Bytes the user has uploaded
+	Download           uint64 `json:"d,omitempty"`                      // Bytes the user has downloaded
+	Level              int    `json:"class"`
+	Protocol           string `json:"protocol"`
+	ProtocolParam      string `json:"protocol_param"`
+	Obfs               string `json:"obfs"`
+	ObfsParam          string `json:"obfs_param"`
+	ForbiddenIP        string `json:"forbidden_ip"`
+	ForbiddenPort      string `json:"forbidden_port"`
+	UUID               string `json:"uuid"`
 }
 
 // Response is the common response
 type Response struct {
-	Ret  uint            `json:"ret"`
-	Data json.RawMessage `json:"data"`
+	Ret        uint            `json:"ret"`
+	Data       json.RawMessage `json:"data"`
+	NextCursor string          `json:"next_cursor,omitempty"` // The cursor of the next page of the user list, empty on the last page
 }
 
 // PostData is the data structure of post data
@@ -45,8 +53,20 @@ type PostData struct {
 
 // SystemLoad is the data structure of systemload
 type SystemLoad struct {
-	Uptime string `json:"uptime"`
-	Load   string `json:"load"`
+	Uptime           string `json:"uptime"`
+	Load             string `json:"load"`
+	OnlineUsers      int    `json:"online_users"`
+	PeakOnlineUsers  int    `json:"peak_online_users"`
+	MemTotal         uint64 `json:"mem_total"`
+	MemUsed          uint64 `json:"mem_used"`
+	MemAvailable     uint64 `json:"mem_available"`
+	DiskRead         uint64 `json:"disk_read"`
+	DiskWrite        uint64 `json:"disk_write"`
+	Version          string `json:"version,omitempty"`
+	CoreVersion      string `json:"core_version,omitempty"`
+	ControllerUptime int    `json:"controller_uptime,omitempty"`
+	// The failed dispatches by the category, rule_reject, device_limit, data_limit, conn_limit, sniffing, no_outbound and dial
+	DispatchFailures map[string]int64 `json:"dispatch_failures,omitempty"`
 }
 
 // OnlineUser is the data structure of online user
@@ -57,14 +77,26 @@ type OnlineUser struct {
 
 // UserTraffic is the data structure of traffic
 type UserTraffic struct {
-	UID      int   `json:"user_id"`
-	Upload   int64 `json:"u"`
-	Download int64 `json:"d"`
+	UID      int      `json:"user_id"`
+	Upload   int64    `json:"u"`
+	Download int64    `json:"d"`
+	SNI      []string `json:"sni,omitempty"`
+	// The bytes left of the transfer_enable of the user, only sent for the users with it
+	Remaining *uint64 `json:"remaining,omitempty"`
 }
 
 type RuleItem struct{
 	ID int `json:"id"`
 	Content string `json:"regex"`
+	Schedule *RuleScheduleItem `json:"schedule,omitempty"`
+}
+
+// RuleScheduleItem is the time window of a rule, e.g. {"days": [1, 2, 3, 4, 5], "start": "08:00", "end": "17:00", "timezone": "Asia/Shanghai"}
+type RuleScheduleItem struct {
+	Days     []int  `json:"days"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
 }
 
 type IllegalItem struct{
@@ -1,8 +1,11 @@
 package sspanel
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"log"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -19,18 +22,23 @@ var (
 	hostRe        = regexp.MustCompile(`(?m)host=([\w\.]+)\|?`)       // Host
 	enableXtlsRe  = regexp.MustCompile(`(?m)enable_xtls=(\w+)\|?`)    // EnableXtls
 	enableVlessRe = regexp.MustCompile(`(?m)enable_vless=(\w+)\|?`)   // EnableVless
+	serviceNameRe = regexp.MustCompile(`(?m)service_name=([^|]+)\|?`) // gRPC service name
+	multiModeRe   = regexp.MustCompile(`(?m)multi_mode=(\w+)\|?`)     // gRPC multi mode
 
 )
 
 // APIClient create a api client to the panel.
 type APIClient struct {
-	client      *resty.Client
-	APIHost     string
-	NodeID      int
-	Key         string
-	NodeType    string
-	EnableVless bool
-	EnableXTLS  bool
+	client        *resty.Client
+	APIHost       string
+	NodeID        int
+	Key           string
+	NodeType      string
+	EnableVless   bool
+	EnableXTLS    bool
+	Signer        *api.Signer // Signs each request if the panel requires it
+	GzipThreshold int         // Gzip the report bodies larger than this many bytes, 0 means no compression
+	PageConfig    *api.PageConfig
 }
 
 // New creat a api instance
@@ -40,16 +48,40 @@ func New(apiConfig *api.Config) *APIClient {
 	client.SetRetryCount(3)
 	client.SetTimeout(5 * time.Second)
 	client.SetHostURL(apiConfig.APIHost)
+	// The panel on the same host may listen on a Unix domain socket instead of a port
+	if api.IsUnixSocket(apiConfig.APIHost) {
+		transport, baseURL, err := api.UnixSocketTransport(apiConfig.APIHost)
+		if err != nil {
+			log.Panicf("Invalid ApiHost: %s", err)
+		}
+		client.SetTransport(transport)
+		client.SetHostURL(baseURL)
+	}
 	// Create Key for each requests
 	client.SetQueryParam("key", apiConfig.Key)
 	apiClient := &APIClient{
-		client:      client,
-		NodeID:      apiConfig.NodeID,
-		Key:         apiConfig.Key,
-		APIHost:     apiConfig.APIHost,
-		NodeType:    apiConfig.NodeType,
-		EnableVless: apiConfig.EnableVless,
-		EnableXTLS:  apiConfig.EnableXTLS,
+		client:        client,
+		NodeID:        apiConfig.NodeID,
+		Key:           apiConfig.Key,
+		APIHost:       apiConfig.APIHost,
+		NodeType:      apiConfig.NodeType,
+		EnableVless:   apiConfig.EnableVless,
+		EnableXTLS:    apiConfig.EnableXTLS,
+		GzipThreshold: apiConfig.GzipThreshold,
+		PageConfig:    apiConfig.PageConfig,
+	}
+	if apiConfig.SignConfig != nil {
+		signer, err := api.NewSigner(apiConfig.SignConfig)
+		if err != nil {
+			log.Panicf("Invalid SignConfig: %s", err)
+		}
+		apiClient.Signer = signer
+		// The user middlewares run before the host is joined, so the url is the path of the request
+		client.OnBeforeRequest(func(_ *resty.Client, r *resty.Request) error {
+			path := strings.SplitN(r.URL, "?", 2)[0]
+			r.SetHeaders(apiClient.Signer.Sign(path))
+			return nil
+		})
 	}
 	return apiClient
 }
@@ -64,15 +96,29 @@ func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
 }
 
+// ReportNodeInfoChange is a no-op, SSPanel has no api of the node info changes
+func (c *APIClient) ReportNodeInfoChange(change *api.NodeInfoChange) error {
+	return nil
+}
+
+// ReportUserLastSeen is a no-op, SSPanel has no api of the last seen time of the users
+func (c *APIClient) ReportUserLastSeen(lastSeen *[]api.UserLastSeen) error {
+	return nil
+}
+
 func (c *APIClient) assembleURL(path string) string {
 	return c.APIHost + path
 }
 
 func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (*Response, error) {
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
+		return nil, &api.UnavailableError{Err: fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)}
 	}
 
+	if res.StatusCode() >= 500 {
+		body := res.Body()
+		return nil, &api.UnavailableError{Err: fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)}
+	}
 	if res.StatusCode() > 400 {
 		body := res.Body()
 		return nil, fmt.Errorf("request %s failed: %s, %s", c.assembleURL(path), string(body), err)
@@ -111,6 +157,8 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 		nodeInfo, err = c.ParseTrojanNodeResponse(nodeInfoResponse)
 	case "Shadowsocks":
 		nodeInfo, err = c.ParseSSNodeResponse(nodeInfoResponse)
+	case "Hysteria2":
+		nodeInfo, err = c.ParseHysteria2NodeResponse(nodeInfoResponse)
 	default:
 		return nil, fmt.Errorf("Unsupported Node type: %s", c.NodeType)
 	}
@@ -125,34 +173,113 @@ func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
 
 // GetUserList will pull user form sspanel
 func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
+	var userListResponse *[]UserResponse
+	if c.PageConfig == nil {
+		userListResponse, _, err = c.getUserPage(nil)
+	} else {
+		userListResponse, err = c.getUserPages()
+	}
+	if err != nil {
+		return nil, err
+	}
+	userList, err := c.ParseUserListResponse(userListResponse)
+	if err != nil {
+		res, _ := json.Marshal(userListResponse)
+		return nil, fmt.Errorf("Parse user list failed: %s", string(res))
+	}
+	return userList, nil
+}
+
+// getUserPage fetches a page of the user list, and returns the cursor of the next page
+func (c *APIClient) getUserPage(params map[string]string) (*[]UserResponse, string, error) {
 	path := "/mod_mu/users"
 	res, err := c.client.R().
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
+		SetQueryParams(params).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Get(path)
 
 	response, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return nil, "", err
+	}
 
 	userListResponse := new([]UserResponse)
 
 	if err := json.Unmarshal(response.Data, userListResponse); err != nil {
-		return nil, fmt.Errorf("Unmarshal %s failed: %s", reflect.TypeOf(userListResponse), err)
+		return nil, "", fmt.Errorf("Unmarshal %s failed: %s", reflect.TypeOf(userListResponse), err)
 	}
-	userList, err := c.ParseUserListResponse(userListResponse)
-	if err != nil {
-		res, _ := json.Marshal(userListResponse)
-		return nil, fmt.Errorf("Parse user list failed: %s", string(res))
+	return userListResponse, response.NextCursor, nil
+}
+
+// getUserPages fetches the pages of the user list until the last one. A user moved to a later page while fetching is kept once.
+func (c *APIClient) getUserPages() (*[]UserResponse, error) {
+	pageSize, maxPages := c.PageConfig.PageSize, c.PageConfig.MaxPages
+	if pageSize <= 0 {
+		pageSize = 500
+	}
+	if maxPages <= 0 {
+		maxPages = 1000
+	}
+	cursorMode := c.PageConfig.Mode == "cursor"
+	if !cursorMode && c.PageConfig.Mode != "" && c.PageConfig.Mode != "page" {
+		return nil, fmt.Errorf("Unsupported page mode: %s, Only support: page, cursor", c.PageConfig.Mode)
+	}
+	userList := make([]UserResponse, 0, pageSize)
+	fetched := make(map[int]bool)
+	cursors := make(map[string]bool)
+	cursor := ""
+	for page := 1; page <= maxPages; page++ {
+		params := map[string]string{"page_size": strconv.Itoa(pageSize)}
+		if cursorMode {
+			params["cursor"] = cursor
+		} else {
+			params["page"] = strconv.Itoa(page)
+		}
+		users, nextCursor, err := c.getUserPage(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range *users {
+			if !fetched[user.ID] {
+				fetched[user.ID] = true
+				userList = append(userList, user)
+			}
+		}
+		if cursorMode {
+			if nextCursor == "" || len(*users) == 0 {
+				return &userList, nil
+			}
+			if cursors[nextCursor] {
+				return nil, fmt.Errorf("User list cursor %s of page %d is repeated", nextCursor, page)
+			}
+			cursors[nextCursor] = true
+			cursor = nextCursor
+		} else if len(*users) < pageSize {
+			return &userList, nil
+		}
 	}
-	return userList, nil
+	return nil, fmt.Errorf("User list has more than %d pages of %d users", maxPages, pageSize)
 }
 
 // ReportNodeStatus reports the node status to the sspanel
 func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
 	path := fmt.Sprintf("/mod_mu/nodes/%d/info", c.NodeID)
 	systemload := SystemLoad{
-		Uptime: strconv.Itoa(nodeStatus.Uptime),
-		Load:   fmt.Sprintf("%.2f %.2f %.2f", nodeStatus.CPU/100, nodeStatus.CPU/100, nodeStatus.CPU/100),
+		Uptime:           strconv.Itoa(nodeStatus.Uptime),
+		Load:             fmt.Sprintf("%.2f %.2f %.2f", nodeStatus.CPU/100, nodeStatus.CPU/100, nodeStatus.CPU/100),
+		OnlineUsers:      nodeStatus.OnlineUsers,
+		PeakOnlineUsers:  nodeStatus.PeakOnlineUsers,
+		MemTotal:         nodeStatus.MemTotal,
+		MemUsed:          nodeStatus.MemUsed,
+		MemAvailable:     nodeStatus.MemAvailable,
+		DiskRead:         nodeStatus.DiskRead,
+		DiskWrite:        nodeStatus.DiskWrite,
+		Version:          nodeStatus.Version,
+		CoreVersion:      nodeStatus.CoreVersion,
+		ControllerUptime: nodeStatus.ControllerUptime,
+		DispatchFailures: nodeStatus.DispatchFailures,
 	}
 
 	res, err := c.client.R().
@@ -178,9 +305,12 @@ func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) erro
 	}
 	postData := &PostData{Data: data}
 	path := fmt.Sprintf("/mod_mu/users/aliveip")
-	res, err := c.client.R().
+	request, err := c.reportRequest(postData)
+	if err != nil {
+		return err
+	}
+	res, err := request.
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
-		SetBody(postData).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Post(path)
@@ -199,15 +329,20 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	data := make([]UserTraffic, len(*userTraffic))
 	for i, traffic := range *userTraffic {
 		data[i] = UserTraffic{
-			UID:      traffic.UID,
-			Upload:   traffic.Upload,
-			Download: traffic.Download}
+			UID:       traffic.UID,
+			Upload:    traffic.Upload,
+			Download:  traffic.Download,
+			SNI:       traffic.SNI,
+			Remaining: traffic.DataRemaining}
 	}
 	postData := &PostData{Data: data}
 	path := "/mod_mu/users/traffic"
-	res, err := c.client.R().
+	request, err := c.reportRequest(postData)
+	if err != nil {
+		return err
+	}
+	res, err := request.
 		SetQueryParam("node_id", strconv.Itoa(c.NodeID)).
-		SetBody(postData).
 		SetResult(&Response{}).
 		ForceContentType("application/json").
 		Post(path)
@@ -219,6 +354,33 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	return nil
 }
 
+// reportRequest creates the request with the JSON body of the report, which is gzipped if it is larger than the threshold
+func (c *APIClient) reportRequest(postData *PostData) (*resty.Request, error) {
+	request := c.client.R()
+	if c.GzipThreshold <= 0 {
+		return request.SetBody(postData), nil
+	}
+	body, err := json.Marshal(postData)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal report failed: %s", err)
+	}
+	if len(body) <= c.GzipThreshold {
+		return request.SetHeader("Content-Type", "application/json").SetBody(body), nil
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("Gzip report failed: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("Gzip report failed: %s", err)
+	}
+	return request.
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", "gzip").
+		SetBody(compressed.Bytes()), nil
+}
+
 // GetNodeRule will pull the audit rule form sspanel
 func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	path := "mod_mu/func/detect_rules"
@@ -228,6 +390,9 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 		Get(path)
 
 	response, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return nil, err
+	}
 
 	ruleListResponse := new([]RuleItem)
 
@@ -240,6 +405,14 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 			ID:      r.ID,
 			Pattern: r.Content,
 		}
+		if r.Schedule != nil {
+			ruleList[i].Schedule = &api.RuleSchedule{
+				Days:     r.Schedule.Days,
+				Start:    r.Schedule.Start,
+				End:      r.Schedule.End,
+				Timezone: r.Schedule.Timezone,
+			}
+		}
 	}
 	return &ruleList, nil
 }
@@ -273,7 +446,10 @@ func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
 func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
 	var enableTLS, enableVless bool
 	enableVless = c.EnableVless
-	var path, host string
+	var path, host, extraPorts string
+	kcpConfig := new(api.KCPConfig)
+	grpcConfig := new(api.GRPCConfig)
+	wsConfig := new(api.WSConfig)
 	if nodeInfoResponse.RawServerString == "" {
 		return nil, fmt.Errorf("No server info in response")
 	}
@@ -318,6 +494,44 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (
 					enableVless = true
 				}
 			}
+		case "extra_ports":
+			extraPorts = value
+		case "header_type":
+			kcpConfig.HeaderType = value
+		case "seed":
+			kcpConfig.Seed = value
+		case "mtu", "tti":
+			v, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid kcp %s: %s", key, value)
+			}
+			if key == "mtu" {
+				kcpConfig.MTU = uint32(v)
+			} else {
+				kcpConfig.TTI = uint32(v)
+			}
+		case "service_name":
+			grpcConfig.ServiceName = value
+		case "multi_mode":
+			grpcConfig.MultiMode = value == "true"
+		case "max_early_data":
+			v, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ws max_early_data: %s", value)
+			}
+			wsConfig.MaxEarlyData = uint32(v)
+		case "early_data_header_name":
+			wsConfig.EarlyDataHeaderName = value
+		case "headers":
+			// Name:Value pairs separated by commas, e.g. headers=X-Forwarded-Proto:https,X-Client:browser
+			wsConfig.Headers = make(map[string]string)
+			for _, header := range strings.Split(strings.Join(conf[1:], "="), ",") {
+				pair := strings.SplitN(header, ":", 2)
+				if len(pair) != 2 {
+					return nil, fmt.Errorf("Invalid ws header: %s", header)
+				}
+				wsConfig.Headers[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+			}
 		}
 	}
 	speedlimit := (nodeInfoResponse.SpeedLimit * 1000000) / 8
@@ -326,6 +540,7 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (
 		NodeType:          c.NodeType,
 		NodeID:            c.NodeID,
 		Port:              port,
+		ExtraPorts:        extraPorts,
 		SpeedLimit:        speedlimit,
 		AlterID:           alterID,
 		TransportProtocol: transportProtocol,
@@ -335,6 +550,15 @@ func (c *APIClient) ParseV2rayNodeResponse(nodeInfoResponse *NodeInfoResponse) (
 		Host:              host,
 		EnableVless:       enableVless,
 	}
+	if transportProtocol == "kcp" || transportProtocol == "mkcp" {
+		nodeinfo.KCPConfig = kcpConfig
+	}
+	if transportProtocol == "grpc" || transportProtocol == "gun" {
+		nodeinfo.GRPCConfig = grpcConfig
+	}
+	if (transportProtocol == "ws" || transportProtocol == "websocket") && !reflect.DeepEqual(wsConfig, &api.WSConfig{}) {
+		nodeinfo.WSConfig = wsConfig
+	}
 
 	return nodeinfo, nil
 }
@@ -346,6 +570,10 @@ func (c *APIClient) ParseSSNodeResponse(nodeInfoResponse *NodeInfoResponse) (*ap
 		return nil, fmt.Errorf("No server info in response")
 	}
 	//nodeInfo.RawServerString = strings.ToLower(nodeInfo.RawServerString)
+	// 域名或IP;port;plugin=xx|mode=xx|host=xx|path=xx|tls=true|method=xx
+	// ss.aaa.com;443;plugin=v2ray-plugin|host=ss.aaa.com|path=/ws|tls=true
+	// ss.aaa.com;443;obfs=simple_obfs_http|obfs_param=www.bing.com
+	// ss.aaa.com;443;method=aes-256-gcm
 	serverConf := strings.Split(nodeInfoResponse.RawServerString, ";")
 	port, err := strconv.Atoi(serverConf[1])
 	if err != nil {
@@ -360,6 +588,97 @@ func (c *APIClient) ParseSSNodeResponse(nodeInfoResponse *NodeInfoResponse) (*ap
 		SpeedLimit:        speedlimit,
 		TransportProtocol: "tcp",
 	}
+	if len(serverConf) > 2 && serverConf[2] != "" {
+		pluginConfig := new(api.SSPluginConfig)
+		for _, item := range strings.Split(serverConf[2], "|") {
+			conf := strings.SplitN(item, "=", 2)
+			if len(conf) != 2 {
+				continue
+			}
+			key, value := conf[0], conf[1]
+			switch key {
+			case "plugin":
+				pluginConfig.Plugin = value
+			case "mode":
+				pluginConfig.Mode = value
+			case "obfs":
+				// The obfs of the panel users, e.g. simple_obfs_http
+				if mode := strings.TrimPrefix(value, "simple_obfs_"); mode != value {
+					pluginConfig.Plugin, pluginConfig.Mode = "obfs", mode
+				} else if value != "plain" {
+					pluginConfig.Plugin = value
+				}
+			case "method":
+				// The single-port node of one cipher for all the users
+				nodeinfo.Method = value
+			case "host", "obfs_param":
+				pluginConfig.Host = value
+			case "path":
+				pluginConfig.Path = value
+			case "tls":
+				if value == "true" || value == "1" {
+					nodeinfo.EnableTLS = true
+					nodeinfo.TLSType = "tls"
+				}
+			}
+		}
+		if pluginConfig.Plugin != "" {
+			nodeinfo.SSPluginConfig = pluginConfig
+		}
+	}
+
+	return nodeinfo, nil
+}
+
+// ParseHysteria2NodeResponse parse the response for the given nodeinfor format
+func (c *APIClient) ParseHysteria2NodeResponse(nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
+	// 域名或IP;port;up_mbps=xx|down_mbps=xx|obfs_password=xx
+	// hy2.aaa.com;443;up_mbps=100|down_mbps=100|obfs_password=secret
+	if nodeInfoResponse.RawServerString == "" {
+		return nil, fmt.Errorf("No server info in response")
+	}
+	serverConf := strings.Split(nodeInfoResponse.RawServerString, ";")
+	if len(serverConf) < 2 {
+		return nil, fmt.Errorf("No port in server info")
+	}
+	port, err := strconv.Atoi(serverConf[1])
+	if err != nil {
+		return nil, err
+	}
+	hysteria2Config := new(api.Hysteria2Config)
+	if len(serverConf) > 2 {
+		for _, item := range strings.Split(serverConf[2], "|") {
+			conf := strings.SplitN(item, "=", 2)
+			if len(conf) != 2 {
+				continue
+			}
+			key, value := conf[0], conf[1]
+			switch key {
+			case "up_mbps":
+				if hysteria2Config.UpMbps, err = strconv.Atoi(value); err != nil {
+					return nil, err
+				}
+			case "down_mbps":
+				if hysteria2Config.DownMbps, err = strconv.Atoi(value); err != nil {
+					return nil, err
+				}
+			case "obfs_password":
+				hysteria2Config.ObfsPassword = value
+			}
+		}
+	}
+	speedlimit := (nodeInfoResponse.SpeedLimit * 1000000) / 8
+	// Create GeneralNodeInfo
+	nodeinfo := &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              port,
+		SpeedLimit:        speedlimit,
+		TransportProtocol: "udp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+		Hysteria2Config:   hysteria2Config,
+	}
 
 	return nodeinfo, nil
 }
@@ -368,6 +687,7 @@ func (c *APIClient) ParseSSNodeResponse(nodeInfoResponse *NodeInfoResponse) (*ap
 func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *NodeInfoResponse) (*api.NodeInfo, error) {
 	// 域名或IP;port=连接端口#偏移端口|host=xx
 	// gz.aaa.com;port=443#12345|host=hk.aaa.com
+	// The gRPC transport is enabled by the service name, e.g. gz.aaa.com;port=443|service_name=trojan|multi_mode=true
 	var p, TLSType, host, enableXtls, outsidePort, insidePort string
 	TLSType = "tls"
 	if nodeInfoResponse.RawServerString == "" {
@@ -399,6 +719,15 @@ func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *NodeInfoResponse)
 	if enableXtls == "true" {
 		TLSType = "xtls"
 	}
+	transportProtocol := "tcp"
+	var grpcConfig *api.GRPCConfig
+	if result := serviceNameRe.FindStringSubmatch(nodeInfoResponse.RawServerString); len(result) > 1 {
+		transportProtocol = "grpc"
+		grpcConfig = &api.GRPCConfig{ServiceName: result[1]}
+		if result := multiModeRe.FindStringSubmatch(nodeInfoResponse.RawServerString); len(result) > 1 {
+			grpcConfig.MultiMode = result[1] == "true"
+		}
+	}
 	speedlimit := (nodeInfoResponse.SpeedLimit * 1000000) / 8
 	// Create GeneralNodeInfo
 	nodeinfo := &api.NodeInfo{
@@ -406,10 +735,11 @@ func (c *APIClient) ParseTrojanNodeResponse(nodeInfoResponse *NodeInfoResponse)
 		NodeID:            c.NodeID,
 		Port:              port,
 		SpeedLimit:        speedlimit,
-		TransportProtocol: "tcp",
+		TransportProtocol: transportProtocol,
 		EnableTLS:         true,
 		TLSType:           TLSType,
 		Host:              host,
+		GRPCConfig:        grpcConfig,
 	}
 
 	return nodeinfo, nil
@@ -420,18 +750,24 @@ func (c *APIClient) ParseUserListResponse(userInfoResponse *[]UserResponse) (*[]
 	userList := make([]api.UserInfo, len(*userInfoResponse))
 	for i, user := range *userInfoResponse {
 		userList[i] = api.UserInfo{
-			UID:           user.ID,
-			Email:         user.Email,
-			UUID:          user.UUID,
-			Passwd:        user.Passwd,
-			SpeedLimit:    (user.SpeedLimit * 1000000) / 8,
-			DeviceLimit:   user.DeviceLimit,
-			Port:          user.Port,
-			Method:        user.Method,
-			Protocol:      user.Protocol,
-			ProtocolParam: user.ProtocolParam,
-			Obfs:          user.Obfs,
-			ObfsParam:     user.ObfsParam,
+			UID:                user.ID,
+			Email:              user.Email,
+			UUID:               user.UUID,
+			Passwd:             user.Passwd,
+			SpeedLimit:         (user.SpeedLimit * 1000000) / 8,
+			UploadSpeedLimit:   (user.UploadSpeedLimit * 1000000) / 8,
+			DownloadSpeedLimit: (user.DownloadSpeedLimit * 1000000) / 8,
+			DeviceLimit:        user.DeviceLimit,
+			UnlimitedDevices:   user.UnlimitedDevices,
+			DataLimit:          user.TransferEnable,
+			DataUsed:           user.Upload + user.Download,
+			Level:              user.Level,
+			Port:               user.Port,
+			Method:             user.Method,
+			Protocol:           user.Protocol,
+			ProtocolParam:      user.ProtocolParam,
+			Obfs:               user.Obfs,
+			ObfsParam:          user.ObfsParam,
 		}
 	}
 
@@ -1,8 +1,21 @@
 package sspanel_test
 
 import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/api/sspanel"
@@ -83,7 +96,7 @@ func TestGetUserList(t *testing.T) {
 func TestReportNodeStatus(t *testing.T) {
 	client := CreateClient()
 	nodeStatus := &api.NodeStatus{
-		1, 1, 1, 256,
+		CPU: 1, Mem: 1, Disk: 1, Uptime: 256,
 	}
 	err := client.ReportNodeStatus(nodeStatus)
 	if err != nil {
@@ -148,8 +161,8 @@ func TestReportIllegal(t *testing.T) {
 	client := CreateClient()
 
 	detectResult := []api.DetectResult{
-		api.DetectResult{1, 2},
-		api.DetectResult{1, 3},
+		{UID: 1, RuleID: 2},
+		{UID: 1, RuleID: 3},
 	}
 	client.Debug()
 	err := client.ReportIllegal(&detectResult)
@@ -157,3 +170,344 @@ func TestReportIllegal(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestParseSSMethodNodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "Shadowsocks"})
+	for server, want := range map[string]string{
+		"1.1.1.1;443":                                     "",
+		"1.1.1.1;443;method=aes-256-gcm":                  "aes-256-gcm",
+		"1.1.1.1;443;obfs=plain|method=chacha20-poly1305": "chacha20-poly1305",
+	} {
+		nodeInfo, err := client.ParseSSNodeResponse(&sspanel.NodeInfoResponse{RawServerString: server})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeInfo.Method != want || nodeInfo.SSPluginConfig != nil {
+			t.Errorf("%s: want the method %q without a plugin, but got %q and %+v", server, want, nodeInfo.Method, nodeInfo.SSPluginConfig)
+		}
+	}
+}
+
+func TestParseSSPluginNodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "Shadowsocks"})
+	testCases := []struct {
+		server  string
+		want    *api.SSPluginConfig
+		withTLS bool
+	}{
+		{"1.1.1.1;443", nil, false},
+		{"1.1.1.1;443;obfs=plain", nil, false},
+		{"1.1.1.1;443;obfs=simple_obfs_http|obfs_param=www.bing.com", &api.SSPluginConfig{Plugin: "obfs", Mode: "http", Host: "www.bing.com"}, false},
+		{"1.1.1.1;443;plugin=v2ray-plugin|host=ss.test.tk|path=/ws|tls=true", &api.SSPluginConfig{Plugin: "v2ray-plugin", Host: "ss.test.tk", Path: "/ws"}, true},
+	}
+	for _, testCase := range testCases {
+		nodeInfo, err := client.ParseSSNodeResponse(&sspanel.NodeInfoResponse{RawServerString: testCase.server})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (nodeInfo.SSPluginConfig == nil) != (testCase.want == nil) || testCase.want != nil && *nodeInfo.SSPluginConfig != *testCase.want {
+			t.Errorf("%s: want plugin %+v, but got %+v", testCase.server, testCase.want, nodeInfo.SSPluginConfig)
+		}
+		if nodeInfo.EnableTLS != testCase.withTLS {
+			t.Errorf("%s: want tls %t, but got %t", testCase.server, testCase.withTLS, nodeInfo.EnableTLS)
+		}
+	}
+}
+
+func TestParseExtraPortsNodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "V2ray"})
+	nodeInfoResponse := &sspanel.NodeInfoResponse{
+		RawServerString: "1.1.1.1;443;0;tcp;;extra_ports=8443,10000-10100",
+	}
+	nodeInfo, err := client.ParseV2rayNodeResponse(nodeInfoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.ExtraPorts != "8443,10000-10100" {
+		t.Errorf("unexpected extra ports: %s", nodeInfo.ExtraPorts)
+	}
+}
+
+func TestParseKCPNodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "V2ray"})
+	nodeInfoResponse := &sspanel.NodeInfoResponse{
+		RawServerString: "1.1.1.1;443;0;kcp;;header_type=wechat-video|seed=secret|mtu=1350|tti=20",
+	}
+	nodeInfo, err := client.ParseV2rayNodeResponse(nodeInfoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := api.KCPConfig{HeaderType: "wechat-video", Seed: "secret", MTU: 1350, TTI: 20}
+	if nodeInfo.KCPConfig == nil || *nodeInfo.KCPConfig != want {
+		t.Errorf("unexpected kcp config: %+v", nodeInfo.KCPConfig)
+	}
+}
+
+func TestParseWSNodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "V2ray"})
+	nodeInfoResponse := &sspanel.NodeInfoResponse{
+		RawServerString: "1.1.1.1;443;0;ws;tls;path=/ws|max_early_data=2048|early_data_header_name=Sec-WebSocket-Protocol|headers=X-Forwarded-Proto:https,X-Client:browser",
+	}
+	nodeInfo, err := client.ParseV2rayNodeResponse(nodeInfoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &api.WSConfig{
+		MaxEarlyData:        2048,
+		EarlyDataHeaderName: "Sec-WebSocket-Protocol",
+		Headers:             map[string]string{"X-Forwarded-Proto": "https", "X-Client": "browser"},
+	}
+	if !reflect.DeepEqual(nodeInfo.WSConfig, want) {
+		t.Errorf("unexpected ws config: %+v", nodeInfo.WSConfig)
+	}
+	// The ws settings are off if the panel gives none
+	nodeInfoResponse.RawServerString = "1.1.1.1;443;0;ws;tls;path=/ws"
+	if nodeInfo, err = client.ParseV2rayNodeResponse(nodeInfoResponse); err != nil || nodeInfo.WSConfig != nil {
+		t.Errorf("unexpected ws config: %+v, %v", nodeInfo.WSConfig, err)
+	}
+}
+
+func TestParseGRPCNodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "V2ray"})
+	nodeInfoResponse := &sspanel.NodeInfoResponse{
+		RawServerString: "1.1.1.1;443;0;grpc;tls;service_name=vmess|multi_mode=true",
+	}
+	nodeInfo, err := client.ParseV2rayNodeResponse(nodeInfoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := api.GRPCConfig{ServiceName: "vmess", MultiMode: true}
+	if nodeInfo.TransportProtocol != "grpc" || nodeInfo.GRPCConfig == nil || *nodeInfo.GRPCConfig != want {
+		t.Errorf("unexpected grpc config: %s %+v", nodeInfo.TransportProtocol, nodeInfo.GRPCConfig)
+	}
+
+	client = sspanel.New(&api.Config{NodeID: 3, NodeType: "Trojan"})
+	nodeInfoResponse = &sspanel.NodeInfoResponse{
+		RawServerString: "gz.aaa.com;port=443|host=hk.aaa.com|service_name=trojan",
+	}
+	nodeInfo, err = client.ParseTrojanNodeResponse(nodeInfoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = api.GRPCConfig{ServiceName: "trojan"}
+	if nodeInfo.TransportProtocol != "grpc" || nodeInfo.GRPCConfig == nil || *nodeInfo.GRPCConfig != want {
+		t.Errorf("unexpected grpc config: %s %+v", nodeInfo.TransportProtocol, nodeInfo.GRPCConfig)
+	}
+}
+
+func TestParseHysteria2NodeResponse(t *testing.T) {
+	client := sspanel.New(&api.Config{NodeID: 3, NodeType: "Hysteria2"})
+	nodeInfoResponse := &sspanel.NodeInfoResponse{
+		RawServerString: "hy2.test.com;443;up_mbps=100|down_mbps=50|obfs_password=secret",
+	}
+	nodeInfo, err := client.ParseHysteria2NodeResponse(nodeInfoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := api.Hysteria2Config{UpMbps: 100, DownMbps: 50, ObfsPassword: "secret"}
+	if nodeInfo.Port != 443 || nodeInfo.Hysteria2Config == nil || *nodeInfo.Hysteria2Config != want {
+		t.Errorf("unexpected node info: %+v %+v", nodeInfo, nodeInfo.Hysteria2Config)
+	}
+}
+
+func TestSignGetNodeInfo(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.Write([]byte(`{"ret":1,"data":{"server":"1.1.1.1;443;0;tcp;;","sort":11}}`))
+	}))
+	defer server.Close()
+	client := sspanel.New(&api.Config{
+		APIHost:    server.URL,
+		Key:        "123",
+		NodeID:     3,
+		NodeType:   "V2ray",
+		SignConfig: &api.SignConfig{Secret: "secret", Header: "X-Sign"},
+	})
+	client.Signer.Now = func() time.Time { return time.Unix(1700000000, 0) }
+	if _, err := client.GetNodeInfo(); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("/mod_mu/nodes/3/info1700000000"))
+	if got := header.Get("X-Sign"); got != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("unexpected signature: %s", got)
+	}
+	if got := header.Get("X-Timestamp"); got != "1700000000" {
+		t.Errorf("unexpected timestamp: %s", got)
+	}
+}
+
+func TestFailoverGetNodeInfo(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ret":1,"data":{"server":"1.1.1.1;8443;0;tcp;;","sort":11}}`))
+	}))
+	defer secondary.Close()
+	primaryClient := sspanel.New(&api.Config{APIHost: primary.URL, Key: "123", NodeID: 3, NodeType: "V2ray"})
+	secondaryClient := sspanel.New(&api.Config{APIHost: secondary.URL, Key: "123", NodeID: 3, NodeType: "V2ray"})
+	nodeInfo, err := api.NewFailover(primaryClient, secondaryClient).GetNodeInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.Port != 8443 {
+		t.Errorf("the node info should be fetched from the secondary, got port %d", nodeInfo.Port)
+	}
+}
+
+func TestGzipReportUserTraffic(t *testing.T) {
+	var encoding string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader := r.Body
+		if encoding == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			reader = gzipReader
+		}
+		body, _ = ioutil.ReadAll(reader)
+		w.Write([]byte(`{"ret":1,"data":[]}`))
+	}))
+	defer server.Close()
+	client := sspanel.New(&api.Config{APIHost: server.URL, Key: "123", NodeID: 3, NodeType: "V2ray", GzipThreshold: 100})
+	userTraffic := make([]api.UserTraffic, 10)
+	for i := range userTraffic {
+		userTraffic[i] = api.UserTraffic{UID: i + 1, Upload: 114514, Download: 1919810}
+	}
+	if err := client.ReportUserTraffic(&userTraffic); err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "gzip" {
+		t.Fatalf("the report larger than the threshold should be gzipped, got encoding %q", encoding)
+	}
+	var postData struct {
+		Data []sspanel.UserTraffic `json:"data"`
+	}
+	if err := json.Unmarshal(body, &postData); err != nil {
+		t.Fatal(err)
+	}
+	if len(postData.Data) != 10 || postData.Data[9].UID != 10 || postData.Data[9].Download != 1919810 {
+		t.Errorf("unexpected report: %s", body)
+	}
+
+	userTraffic = userTraffic[:1]
+	if err := client.ReportUserTraffic(&userTraffic); err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "" {
+		t.Errorf("the report smaller than the threshold should not be gzipped, got encoding %q", encoding)
+	}
+	if err := json.Unmarshal(body, &postData); err != nil || len(postData.Data) != 1 {
+		t.Errorf("unexpected report: %s", body)
+	}
+}
+
+// pagedPanel serves the users 1 to total, page by page or by cursor
+func pagedPanel(total int, repeatCursor bool) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		pageSize, _ := strconv.Atoi(query.Get("page_size"))
+		start := 0
+		if cursor := query.Get("cursor"); cursor != "" {
+			start, _ = strconv.Atoi(cursor)
+		} else if page, err := strconv.Atoi(query.Get("page")); err == nil {
+			start = (page - 1) * pageSize
+		}
+		users := []sspanel.UserResponse{}
+		for id := start + 1; id <= total && id <= start+pageSize; id++ {
+			users = append(users, sspanel.UserResponse{ID: id, Email: fmt.Sprintf("%d@test.com", id), UUID: "a"})
+		}
+		response := map[string]interface{}{"ret": 1, "data": users}
+		if next := start + pageSize; next < total {
+			response["next_cursor"] = strconv.Itoa(next)
+		}
+		if repeatCursor {
+			response["next_cursor"] = "0"
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	return server, &requests
+}
+
+func TestGetUserListPages(t *testing.T) {
+	testCases := []struct {
+		mode     string
+		total    int
+		requests int
+	}{
+		{"page", 7, 3},
+		// The last full page is followed by an empty one
+		{"page", 6, 3},
+		{"cursor", 7, 3},
+		{"cursor", 6, 2},
+		{"cursor", 0, 1},
+	}
+	for _, testCase := range testCases {
+		server, requests := pagedPanel(testCase.total, false)
+		client := sspanel.New(&api.Config{APIHost: server.URL, Key: "123", NodeID: 3, NodeType: "V2ray",
+			PageConfig: &api.PageConfig{Mode: testCase.mode, PageSize: 3}})
+		userList, err := client.GetUserList()
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*userList) != testCase.total || (testCase.total > 0 && (*userList)[testCase.total-1].UID != testCase.total) {
+			t.Errorf("%s of %d users: unexpected user list %v", testCase.mode, testCase.total, *userList)
+		}
+		if *requests != testCase.requests {
+			t.Errorf("%s of %d users: want %d requests, but got %d", testCase.mode, testCase.total, testCase.requests, *requests)
+		}
+	}
+}
+
+func TestGetUserListPagesMisbehaving(t *testing.T) {
+	// The cursor never moves on
+	server, _ := pagedPanel(7, true)
+	defer server.Close()
+	client := sspanel.New(&api.Config{APIHost: server.URL, Key: "123", NodeID: 3, NodeType: "V2ray",
+		PageConfig: &api.PageConfig{Mode: "cursor", PageSize: 3}})
+	if _, err := client.GetUserList(); err == nil {
+		t.Error("the repeated cursor should fail")
+	}
+	// The pages never get short
+	server, requests := pagedPanel(100, false)
+	defer server.Close()
+	client = sspanel.New(&api.Config{APIHost: server.URL, Key: "123", NodeID: 3, NodeType: "V2ray",
+		PageConfig: &api.PageConfig{PageSize: 3, MaxPages: 5}})
+	if _, err := client.GetUserList(); err == nil || *requests != 5 {
+		t.Errorf("want the fetch stopped after 5 pages, but got %d requests: %v", *requests, err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "panel.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var path string
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"ret":1,"data":{"server":"1.1.1.1;443;0;tcp;;","sort":11}}`))
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	client := sspanel.New(&api.Config{APIHost: "unix://" + socket, Key: "123", NodeID: 3, NodeType: "V2ray"})
+	nodeInfo, err := client.GetNodeInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.Port != 443 || path != "/mod_mu/nodes/3/info" {
+		t.Errorf("the node info should be fetched over the socket, got port %d from %s", nodeInfo.Port, path)
+	}
+}
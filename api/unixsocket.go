@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// UnixSocketScheme is the scheme of the ApiHost of a panel listening on a Unix domain socket, e.g. unix:///run/panel.sock
+const UnixSocketScheme = "unix://"
+
+// unixSocketBaseURL is the base URL of the requests over the socket, the host is only sent in the Host header
+const unixSocketBaseURL = "http://localhost"
+
+// IsUnixSocket returns whether the ApiHost is a Unix domain socket
+func IsUnixSocket(apiHost string) bool {
+	return strings.HasPrefix(apiHost, UnixSocketScheme)
+}
+
+// UnixSocketTransport returns the transport dialing the Unix domain socket of the ApiHost, and the base URL of the
+// requests through it. The requests keep the HTTP semantics, only the connections go over the socket
+func UnixSocketTransport(apiHost string) (*http.Transport, string, error) {
+	path := strings.TrimPrefix(apiHost, UnixSocketScheme)
+	if path == "" {
+		return nil, "", fmt.Errorf("ApiHost %s has no socket path", apiHost)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid panel socket %s: %s", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil, "", fmt.Errorf("Invalid panel socket %s: not a Unix domain socket", path)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return transport, unixSocketBaseURL, nil
+}
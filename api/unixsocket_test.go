@@ -0,0 +1,42 @@
+package api_test
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestUnixSocketTransport(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "panel.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !api.IsUnixSocket("unix://"+socket) || api.IsUnixSocket("http://127.0.0.1:667") {
+		t.Error("only the unix:// ApiHost should be a socket")
+	}
+	if _, baseURL, err := api.UnixSocketTransport("unix://" + socket); err != nil || baseURL != "http://localhost" {
+		t.Errorf("the socket should be dialed with the base URL http://localhost, got %s, %v", baseURL, err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[string]string{
+		"unix://":                              "no socket path",
+		"unix://" + filepath.Join(dir, "none"): "no such file",
+		"unix://" + file:                       "not a Unix domain socket",
+	}
+	for apiHost, want := range testCases {
+		if _, _, err := api.UnixSocketTransport(apiHost); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s should be rejected with %q, got %v", apiHost, want, err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package mydispatcher
+
+// UpdateOverCap marks the inbound of the node over its bandwidth cap, the new connections of the inbound are
+// refused while the established ones go on. false removes the mark.
+func (d *DefaultDispatcher) UpdateOverCap(tag string, over bool) {
+	if !over {
+		d.OverCap.Delete(tag)
+		return
+	}
+	d.OverCap.Store(tag, true)
+}
+
+func (d *DefaultDispatcher) overCap(tag string) bool {
+	_, ok := d.OverCap.Load(tag)
+	return ok
+}
@@ -0,0 +1,56 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/policy"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+)
+
+func TestDispatchOverCap(t *testing.T) {
+	pm, err := policy.New(context.Background(), &policy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	handler := &slowHandler{testHandler: testHandler{tag: "direct"}, delay: 200 * time.Millisecond}
+	if err := d.Init(&Config{}, &testOutboundManager{handlers: []outbound.Handler{handler}}, nil, pm, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    "V2ray_1145",
+		Source: net.TCPDestination(net.ParseAddress("2.2.2.2"), 12345),
+		User:   &protocol.MemoryUser{Email: "a@test.com"},
+	})
+	destination := net.TCPDestination(net.ParseAddress("1.1.1.1"), 443)
+	link, err := d.Dispatch(ctx, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	d.UpdateOverCap("V2ray_1145", true)
+	if _, err := d.Dispatch(ctx, destination); err == nil {
+		t.Error("the new connection of the node over its cap should be refused")
+	}
+	// The connection in flight goes on
+	mb, err := link.Reader.ReadMultiBuffer()
+	if err != nil {
+		t.Fatalf("the connection in flight should not be closed: %s", err)
+	}
+	if mb.String() != "pong" {
+		t.Errorf("unexpected response: %s", mb.String())
+	}
+	buf.ReleaseMulti(mb)
+	d.UpdateOverCap("V2ray_1145", false)
+	if _, err := d.Dispatch(ctx, destination); err != nil {
+		t.Errorf("the node back under its cap should take new connections: %s", err)
+	}
+}
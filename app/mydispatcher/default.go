@@ -9,15 +9,20 @@ import (
 	"sync"
 	"time"
 
+	"github.com/XrayR-project/XrayR/common/geodata"
 	"github.com/XrayR-project/XrayR/common/limiter"
 	"github.com/XrayR-project/XrayR/common/rule"
+	"github.com/juju/ratelimit"
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 	"github.com/xtls/xray-core/common/log"
 	"github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/strmatcher"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
 	"github.com/xtls/xray-core/features/outbound"
 	"github.com/xtls/xray-core/features/policy"
 	"github.com/xtls/xray-core/features/routing"
@@ -31,6 +36,13 @@ var (
 	errSniffingTimeout = newError("timeout on sniffing")
 )
 
+// The outcomes of sniffing counted by the inbound, see SniffingCounterName
+const (
+	SniffingSuccess = "success"
+	SniffingTimeout = "timeout"
+	SniffingUnknown = "unknown"
+)
+
 type cachedReader struct {
 	sync.Mutex
 	reader *pipe.Reader
@@ -92,12 +104,28 @@ func (r *cachedReader) Interrupt() {
 
 // DefaultDispatcher is a default implementation of Dispatcher.
 type DefaultDispatcher struct {
-	ohm         outbound.Manager
-	router      routing.Router
-	policy      policy.Manager
-	stats       stats.Manager
-	Limiter     *limiter.Limiter
-	RuleManager *rule.RuleManager
+	ohm                 outbound.Manager
+	router              routing.Router
+	policy              policy.Manager
+	stats               stats.Manager
+	Limiter             *limiter.Limiter
+	RuleManager         *rule.RuleManager
+	SNIRouter           *SNIRouter
+	ProtocolRouter      *ProtocolRouter
+	SniffIncludeDomains *sync.Map         // Key: inbound tag, Value: []string, the sniffed domains to override the destination with
+	ConnectTimeouts     *sync.Map         // Key: inbound tag, Value: time.Duration, how long the outbound has to reach the destination
+	OutboundHealth      *sync.Map         // Key: outbound tag, Value: OutboundHealth of the last health check
+	LogLevels           *sync.Map         // Key: inbound tag, Value: log.Severity of the connections of the node with a log level of its own
+	DNSCache            *DNSCache         // Resolves the domain destinations for the outbounds if set
+	IPBanner            *IPBanner         // Bans the source IPs rejected by the rules too often if set
+	GeoData             *geodata.GeoData  // The geoip and geosite lookups shared with the rule manager if set
+	FakeDNS             dns.FakeDNSEngine // Recovers the domains of the fake IPs handed out by the FakeDNS of the core if set
+	DNSOutbounds        *sync.Map         // Key: inbound tag, Value: tag of the outbound answering the DNS queries of the node with fake IPs
+	OverCap             *sync.Map         // Key: inbound tag, Value: true, the inbounds of the nodes over their bandwidth cap refuse the new connections
+	Sniffers            *sync.Map         // Key: inbound tag, Value: []string, the sniffers run on the connections of the inbound, all if not set
+	RejectResponses     *sync.Map         // Key: inbound tag, Value: []byte, the HTTP response to the HTTP connections blocked by the rules
+	DialLimits          *sync.Map         // Key: inbound tag, Value: *DialLimit of the node, shared by the inbounds of the node
+	StaticHosts         *sync.Map         // Key: inbound tag, Value: *StaticHosts pinning the domains of the node to the IPs
 }
 
 func init() {
@@ -120,6 +148,18 @@ func (d *DefaultDispatcher) Init(config *Config, om outbound.Manager, router rou
 	d.stats = sm
 	d.Limiter = limiter.New()
 	d.RuleManager = rule.New()
+	d.SNIRouter = NewSNIRouter()
+	d.ProtocolRouter = NewProtocolRouter()
+	d.SniffIncludeDomains = new(sync.Map)
+	d.ConnectTimeouts = new(sync.Map)
+	d.OutboundHealth = new(sync.Map)
+	d.LogLevels = new(sync.Map)
+	d.DNSOutbounds = new(sync.Map)
+	d.OverCap = new(sync.Map)
+	d.Sniffers = new(sync.Map)
+	d.RejectResponses = new(sync.Map)
+	d.DialLimits = new(sync.Map)
+	d.StaticHosts = new(sync.Map)
 	return nil
 }
 
@@ -136,7 +176,7 @@ func (*DefaultDispatcher) Start() error {
 // Close implements common.Closable.
 func (*DefaultDispatcher) Close() error { return nil }
 
-func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *transport.Link) {
+func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network) (*transport.Link, *transport.Link) {
 	opt := pipe.OptionsFromContext(ctx)
 	uplinkReader, uplinkWriter := pipe.New(opt...)
 	downlinkReader, downlinkWriter := pipe.New(opt...)
@@ -159,48 +199,230 @@ func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *tran
 
 	if user != nil && len(user.Email) > 0 {
 		// Speed Limit and Device Limit
-		bucket, ok, reject := d.Limiter.GetUserBucket(sessionInbound.Tag, user.Email, sessionInbound.Source.Address.IP().String())
-		if reject {
-			newError("Devices reach the limit: ", user.Email).AtError().WriteToLog()
+		sourceIP := sessionInbound.Source.Address.IP().String()
+		closeLink := func() {
 			common.Close(outboundLink.Writer)
 			common.Close(inboundLink.Writer)
 			common.Interrupt(outboundLink.Reader)
 			common.Interrupt(inboundLink.Reader)
 		}
-		if ok {
-			inboundLink.Writer = d.Limiter.RateWriter(inboundLink.Writer, bucket)
-			outboundLink.Writer = d.Limiter.RateWriter(outboundLink.Writer, bucket)
+		// The user over the data limit is refused before it counts as a device
+		var uploadBucket, downloadBucket *ratelimit.Bucket
+		reject := d.Limiter.OverDataLimit(sessionInbound.Tag, user.Email)
+		if reject {
+			d.writeLog(ctx, newError("Data limit reached: ", user.Email).AtError())
+			d.countFailure(sessionInbound.Tag, FailureDataLimit)
+			closeLink()
+		} else if uploadBucket, downloadBucket, reject = d.Limiter.GetUserBuckets(sessionInbound.Tag, user.Email, sourceIP, network.SystemString()); reject {
+			d.writeLog(ctx, newError("Devices reach the limit: ", user.Email).AtError())
+			d.countFailure(sessionInbound.Tag, FailureDeviceLimit)
+			closeLink()
+		}
+		// The connections of the user are counted across all the IPs, until the outbound closes the link
+		var release func()
+		if !reject {
+			var allowed bool
+			if release, allowed = d.Limiter.AcquireConn(sessionInbound.Tag, user.Email); !allowed {
+				d.writeLog(ctx, newError("Connections reach the limit: ", user.Email).AtError())
+				d.countFailure(sessionInbound.Tag, FailureConnLimit)
+				closeLink()
+				reject = true
+			}
+		}
+		// The live connections of the user are counted in the stats by the same release
+		if !reject {
+			if untrack := d.trackUserConn(user.Email); untrack != nil {
+				limitRelease := release
+				release = func() {
+					untrack()
+					if limitRelease != nil {
+						limitRelease()
+					}
+				}
+			}
+		}
+		// The upload is written to the inbound link and the download to the outbound link
+		var uploadBuckets, downloadBuckets []*ratelimit.Bucket
+		if uploadBucket != nil {
+			uploadBuckets = append(uploadBuckets, uploadBucket)
+		}
+		if downloadBucket != nil {
+			downloadBuckets = append(downloadBuckets, downloadBucket)
+		}
+		// Each source IP of the user is also limited on its own, the connections of the IP share the bucket until closed
+		if !reject {
+			if ipBucket, releaseIP, ok := d.Limiter.GetIPBucket(sessionInbound.Tag, user.Email, sourceIP); ok {
+				uploadBuckets = append(uploadBuckets, ipBucket)
+				downloadBuckets = append(downloadBuckets, ipBucket)
+				connRelease := release
+				release = func() {
+					releaseIP()
+					if connRelease != nil {
+						connRelease()
+					}
+				}
+			}
+		}
+		if len(uploadBuckets) > 0 {
+			inboundLink.Writer = d.Limiter.RateWriter(inboundLink.Writer, uploadBuckets...)
+		}
+		if len(downloadBuckets) > 0 {
+			outboundLink.Writer = d.Limiter.RateWriter(outboundLink.Writer, downloadBuckets...)
 		}
 		p := d.policy.ForLevel(user.Level)
+		// The traffic is counted in total and by the network, the total is kept for the panels wanting one number
 		if p.Stats.UserUplink {
-			name := "user>>>" + user.Email + ">>>traffic>>>uplink"
-			if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
-				inboundLink.Writer = &SizeStatWriter{
-					Counter: c,
-					Writer:  inboundLink.Writer,
+			for _, name := range userTrafficCounterNames(user.Email, network, "uplink") {
+				if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
+					inboundLink.Writer = &SizeStatWriter{
+						Counter: c,
+						Writer:  inboundLink.Writer,
+					}
 				}
 			}
 		}
 		if p.Stats.UserDownlink {
-			name := "user>>>" + user.Email + ">>>traffic>>>downlink"
-			if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
-				outboundLink.Writer = &SizeStatWriter{
-					Counter: c,
-					Writer:  outboundLink.Writer,
+			for _, name := range userTrafficCounterNames(user.Email, network, "downlink") {
+				if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
+					outboundLink.Writer = &SizeStatWriter{
+						Counter: c,
+						Writer:  outboundLink.Writer,
+					}
 				}
 			}
 		}
+		if release != nil {
+			outboundLink.Writer = d.Limiter.ReleaseWriter(outboundLink.Writer, release)
+		}
 	}
 
 	return inboundLink, outboundLink
 }
 
-func shouldOverride(result SniffResult, request session.SniffingRequest) bool {
-	domain := result.Domain()
-	for _, d := range request.ExcludeForDomain {
-		if domain == d {
-			return false
+// userTrafficCounterNames returns the total and the network counter of the traffic of the user,
+// e.g. user>>>email>>>traffic>>>uplink and user>>>email>>>traffic>>>udp>>>uplink
+func userTrafficCounterNames(email string, network net.Network, direction string) []string {
+	networkName := "tcp"
+	if network == net.Network_UDP {
+		networkName = "udp"
+	}
+	return []string{
+		"user>>>" + email + ">>>traffic>>>" + direction,
+		"user>>>" + email + ">>>traffic>>>" + networkName + ">>>" + direction,
+	}
+}
+
+// SniffingCounterName returns the counter of the sniffing outcome of the inbound, e.g. inbound>>>tag>>>sniffing>>>timeout
+func SniffingCounterName(tag string, outcome string) string {
+	return "inbound>>>" + tag + ">>>sniffing>>>" + outcome
+}
+
+// countSniffing counts the outcome of sniffing a connection of the inbound, the connections closed meanwhile are not counted
+func (d *DefaultDispatcher) countSniffing(tag string, err error) {
+	if d.stats == nil {
+		return
+	}
+	var outcome string
+	switch err {
+	case nil:
+		outcome = SniffingSuccess
+	case errSniffingTimeout:
+		outcome = SniffingTimeout
+	case errUnknownContent:
+		outcome = SniffingUnknown
+	default:
+		return
+	}
+	if c, _ := stats.GetOrRegisterCounter(d.stats, SniffingCounterName(tag, outcome)); c != nil {
+		c.Add(1)
+	}
+}
+
+// domainMatchers caches the compiled sniffing domain lists. Key: the joined list, Value: *strmatcher.MatcherGroup
+var domainMatchers sync.Map
+
+// getDomainMatcher compiles the domain list once, the domains support the domain:, regexp: and full: prefixes
+// and the *.example.com wildcard, a domain without prefix is matched exactly.
+func getDomainMatcher(domains []string) *strmatcher.MatcherGroup {
+	key := strings.Join(domains, "\n")
+	if v, ok := domainMatchers.Load(key); ok {
+		return v.(*strmatcher.MatcherGroup)
+	}
+	group := new(strmatcher.MatcherGroup)
+	for _, domain := range domains {
+		matcherType, pattern := strmatcher.Full, domain
+		switch {
+		case strings.HasPrefix(domain, "domain:"):
+			matcherType, pattern = strmatcher.Domain, domain[len("domain:"):]
+		case strings.HasPrefix(domain, "*."):
+			matcherType, pattern = strmatcher.Domain, domain[len("*."):]
+		case strings.HasPrefix(domain, "regexp:"):
+			matcherType, pattern = strmatcher.Regex, domain[len("regexp:"):]
+		case strings.HasPrefix(domain, "full:"):
+			pattern = domain[len("full:"):]
+		}
+		matcher, err := matcherType.New(pattern)
+		if err != nil {
+			newError("invalid sniffing domain: ", domain).Base(err).AtWarning().WriteToLog()
+			continue
+		}
+		group.Add(matcher)
+	}
+	v, _ := domainMatchers.LoadOrStore(key, group)
+	return v.(*strmatcher.MatcherGroup)
+}
+
+// UpdateSniffIncludeDomains sets the domains of the inbound to override the destination with, nil removes them
+func (d *DefaultDispatcher) UpdateSniffIncludeDomains(tag string, domains []string) {
+	if len(domains) == 0 {
+		d.SniffIncludeDomains.Delete(tag)
+		return
+	}
+	d.SniffIncludeDomains.Store(tag, domains)
+}
+
+func (d *DefaultDispatcher) sniffIncludeDomains(tag string) []string {
+	if v, ok := d.SniffIncludeDomains.Load(tag); ok {
+		return v.([]string)
+	}
+	return nil
+}
+
+// UpdateSniffers sets the sniffers run on the connections of the inbound, e.g. tls. The unknown sniffers are
+// logged and ignored, and nil runs all the sniffers.
+func (d *DefaultDispatcher) UpdateSniffers(tag string, names []string) {
+	var sniffers []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !isKnownSniffer(name) {
+			newError("unknown sniffer: ", name, ", the known ones are http, tls and bittorrent").AtWarning().WriteToLog()
+			continue
 		}
+		sniffers = append(sniffers, name)
+	}
+	if len(sniffers) == 0 {
+		d.Sniffers.Delete(tag)
+		return
+	}
+	d.Sniffers.Store(tag, sniffers)
+}
+
+func (d *DefaultDispatcher) sniffers(tag string) []string {
+	if v, ok := d.Sniffers.Load(tag); ok {
+		return v.([]string)
+	}
+	return nil
+}
+
+// shouldOverride checks if the sniffed domain should override the destination.
+// An excluded domain is never overridden, and when the include list is not empty only the included domains are.
+func shouldOverride(result SniffResult, request session.SniffingRequest, includeDomains []string) bool {
+	domain := strings.ToLower(result.Domain())
+	if len(request.ExcludeForDomain) > 0 && len(getDomainMatcher(request.ExcludeForDomain).Match(domain)) > 0 {
+		return false
+	}
+	if len(includeDomains) > 0 && len(getDomainMatcher(includeDomains).Match(domain)) == 0 {
+		return false
 	}
 
 	protocol := result.Protocol()
@@ -220,8 +442,31 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 	}
 	// Check if domain and protocol hit the rule
 	sessionInbound := session.InboundFromContext(ctx)
+	if sessionInbound == nil || sessionInbound.User == nil {
+		return d.dispatchCore(ctx, destination), nil
+	}
+	sourceIP := sourceIPOf(sessionInbound)
+	if d.IPBanner != nil && sourceIP != "" && d.IPBanner.Banned(sourceIP) {
+		return nil, newError("source IP ", sourceIP, " is banned")
+	}
+	if d.overCap(sessionInbound.Tag) {
+		return nil, newError("node ", sessionInbound.Tag, " is over its bandwidth cap")
+	}
+	// The fake IPs are mapped back to their domains, so the rules and the routes see the domains without sniffing
+	if domain := d.fakeDomainOf(destination); domain != "" {
+		d.writeLog(ctx, newError("fake dns got domain: ", domain, " for ip: ", destination.Address))
+		destination.Address = net.ParseAddress(domain)
+	}
 	if d.RuleManager.Detect(sessionInbound.Tag, destination.String(), sessionInbound.User.Email) {
-		newError(fmt.Sprintf("User %s access %s reject by rule", sessionInbound.User.Email, destination.String())).AtError().WriteToLog()
+		d.writeLog(ctx, newError(fmt.Sprintf("User %s access %s reject by rule", sessionInbound.User.Email, destination.String())).AtError())
+		d.countFailure(sessionInbound.Tag, FailureRuleReject)
+		if d.IPBanner != nil && sourceIP != "" && d.IPBanner.Hit(sourceIP) {
+			d.writeLog(ctx, newError(fmt.Sprintf("Source IP %s of user %s is banned for hitting the rules too often", sourceIP, sessionInbound.User.Email)).AtWarning())
+		}
+		// The blocked HTTP requests are answered, so the users know why instead of seeing a reset
+		if response := d.rejectResponse(sessionInbound.Tag); response != nil && destination.Network == net.Network_TCP {
+			return d.rejectLink(ctx, response), nil
+		}
 		return nil, newError("destination is reject by rule")
 	}
 
@@ -229,8 +474,14 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 		Target: destination,
 	}
 	ctx = session.ContextWithOutbound(ctx, ob)
+	// The DNS queries of the node are answered with the fake IPs
+	if destination.Port == 53 {
+		if tag := d.dnsOutbound(sessionInbound.Tag); tag != "" {
+			ctx = contextWithPreferredOutbound(ctx, tag)
+		}
+	}
 
-	inbound, outbound := d.getLink(ctx)
+	inbound, outbound := d.getLink(ctx, destination.Network)
 	content := session.ContentFromContext(ctx)
 	if content == nil {
 		content = new(session.Content)
@@ -245,13 +496,39 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 				reader: outbound.Reader.(*pipe.Reader),
 			}
 			outbound.Reader = cReader
-			result, err := sniffer(ctx, cReader)
+			result, err := sniffer(ctx, cReader, d.sniffers(sessionInbound.Tag))
+			d.countSniffing(sessionInbound.Tag, err)
+			if err == errSniffingTimeout {
+				d.countFailure(sessionInbound.Tag, FailureSniffing)
+			}
 			if err == nil {
 				content.Protocol = result.Protocol()
 			}
-			if err == nil && shouldOverride(result, sniffingRequest) {
+			if err == nil && d.RuleManager.DetectProtocol(sessionInbound.Tag, result.Protocol(), sessionInbound.User.Email) {
+				d.writeLog(ctx, newError(fmt.Sprintf("User %s access %s with %s reject by protocol rule", sessionInbound.User.Email, destination.String(), result.Protocol())).AtError())
+				d.countFailure(sessionInbound.Tag, FailureRuleReject)
+				common.Close(outbound.Writer)
+				common.Interrupt(outbound.Reader)
+				return
+			}
+			if err == nil {
+				if tag, ok := d.ProtocolRouter.Match(result.Protocol()); ok {
+					ctx = contextWithPreferredOutbound(ctx, tag)
+				}
+			}
+			// The server name is more specific than the protocol
+			if err == nil && result.Protocol() == "tls" && result.Domain() != "" {
+				if tag, ok := d.SNIRouter.Match(result.Domain()); ok {
+					ctx = contextWithPreferredOutbound(ctx, tag)
+				}
+				ctx = contextWithSNI(ctx, result.Domain())
+				if sessionInbound.User != nil && sessionInbound.User.Email != "" {
+					d.Limiter.RecordSNI(sessionInbound.Tag, sessionInbound.User.Email, result.Domain())
+				}
+			}
+			if err == nil && shouldOverride(result, sniffingRequest, d.sniffIncludeDomains(sessionInbound.Tag)) {
 				domain := result.Domain()
-				newError("sniffed domain: ", domain).WriteToLog(session.ExportIDToError(ctx))
+				d.writeLog(ctx, newError("sniffed domain: ", domain))
 				destination.Address = net.ParseAddress(domain)
 				ob.Target = destination
 			}
@@ -261,11 +538,30 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 	return inbound, nil
 }
 
-func sniffer(ctx context.Context, cReader *cachedReader) (SniffResult, error) {
+// dispatchCore routes the connections of the core itself, like the queries of the DoH server of the DNS, which come
+// from no inbound or user. They are not limited, checked against the rules of a node nor sniffed
+func (d *DefaultDispatcher) dispatchCore(ctx context.Context, destination net.Destination) *transport.Link {
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{
+		Target: destination,
+	})
+	inbound, outbound := d.getLink(ctx, destination.Network)
+	go d.routedDispatch(ctx, outbound, destination)
+	return inbound
+}
+
+// sourceIPOf returns the source IP of the inbound connection, or empty if it is unknown
+func sourceIPOf(sessionInbound *session.Inbound) string {
+	if sessionInbound.Source.Address == nil || !sessionInbound.Source.Address.Family().IsIP() {
+		return ""
+	}
+	return sessionInbound.Source.Address.IP().String()
+}
+
+func sniffer(ctx context.Context, cReader *cachedReader, enabled []string) (SniffResult, error) {
 	payload := buf.New()
 	defer payload.Release()
 
-	sniffer := NewSniffer()
+	sniffer := NewSniffer(enabled)
 	totalAttempt := 0
 	for {
 		select {
@@ -302,27 +598,45 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 	routingLink := routing_session.AsRoutingContext(ctx)
 	inTag := routingLink.GetInboundTag()
 	isPickRoute := false
-	if d.router != nil && !skipRoutePick {
+	// The outbound picked by the sniffed server name or protocol takes priority over the router
+	if outTag := preferredOutboundFromContext(ctx); outTag != "" {
+		if h := d.ohm.GetHandler(outTag); h != nil {
+			d.writeLog(ctx, newError("taking sniffing detour [", outTag, "] for [", destination, "]"))
+			handler = h
+			isPickRoute = true
+		} else {
+			d.writeLog(ctx, newError("non existing sniffing outTag: ", outTag).AtWarning())
+		}
+	}
+	if handler == nil && d.router != nil && !skipRoutePick {
 		if route, err := d.router.PickRoute(routingLink); err == nil {
 			outTag := route.GetOutboundTag()
 			isPickRoute = true
 			if h := d.ohm.GetHandler(outTag); h != nil {
-				newError("taking detour [", outTag, "] for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
+				d.writeLog(ctx, newError("taking detour [", outTag, "] for [", destination, "]"))
 				handler = h
 			} else {
-				newError("non existing outTag: ", outTag).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+				d.writeLog(ctx, newError("non existing outTag: ", outTag).AtWarning())
 			}
 		} else {
-			newError("default route for ", destination).WriteToLog(session.ExportIDToError(ctx))
+			d.writeLog(ctx, newError("default route for ", destination))
 		}
 	}
 
+	// The unhealthy outbound is skipped in favor of the default one
+	if handler != nil && d.skipOutbound(handler.Tag()) {
+		d.writeLog(ctx, newError("outbound [", handler.Tag(), "] is unhealthy, take the default route for [", destination, "]").AtInfo())
+		handler = nil
+		isPickRoute = false
+	}
+
 	if handler == nil {
 		handler = d.ohm.GetDefaultHandler()
 	}
 
 	if handler == nil {
-		newError("default outbound handler not exist").WriteToLog(session.ExportIDToError(ctx))
+		d.writeLog(ctx, newError("default outbound handler not exist"))
+		d.countFailure(inTag, FailureNoOutbound)
 		common.Close(link.Writer)
 		common.Interrupt(link.Reader)
 		return
@@ -344,8 +658,80 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 				}
 			}
 		}
+		if sni := sniFromContext(ctx); sni != "" && serial.ToString(accessMessage.Reason) == "" {
+			accessMessage.Reason = "sni: " + sni
+		}
 		log.Record(accessMessage)
 	}
 
-	handler.Dispatch(ctx, link)
+	// Resolve the domain after routing, so the routing rules still see it and the outbound does not resolve it again.
+	// The hosts of the node win over the DNS
+	resolved := false
+	if hosts := d.staticHosts(inTag); hosts != nil && destination.Address.Family().IsDomain() {
+		if ob := session.OutboundFromContext(ctx); ob != nil {
+			if ip, ok := hosts.Lookup(destination.Address.Domain()); ok {
+				d.writeLog(ctx, newError("pin ", destination.Address, " to ", ip, " by the hosts of [", inTag, "]"))
+				ob.Target.Address = ip
+				resolved = true
+			}
+		}
+	}
+	if d.DNSCache != nil && !resolved && destination.Address.Family().IsDomain() {
+		if ob := session.OutboundFromContext(ctx); ob != nil {
+			if ips, err := d.DNSCache.LookupIP(destination.Address.Domain()); err == nil {
+				ob.Target.Address = net.IPAddress(ips[0])
+			} else {
+				d.writeLog(ctx, newError("failed to resolve ", destination.Address, ", leave it to the outbound").Base(err).AtWarning())
+			}
+		}
+	}
+
+	if tag := handler.Tag(); tag != "" && d.stats != nil {
+		link = d.outboundStatLink(tag, link)
+	}
+
+	// Bound the dials in flight of the node, the slot is released once the outbound is connected or returns
+	if limit := d.dialLimit(inTag); limit != nil {
+		if !limit.acquire(ctx) {
+			d.writeLog(ctx, newError("too many outbound dials in flight on [", inTag, "], close the connection to ", destination).AtWarning())
+			common.Close(link.Writer)
+			common.Interrupt(link.Reader)
+			return
+		}
+		release := limit.releaseOnce()
+		defer release()
+		link = connectLink(link, release)
+	}
+
+	// Drop the connection stuck on an unreachable destination, instead of holding the link until the dial gives up
+	if timeout := d.connectTimeout(inTag); timeout > 0 {
+		var guard *connectGuard
+		ctx, link, guard = guardConnect(ctx, link, timeout, destination.String())
+		defer guard.Done()
+	}
+
+	d.dispatchOutbound(ctx, handler, link, inTag)
+}
+
+// outboundStatLink counts the traffic of the link by the outbound tag, the uplink is read by the outbound and the downlink written by it
+func (d *DefaultDispatcher) outboundStatLink(tag string, link *transport.Link) *transport.Link {
+	statLink := &transport.Link{
+		Reader: link.Reader,
+		Writer: link.Writer,
+	}
+	name := "outbound>>>" + tag + ">>>traffic>>>uplink"
+	if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
+		statLink.Reader = &SizeStatReader{
+			Counter: c,
+			Reader:  link.Reader,
+		}
+	}
+	name = "outbound>>>" + tag + ">>>traffic>>>downlink"
+	if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
+		statLink.Writer = &SizeStatWriter{
+			Counter: c,
+			Writer:  link.Writer,
+		}
+	}
+	return statLink
 }
@@ -0,0 +1,448 @@
+package mydispatcher
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/app/policy"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+// newTestDispatcher returns a dispatcher with the outbounds direct (default) and streaming,
+// the tag of the outbound is sent to the channel when a connection is dispatched.
+func newTestDispatcher(t *testing.T) (*DefaultDispatcher, chan string) {
+	dispatched := make(chan string, 1)
+	ohm := &testOutboundManager{handlers: []outbound.Handler{
+		&testHandler{tag: "direct", dispatched: dispatched},
+		&testHandler{tag: "streaming", dispatched: dispatched},
+	}}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	return d, dispatched
+}
+
+// dispatchPayload dispatches a sniffing enabled tcp connection of the user on the inbound V2ray_1145, and sends the payload
+func dispatchPayload(t *testing.T, d *DefaultDispatcher, email string, payload []byte) *transport.Link {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{Email: email}})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: session.SniffingRequest{Enabled: true},
+	})
+	link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, payload)); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+type testSniffResult string
+
+func (r testSniffResult) Protocol() string { return "tls" }
+func (r testSniffResult) Domain() string   { return string(r) }
+
+func TestShouldOverrideExclude(t *testing.T) {
+	request := session.SniffingRequest{
+		OverrideDestinationForProtocol: []string{"tls"},
+		ExcludeForDomain: []string{
+			"exact.example.com",
+			"full:full.example.com",
+			"domain:corp.internal",
+			"regexp:^api[0-9]+\\.example\\.org$",
+			"regexp:[",
+		},
+	}
+	cases := map[string]bool{
+		"exact.example.com":     false,
+		"www.exact.example.com": true,
+		"full.example.com":      false,
+		"www.full.example.com":  true,
+		"corp.internal":         false,
+		"git.corp.internal":     false,
+		"notcorp.internal":      true,
+		"api12.example.org":     false,
+		"api.example.org":       true,
+		"www.example.com":       true,
+	}
+	for domain, want := range cases {
+		if got := shouldOverride(testSniffResult(domain), request, nil); got != want {
+			t.Errorf("unexpected override of %s. want %v, but got %v", domain, want, got)
+		}
+	}
+}
+
+func TestShouldOverrideExcludeCached(t *testing.T) {
+	domains := []string{"domain:cached.example.com"}
+	if getDomainMatcher(domains) != getDomainMatcher(domains) {
+		t.Error("the domain list should be compiled once")
+	}
+}
+
+func TestShouldOverrideInclude(t *testing.T) {
+	request := session.SniffingRequest{
+		OverrideDestinationForProtocol: []string{"tls"},
+		ExcludeForDomain:               []string{"domain:private.cdn.example.com"},
+	}
+	include := []string{"*.cdn.example.com", "full:video.example.net"}
+	cases := map[string]bool{
+		// Include hit
+		"img.cdn.example.com": true,
+		"video.example.net":   true,
+		// Include miss
+		"www.example.com":         false,
+		"live.video.example.net":  false,
+		"cdn.example.com.evil.io": false,
+		// Exclude wins over include
+		"private.cdn.example.com":     false,
+		"api.private.cdn.example.com": false,
+	}
+	for domain, want := range cases {
+		if got := shouldOverride(testSniffResult(domain), request, include); got != want {
+			t.Errorf("unexpected override of %s. want %v, but got %v", domain, want, got)
+		}
+	}
+	// The include list does not enable the override for the other protocols
+	request.OverrideDestinationForProtocol = []string{"http"}
+	if shouldOverride(testSniffResult("img.cdn.example.com"), request, include) {
+		t.Error("included domain should not be overridden for a protocol without override")
+	}
+}
+
+func TestUpdateSniffIncludeDomains(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+	d.UpdateSniffIncludeDomains("V2ray_1145", []string{"*.cdn.example.com"})
+	if domains := d.sniffIncludeDomains("V2ray_1145"); len(domains) != 1 {
+		t.Errorf("unexpected include domains: %v", domains)
+	}
+	if domains := d.sniffIncludeDomains("V2ray_8443"); domains != nil {
+		t.Errorf("the other inbound should have no include domains, got %v", domains)
+	}
+	d.UpdateSniffIncludeDomains("V2ray_1145", nil)
+	if domains := d.sniffIncludeDomains("V2ray_1145"); domains != nil {
+		t.Errorf("include domains should be removed, got %v", domains)
+	}
+}
+
+// targetHandler sends the destination of the connection to the channel
+type targetHandler struct {
+	testHandler
+	targets chan net.Destination
+}
+
+func (h *targetHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	h.targets <- session.OutboundFromContext(ctx).Target
+}
+
+func TestDispatchSniffers(t *testing.T) {
+	handler := &targetHandler{testHandler: testHandler{tag: "direct"}, targets: make(chan net.Destination, 1)}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{handlers: []outbound.Handler{handler}}, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	dispatchHTTP := func() net.Destination {
+		ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{}})
+		ctx = session.ContextWithContent(ctx, &session.Content{
+			SniffingRequest: session.SniffingRequest{Enabled: true, OverrideDestinationForProtocol: []string{"http", "tls"}},
+		})
+		link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 80))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case target := <-handler.targets:
+			return target
+		case <-time.After(2 * time.Second):
+			t.Fatal("the http connection should be dispatched")
+		}
+		return net.Destination{}
+	}
+	if target := dispatchHTTP(); target.Address.String() != "www.example.com" {
+		t.Errorf("all the sniffers run by default, the host should override the destination, got %s", target)
+	}
+	// The unknown sniffers are ignored
+	d.UpdateSniffers("V2ray_1145", []string{"TLS", "fakedns"})
+	if sniffers := d.sniffers("V2ray_1145"); len(sniffers) != 1 || sniffers[0] != "tls" {
+		t.Errorf("only the tls sniffer should be enabled, got %v", sniffers)
+	}
+	if target := dispatchHTTP(); target.Address.String() != "1.1.1.1" {
+		t.Errorf("the tls only inbound should not sniff the http host, got %s", target)
+	}
+	d.UpdateSniffers("V2ray_1145", nil)
+	if sniffers := d.sniffers("V2ray_1145"); sniffers != nil {
+		t.Errorf("the sniffers should be removed, got %v", sniffers)
+	}
+}
+
+func TestDispatchBlockProtocol(t *testing.T) {
+	d, dispatched := newTestDispatcher(t)
+	d.RuleManager.UpdateProtocolRule("V2ray_1145", []string{"bittorrent"})
+
+	handshake := append([]byte{19}, []byte("BitTorrent protocol")...)
+	handshake = append(handshake, make([]byte, 48)...)
+	link := dispatchPayload(t, d, "", handshake)
+	if _, err := link.Reader.ReadMultiBuffer(); err == nil {
+		t.Error("the bittorrent connection should be closed")
+	}
+	select {
+	case tag := <-dispatched:
+		t.Errorf("the bittorrent connection should be rejected, but dispatched to %s", tag)
+	default:
+	}
+}
+
+func TestDispatchBlockProtocolNotBlocked(t *testing.T) {
+	d, dispatched := newTestDispatcher(t)
+	d.RuleManager.UpdateProtocolRule("V2ray_1145", []string{"bittorrent"})
+	dispatchPayload(t, d, "", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	select {
+	case tag := <-dispatched:
+		if tag != "direct" {
+			t.Errorf("unexpected outbound: %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the http connection should be dispatched")
+	}
+}
+
+// echoHandler reads the request of the connection and writes the response back
+type echoHandler struct {
+	testHandler
+	response []byte
+}
+
+func (h *echoHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	if mb, err := link.Reader.ReadMultiBuffer(); err == nil {
+		buf.ReleaseMulti(mb)
+		link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, h.response))
+	}
+	h.dispatched <- h.tag
+}
+
+func TestDispatchOutboundStats(t *testing.T) {
+	dispatched := make(chan string, 1)
+	ohm := &testOutboundManager{handlers: []outbound.Handler{
+		&testHandler{tag: "direct", dispatched: dispatched},
+		&echoHandler{testHandler: testHandler{tag: "relay", dispatched: dispatched}, response: []byte("pong")},
+	}}
+	sm, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, nil, sm); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ProtocolRouter.Update([]*ProtocolRoute{{Protocol: "http", OutboundTag: "relay"}}); err != nil {
+		t.Fatal(err)
+	}
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	link := dispatchPayload(t, d, "", request)
+	select {
+	case tag := <-dispatched:
+		if tag != "relay" {
+			t.Fatalf("unexpected outbound: %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the http connection should be dispatched")
+	}
+	mb, err := link.Reader.ReadMultiBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.ReleaseMulti(mb)
+
+	counterValue := func(name string) int64 {
+		if c := sm.GetCounter(name); c != nil {
+			return c.Value()
+		}
+		return 0
+	}
+	if up := counterValue("outbound>>>relay>>>traffic>>>uplink"); up != int64(len(request)) {
+		t.Errorf("unexpected uplink of relay: %d, want %d", up, len(request))
+	}
+	if down := counterValue("outbound>>>relay>>>traffic>>>downlink"); down != 4 {
+		t.Errorf("unexpected downlink of relay: %d, want 4", down)
+	}
+	if up := counterValue("outbound>>>direct>>>traffic>>>uplink"); up != 0 {
+		t.Errorf("the traffic should not be counted to direct, got %d", up)
+	}
+}
+
+func TestDispatchUserNetworkStats(t *testing.T) {
+	dispatched := make(chan string, 2)
+	ohm := &testOutboundManager{handlers: []outbound.Handler{
+		&echoHandler{testHandler: testHandler{tag: "direct", dispatched: dispatched}, response: []byte("pong")},
+	}}
+	sm, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := policy.New(context.Background(), &policy.Config{Level: map[uint32]*policy.Policy{
+		0: {Stats: &policy.Policy_Stats{UserUplink: true, UserDownlink: true}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, pm, sm); err != nil {
+		t.Fatal(err)
+	}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    "V2ray_1145",
+		Source: net.TCPDestination(net.ParseAddress("1.2.3.4"), 1234),
+		User:   &protocol.MemoryUser{Email: "user@example.com"},
+	})
+	send := func(destination net.Destination, payload string) {
+		link, err := d.Dispatch(ctx, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte(payload))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-dispatched:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the connection to %s should be dispatched", destination)
+		}
+		mb, err := link.Reader.ReadMultiBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.ReleaseMulti(mb)
+	}
+	send(net.TCPDestination(net.ParseAddress("1.1.1.1"), 443), "tcp request")
+	send(net.UDPDestination(net.ParseAddress("8.8.8.8"), 53), "dns")
+
+	counterValue := func(name string) int64 {
+		if c := sm.GetCounter(name); c != nil {
+			return c.Value()
+		}
+		return -1
+	}
+	testCases := map[string]int64{
+		"user>>>user@example.com>>>traffic>>>uplink":         int64(len("tcp request") + len("dns")),
+		"user>>>user@example.com>>>traffic>>>downlink":       8,
+		"user>>>user@example.com>>>traffic>>>tcp>>>uplink":   int64(len("tcp request")),
+		"user>>>user@example.com>>>traffic>>>tcp>>>downlink": 4,
+		"user>>>user@example.com>>>traffic>>>udp>>>uplink":   int64(len("dns")),
+		"user>>>user@example.com>>>traffic>>>udp>>>downlink": 4,
+	}
+	for name, want := range testCases {
+		if value := counterValue(name); value != want {
+			t.Errorf("unexpected %s: %d, want %d", name, value, want)
+		}
+	}
+}
+
+func TestGetLinkUploadDownloadSpeedLimit(t *testing.T) {
+	pm, err := policy.New(context.Background(), &policy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{}, nil, pm, nil); err != nil {
+		t.Fatal(err)
+	}
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com", UploadSpeedLimit: 1000, DownloadSpeedLimit: 5000},
+		{UID: 2, Email: "b@test.com", SpeedLimit: 5000},
+	}
+	if err := d.Limiter.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	// write sends the bytes of the user to the upload and the download of a new link
+	write := func(email string, upload int, download int) {
+		ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+			Tag:    "V2ray_1145",
+			Source: net.TCPDestination(net.ParseAddress("1.2.3.4"), 1234),
+			User:   &protocol.MemoryUser{Email: email},
+		})
+		inboundLink, outboundLink := d.getLink(ctx, net.Network_TCP)
+		if err := inboundLink.Writer.WriteMultiBuffer(buf.MergeBytes(nil, make([]byte, upload))); err != nil {
+			t.Fatal(err)
+		}
+		if err := outboundLink.Writer.WriteMultiBuffer(buf.MergeBytes(nil, make([]byte, download))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The directions are throttled by their own buckets
+	write("a@test.com", 600, 0)
+	uploadBucket, downloadBucket, _ := d.Limiter.GetUserBuckets("V2ray_1145", "a@test.com", "1.2.3.4", "tcp")
+	if available := uploadBucket.Available(); available > 400 {
+		t.Errorf("the upload should take the upload bucket, %d left", available)
+	}
+	if available := downloadBucket.Available(); available != 5000 {
+		t.Errorf("the upload should not take the download bucket, %d left", available)
+	}
+	// The single limit is shared by both directions
+	write("b@test.com", 1000, 2000)
+	bucket, _, _ := d.Limiter.GetUserBuckets("V2ray_1145", "b@test.com", "1.2.3.4", "tcp")
+	if available := bucket.Available(); available > 2000 {
+		t.Errorf("both directions should take the shared bucket, %d left", available)
+	}
+}
+
+func TestDispatchSniffingCounters(t *testing.T) {
+	dispatched := make(chan string, 1)
+	ohm := &testOutboundManager{handlers: []outbound.Handler{&testHandler{tag: "direct", dispatched: dispatched}}}
+	sm, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, nil, sm); err != nil {
+		t.Fatal(err)
+	}
+	count := func(outcome string) int64 {
+		if c := sm.GetCounter(SniffingCounterName("V2ray_1145", outcome)); c != nil {
+			return c.Value()
+		}
+		return 0
+	}
+	wait := func() {
+		select {
+		case <-dispatched:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the connection should be dispatched")
+		}
+	}
+
+	// A TLS flow is sniffed
+	dispatchPayload(t, d, "", clientHello(t, "www.example.com"))
+	wait()
+	if count(SniffingSuccess) != 1 || count(SniffingTimeout) != 0 || count(SniffingUnknown) != 0 {
+		t.Errorf("the TLS flow should count a success, got %d %d %d", count(SniffingSuccess), count(SniffingTimeout), count(SniffingUnknown))
+	}
+	// A client sending nothing within the sniffing attempts times out
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{}})
+	ctx = session.ContextWithContent(ctx, &session.Content{SniffingRequest: session.SniffingRequest{Enabled: true}})
+	if _, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443)); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	if count(SniffingTimeout) != 1 || count(SniffingSuccess) != 1 {
+		t.Errorf("the slow client should count a timeout, got %d", count(SniffingTimeout))
+	}
+	// A full payload of no known protocol is unknown content
+	dispatchPayload(t, d, "", bytes.Repeat([]byte{0xff}, buf.Size))
+	wait()
+	if count(SniffingUnknown) != 1 {
+		t.Errorf("the unknown content should be counted, got %d", count(SniffingUnknown))
+	}
+}
@@ -0,0 +1,74 @@
+package mydispatcher
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DialLimit bounds the outbound dials in flight of a node, a dial is in flight until the outbound is connected or
+// returns. The connections beyond the bound wait for a slot up to the queue timeout, then they are closed
+type DialLimit struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewDialLimit returns the bound of maxDials dials in flight, nil if maxDials is 0 or less, which means unlimited
+func NewDialLimit(maxDials int, queueTimeout time.Duration) *DialLimit {
+	if maxDials <= 0 {
+		return nil
+	}
+	return &DialLimit{slots: make(chan struct{}, maxDials), queueTimeout: queueTimeout}
+}
+
+// InFlight returns the number of the dials in flight
+func (l *DialLimit) InFlight() int {
+	return len(l.slots)
+}
+
+// acquire takes a slot, false if none is freed in the queue timeout or the connection is closed meanwhile
+func (l *DialLimit) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseOnce returns the release of the acquired slot, which frees it on the first call only
+func (l *DialLimit) releaseOnce() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.slots })
+	}
+}
+
+// UpdateDialLimit sets the bound of the dials in flight of the connections of the inbound, nil removes it.
+// The inbounds of a node share its bound
+func (d *DefaultDispatcher) UpdateDialLimit(tag string, limit *DialLimit) {
+	if limit == nil {
+		d.DialLimits.Delete(tag)
+		return
+	}
+	d.DialLimits.Store(tag, limit)
+}
+
+func (d *DefaultDispatcher) dialLimit(tag string) *DialLimit {
+	if v, ok := d.DialLimits.Load(tag); ok {
+		return v.(*DialLimit)
+	}
+	return nil
+}
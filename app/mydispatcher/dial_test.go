@@ -0,0 +1,150 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/policy"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+// dialingHandler dials until the test connects or fails the dial, then it reports the dial done
+type dialingHandler struct {
+	testHandler
+	connect chan bool
+	done    chan struct{}
+}
+
+func (h *dialingHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	defer func() { h.done <- struct{}{} }()
+	if connected := <-h.connect; !connected {
+		// The same as the outbound handlers on a failed dial
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("pong")))
+	// The connected outbound stays until the connection is closed
+	<-ctx.Done()
+}
+
+func newDialDispatcher(t *testing.T, handler outbound.Handler, limit *DialLimit) *DefaultDispatcher {
+	pm, err := policy.New(context.Background(), &policy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{handlers: []outbound.Handler{handler}}, nil, pm, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.UpdateDialLimit("V2ray_1145", limit)
+	return d
+}
+
+func dispatchDial(t *testing.T, ctx context.Context, d *DefaultDispatcher) *transport.Link {
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{
+		Tag:    "V2ray_1145",
+		Source: net.TCPDestination(net.ParseAddress("2.2.2.2"), 12345),
+		User:   &protocol.MemoryUser{Email: "a@test.com"},
+	})
+	link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// waitInFlight waits for the dials in flight to reach the number
+func waitInFlight(t *testing.T, limit *DialLimit, want int) {
+	for start := time.Now(); limit.InFlight() != want; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("want %d dials in flight, got %d", want, limit.InFlight())
+		}
+	}
+}
+
+func TestDispatchDialLimit(t *testing.T) {
+	handler := &dialingHandler{testHandler: testHandler{tag: "direct"}, connect: make(chan bool), done: make(chan struct{}, 10)}
+	limit := NewDialLimit(2, 0)
+	d := newDialDispatcher(t, handler, limit)
+	ctx, closeConnected := context.WithCancel(context.Background())
+	defer closeConnected()
+	dispatchDial(t, ctx, d)
+	dispatchDial(t, ctx, d)
+	waitInFlight(t, limit, 2)
+
+	// The dial beyond the bound is closed at once
+	link := dispatchDial(t, ctx, d)
+	if _, err := link.Reader.ReadMultiBuffer(); err == nil {
+		t.Fatal("the dial beyond the bound should be closed")
+	}
+	// The slot of the connected dial is freed for a new one
+	handler.connect <- true
+	waitInFlight(t, limit, 1)
+	link = dispatchDial(t, ctx, d)
+	waitInFlight(t, limit, 2)
+	// The slot of the failed dial is freed too
+	handler.connect <- false
+	handler.connect <- false
+	<-handler.done
+	<-handler.done
+	waitInFlight(t, limit, 0)
+	if _, err := link.Reader.ReadMultiBuffer(); err == nil {
+		t.Error("the failed dial should close the connection")
+	}
+	// Closing the connected connection leaves no slot taken
+	closeConnected()
+	<-handler.done
+	if limit.InFlight() != 0 {
+		t.Errorf("want no dial in flight, got %d", limit.InFlight())
+	}
+}
+
+func TestDispatchDialLimitQueue(t *testing.T) {
+	handler := &dialingHandler{testHandler: testHandler{tag: "direct"}, connect: make(chan bool), done: make(chan struct{}, 10)}
+	limit := NewDialLimit(1, 300*time.Millisecond)
+	d := newDialDispatcher(t, handler, limit)
+	ctx, closeConnected := context.WithCancel(context.Background())
+	defer closeConnected()
+	dispatchDial(t, ctx, d)
+	waitInFlight(t, limit, 1)
+
+	// The queued dial takes the slot freed in the queue timeout
+	link := dispatchDial(t, ctx, d)
+	time.Sleep(100 * time.Millisecond)
+	handler.connect <- false
+	handler.connect <- true
+	mb, err := link.Reader.ReadMultiBuffer()
+	if err != nil {
+		t.Fatalf("the queued dial should get the freed slot: %s", err)
+	}
+	buf.ReleaseMulti(mb)
+	waitInFlight(t, limit, 0)
+
+	// The queued dial is closed if no slot is freed in the queue timeout
+	dispatchDial(t, ctx, d)
+	waitInFlight(t, limit, 1)
+	start := time.Now()
+	link = dispatchDial(t, ctx, d)
+	if _, err := link.Reader.ReadMultiBuffer(); err == nil {
+		t.Fatal("the queued dial should be closed on the queue timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > time.Second {
+		t.Errorf("the queued dial should be closed on the queue timeout, but took %s", elapsed)
+	}
+	handler.connect <- false
+	waitInFlight(t, limit, 0)
+}
+
+func TestNewDialLimitUnlimited(t *testing.T) {
+	if NewDialLimit(0, time.Second) != nil || NewDialLimit(-1, 0) != nil {
+		t.Error("the bound of 0 or less should be unlimited")
+	}
+}
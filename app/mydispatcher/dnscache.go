@@ -0,0 +1,196 @@
+package mydispatcher
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// DNSCacheConfig enables the cache of the domains resolved on the node for the outbounds
+type DNSCacheConfig struct {
+	Size   int `mapstructure:"Size"`   // Max domains in the cache, the least recently used one is evicted. Default 1024
+	MinTTL int `mapstructure:"MinTTL"` // Seconds, the records of a shorter TTL are cached this long
+	MaxTTL int `mapstructure:"MaxTTL"` // Seconds, the records of a longer TTL are cached this long. 0 means no limit
+}
+
+// Resolver resolves the domain to its IPs and the TTL of the records
+type Resolver interface {
+	LookupIP(domain string) ([]net.IP, time.Duration, error)
+}
+
+type dnsCacheEntry struct {
+	domain  string
+	ips     []net.IP
+	expires time.Time
+}
+
+// DNSCache caches the IPs of the domains until their TTL expires, it is safe for concurrent use
+type DNSCache struct {
+	Now      func() time.Time // Clock of the expiry, can be replaced in tests
+	resolver Resolver
+	config   DNSCacheConfig
+	access   sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // Front is the most recently used
+	group    singleflight.Group
+}
+
+func NewDNSCache(config *DNSCacheConfig, resolver Resolver) *DNSCache {
+	c := &DNSCache{
+		Now:      time.Now,
+		resolver: resolver,
+		config:   *config,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if c.config.Size <= 0 {
+		c.config.Size = 1024
+	}
+	return c
+}
+
+// LookupIP returns the cached IPs of the domain, or resolves it if they are missing or expired.
+// The concurrent lookups of the same domain share one resolution.
+func (c *DNSCache) LookupIP(domain string) ([]net.IP, error) {
+	domain = strings.ToLower(domain)
+	if ips, ok := c.load(domain); ok {
+		return ips, nil
+	}
+	v, err, _ := c.group.Do(domain, func() (interface{}, error) {
+		ips, ttl, err := c.resolver.LookupIP(domain)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no IP of %s", domain)
+		}
+		c.store(domain, ips, c.clampTTL(ttl))
+		return ips, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]net.IP), nil
+}
+
+func (c *DNSCache) load(domain string) ([]net.IP, bool) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	element, ok := c.entries[domain]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*dnsCacheEntry)
+	if !c.Now().Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, domain)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.ips, true
+}
+
+func (c *DNSCache) store(domain string, ips []net.IP, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	entry := &dnsCacheEntry{domain: domain, ips: ips, expires: c.Now().Add(ttl)}
+	if element, ok := c.entries[domain]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[domain] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).domain)
+	}
+}
+
+func (c *DNSCache) clampTTL(ttl time.Duration) time.Duration {
+	if minTTL := time.Duration(c.config.MinTTL) * time.Second; ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL := time.Duration(c.config.MaxTTL) * time.Second; maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// SystemResolver queries the name servers of the system for the A and AAAA records
+type SystemResolver struct {
+	client  *dns.Client
+	servers []string
+}
+
+// NewSystemResolver reads the name servers from /etc/resolv.conf
+func NewSystemResolver() (*SystemResolver, error) {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("read the system name servers failed: %s", err)
+	}
+	servers := make([]string, len(config.Servers))
+	for i, server := range config.Servers {
+		servers[i] = net.JoinHostPort(server, config.Port)
+	}
+	return &SystemResolver{
+		client:  &dns.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		servers: servers,
+	}, nil
+}
+
+// LookupIP returns the IPv4 addresses before the IPv6 ones, the TTL is the shortest one of the answers
+func (r *SystemResolver) LookupIP(domain string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl uint32
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, err := r.exchange(domain, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range answers {
+			if header := answer.Header(); ttl == 0 || header.Ttl < ttl {
+				ttl = header.Ttl
+			}
+			switch record := answer.(type) {
+			case *dns.A:
+				ips = append(ips, record.A)
+			case *dns.AAAA:
+				ips = append(ips, record.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func (r *SystemResolver) exchange(domain string, qtype uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(domain), qtype)
+	var lastErr error = fmt.Errorf("no name server to resolve %s", domain)
+	for _, server := range r.servers {
+		res, _, err := r.client.Exchange(msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("resolve %s failed: %s", domain, dns.RcodeToString[res.Rcode])
+		}
+		return res.Answer, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,115 @@
+package mydispatcher
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testResolver resolves every domain to 192.0.2.1 with the TTL, and counts the lookups of each domain
+type testResolver struct {
+	sync.Mutex
+	ttl   time.Duration
+	calls map[string]int
+}
+
+func (r *testResolver) LookupIP(domain string) ([]net.IP, time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls[domain]++
+	return []net.IP{net.ParseIP("192.0.2.1")}, r.ttl, nil
+}
+
+func (r *testResolver) callsOf(domain string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.calls[domain]
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	resolver := &testResolver{ttl: 60 * time.Second, calls: make(map[string]int)}
+	cache := NewDNSCache(&DNSCacheConfig{}, resolver)
+	now := time.Unix(1700000000, 0)
+	cache.Now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		ips, err := cache.LookupIP("www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("unexpected ips: %v", ips)
+		}
+	}
+	if calls := resolver.callsOf("www.example.com"); calls != 1 {
+		t.Errorf("the cached domain should be resolved once, but got %d calls", calls)
+	}
+	// The record expires after the TTL
+	now = now.Add(59 * time.Second)
+	cache.LookupIP("WWW.example.com")
+	if calls := resolver.callsOf("www.example.com"); calls != 1 {
+		t.Errorf("the record should be cached within the TTL, but got %d calls", calls)
+	}
+	now = now.Add(time.Second)
+	cache.LookupIP("www.example.com")
+	if calls := resolver.callsOf("www.example.com"); calls != 2 {
+		t.Errorf("the expired record should be resolved again, but got %d calls", calls)
+	}
+}
+
+func TestDNSCacheClampTTL(t *testing.T) {
+	resolver := &testResolver{ttl: 0, calls: make(map[string]int)}
+	cache := NewDNSCache(&DNSCacheConfig{MinTTL: 10, MaxTTL: 300}, resolver)
+	now := time.Unix(1700000000, 0)
+	cache.Now = func() time.Time { return now }
+	cache.LookupIP("short.example.com")
+	now = now.Add(9 * time.Second)
+	cache.LookupIP("short.example.com")
+	if calls := resolver.callsOf("short.example.com"); calls != 1 {
+		t.Errorf("the record should be cached for MinTTL, but got %d calls", calls)
+	}
+	resolver.ttl = time.Hour
+	cache.LookupIP("long.example.com")
+	now = now.Add(300 * time.Second)
+	cache.LookupIP("long.example.com")
+	if calls := resolver.callsOf("long.example.com"); calls != 2 {
+		t.Errorf("the record should be cached for MaxTTL at most, but got %d calls", calls)
+	}
+}
+
+func TestDNSCacheEvict(t *testing.T) {
+	resolver := &testResolver{ttl: time.Hour, calls: make(map[string]int)}
+	cache := NewDNSCache(&DNSCacheConfig{Size: 2}, resolver)
+	cache.LookupIP("a.example.com")
+	cache.LookupIP("b.example.com")
+	cache.LookupIP("a.example.com") // b is the least recently used now
+	cache.LookupIP("c.example.com")
+	cache.LookupIP("a.example.com")
+	cache.LookupIP("b.example.com")
+	if calls := resolver.callsOf("a.example.com"); calls != 1 {
+		t.Errorf("the recently used domain should be kept, but got %d calls", calls)
+	}
+	if calls := resolver.callsOf("b.example.com"); calls != 2 {
+		t.Errorf("the least recently used domain should be evicted, but got %d calls", calls)
+	}
+}
+
+func TestDNSCacheConcurrent(t *testing.T) {
+	resolver := &testResolver{ttl: time.Hour, calls: make(map[string]int)}
+	cache := NewDNSCache(&DNSCacheConfig{Size: 8}, resolver)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := cache.LookupIP(fmt.Sprintf("%d.example.com", i%16)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(cache.entries) != 8 || cache.lru.Len() != 8 {
+		t.Errorf("the cache should be bounded to 8 domains, but got %d and %d", len(cache.entries), cache.lru.Len())
+	}
+}
@@ -0,0 +1,90 @@
+package mydispatcher
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/stats"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/blackhole"
+	"github.com/xtls/xray-core/transport"
+)
+
+// The categories of the failed dispatches counted by the inbound, see FailureCounterName. They are reported as they
+// are, so they never change
+const (
+	FailureRuleReject  = "rule_reject"  // The destination or the sniffed protocol is blocked by the rules
+	FailureDeviceLimit = "device_limit" // The user is over the device limit
+	FailureDataLimit   = "data_limit"   // The user has used up its data limit
+	FailureConnLimit   = "conn_limit"   // The user is over the connection limit
+	FailureSniffing    = "sniffing"     // Nothing was sniffed before the sniffing timed out
+	FailureNoOutbound  = "no_outbound"  // No outbound handler to route the connection to
+	FailureDial        = "dial"         // The outbound returned without reaching the destination
+)
+
+// DispatchFailures is all the categories of the failed dispatches
+var DispatchFailures = []string{FailureRuleReject, FailureDeviceLimit, FailureDataLimit, FailureConnLimit, FailureSniffing, FailureNoOutbound, FailureDial}
+
+// FailureCounterName returns the counter of the failed dispatches of the inbound, e.g. inbound>>>tag>>>failure>>>dial
+func FailureCounterName(tag string, category string) string {
+	return "inbound>>>" + tag + ">>>failure>>>" + category
+}
+
+// countFailure counts a failed dispatch of the connection of the inbound
+func (d *DefaultDispatcher) countFailure(tag string, category string) {
+	if d.stats == nil || tag == "" {
+		return
+	}
+	if c, _ := stats.GetOrRegisterCounter(d.stats, FailureCounterName(tag, category)); c != nil {
+		c.Add(1)
+	}
+}
+
+// dispatchOutbound runs the outbound, and counts the dial failed if the outbound fails before it writes anything to
+// the downlink. The outbound handler interrupts the downlink when the outbound returns an error, and closes it when
+// the outbound succeeds. An error once the destination has answered is not a failed dial, like the idle timeout.
+// The blackhole never reaches a destination, so it is not counted
+func (d *DefaultDispatcher) dispatchOutbound(ctx context.Context, handler outbound.Handler, link *transport.Link, inTag string) {
+	if d.stats == nil || inTag == "" || isBlackhole(handler) {
+		handler.Dispatch(ctx, link)
+		return
+	}
+	writer := &outcomeWriter{Writer: link.Writer, failed: func() { d.countFailure(inTag, FailureDial) }}
+	handler.Dispatch(ctx, &transport.Link{Reader: link.Reader, Writer: writer})
+}
+
+// outcomeWriter calls failed if the outbound interrupts the downlink before it writes to it. It is called by the
+// interrupt itself, so the mux outbounds failing after their Dispatch returns are counted too
+type outcomeWriter struct {
+	buf.Writer
+	settled int32 // The outbound wrote to the downlink or closed it, a later interrupt is not a failed dial
+	failed  func()
+}
+
+func (w *outcomeWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	atomic.StoreInt32(&w.settled, 1)
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *outcomeWriter) Close() error {
+	atomic.StoreInt32(&w.settled, 1)
+	return common.Close(w.Writer)
+}
+
+func (w *outcomeWriter) Interrupt() {
+	if atomic.CompareAndSwapInt32(&w.settled, 0, 1) {
+		w.failed()
+	}
+	common.Interrupt(w.Writer)
+}
+
+func isBlackhole(handler outbound.Handler) bool {
+	if h, ok := handler.(proxy.GetOutbound); ok {
+		_, ok = h.GetOutbound().(*blackhole.Handler)
+		return ok
+	}
+	return false
+}
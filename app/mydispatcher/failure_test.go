@@ -0,0 +1,216 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/app/policy"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+// noDefaultManager has no default outbound handler
+type noDefaultManager struct {
+	testOutboundManager
+}
+
+func (m *noDefaultManager) GetDefaultHandler() outbound.Handler { return nil }
+
+// readingOutbound has the default outbound answering the uplink as the connected outbounds do, so it counts no dial failure
+func readingOutbound() *testOutboundManager {
+	return &testOutboundManager{handlers: []outbound.Handler{
+		&echoHandler{testHandler: testHandler{tag: "direct", dispatched: make(chan string, 2)}, response: []byte("pong")},
+	}}
+}
+
+// newFailureDispatcher returns a dispatcher counting the failures to the stats manager
+func newFailureDispatcher(t *testing.T, ohm outbound.Manager) (*DefaultDispatcher, *stats.Manager) {
+	sm, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := policy.New(context.Background(), &policy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, pm, sm); err != nil {
+		t.Fatal(err)
+	}
+	return d, sm
+}
+
+// failures returns the failed dispatches of the inbound V2ray_1145 by the category
+func failures(sm *stats.Manager) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, category := range DispatchFailures {
+		if c := sm.GetCounter(FailureCounterName("V2ray_1145", category)); c != nil && c.Value() != 0 {
+			counts[category] = c.Value()
+		}
+	}
+	return counts
+}
+
+// waitFailure waits for the only failure counted to be the category
+func waitFailure(t *testing.T, sm *stats.Manager, category string) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		counts := failures(sm)
+		if len(counts) == 1 && counts[category] == 1 {
+			return
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("want a failure of %s, got %v", category, counts)
+		}
+	}
+}
+
+func dispatchFrom(t *testing.T, d *DefaultDispatcher, ip string, sniffing bool) {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    "V2ray_1145",
+		Source: net.TCPDestination(net.ParseAddress(ip), 12345),
+		User:   &protocol.MemoryUser{Email: "a@test.com"},
+	})
+	if sniffing {
+		ctx = session.ContextWithContent(ctx, &session.Content{SniffingRequest: session.SniffingRequest{Enabled: true}})
+	}
+	if _, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchFailureRuleReject(t *testing.T) {
+	d, sm := newFailureDispatcher(t, readingOutbound())
+	if err := d.RuleManager.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 1, Pattern: `blocked\.com`}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{Email: "a@test.com"}})
+	d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("www.blocked.com"), 80))
+	waitFailure(t, sm, FailureRuleReject)
+}
+
+func TestDispatchFailureProtocolRuleReject(t *testing.T) {
+	d, sm := newFailureDispatcher(t, readingOutbound())
+	d.RuleManager.UpdateProtocolRule("V2ray_1145", []string{"bittorrent"})
+	handshake := append([]byte{19}, []byte("BitTorrent protocol")...)
+	dispatchPayload(t, d, "", append(handshake, make([]byte, 48)...))
+	waitFailure(t, sm, FailureRuleReject)
+}
+
+func TestDispatchFailureDeviceLimit(t *testing.T) {
+	d, sm := newFailureDispatcher(t, readingOutbound())
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", DeviceLimit: 1}}
+	if err := d.Limiter.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	dispatchFrom(t, d, "1.2.3.4", false)
+	dispatchFrom(t, d, "5.6.7.8", false)
+	waitFailure(t, sm, FailureDeviceLimit)
+}
+
+func TestDispatchFailureDataLimit(t *testing.T) {
+	d, sm := newFailureDispatcher(t, readingOutbound())
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", DataLimit: 1000, DataUsed: 1000}}
+	if err := d.Limiter.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	dispatchFrom(t, d, "1.2.3.4", false)
+	waitFailure(t, sm, FailureDataLimit)
+}
+
+func TestDispatchFailureConnLimit(t *testing.T) {
+	d, sm := newFailureDispatcher(t, readingOutbound())
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", ConnLimit: 1}}
+	if err := d.Limiter.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The first connection is still open
+	dispatchFrom(t, d, "1.2.3.4", false)
+	dispatchFrom(t, d, "1.2.3.4", false)
+	waitFailure(t, sm, FailureConnLimit)
+}
+
+func TestDispatchFailureSniffing(t *testing.T) {
+	d, sm := newFailureDispatcher(t, readingOutbound())
+	// The client sends nothing within the sniffing attempts
+	dispatchFrom(t, d, "1.2.3.4", true)
+	waitFailure(t, sm, FailureSniffing)
+}
+
+func TestDispatchFailureNoOutbound(t *testing.T) {
+	d, sm := newFailureDispatcher(t, &noDefaultManager{})
+	dispatchFrom(t, d, "1.2.3.4", false)
+	waitFailure(t, sm, FailureNoOutbound)
+}
+
+func TestDispatchFailureDial(t *testing.T) {
+	handler := &dialingHandler{testHandler: testHandler{tag: "direct"}, connect: make(chan bool, 2), done: make(chan struct{}, 2)}
+	d, sm := newFailureDispatcher(t, &testOutboundManager{handlers: []outbound.Handler{handler}})
+	handler.connect <- false
+	dispatchFrom(t, d, "1.2.3.4", false)
+	<-handler.done
+	waitFailure(t, sm, FailureDial)
+
+	// The connected outbound is not counted
+	ctx, cancel := context.WithCancel(context.Background())
+	handler.connect <- true
+	dispatchDial(t, ctx, d)
+	cancel()
+	<-handler.done
+	if counts := failures(sm); counts[FailureDial] != 1 {
+		t.Errorf("the connected outbound should not count a dial failure, got %v", counts)
+	}
+}
+
+// failingHandler reads the first payload of the uplink, answers it if set, and then fails as the outbound handlers do
+type failingHandler struct {
+	testHandler
+	answer bool
+	done   chan struct{}
+}
+
+func (h *failingHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	defer func() { h.done <- struct{}{} }()
+	if mb, err := link.Reader.ReadMultiBuffer(); err == nil {
+		buf.ReleaseMulti(mb)
+	}
+	if h.answer {
+		link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("pong")))
+	}
+	common.Interrupt(link.Writer)
+	common.Interrupt(link.Reader)
+}
+
+func TestDispatchFailureDialAfterRead(t *testing.T) {
+	handler := &failingHandler{testHandler: testHandler{tag: "direct"}, done: make(chan struct{}, 1)}
+	d, sm := newFailureDispatcher(t, &testOutboundManager{handlers: []outbound.Handler{handler}})
+	// The outbound read the request, but failed to reach the destination
+	dispatchPayload(t, d, "", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	<-handler.done
+	waitFailure(t, sm, FailureDial)
+}
+
+func TestDispatchFailureAfterAnswer(t *testing.T) {
+	handler := &failingHandler{testHandler: testHandler{tag: "direct"}, answer: true, done: make(chan struct{}, 1)}
+	d, sm := newFailureDispatcher(t, &testOutboundManager{handlers: []outbound.Handler{handler}})
+	// The error once the destination answered, like the idle timeout, is not a failed dial
+	dispatchPayload(t, d, "", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	<-handler.done
+	time.Sleep(100 * time.Millisecond)
+	if counts := failures(sm); len(counts) != 0 {
+		t.Errorf("the outbound failed after the answer should not count a failure, got %v", counts)
+	}
+}
+
+func TestFailureCounterName(t *testing.T) {
+	if name := FailureCounterName("V2ray_1145", FailureDial); name != "inbound>>>V2ray_1145>>>failure>>>dial" {
+		t.Errorf("unexpected counter name: %s", name)
+	}
+}
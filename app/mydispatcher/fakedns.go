@@ -0,0 +1,29 @@
+package mydispatcher
+
+import (
+	"github.com/xtls/xray-core/common/net"
+)
+
+// UpdateDNSOutbound sets the outbound answering the DNS queries of the inbound with the fake IPs, empty removes it
+func (d *DefaultDispatcher) UpdateDNSOutbound(tag string, outboundTag string) {
+	if outboundTag == "" {
+		d.DNSOutbounds.Delete(tag)
+		return
+	}
+	d.DNSOutbounds.Store(tag, outboundTag)
+}
+
+func (d *DefaultDispatcher) dnsOutbound(tag string) string {
+	if v, ok := d.DNSOutbounds.Load(tag); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// fakeDomainOf returns the domain the destination is a fake IP of, or empty if it is not a fake IP handed out
+func (d *DefaultDispatcher) fakeDomainOf(destination net.Destination) string {
+	if d.FakeDNS == nil || !destination.Address.Family().IsIP() {
+		return ""
+	}
+	return d.FakeDNS.GetDomainFromFakeDNS(destination.Address)
+}
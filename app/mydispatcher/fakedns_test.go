@@ -0,0 +1,92 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/app/dns/fakedns"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+)
+
+func newFakeDNSDispatcher(t *testing.T) (*DefaultDispatcher, *fakedns.Holder, chan string) {
+	dispatched := make(chan string, 1)
+	ohm := &testOutboundManager{handlers: []outbound.Handler{
+		&testHandler{tag: "direct", dispatched: dispatched},
+		&testHandler{tag: "V2ray_1145_dns", dispatched: dispatched},
+	}}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	holder, err := fakedns.NewFakeDNSHolder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FakeDNS = holder
+	return d, holder, dispatched
+}
+
+func dispatchTo(d *DefaultDispatcher, destination net.Destination) error {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{}})
+	_, err := d.Dispatch(ctx, destination)
+	return err
+}
+
+func TestDispatchFakeDNSRule(t *testing.T) {
+	d, holder, dispatched := newFakeDNSDispatcher(t)
+	if err := d.RuleManager.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 1, Pattern: `blocked\.com`}}); err != nil {
+		t.Fatal(err)
+	}
+	// The connection to the fake IP is matched by the domain, though it is not sniffed
+	fakeIP := holder.GetFakeIPForDomain("www.blocked.com")[0]
+	if err := dispatchTo(d, net.TCPDestination(fakeIP, 443)); err == nil {
+		t.Fatalf("the fake IP %s of www.blocked.com should be rejected by the rule", fakeIP)
+	}
+	fakeIP = holder.GetFakeIPForDomain("www.example.com")[0]
+	if err := dispatchTo(d, net.TCPDestination(fakeIP, 443)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tag := <-dispatched:
+		if tag != "direct" {
+			t.Errorf("unexpected outbound: %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the connection to www.example.com should be dispatched")
+	}
+}
+
+func TestDispatchFakeDNSOutbound(t *testing.T) {
+	d, _, dispatched := newFakeDNSDispatcher(t)
+	d.UpdateDNSOutbound("V2ray_1145", "V2ray_1145_dns")
+	// The DNS queries are answered by the dns outbound
+	if err := dispatchTo(d, net.UDPDestination(net.ParseAddress("8.8.8.8"), 53)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tag := <-dispatched:
+		if tag != "V2ray_1145_dns" {
+			t.Errorf("the DNS query should be sent to the dns outbound, got %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the DNS query should be dispatched")
+	}
+	// The other connections are not
+	d.UpdateDNSOutbound("V2ray_1145", "")
+	if err := dispatchTo(d, net.UDPDestination(net.ParseAddress("8.8.8.8"), 53)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tag := <-dispatched:
+		if tag != "direct" {
+			t.Errorf("the DNS query should be sent to the default outbound once removed, got %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the DNS query should be dispatched")
+	}
+}
@@ -0,0 +1,109 @@
+package mydispatcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/net/cnc"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// HealthCheck is the settings of the health check of an outbound
+type HealthCheck struct {
+	Target   string        // URL requested through the outbound, any response counts as healthy
+	Timeout  time.Duration // Of the whole request
+	Failures int           // Consecutive failed checks to mark the outbound unhealthy
+	Skip     bool          // Route the connections of the unhealthy outbound to the default one
+}
+
+// OutboundHealth is the result of the last health check of an outbound
+type OutboundHealth struct {
+	Tag       string
+	Healthy   bool
+	Latency   time.Duration // Of the last successful check
+	Failures  int           // Consecutive failed checks
+	Error     string        // Of the last failed check
+	CheckedAt time.Time
+	skip      bool
+}
+
+// CheckOutbound requests the target through the outbound, and records the result. The request does not go through
+// the dispatcher, so it is neither counted to a user or the outbound stats, nor limited.
+func (d *DefaultDispatcher) CheckOutbound(ctx context.Context, tag string, check *HealthCheck) OutboundHealth {
+	health, _ := d.GetOutboundHealth(tag)
+	health.Tag = tag
+	health.CheckedAt = time.Now()
+	latency, err := d.probeOutbound(ctx, tag, check)
+	if err != nil {
+		health.Failures++
+		health.Error = err.Error()
+		if health.Failures >= check.Failures {
+			health.Healthy = false
+		}
+	} else {
+		health.Healthy, health.Latency, health.Failures, health.Error = true, latency, 0, ""
+	}
+	health.skip = check.Skip && !health.Healthy
+	d.OutboundHealth.Store(tag, health)
+	return health
+}
+
+// GetOutboundHealth returns the result of the last health check of the outbound
+func (d *DefaultDispatcher) GetOutboundHealth(tag string) (OutboundHealth, bool) {
+	if v, ok := d.OutboundHealth.Load(tag); ok {
+		return v.(OutboundHealth), true
+	}
+	return OutboundHealth{Tag: tag, Healthy: true}, false
+}
+
+// RemoveOutboundHealth drops the health of the removed outbound
+func (d *DefaultDispatcher) RemoveOutboundHealth(tag string) {
+	d.OutboundHealth.Delete(tag)
+}
+
+// skipOutbound reports whether the outbound is unhealthy and should be skipped in routing
+func (d *DefaultDispatcher) skipOutbound(tag string) bool {
+	health, _ := d.GetOutboundHealth(tag)
+	return health.skip
+}
+
+func (d *DefaultDispatcher) probeOutbound(ctx context.Context, tag string, check *HealthCheck) (time.Duration, error) {
+	handler := d.ohm.GetHandler(tag)
+	if handler == nil {
+		return 0, fmt.Errorf("no such outbound: %s", tag)
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				destination, err := net.ParseDestination("tcp:" + addr)
+				if err != nil {
+					return nil, err
+				}
+				ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+				uplinkReader, uplinkWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+				downlinkReader, downlinkWriter := pipe.New(pipe.WithSizeLimit(64 * 1024))
+				go handler.Dispatch(ctx, &transport.Link{Reader: uplinkReader, Writer: downlinkWriter})
+				return cnc.NewConnection(cnc.ConnectionInputMulti(uplinkWriter), cnc.ConnectionOutputMulti(downlinkReader)), nil
+			},
+		},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, check.Target, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return time.Since(start), nil
+}
@@ -0,0 +1,132 @@
+package mydispatcher
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+const testHealthTarget = "http://probe.test/generate_204"
+
+// healthHandler answers the health checks to probe.test after the delay, or fails them while fail is set.
+// The other connections are only reported to the channel.
+type healthHandler struct {
+	testHandler
+	delay time.Duration
+	fail  int32
+}
+
+func (h *healthHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	if ob := session.OutboundFromContext(ctx); ob == nil || ob.Target.Address.String() != "probe.test" {
+		h.dispatched <- h.tag
+		return
+	}
+	if atomic.LoadInt32(&h.fail) == 1 {
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+	var request []byte
+	for !bytes.Contains(request, []byte("\r\n\r\n")) {
+		mb, err := link.Reader.ReadMultiBuffer()
+		if err != nil {
+			return
+		}
+		request = append(request, mb.String()...)
+		buf.ReleaseMulti(mb)
+	}
+	select {
+	case <-time.After(h.delay):
+	case <-ctx.Done():
+		return
+	}
+	link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("HTTP/1.1 204 No Content\r\nContent-Length: 0\r\n\r\n")))
+	common.Close(link.Writer)
+}
+
+func newHealthDispatcher(t *testing.T, relay *healthHandler) *DefaultDispatcher {
+	ohm := &testOutboundManager{handlers: []outbound.Handler{
+		&testHandler{tag: "direct", dispatched: relay.dispatched},
+		relay,
+	}}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, ohm, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ProtocolRouter.Update([]*ProtocolRoute{{Protocol: "http", OutboundTag: "relay"}}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCheckOutboundLatency(t *testing.T) {
+	relay := &healthHandler{testHandler: testHandler{tag: "relay", dispatched: make(chan string, 1)}, delay: 50 * time.Millisecond}
+	d := newHealthDispatcher(t, relay)
+	health := d.CheckOutbound(context.Background(), "relay", &HealthCheck{Target: testHealthTarget, Timeout: time.Second, Failures: 1})
+	if !health.Healthy || health.Error != "" {
+		t.Fatalf("the relay should be healthy, got %+v", health)
+	}
+	if health.Latency < 50*time.Millisecond || health.Latency > 500*time.Millisecond {
+		t.Errorf("want the latency of about 50ms, but got %s", health.Latency)
+	}
+	if got, ok := d.GetOutboundHealth("relay"); !ok || got.Latency != health.Latency {
+		t.Errorf("the result should be recorded, got %+v", got)
+	}
+	// The check times out on a slow outbound
+	relay.delay = time.Second
+	start := time.Now()
+	if health := d.CheckOutbound(context.Background(), "relay", &HealthCheck{Target: testHealthTarget, Timeout: 100 * time.Millisecond, Failures: 1}); health.Healthy {
+		t.Error("the slow relay should be unhealthy")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the check should time out in 100ms, but took %s", elapsed)
+	}
+	if health := d.CheckOutbound(context.Background(), "unknown", &HealthCheck{Target: testHealthTarget, Timeout: time.Second, Failures: 1}); health.Healthy {
+		t.Error("an unknown outbound should be unhealthy")
+	}
+}
+
+func TestCheckOutboundSkipUnhealthy(t *testing.T) {
+	relay := &healthHandler{testHandler: testHandler{tag: "relay", dispatched: make(chan string, 1)}, fail: 1}
+	d := newHealthDispatcher(t, relay)
+	check := &HealthCheck{Target: testHealthTarget, Timeout: time.Second, Failures: 2, Skip: true}
+	dispatchTo := func() string {
+		dispatchPayload(t, d, "", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+		select {
+		case tag := <-relay.dispatched:
+			return tag
+		case <-time.After(2 * time.Second):
+			t.Fatal("the http connection should be dispatched")
+		}
+		return ""
+	}
+	// One failure is tolerated
+	if health := d.CheckOutbound(context.Background(), "relay", check); !health.Healthy || health.Failures != 1 {
+		t.Fatalf("the relay should stay healthy after one failure, got %+v", health)
+	}
+	if tag := dispatchTo(); tag != "relay" {
+		t.Errorf("want the connection routed to relay, but got %s", tag)
+	}
+	if health := d.CheckOutbound(context.Background(), "relay", check); health.Healthy || health.Failures != 2 {
+		t.Fatalf("the relay should be unhealthy after two failures, got %+v", health)
+	}
+	if tag := dispatchTo(); tag != "direct" {
+		t.Errorf("want the connection routed to the default outbound, but got %s", tag)
+	}
+	// The relay is back once a check succeeds
+	atomic.StoreInt32(&relay.fail, 0)
+	if health := d.CheckOutbound(context.Background(), "relay", check); !health.Healthy || health.Failures != 0 {
+		t.Fatalf("the relay should be healthy again, got %+v", health)
+	}
+	if tag := dispatchTo(); tag != "relay" {
+		t.Errorf("want the connection routed to relay again, but got %s", tag)
+	}
+}
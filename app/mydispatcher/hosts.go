@@ -0,0 +1,87 @@
+package mydispatcher
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/strmatcher"
+)
+
+// StaticHosts pins the domain destinations of the node to the IPs, the outbounds dial the IPs without resolving them
+type StaticHosts struct {
+	matchers *strmatcher.MatcherGroup
+	ips      map[uint32][]net.Address // Key: the index of the matcher
+}
+
+// NewStaticHosts compiles the hosts of the node, nil if there is none. The domains support the domain:, keyword:,
+// regexp: and full: prefixes and the *.example.com wildcard, a domain without prefix is matched exactly.
+// Each domain is pinned to one IP or more.
+func NewStaticHosts(hosts map[string][]string) (*StaticHosts, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	h := &StaticHosts{matchers: new(strmatcher.MatcherGroup), ips: make(map[uint32][]net.Address)}
+	for domain, ips := range hosts {
+		matcherType, pattern := strmatcher.Full, strings.ToLower(domain)
+		switch {
+		case strings.HasPrefix(domain, "domain:"):
+			matcherType, pattern = strmatcher.Domain, pattern[len("domain:"):]
+		case strings.HasPrefix(domain, "*."):
+			matcherType, pattern = strmatcher.Domain, pattern[len("*."):]
+		case strings.HasPrefix(domain, "keyword:"):
+			matcherType, pattern = strmatcher.Substr, pattern[len("keyword:"):]
+		case strings.HasPrefix(domain, "regexp:"):
+			// The regexp is case sensitive
+			matcherType, pattern = strmatcher.Regex, domain[len("regexp:"):]
+		case strings.HasPrefix(domain, "full:"):
+			pattern = pattern[len("full:"):]
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("empty domain of the host %s", domain)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no IP of the host %s", domain)
+		}
+		addresses := make([]net.Address, len(ips))
+		for i, ip := range ips {
+			if addresses[i] = net.ParseAddress(ip); !addresses[i].Family().IsIP() {
+				return nil, fmt.Errorf("invalid IP %s of the host %s", ip, domain)
+			}
+		}
+		matcher, err := matcherType.New(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain of the host %s: %s", domain, err)
+		}
+		h.ips[h.matchers.Add(matcher)] = addresses
+	}
+	return h, nil
+}
+
+// Lookup returns one of the IPs the domain is pinned to, picked at random so the connections are spread over them.
+// The exact domains win over the patterns
+func (h *StaticHosts) Lookup(domain string) (net.Address, bool) {
+	matches := h.matchers.Match(strings.ToLower(domain))
+	if len(matches) == 0 {
+		return nil, false
+	}
+	ips := h.ips[matches[0]]
+	return ips[rand.Intn(len(ips))], true
+}
+
+// UpdateStaticHosts sets the hosts of the inbound, nil removes them
+func (d *DefaultDispatcher) UpdateStaticHosts(tag string, hosts *StaticHosts) {
+	if hosts == nil {
+		d.StaticHosts.Delete(tag)
+		return
+	}
+	d.StaticHosts.Store(tag, hosts)
+}
+
+func (d *DefaultDispatcher) staticHosts(tag string) *StaticHosts {
+	if v, ok := d.StaticHosts.Load(tag); ok {
+		return v.(*StaticHosts)
+	}
+	return nil
+}
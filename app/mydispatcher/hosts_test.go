@@ -0,0 +1,117 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+)
+
+func TestStaticHostsLookup(t *testing.T) {
+	hosts, err := NewStaticHosts(map[string][]string{
+		"api.example.com":      {"1.2.3.4"},
+		"domain:example.com":   {"5.6.7.8"},
+		"keyword:internal":     {"10.0.0.2", "10.0.0.3"},
+		"regexp:^cdn[0-9]\\.":  {"2001:db8::1"},
+		"full:www.example.org": {"9.9.9.9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]string{
+		"API.example.com":  "1.2.3.4",
+		"www.example.com":  "5.6.7.8",
+		"example.com":      "5.6.7.8",
+		"cdn1.test.net":    "[2001:db8::1]",
+		"www.example.org":  "9.9.9.9",
+		"my.internal.corp": "",
+		"example.org":      "-",
+		"notexample.com":   "-",
+	} {
+		ip, ok := hosts.Lookup(domain)
+		switch want {
+		case "-":
+			if ok {
+				t.Errorf("%s should not be pinned, got %s", domain, ip)
+			}
+		case "":
+			if !ok || (ip.String() != "10.0.0.2" && ip.String() != "10.0.0.3") {
+				t.Errorf("%s should be pinned to one of its IPs, got %v", domain, ip)
+			}
+		default:
+			if !ok || ip.String() != want {
+				t.Errorf("%s should be pinned to %s, got %v", domain, want, ip)
+			}
+		}
+	}
+	// The connections are spread over the IPs
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ip, _ := hosts.Lookup("my.internal.corp")
+		seen[ip.String()] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("the connections should take all the IPs, got %v", seen)
+	}
+}
+
+func TestStaticHostsInvalid(t *testing.T) {
+	for _, hosts := range []map[string][]string{
+		{"api.example.com": {"api.example.net"}},
+		{"api.example.com": {}},
+		{"domain:": {"1.2.3.4"}},
+		{"regexp:(": {"1.2.3.4"}},
+	} {
+		if _, err := NewStaticHosts(hosts); err == nil {
+			t.Errorf("the hosts should be rejected: %v", hosts)
+		}
+	}
+	if hosts, err := NewStaticHosts(nil); hosts != nil || err != nil {
+		t.Errorf("no hosts should be built without the mappings, got %v %v", hosts, err)
+	}
+}
+
+func TestDispatchStaticHosts(t *testing.T) {
+	handler := &targetHandler{testHandler: testHandler{tag: "direct"}, targets: make(chan net.Destination, 1)}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{handlers: []outbound.Handler{handler}}, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := NewStaticHosts(map[string][]string{"api.example.com": {"1.2.3.4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.UpdateStaticHosts("V2ray_1145", hosts)
+	dispatch := func(tag string, domain string) net.Destination {
+		ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: tag, User: &protocol.MemoryUser{}})
+		if _, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress(domain), 443)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case target := <-handler.targets:
+			return target
+		case <-time.After(2 * time.Second):
+			t.Fatal("the connection should be dispatched")
+		}
+		return net.Destination{}
+	}
+
+	if target := dispatch("V2ray_1145", "api.example.com"); target.String() != "tcp:1.2.3.4:443" {
+		t.Errorf("the domain should be pinned to the IP of the hosts, got %s", target)
+	}
+	if target := dispatch("V2ray_1145", "www.example.com"); target.String() != "tcp:www.example.com:443" {
+		t.Errorf("the other domains should be left to the outbound, got %s", target)
+	}
+	// The hosts do not leak to the other nodes
+	if target := dispatch("Shadowsocks_1146", "api.example.com"); target.String() != "tcp:api.example.com:443" {
+		t.Errorf("the hosts of a node should not apply to the other nodes, got %s", target)
+	}
+	d.UpdateStaticHosts("V2ray_1145", nil)
+	if target := dispatch("V2ray_1145", "api.example.com"); target.String() != "tcp:api.example.com:443" {
+		t.Errorf("the removed hosts should not apply, got %s", target)
+	}
+}
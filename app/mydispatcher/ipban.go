@@ -0,0 +1,106 @@
+package mydispatcher
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// IPBanConfig bans the source IPs which are rejected by the rules too often
+type IPBanConfig struct {
+	Threshold int `mapstructure:"Threshold"` // Rejections within the window to ban the IP. Default 10
+	Window    int `mapstructure:"Window"`    // Seconds to count the rejections in. Default 60
+	Duration  int `mapstructure:"Duration"`  // Seconds to ban the IP for. Default 600
+	Size      int `mapstructure:"Size"`      // Max IPs tracked, the least recently rejected one is dropped. Default 10000
+}
+
+type ipBanEntry struct {
+	ip          string
+	windowStart time.Time
+	hits        int
+	bannedUntil time.Time
+}
+
+// IPBanner counts the rejections of each source IP and bans the IP for a while when they reach the threshold,
+// it is safe for concurrent use
+type IPBanner struct {
+	Now     func() time.Time // Clock of the window and the ban, can be replaced in tests
+	config  IPBanConfig
+	access  sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Front is the most recently rejected
+}
+
+func NewIPBanner(config *IPBanConfig) *IPBanner {
+	b := &IPBanner{
+		Now:     time.Now,
+		config:  *config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if b.config.Threshold <= 0 {
+		b.config.Threshold = 10
+	}
+	if b.config.Window <= 0 {
+		b.config.Window = 60
+	}
+	if b.config.Duration <= 0 {
+		b.config.Duration = 600
+	}
+	if b.config.Size <= 0 {
+		b.config.Size = 10000
+	}
+	return b
+}
+
+// Banned reports whether the IP is banned now, the expired ban is removed
+func (b *IPBanner) Banned(ip string) bool {
+	b.access.Lock()
+	defer b.access.Unlock()
+	element, ok := b.entries[ip]
+	if !ok {
+		return false
+	}
+	entry := element.Value.(*ipBanEntry)
+	if entry.bannedUntil.IsZero() {
+		return false
+	}
+	if b.Now().Before(entry.bannedUntil) {
+		return true
+	}
+	b.lru.Remove(element)
+	delete(b.entries, ip)
+	return false
+}
+
+// Hit records a rejection of the IP, and returns true if it bans the IP
+func (b *IPBanner) Hit(ip string) (banned bool) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	now := b.Now()
+	element, ok := b.entries[ip]
+	if !ok {
+		element = b.lru.PushFront(&ipBanEntry{ip: ip, windowStart: now})
+		b.entries[ip] = element
+		for b.lru.Len() > b.config.Size {
+			oldest := b.lru.Back()
+			b.lru.Remove(oldest)
+			delete(b.entries, oldest.Value.(*ipBanEntry).ip)
+		}
+	} else {
+		b.lru.MoveToFront(element)
+	}
+	entry := element.Value.(*ipBanEntry)
+	if !entry.bannedUntil.IsZero() && now.Before(entry.bannedUntil) {
+		return false
+	}
+	if !entry.bannedUntil.IsZero() || now.Sub(entry.windowStart) >= time.Duration(b.config.Window)*time.Second {
+		entry.windowStart, entry.hits, entry.bannedUntil = now, 0, time.Time{}
+	}
+	entry.hits++
+	if entry.hits < b.config.Threshold {
+		return false
+	}
+	entry.bannedUntil = now.Add(time.Duration(b.config.Duration) * time.Second)
+	return true
+}
@@ -0,0 +1,105 @@
+package mydispatcher
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+)
+
+func TestIPBannerBanAndExpire(t *testing.T) {
+	banner := NewIPBanner(&IPBanConfig{Threshold: 3, Window: 60, Duration: 600})
+	now := time.Unix(1700000000, 0)
+	banner.Now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if banner.Hit("192.0.2.1") {
+			t.Fatalf("hit %d should not ban the IP", i+1)
+		}
+	}
+	if banner.Banned("192.0.2.1") {
+		t.Fatal("the IP should not be banned under the threshold")
+	}
+	if !banner.Hit("192.0.2.1") {
+		t.Fatal("the third hit should ban the IP")
+	}
+	if !banner.Banned("192.0.2.1") || banner.Banned("192.0.2.2") {
+		t.Fatal("only the IP reaching the threshold should be banned")
+	}
+	now = now.Add(599 * time.Second)
+	if !banner.Banned("192.0.2.1") {
+		t.Fatal("the ban should last for the duration")
+	}
+	now = now.Add(time.Second)
+	if banner.Banned("192.0.2.1") {
+		t.Fatal("the ban should expire after the duration")
+	}
+	if banner.Hit("192.0.2.1") {
+		t.Fatal("the hits should be counted again after the ban expires")
+	}
+}
+
+func TestIPBannerWindow(t *testing.T) {
+	banner := NewIPBanner(&IPBanConfig{Threshold: 2, Window: 60})
+	now := time.Unix(1700000000, 0)
+	banner.Now = func() time.Time { return now }
+	banner.Hit("192.0.2.1")
+	now = now.Add(60 * time.Second)
+	if banner.Hit("192.0.2.1") {
+		t.Fatal("the hits out of the window should not ban the IP")
+	}
+	if !banner.Hit("192.0.2.1") {
+		t.Fatal("the hits within the window should ban the IP")
+	}
+}
+
+func TestIPBannerSize(t *testing.T) {
+	banner := NewIPBanner(&IPBanConfig{Threshold: 2, Size: 2})
+	banner.Hit("192.0.2.1")
+	banner.Hit("192.0.2.2")
+	banner.Hit("192.0.2.3")
+	if len(banner.entries) != 2 || banner.lru.Len() != 2 {
+		t.Fatalf("the banner should track 2 IPs at most, got %d", len(banner.entries))
+	}
+	if banner.Hit("192.0.2.1") {
+		t.Fatal("the least recently rejected IP should be dropped")
+	}
+	for i := 0; i < 100; i++ {
+		banner.Hit(fmt.Sprintf("198.51.100.%d", i))
+	}
+	if len(banner.entries) != 2 {
+		t.Fatalf("the banner should track 2 IPs at most, got %d", len(banner.entries))
+	}
+}
+
+func TestDispatchIPBan(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+	d.IPBanner = NewIPBanner(&IPBanConfig{Threshold: 2})
+	if err := d.RuleManager.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 1, Pattern: "blocked.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	dispatch := func(domain string) error {
+		ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+			Tag:    "V2ray_1145",
+			Source: net.TCPDestination(net.ParseAddress("192.0.2.1"), 12345),
+			User:   &protocol.MemoryUser{Email: "test@example.com"},
+		})
+		_, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress(domain), 443))
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := dispatch("blocked.example.com"); err == nil {
+			t.Fatal("the blocked destination should be rejected")
+		}
+	}
+	if !d.IPBanner.Banned("192.0.2.1") {
+		t.Fatal("the IP should be banned after the repeated rejections")
+	}
+	if err := dispatch("www.example.com"); err == nil {
+		t.Error("the banned IP should be rejected for any destination")
+	}
+}
@@ -0,0 +1,43 @@
+package mydispatcher
+
+import (
+	"context"
+
+	"github.com/XrayR-project/XrayR/common/logger"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// UpdateLogLevel sets the log level of the connections of the inbound, e.g. debug. Empty level removes it,
+// and the connections are logged with the global level.
+func (d *DefaultDispatcher) UpdateLogLevel(tag string, level string) {
+	if level == "" {
+		d.LogLevels.Delete(tag)
+		return
+	}
+	d.LogLevels.Store(tag, logger.ParseLevel(level))
+}
+
+// writeLog writes the error of the connection, with the log level of its inbound if it has one
+func (d *DefaultDispatcher) writeLog(ctx context.Context, err *errors.Error) {
+	var level interface{}
+	var ok bool
+	if inbound := session.InboundFromContext(ctx); inbound != nil {
+		level, ok = d.LogLevels.Load(inbound.Tag)
+	}
+	if !ok {
+		err.WriteToLog(session.ExportIDToError(ctx))
+		return
+	}
+	var holder errors.ExportOptionHolder
+	session.ExportIDToError(ctx)(&holder)
+	log.Record(&log.GeneralMessage{
+		Severity: errors.GetSeverity(err),
+		Content: &logger.NodeContent{
+			Level:     level.(log.Severity),
+			SessionID: holder.SessionID,
+			Content:   err,
+		},
+	})
+}
@@ -0,0 +1,63 @@
+package mydispatcher
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/common/logger"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/session"
+)
+
+type captureLog struct {
+	access   sync.Mutex
+	messages []string
+}
+
+func (c *captureLog) Handle(msg log.Message) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.messages = append(c.messages, msg.String())
+}
+
+type discardLog struct{}
+
+func (discardLog) Handle(log.Message) {}
+
+func TestLogLevel(t *testing.T) {
+	capture := &captureLog{}
+	log.RegisterHandler(logger.NewLevelFilter(capture, log.Severity_Warning))
+	defer log.RegisterHandler(discardLog{})
+
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{}, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.UpdateLogLevel("V2ray_1145", "debug")
+	d.UpdateLogLevel("Trojan_1146", "warning")
+	for _, tag := range []string{"V2ray_1145", "Trojan_1146", "Shadowsocks_1147"} {
+		ctx := session.ContextWithID(context.Background(), 42)
+		ctx = session.ContextWithInbound(ctx, &session.Inbound{Tag: tag})
+		d.writeLog(ctx, newError("taking detour of ", tag).AtDebug())
+		d.writeLog(ctx, newError("non existing outTag of ", tag).AtWarning())
+	}
+	// The node at debug emits the messages the node at warning suppresses, and the node without a level takes the global one
+	want := []string{"taking detour of V2ray_1145", "non existing outTag of V2ray_1145", "non existing outTag of Trojan_1146", "non existing outTag of Shadowsocks_1147"}
+	if len(capture.messages) != len(want) {
+		t.Fatalf("unexpected messages: %q", capture.messages)
+	}
+	for i, message := range capture.messages {
+		if !strings.Contains(message, "[42] ") || !strings.Contains(message, want[i]) {
+			t.Errorf("want %q of the session, but got %q", want[i], message)
+		}
+	}
+
+	d.UpdateLogLevel("V2ray_1145", "")
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145"})
+	d.writeLog(ctx, newError("taking detour").AtDebug())
+	if len(capture.messages) != 4 {
+		t.Errorf("the node without a level should take the global one: %q", capture.messages)
+	}
+}
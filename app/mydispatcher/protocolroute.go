@@ -0,0 +1,53 @@
+package mydispatcher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ProtocolRoute sends the connections of a sniffed protocol to the outbound
+type ProtocolRoute struct {
+	Protocol    string `mapstructure:"Protocol"` // http, tls, bittorrent...
+	OutboundTag string `mapstructure:"OutboundTag"`
+}
+
+// ProtocolRouter picks the outbound by the sniffed application protocol
+type ProtocolRouter struct {
+	sync.RWMutex
+	routes []*ProtocolRoute
+}
+
+func NewProtocolRouter() *ProtocolRouter {
+	return &ProtocolRouter{}
+}
+
+// Update replaces all the routes
+func (r *ProtocolRouter) Update(routes []*ProtocolRoute) error {
+	newRoutes := make([]*ProtocolRoute, 0, len(routes))
+	for _, route := range routes {
+		protocol := strings.ToLower(strings.TrimSpace(route.Protocol))
+		if protocol == "" || route.OutboundTag == "" {
+			return fmt.Errorf("protocol route requires both Protocol and OutboundTag: %+v", *route)
+		}
+		newRoutes = append(newRoutes, &ProtocolRoute{Protocol: protocol, OutboundTag: route.OutboundTag})
+	}
+	r.Lock()
+	r.routes = newRoutes
+	r.Unlock()
+	return nil
+}
+
+// Match returns the outbound tag of the sniffed protocol, a route matches the protocols with its name as prefix,
+// e.g. http matches http1. The first matched route wins.
+func (r *ProtocolRouter) Match(protocol string) (string, bool) {
+	protocol = strings.ToLower(protocol)
+	r.RLock()
+	defer r.RUnlock()
+	for _, route := range r.routes {
+		if strings.HasPrefix(protocol, route.Protocol) {
+			return route.OutboundTag, true
+		}
+	}
+	return "", false
+}
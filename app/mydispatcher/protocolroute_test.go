@@ -0,0 +1,77 @@
+package mydispatcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProtocolRouterMatch(t *testing.T) {
+	r := NewProtocolRouter()
+	err := r.Update([]*ProtocolRoute{
+		{Protocol: "HTTP", OutboundTag: "audit"},
+		{Protocol: "bittorrent", OutboundTag: "block"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"http1":      "audit",
+		"bittorrent": "block",
+		"tls":        "",
+	}
+	for protocol, want := range cases {
+		if tag, _ := r.Match(protocol); tag != want {
+			t.Errorf("unexpected outbound of %s. want %q, but got %q", protocol, want, tag)
+		}
+	}
+}
+
+func TestProtocolRouterInvalid(t *testing.T) {
+	r := NewProtocolRouter()
+	if err := r.Update([]*ProtocolRoute{{Protocol: "http"}}); err == nil {
+		t.Error("route without outbound tag should be rejected")
+	}
+}
+
+// dispatchProtocol dispatches the payload with http routed to the outbound streaming, and returns the picked outbound
+func dispatchProtocol(t *testing.T, payload []byte) string {
+	d, dispatched := newTestDispatcher(t)
+	if err := d.ProtocolRouter.Update([]*ProtocolRoute{{Protocol: "http", OutboundTag: "streaming"}}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchPayload(t, d, "", payload)
+	select {
+	case tag := <-dispatched:
+		return tag
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection is not dispatched")
+	}
+	return ""
+}
+
+func TestDispatchProtocolRoute(t *testing.T) {
+	if tag := dispatchProtocol(t, []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")); tag != "streaming" {
+		t.Errorf("mapped protocol should take the protocol outbound, but got %s", tag)
+	}
+}
+
+func TestDispatchProtocolRouteNoMatch(t *testing.T) {
+	if tag := dispatchProtocol(t, clientHello(t, "www.example.com")); tag != "direct" {
+		t.Errorf("unmapped protocol should fall back to the default outbound, but got %s", tag)
+	}
+}
+
+func TestDispatchProtocolRouteSNIWins(t *testing.T) {
+	d, dispatched := newTestDispatcher(t)
+	d.ProtocolRouter.Update([]*ProtocolRoute{{Protocol: "tls", OutboundTag: "streaming"}})
+	d.SNIRouter.Update([]*SNIRoute{{Domain: "www.example.com", OutboundTag: "direct"}})
+	dispatchPayload(t, d, "", clientHello(t, "www.example.com"))
+	select {
+	case tag := <-dispatched:
+		if tag != "direct" {
+			t.Errorf("the SNI route should win over the protocol route, but got %s", tag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection is not dispatched")
+	}
+}
@@ -0,0 +1,56 @@
+package mydispatcher
+
+import (
+	"context"
+	"strings"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// UpdateRejectResponse sets the HTTP response written to the HTTP connections of the inbound blocked by the rules,
+// the other connections are still reset. An empty response removes it.
+func (d *DefaultDispatcher) UpdateRejectResponse(tag string, response []byte) {
+	if len(response) == 0 {
+		d.RejectResponses.Delete(tag)
+		return
+	}
+	d.RejectResponses.Store(tag, response)
+}
+
+func (d *DefaultDispatcher) rejectResponse(tag string) []byte {
+	if v, ok := d.RejectResponses.Load(tag); ok {
+		return v.([]byte)
+	}
+	return nil
+}
+
+// rejectLink returns the link of a connection blocked by the rules, which is never dispatched to an outbound.
+// The request is sniffed, an HTTP request gets the response and the connection is closed after it, the others are reset
+func (d *DefaultDispatcher) rejectLink(ctx context.Context, response []byte) *transport.Link {
+	opt := pipe.OptionsFromContext(ctx)
+	uplinkReader, uplinkWriter := pipe.New(opt...)
+	downlinkReader, downlinkWriter := pipe.New(opt...)
+	go func() {
+		cReader := &cachedReader{
+			reader: uplinkReader,
+		}
+		defer cReader.Interrupt()
+		result, err := sniffer(ctx, cReader, []string{"http"})
+		if err != nil || !strings.HasPrefix(result.Protocol(), "http") {
+			common.Interrupt(downlinkWriter)
+			return
+		}
+		if err := downlinkWriter.WriteMultiBuffer(buf.MergeBytes(nil, response)); err != nil {
+			common.Interrupt(downlinkWriter)
+			return
+		}
+		common.Close(downlinkWriter)
+	}()
+	return &transport.Link{
+		Reader: downlinkReader,
+		Writer: uplinkWriter,
+	}
+}
@@ -0,0 +1,75 @@
+package mydispatcher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// readAll reads the link until it is closed, and returns the bytes read and whether it was closed gracefully
+func readAll(t *testing.T, reader buf.Reader) ([]byte, bool) {
+	var data []byte
+	for {
+		mb, err := reader.(buf.TimeoutReader).ReadMultiBufferTimeout(2 * time.Second)
+		for _, b := range mb {
+			data = append(data, b.Bytes()...)
+		}
+		buf.ReleaseMulti(mb)
+		if err == buf.ErrReadTimeout {
+			t.Fatal("the link should be closed")
+		}
+		if err != nil {
+			return data, err == io.EOF
+		}
+	}
+}
+
+func TestDispatchRejectResponse(t *testing.T) {
+	d, dispatched := newTestDispatcher(t)
+	if err := d.RuleManager.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 1, Pattern: `blocked\.com`}}); err != nil {
+		t.Fatal(err)
+	}
+	response := []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\nConnection: close\r\n\r\nblocked")
+	d.UpdateRejectResponse("V2ray_1145", response)
+	dispatch := func(payload []byte) ([]byte, bool) {
+		ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{Email: "a@test.com"}})
+		link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("www.blocked.com"), 80))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, payload)); err != nil {
+			t.Fatal(err)
+		}
+		return readAll(t, link.Reader)
+	}
+
+	// The HTTP request gets the response
+	data, closed := dispatch([]byte("GET / HTTP/1.1\r\nHost: www.blocked.com\r\n\r\n"))
+	if !bytes.Equal(data, response) || !closed {
+		t.Errorf("the blocked HTTP request should get the response and be closed, got %q", data)
+	}
+	// The other protocols are reset
+	if data, closed = dispatch([]byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01}); len(data) != 0 || closed {
+		t.Errorf("the blocked TLS connection should be reset, got %q", data)
+	}
+	select {
+	case tag := <-dispatched:
+		t.Errorf("the blocked connections should not be dispatched, got %s", tag)
+	default:
+	}
+
+	// Without a response the blocked connection is refused at once
+	d.UpdateRejectResponse("V2ray_1145", nil)
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{Email: "a@test.com"}})
+	if _, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("www.blocked.com"), 80)); err == nil {
+		t.Error("the blocked connection should be refused without a response")
+	}
+}
@@ -18,14 +18,43 @@ type Sniffer struct {
 	sniffer []protocolSniffer
 }
 
-func NewSniffer() *Sniffer {
-	return &Sniffer{
-		sniffer: []protocolSniffer{
-			func(b []byte) (SniffResult, error) { return http.SniffHTTP(b) },
-			func(b []byte) (SniffResult, error) { return tls.SniffTLS(b) },
-			func(b []byte) (SniffResult, error) { return bittorrent.SniffBittorrent(b) },
-		},
+// knownSniffers are the sniffers by the protocol they detect, in the order they run
+var knownSniffers = []struct {
+	name    string
+	sniffer protocolSniffer
+}{
+	{"http", func(b []byte) (SniffResult, error) { return http.SniffHTTP(b) }},
+	{"tls", func(b []byte) (SniffResult, error) { return tls.SniffTLS(b) }},
+	{"bittorrent", func(b []byte) (SniffResult, error) { return bittorrent.SniffBittorrent(b) }},
+}
+
+// NewSniffer returns the sniffer running the enabled sniffers, or all of them if none is enabled
+func NewSniffer(enabled []string) *Sniffer {
+	s := &Sniffer{}
+	for _, known := range knownSniffers {
+		if len(enabled) == 0 || hasSniffer(enabled, known.name) {
+			s.sniffer = append(s.sniffer, known.sniffer)
+		}
+	}
+	return s
+}
+
+func isKnownSniffer(name string) bool {
+	for _, known := range knownSniffers {
+		if known.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSniffer(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
 	}
+	return false
 }
 
 var errUnknownContent = newError("unknown content")
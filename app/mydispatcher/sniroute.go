@@ -0,0 +1,111 @@
+package mydispatcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SNIRoute sends the TLS connections with a matched server name to the outbound
+type SNIRoute struct {
+	Domain      string `mapstructure:"Domain"` // www.example.com or *.example.com
+	OutboundTag string `mapstructure:"OutboundTag"`
+}
+
+// SNIRouter picks the outbound by the sniffed TLS server name
+type SNIRouter struct {
+	sync.RWMutex
+	exact  map[string]string
+	suffix map[string]string // *.example.com is stored as .example.com
+}
+
+func NewSNIRouter() *SNIRouter {
+	return &SNIRouter{
+		exact:  make(map[string]string),
+		suffix: make(map[string]string),
+	}
+}
+
+// Update replaces all the routes
+func (r *SNIRouter) Update(routes []*SNIRoute) error {
+	exact := make(map[string]string)
+	suffix := make(map[string]string)
+	for _, route := range routes {
+		domain := normalizeDomain(route.Domain)
+		if domain == "" || route.OutboundTag == "" {
+			return fmt.Errorf("SNI route requires both Domain and OutboundTag: %+v", *route)
+		}
+		if strings.HasPrefix(domain, "*.") {
+			domain = domain[1:]
+			if strings.Contains(domain, "*") {
+				return fmt.Errorf("invalid SNI route domain: %s", route.Domain)
+			}
+			suffix[domain] = route.OutboundTag
+		} else {
+			if strings.Contains(domain, "*") {
+				return fmt.Errorf("invalid SNI route domain: %s", route.Domain)
+			}
+			exact[domain] = route.OutboundTag
+		}
+	}
+	r.Lock()
+	r.exact = exact
+	r.suffix = suffix
+	r.Unlock()
+	return nil
+}
+
+// Match returns the outbound tag of the server name.
+// The exact domain wins over the wildcards, and the longest wildcard wins over the shorter ones.
+func (r *SNIRouter) Match(serverName string) (string, bool) {
+	domain := normalizeDomain(serverName)
+	if domain == "" {
+		return "", false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	if tag, ok := r.exact[domain]; ok {
+		return tag, true
+	}
+	for i := 0; i < len(domain); i++ {
+		if domain[i] != '.' {
+			continue
+		}
+		if tag, ok := r.suffix[domain[i:]]; ok {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+type preferredOutboundKey struct{}
+
+func contextWithPreferredOutbound(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, preferredOutboundKey{}, tag)
+}
+
+func preferredOutboundFromContext(ctx context.Context) string {
+	if tag, ok := ctx.Value(preferredOutboundKey{}).(string); ok {
+		return tag
+	}
+	return ""
+}
+
+type sniKey struct{}
+
+// contextWithSNI keeps the sniffed server name of the TLS connection for the access log
+func contextWithSNI(ctx context.Context, sni string) context.Context {
+	return context.WithValue(ctx, sniKey{}, sni)
+}
+
+func sniFromContext(ctx context.Context) string {
+	if sni, ok := ctx.Value(sniKey{}).(string); ok {
+		return sni
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+package mydispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	gonet "net"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+type testHandler struct {
+	tag        string
+	dispatched chan string
+}
+
+func (h *testHandler) Start() error { return nil }
+func (h *testHandler) Close() error { return nil }
+func (h *testHandler) Tag() string  { return h.tag }
+func (h *testHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	h.dispatched <- h.tag
+}
+
+type testOutboundManager struct {
+	handlers []outbound.Handler
+}
+
+func (m *testOutboundManager) Type() interface{} { return outbound.ManagerType() }
+func (m *testOutboundManager) Start() error      { return nil }
+func (m *testOutboundManager) Close() error      { return nil }
+func (m *testOutboundManager) GetHandler(tag string) outbound.Handler {
+	for _, h := range m.handlers {
+		if h.Tag() == tag {
+			return h
+		}
+	}
+	return nil
+}
+func (m *testOutboundManager) GetDefaultHandler() outbound.Handler { return m.handlers[0] }
+func (m *testOutboundManager) AddHandler(ctx context.Context, handler outbound.Handler) error {
+	return nil
+}
+func (m *testOutboundManager) RemoveHandler(ctx context.Context, tag string) error { return nil }
+
+func TestSNIRouterMatch(t *testing.T) {
+	r := NewSNIRouter()
+	err := r.Update([]*SNIRoute{
+		{Domain: "*.netflix.com", OutboundTag: "streaming"},
+		{Domain: "*.api.netflix.com", OutboundTag: "api"},
+		{Domain: "Netflix.com", OutboundTag: "home"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"www.netflix.com":    "streaming",
+		"a.b.netflix.com":    "streaming",
+		"WWW.NETFLIX.COM.":   "streaming",
+		"v1.api.netflix.com": "api",
+		"netflix.com":        "home",
+		"notnetflix.com":     "",
+		"www.netflix.com.cn": "",
+		"":                   "",
+	}
+	for serverName, want := range cases {
+		tag, _ := r.Match(serverName)
+		if tag != want {
+			t.Errorf("unexpected outbound of %s. want %q, but got %q", serverName, want, tag)
+		}
+	}
+}
+
+func TestSNIRouterInvalidRoute(t *testing.T) {
+	r := NewSNIRouter()
+	if err := r.Update([]*SNIRoute{{Domain: "www.*.com", OutboundTag: "streaming"}}); err == nil {
+		t.Error("wildcard in the middle should be rejected")
+	}
+	if err := r.Update([]*SNIRoute{{Domain: "*.netflix.com"}}); err == nil {
+		t.Error("empty outbound tag should be rejected")
+	}
+}
+
+// clientHello returns the first TLS record a client sends to the server name
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := gonet.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	b := make([]byte, 4096)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := server.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return b[:n]
+}
+
+func dispatchTLS(t *testing.T, serverName string) string {
+	d, dispatched := newTestDispatcher(t)
+	if err := d.SNIRouter.Update([]*SNIRoute{{Domain: "*.netflix.com", OutboundTag: "streaming"}}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchPayload(t, d, "", clientHello(t, serverName))
+	select {
+	case tag := <-dispatched:
+		return tag
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection is not dispatched")
+	}
+	return ""
+}
+
+func TestDispatchSNIRoute(t *testing.T) {
+	if tag := dispatchTLS(t, "www.netflix.com"); tag != "streaming" {
+		t.Errorf("matched server name should take the SNI outbound, but got %s", tag)
+	}
+}
+
+func TestDispatchSNIRouteNoMatch(t *testing.T) {
+	if tag := dispatchTLS(t, "www.example.com"); tag != "direct" {
+		t.Errorf("unmatched server name should fall back to the default outbound, but got %s", tag)
+	}
+}
+
+func TestDispatchSNIAccessMessage(t *testing.T) {
+	d, dispatched := newTestDispatcher(t)
+	accessMessage := &log.AccessMessage{Status: log.AccessAccepted}
+	ctx := log.ContextWithAccessMessage(context.Background(), accessMessage)
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{Tag: "V2ray_1145", User: &protocol.MemoryUser{}})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: session.SniffingRequest{Enabled: true},
+	})
+	link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, clientHello(t, "www.example.com"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dispatched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection is not dispatched")
+	}
+	if reason := accessMessage.Reason; reason != "sni: www.example.com" {
+		t.Errorf("the access message should have the server name, got %v", reason)
+	}
+}
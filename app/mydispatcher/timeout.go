@@ -0,0 +1,112 @@
+package mydispatcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/transport"
+)
+
+// UpdateConnectTimeout sets how long the outbound has to reach the destination for the connections of the inbound,
+// 0 removes the limit
+func (d *DefaultDispatcher) UpdateConnectTimeout(tag string, timeout time.Duration) {
+	if timeout <= 0 {
+		d.ConnectTimeouts.Delete(tag)
+		return
+	}
+	d.ConnectTimeouts.Store(tag, timeout)
+}
+
+func (d *DefaultDispatcher) connectTimeout(tag string) time.Duration {
+	if v, ok := d.ConnectTimeouts.Load(tag); ok {
+		return v.(time.Duration)
+	}
+	return 0
+}
+
+// connectGuard closes the link if the outbound has not reached the destination in time. The outbounds only read
+// the uplink or write the downlink once they are connected, so either of them stops the timer.
+type connectGuard struct {
+	once   sync.Once
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+// guardConnect wraps the link to stop the guard, and returns the context of the outbound which is canceled on timeout
+func guardConnect(ctx context.Context, link *transport.Link, timeout time.Duration, destination string) (context.Context, *transport.Link, *connectGuard) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &connectGuard{cancel: cancel}
+	closeLink := func() {
+		newError("failed to reach ", destination, " in ", timeout, ", close the connection").AtWarning().WriteToLog(session.ExportIDToError(ctx))
+		// The same as the error path, which also releases the limiter slot held by the downlink writer
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		cancel()
+	}
+	g.timer = time.AfterFunc(timeout, closeLink)
+	return ctx, connectLink(link, g.Stop), g
+}
+
+// connectLink wraps the link to call connected once the outbound reads the uplink or writes the downlink
+func connectLink(link *transport.Link, connected func()) *transport.Link {
+	return &transport.Link{
+		Reader: &connectReader{Reader: link.Reader, connected: connected},
+		Writer: &connectWriter{Writer: link.Writer, connected: connected},
+	}
+}
+
+// Stop stops the timer once the outbound is connected
+func (g *connectGuard) Stop() {
+	g.once.Do(func() { g.timer.Stop() })
+}
+
+// Done releases the guard once the outbound returns
+func (g *connectGuard) Done() {
+	g.Stop()
+	g.cancel()
+}
+
+type connectReader struct {
+	Reader    buf.Reader
+	connected func()
+}
+
+func (r *connectReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	r.connected()
+	return r.Reader.ReadMultiBuffer()
+}
+
+// ReadMultiBufferTimeout keeps the first payload timeout of the outbounds working
+func (r *connectReader) ReadMultiBufferTimeout(timeout time.Duration) (buf.MultiBuffer, error) {
+	r.connected()
+	if reader, ok := r.Reader.(buf.TimeoutReader); ok {
+		return reader.ReadMultiBufferTimeout(timeout)
+	}
+	return r.Reader.ReadMultiBuffer()
+}
+
+func (r *connectReader) Interrupt() {
+	common.Interrupt(r.Reader)
+}
+
+type connectWriter struct {
+	Writer    buf.Writer
+	connected func()
+}
+
+func (w *connectWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.connected()
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *connectWriter) Close() error {
+	return common.Close(w.Writer)
+}
+
+func (w *connectWriter) Interrupt() {
+	common.Interrupt(w.Writer)
+}
@@ -0,0 +1,111 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/app/policy"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+// stuckHandler never reaches the destination, it waits for the dial to be canceled like the outbounds do
+type stuckHandler struct {
+	testHandler
+	canceled chan struct{}
+}
+
+func (h *stuckHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	<-ctx.Done()
+	close(h.canceled)
+}
+
+// slowHandler reaches the destination at once, and responds after the delay
+type slowHandler struct {
+	testHandler
+	delay time.Duration
+}
+
+func (h *slowHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	if mb, err := link.Reader.ReadMultiBuffer(); err == nil {
+		buf.ReleaseMulti(mb)
+		time.Sleep(h.delay)
+		link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("pong")))
+	}
+}
+
+// newTimeoutDispatcher returns a dispatcher with the default outbound, and a user limited to one connection
+func newTimeoutDispatcher(t *testing.T, handler outbound.Handler) *DefaultDispatcher {
+	pm, err := policy.New(context.Background(), &policy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{handlers: []outbound.Handler{handler}}, nil, pm, nil); err != nil {
+		t.Fatal(err)
+	}
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", ConnLimit: 1}}
+	if err := d.Limiter.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.UpdateConnectTimeout("V2ray_1145", 100*time.Millisecond)
+	return d
+}
+
+func dispatchUser(t *testing.T, d *DefaultDispatcher) *transport.Link {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    "V2ray_1145",
+		Source: net.TCPDestination(net.ParseAddress("2.2.2.2"), 12345),
+		User:   &protocol.MemoryUser{Email: "a@test.com"},
+	})
+	link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+func TestDispatchConnectTimeout(t *testing.T) {
+	handler := &stuckHandler{testHandler: testHandler{tag: "direct"}, canceled: make(chan struct{})}
+	d := newTimeoutDispatcher(t, handler)
+	start := time.Now()
+	link := dispatchUser(t, d)
+	if _, err := link.Reader.ReadMultiBuffer(); err == nil {
+		t.Fatal("the stuck connection should be closed")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("the stuck connection should be closed on the timeout, but took %s", elapsed)
+	}
+	select {
+	case <-handler.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the dial of the outbound should be canceled")
+	}
+	// The connection slot of the user is released
+	if _, ok := d.Limiter.AcquireConn("V2ray_1145", "a@test.com"); !ok {
+		t.Error("the connection of the stuck connection should be released")
+	}
+}
+
+func TestDispatchConnectTimeoutConnected(t *testing.T) {
+	d := newTimeoutDispatcher(t, &slowHandler{testHandler: testHandler{tag: "direct"}, delay: 300 * time.Millisecond})
+	link := dispatchUser(t, d)
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	// The timeout only applies until the outbound is connected
+	mb, err := link.Reader.ReadMultiBuffer()
+	if err != nil {
+		t.Fatalf("the connected connection should not be closed: %s", err)
+	}
+	if mb.String() != "pong" {
+		t.Errorf("unexpected response: %s", mb.String())
+	}
+	buf.ReleaseMulti(mb)
+}
@@ -0,0 +1,40 @@
+package mydispatcher
+
+import (
+	"sync"
+
+	"github.com/xtls/xray-core/features/stats"
+)
+
+// UserConnCounterName is the name of the counter of the live connections of the user in the stats manager
+func UserConnCounterName(email string) string {
+	return "user>>>" + email + ">>>connection>>>live"
+}
+
+// trackUserConn counts a live connection of the user, the returned untrack must be called once the link is torn down.
+// It is nil if the stats manager does not keep counters.
+func (d *DefaultDispatcher) trackUserConn(email string) (untrack func()) {
+	if d.stats == nil {
+		return nil
+	}
+	c, _ := stats.GetOrRegisterCounter(d.stats, UserConnCounterName(email))
+	if c == nil {
+		return nil
+	}
+	c.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.Add(-1) })
+	}
+}
+
+// RemoveUserConnCounter unregisters the counters of the live connections of the removed users. The connections
+// still open count down on the unregistered counters, a user added again starts from a new one
+func (d *DefaultDispatcher) RemoveUserConnCounter(emails []string) {
+	if d.stats == nil {
+		return
+	}
+	for _, email := range emails {
+		d.stats.UnregisterCounter(UserConnCounterName(email))
+	}
+}
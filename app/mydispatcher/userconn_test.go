@@ -0,0 +1,150 @@
+package mydispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/app/policy"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+)
+
+// closingHandler tears down the link like the outbound handlers of xray-core, once the hold is closed
+type closingHandler struct {
+	testHandler
+	hold chan struct{}
+}
+
+func (h *closingHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	<-h.hold
+	common.Close(link.Writer)
+	common.Interrupt(link.Reader)
+	h.dispatched <- h.tag
+}
+
+// newConnDispatcher returns a dispatcher with the stats, and the user b@test.com limited to one connection
+func newConnDispatcher(t *testing.T, handler outbound.Handler) (*DefaultDispatcher, *stats.Manager) {
+	pm, err := policy.New(context.Background(), &policy.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(DefaultDispatcher)
+	if err := d.Init(&Config{}, &testOutboundManager{handlers: []outbound.Handler{handler}}, nil, pm, sm); err != nil {
+		t.Fatal(err)
+	}
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com"}, {UID: 2, Email: "b@test.com", ConnLimit: 1}}
+	if err := d.Limiter.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	return d, sm
+}
+
+// dispatchConn dispatches a sniffing enabled tcp connection of the user, and sends the payload
+func dispatchConn(t *testing.T, d *DefaultDispatcher, email string, payload []byte) {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    "V2ray_1145",
+		Source: net.TCPDestination(net.ParseAddress("2.2.2.2"), 12345),
+		User:   &protocol.MemoryUser{Email: email},
+	})
+	ctx = session.ContextWithContent(ctx, &session.Content{
+		SniffingRequest: session.SniffingRequest{Enabled: true},
+	})
+	link, err := d.Dispatch(ctx, net.TCPDestination(net.ParseAddress("1.1.1.1"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, payload))
+}
+
+// waitConnCount waits for the live connections of the user to reach the count
+func waitConnCount(t *testing.T, sm *stats.Manager, email string, count int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	var value int64
+	for time.Now().Before(deadline) {
+		if c := sm.GetCounter(UserConnCounterName(email)); c != nil {
+			if value = c.Value(); value == count {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("want %d live connections of %s, but got %d", count, email, value)
+}
+
+func TestUserConnCounter(t *testing.T) {
+	handler := &closingHandler{testHandler: testHandler{tag: "direct", dispatched: make(chan string, 3)}, hold: make(chan struct{})}
+	d, sm := newConnDispatcher(t, handler)
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	dispatchConn(t, d, "a@test.com", request)
+	dispatchConn(t, d, "a@test.com", request)
+	dispatchConn(t, d, "b@test.com", request)
+	waitConnCount(t, sm, "a@test.com", 2)
+	waitConnCount(t, sm, "b@test.com", 1)
+	// The connection over the limit is rejected without being counted
+	dispatchConn(t, d, "b@test.com", request)
+	waitConnCount(t, sm, "b@test.com", 1)
+
+	close(handler.hold)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handler.dispatched:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the connections should be closed")
+		}
+	}
+	waitConnCount(t, sm, "a@test.com", 0)
+	waitConnCount(t, sm, "b@test.com", 0)
+}
+
+func TestUserConnCounterTeardown(t *testing.T) {
+	handler := &closingHandler{testHandler: testHandler{tag: "direct", dispatched: make(chan string, 1)}, hold: make(chan struct{})}
+	close(handler.hold)
+	d, sm := newConnDispatcher(t, handler)
+	// The connection rejected by the protocol rule is closed by the dispatcher
+	if err := d.RuleManager.UpdateProtocolRule("V2ray_1145", []string{"http"}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchConn(t, d, "a@test.com", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	waitConnCount(t, sm, "a@test.com", 0)
+	// The connection failed to sniff is still dispatched, and closed by the outbound
+	dispatchConn(t, d, "a@test.com", []byte{0, 1, 2, 3})
+	select {
+	case <-handler.dispatched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the unknown content should be dispatched")
+	}
+	waitConnCount(t, sm, "a@test.com", 0)
+}
+
+func TestRemoveUserConnCounter(t *testing.T) {
+	handler := &closingHandler{testHandler: testHandler{tag: "direct", dispatched: make(chan string, 1)}, hold: make(chan struct{})}
+	d, sm := newConnDispatcher(t, handler)
+	dispatchConn(t, d, "a@test.com", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	waitConnCount(t, sm, "a@test.com", 1)
+	d.RemoveUserConnCounter([]string{"a@test.com"})
+	if sm.GetCounter(UserConnCounterName("a@test.com")) != nil {
+		t.Fatal("the counter of the removed user should be unregistered")
+	}
+	// The connection open before the removal is closed without the counter
+	close(handler.hold)
+	select {
+	case <-handler.dispatched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection should be closed")
+	}
+	if sm.GetCounter(UserConnCounterName("a@test.com")) != nil {
+		t.Error("the closed connection should not register the counter again")
+	}
+}
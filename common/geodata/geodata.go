@@ -0,0 +1,260 @@
+// Package geodata loads geoip.dat and geosite.dat once, and serves the lookups to all the features using them
+package geodata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/platform"
+	"github.com/xtls/xray-core/common/task"
+)
+
+const (
+	geoIPFile   = "geoip.dat"
+	geoSiteFile = "geosite.dat"
+	// Max IPs with a cached location, the cache is dropped once it is full
+	locationCacheSize = 10000
+)
+
+type Config struct {
+	Path            string `mapstructure:"Path"`            // Directory of geoip.dat and geosite.dat, default is the asset location of xray-core
+	RefreshInterval int    `mapstructure:"RefreshInterval"` // Seconds to check the files for an update, 0 means never
+}
+
+// GeoData holds the loaded databases. The matchers of a code are built on the first lookup and kept until the
+// file is reloaded. A missing or broken file matches nothing, and is loaded once it is fixed.
+type GeoData struct {
+	config          *Config
+	access          sync.RWMutex
+	geoIP           map[string]*router.GeoIP // Key: upper case country code
+	geoSite         map[string]*router.GeoSite
+	geoIPModTime    time.Time
+	geoSiteModTime  time.Time
+	ipMatchers      map[string]*router.GeoIPMatcher
+	domainMatchers  map[string]*router.DomainMatcher
+	countryCodes    []string            // The two letter codes of geoip.dat
+	asnCodes        []string            // The AS<number> codes of geoip.dat
+	locations       map[string]Location // Key: IP
+	refreshPeriodic *task.Periodic
+}
+
+func New(config *Config) *GeoData {
+	g := &GeoData{config: config}
+	if err := g.Refresh(); err != nil {
+		log.Print(err)
+	}
+	return g
+}
+
+// Start implement the Start() function of the service interface
+func (g *GeoData) Start() error {
+	if g.config.RefreshInterval <= 0 {
+		return nil
+	}
+	g.refreshPeriodic = &task.Periodic{
+		Interval: time.Duration(g.config.RefreshInterval) * time.Second,
+		Execute: func() error {
+			if err := g.Refresh(); err != nil {
+				log.Print(err)
+			}
+			return nil
+		},
+	}
+	return g.refreshPeriodic.Start()
+}
+
+// Close implement the Close() function of the service interface
+func (g *GeoData) Close() error {
+	if g.refreshPeriodic != nil {
+		return g.refreshPeriodic.Close()
+	}
+	return nil
+}
+
+func (g *GeoData) location(file string) string {
+	if g.config.Path != "" {
+		return filepath.Join(g.config.Path, file)
+	}
+	return platform.GetAssetLocation(file)
+}
+
+// Refresh reloads the files changed since the last load
+func (g *GeoData) Refresh() error {
+	var errs []string
+	var geoIPList router.GeoIPList
+	if loaded, modTime, err := g.loadFile(geoIPFile, g.geoIPModTime, &geoIPList); err != nil {
+		errs = append(errs, err.Error())
+	} else if loaded {
+		geoIP := make(map[string]*router.GeoIP, len(geoIPList.Entry))
+		var countryCodes, asnCodes []string
+		for _, entry := range geoIPList.Entry {
+			code := strings.ToUpper(entry.CountryCode)
+			geoIP[code] = entry
+			if isCountryCode(code) {
+				countryCodes = append(countryCodes, code)
+			} else if isASNCode(code) {
+				asnCodes = append(asnCodes, code)
+			}
+		}
+		g.access.Lock()
+		g.geoIP, g.geoIPModTime, g.ipMatchers = geoIP, modTime, nil
+		g.countryCodes, g.asnCodes, g.locations = countryCodes, asnCodes, nil
+		g.access.Unlock()
+		log.Printf("Loaded %d geoip codes from %s", len(geoIP), g.location(geoIPFile))
+	}
+	var geoSiteList router.GeoSiteList
+	if loaded, modTime, err := g.loadFile(geoSiteFile, g.geoSiteModTime, &geoSiteList); err != nil {
+		errs = append(errs, err.Error())
+	} else if loaded {
+		geoSite := make(map[string]*router.GeoSite, len(geoSiteList.Entry))
+		for _, entry := range geoSiteList.Entry {
+			geoSite[strings.ToUpper(entry.CountryCode)] = entry
+		}
+		g.access.Lock()
+		g.geoSite, g.geoSiteModTime, g.domainMatchers = geoSite, modTime, nil
+		g.access.Unlock()
+		log.Printf("Loaded %d geosite codes from %s", len(geoSite), g.location(geoSiteFile))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Load geo data failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadFile unmarshals the file into the list if it is modified since the last load
+func (g *GeoData) loadFile(file string, lastModTime time.Time, list proto.Message) (loaded bool, modTime time.Time, err error) {
+	path := g.location(file)
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, modTime, err
+	}
+	if info.ModTime().Equal(lastModTime) {
+		return false, lastModTime, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, modTime, err
+	}
+	if err := proto.Unmarshal(data, list); err != nil {
+		return false, modTime, fmt.Errorf("%s is broken: %s", path, err)
+	}
+	return true, info.ModTime(), nil
+}
+
+// MatchIP reports whether the IP is in the geoip list of the code, e.g. cn or private
+func (g *GeoData) MatchIP(code string, ip net.IP) bool {
+	code = strings.ToUpper(code)
+	g.access.RLock()
+	matcher, ok := g.ipMatchers[code]
+	g.access.RUnlock()
+	if !ok {
+		g.access.Lock()
+		if matcher, ok = g.ipMatchers[code]; !ok {
+			if geoIP, found := g.geoIP[code]; found {
+				matcher = new(router.GeoIPMatcher)
+				if err := matcher.Init(geoIP.Cidr); err != nil {
+					log.Printf("Build the geoip matcher of %s failed: %s", code, err)
+					matcher = nil
+				}
+			}
+			if g.ipMatchers == nil {
+				g.ipMatchers = make(map[string]*router.GeoIPMatcher)
+			}
+			g.ipMatchers[code] = matcher
+		}
+		g.access.Unlock()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4 // The matcher tells IPv4 by the length
+	}
+	return matcher != nil && matcher.Match(ip)
+}
+
+// Location is the country and the autonomous system of an IP
+type Location struct {
+	Country string // Upper case country code, e.g. CN
+	ASN     string // e.g. AS4134
+}
+
+// Locate returns the location of the IP from the two letter and the AS<number> codes of geoip.dat, the fields
+// not found are empty. The locations are cached until the file is reloaded
+func (g *GeoData) Locate(ip net.IP) Location {
+	key := ip.String()
+	g.access.RLock()
+	location, ok := g.locations[key]
+	countryCodes, asnCodes := g.countryCodes, g.asnCodes
+	g.access.RUnlock()
+	if ok {
+		return location
+	}
+	for _, code := range countryCodes {
+		if g.MatchIP(code, ip) {
+			location.Country = code
+			break
+		}
+	}
+	for _, code := range asnCodes {
+		if g.MatchIP(code, ip) {
+			location.ASN = code
+			break
+		}
+	}
+	g.access.Lock()
+	if g.locations == nil || len(g.locations) >= locationCacheSize {
+		g.locations = make(map[string]Location)
+	}
+	g.locations[key] = location
+	g.access.Unlock()
+	return location
+}
+
+func isCountryCode(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
+
+func isASNCode(code string) bool {
+	if len(code) <= 2 || !strings.HasPrefix(code, "AS") {
+		return false
+	}
+	for _, c := range code[2:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchDomain reports whether the domain is in the geosite list of the code, e.g. netflix or category-ads-all
+func (g *GeoData) MatchDomain(code string, domain string) bool {
+	code = strings.ToUpper(code)
+	g.access.RLock()
+	matcher, ok := g.domainMatchers[code]
+	g.access.RUnlock()
+	if !ok {
+		g.access.Lock()
+		if matcher, ok = g.domainMatchers[code]; !ok {
+			if geoSite, found := g.geoSite[code]; found {
+				var err error
+				if matcher, err = router.NewDomainMatcher(geoSite.Domain); err != nil {
+					log.Printf("Build the geosite matcher of %s failed: %s", code, err)
+					matcher = nil
+				}
+			}
+			if g.domainMatchers == nil {
+				g.domainMatchers = make(map[string]*router.DomainMatcher)
+			}
+			g.domainMatchers[code] = matcher
+		}
+		g.access.Unlock()
+	}
+	return matcher != nil && matcher.ApplyDomain(strings.ToLower(domain))
+}
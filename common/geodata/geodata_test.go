@@ -0,0 +1,95 @@
+package geodata_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/geodata"
+)
+
+func TestGeoDataSharedLookup(t *testing.T) {
+	g := geodata.New(&geodata.Config{Path: "testdata"})
+	// The rule manager and the dispatcher look up the same loaded data concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !g.MatchIP("cn", net.ParseIP("1.0.1.1")) || !g.MatchIP("CN", net.ParseIP("240e::1")) {
+				t.Error("the IPs should be in geoip:cn")
+			}
+			if g.MatchIP("cn", net.ParseIP("8.8.8.8")) || g.MatchIP("us", net.ParseIP("8.8.8.8")) {
+				t.Error("8.8.8.8 should not be in geoip:cn or the missing geoip:us")
+			}
+			if !g.MatchIP("private", net.ParseIP("192.168.1.1")) {
+				t.Error("192.168.1.1 should be in geoip:private")
+			}
+			if !g.MatchDomain("netflix", "www.netflix.com") || !g.MatchDomain("netflix", "NFLXVIDEO.NET") {
+				t.Error("the domains should be in geosite:netflix")
+			}
+			if g.MatchDomain("netflix", "cdn.nflxvideo.net") || !g.MatchDomain("category-ads", "ad.doubleclick.net") {
+				t.Error("the full and plain domains should match as in xray-core")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGeoDataMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	g := geodata.New(&geodata.Config{Path: dir})
+	if g.MatchIP("cn", net.ParseIP("1.0.1.1")) || g.MatchDomain("netflix", "netflix.com") {
+		t.Fatal("missing files should match nothing")
+	}
+	// The files are loaded once they are in place
+	for _, file := range []string{"geoip.dat", "geosite.dat"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !g.MatchIP("cn", net.ParseIP("1.0.1.1")) || !g.MatchDomain("netflix", "netflix.com") {
+		t.Error("the files should be loaded on refresh")
+	}
+	// A broken update keeps the loaded data
+	if err := ioutil.WriteFile(filepath.Join(dir, "geoip.dat"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "geoip.dat"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Refresh(); err == nil {
+		t.Error("the broken file should fail to load")
+	}
+	if !g.MatchIP("cn", net.ParseIP("1.0.1.1")) {
+		t.Error("the loaded data should be kept")
+	}
+}
+
+func TestGeoDataLocate(t *testing.T) {
+	g := geodata.New(&geodata.Config{Path: "testdata"})
+	for i := 0; i < 2; i++ { // The second lookup is served by the cache
+		if location := g.Locate(net.ParseIP("1.0.1.1")); location != (geodata.Location{Country: "CN", ASN: "AS4134"}) {
+			t.Errorf("unexpected location of 1.0.1.1: %+v", location)
+		}
+	}
+	if location := g.Locate(net.ParseIP("240e::1")); location != (geodata.Location{Country: "CN"}) {
+		t.Errorf("unexpected location of 240e::1: %+v", location)
+	}
+	// geoip:private is not a country
+	if location := g.Locate(net.ParseIP("192.168.1.1")); location != (geodata.Location{}) {
+		t.Errorf("192.168.1.1 should have no location: %+v", location)
+	}
+}
@@ -0,0 +1,160 @@
+// Package influxdb writes the metrics to InfluxDB 2.x with the line protocol
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the InfluxDB sink configuration
+type Config struct {
+	URL       string `mapstructure:"URL"` // e.g. http://127.0.0.1:8086
+	Token     string `mapstructure:"Token"`
+	Org       string `mapstructure:"Org"`
+	Bucket    string `mapstructure:"Bucket"`
+	BatchSize int    `mapstructure:"BatchSize"` // Max points in one write, default 5000
+	Timeout   int    `mapstructure:"Timeout"`   // Seconds of one write, default 10
+}
+
+// Point is a point of the line protocol
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{} // int, int64, uint64, float64, bool or string
+	Time        time.Time
+}
+
+type Client struct {
+	config *Config
+	client *http.Client
+}
+
+func New(config *Config) (*Client, error) {
+	if config.URL == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("InfluxDB requires URL and Bucket")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 10
+	}
+	return &Client{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}, nil
+}
+
+// Write writes the points in batches, and returns the first error it meets
+func (c *Client) Write(points []*Point) error {
+	batchSize := c.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 5000
+	}
+	for start := 0; start < len(points); start += batchSize {
+		end := start + batchSize
+		if end > len(points) {
+			end = len(points)
+		}
+		if err := c.write(points[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) write(points []*Point) error {
+	body := new(bytes.Buffer)
+	for _, point := range points {
+		body.WriteString(point.LineProtocol())
+		body.WriteByte('\n')
+	}
+	query := url.Values{}
+	query.Set("org", c.config.Org)
+	query.Set("bucket", c.config.Bucket)
+	query.Set("precision", "s")
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.config.URL, "/")+"/api/v2/write?"+query.Encode(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.config.Token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("write to InfluxDB failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("write to InfluxDB failed: %s %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// LineProtocol returns the point in the line protocol with second precision, the tags and fields are sorted by key
+func (p *Point) LineProtocol() string {
+	line := new(strings.Builder)
+	line.WriteString(measurementEscaper.Replace(p.Measurement))
+	for _, key := range sortedKeys(p.Tags) {
+		if p.Tags[key] == "" {
+			continue
+		}
+		line.WriteString("," + tagEscaper.Replace(key) + "=" + tagEscaper.Replace(p.Tags[key]))
+	}
+	fieldKeys := make([]string, 0, len(p.Fields))
+	for key := range p.Fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+	for i, key := range fieldKeys {
+		if i == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(tagEscaper.Replace(key) + "=" + formatField(p.Fields[key]))
+	}
+	if !p.Time.IsZero() {
+		line.WriteString(" " + strconv.FormatInt(p.Time.Unix(), 10))
+	}
+	return line.String()
+}
+
+func formatField(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return `"` + stringEscaper.Replace(fmt.Sprint(v)) + `"`
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,66 @@
+package influxdb_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/influxdb"
+)
+
+func TestWrite(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "xrayr" || r.URL.Query().Get("org") != "home" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("unexpected authorization: %s", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client, err := influxdb.New(&influxdb.Config{URL: server.URL, Token: "secret", Org: "home", Bucket: "xrayr", BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1620000000, 0)
+	points := []*influxdb.Point{
+		{Measurement: "node_status", Tags: map[string]string{"node_id": "1", "node_type": "V2ray"}, Fields: map[string]interface{}{"cpu": 12.5, "uptime": 3600}, Time: now},
+		{Measurement: "user_traffic", Tags: map[string]string{"node_id": "1", "uid": "2"}, Fields: map[string]interface{}{"upload": int64(100), "download": int64(200)}, Time: now},
+		{Measurement: "user traffic", Tags: map[string]string{"email": "a b,c=d"}, Fields: map[string]interface{}{"note": `say "hi"`}, Time: now},
+	}
+	if err := client.Write(points); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"node_status,node_id=1,node_type=V2ray cpu=12.5,uptime=3600i 1620000000\n" +
+			"user_traffic,node_id=1,uid=2 download=200i,upload=100i 1620000000\n",
+		"user\\ traffic,email=a\\ b\\,c\\=d note=\"say \\\"hi\\\"\" 1620000000\n",
+	}
+	if strings.Join(bodies, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected line protocol.\nwant:\n%s\ngot:\n%s", strings.Join(want, "|"), strings.Join(bodies, "|"))
+	}
+}
+
+func TestWriteFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client, err := influxdb.New(&influxdb.Config{URL: server.URL, Bucket: "xrayr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Write([]*influxdb.Point{{Measurement: "node_status", Fields: map[string]interface{}{"cpu": 1.0}}})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("the failed write should return the status, got %v", err)
+	}
+}
@@ -18,6 +18,7 @@ var version = "dev"
 
 type LegoCMD struct {
 	cmdClient *cli.App
+	Server    string // ACME directory URL, default the one of Let's Encrypt
 }
 
 func New() (*LegoCMD, error) {
@@ -55,7 +56,7 @@ func New() (*LegoCMD, error) {
 	return lego, nil
 }
 
-// DNSCert cert a domain using DNS API
+// DNSCert cert a domain using DNS API, the wildcard domain is also issued for its base domain
 func (l *LegoCMD) DNSCert(domain, email, provider string, DNSEnv map[string]string) (CertPath string, KeyPath string, err error) {
 	// Set Env for DNS configuration
 	for key, value := range DNSEnv {
@@ -67,8 +68,7 @@ func (l *LegoCMD) DNSCert(domain, email, provider string, DNSEnv map[string]stri
 		return CertPath, KeyPath, err
 	}
 
-	argstring := fmt.Sprintf("lego -a -d %s -m %s --dns %s run", domain, email, provider)
-	err = l.cmdClient.Run(strings.Split(argstring, " "))
+	err = l.cmdClient.Run(l.args(domain, email, "--dns", provider, "run"))
 	if err != nil {
 		return "", "", err
 	}
@@ -81,14 +81,16 @@ func (l *LegoCMD) DNSCert(domain, email, provider string, DNSEnv map[string]stri
 
 // HTTPCert cert a domain using http methods
 func (l *LegoCMD) HTTPCert(domain, email string) (CertPath string, KeyPath string, err error) {
+	if isWildcard(domain) {
+		return "", "", wildcardError(domain)
+	}
 	// First check if the certificate exists
 	CertPath, KeyPath, err = checkCertfile(domain)
 	if err == nil {
 		return CertPath, KeyPath, err
 	}
 
-	argstring := fmt.Sprintf("lego -a -d %s -m %s --http run", domain, email)
-	err = l.cmdClient.Run(strings.Split(argstring, " "))
+	err = l.cmdClient.Run(l.args(domain, email, "--http", "run"))
 
 	if err != nil {
 		return "", "", err
@@ -102,19 +104,22 @@ func (l *LegoCMD) HTTPCert(domain, email string) (CertPath string, KeyPath strin
 
 //RenewCert renew a domain cert
 func (l *LegoCMD) RenewCert(domain, email, certMode, provider string, DNSEnv map[string]string) (CertPath string, KeyPath string, err error) {
-	var argstring string
+	var args []string
 	if certMode == "http" {
-		argstring = fmt.Sprintf("lego -a -d %s -m %s --http renew --days 30", domain, email)
+		if isWildcard(domain) {
+			return "", "", wildcardError(domain)
+		}
+		args = l.args(domain, email, "--http", "renew", "--days", "30")
 	} else if certMode == "dns" {
 		// Set Env for DNS configuration
 		for key, value := range DNSEnv {
 			os.Setenv(key, value)
 		}
-		argstring = fmt.Sprintf("lego -a -d %s -m %s --dns %s renew --days 30", domain, email, provider)
+		args = l.args(domain, email, "--dns", provider, "renew", "--days", "30")
 	} else {
 		return "", "", fmt.Errorf("Unsupport cert mode: %s", certMode)
 	}
-	err = l.cmdClient.Run(strings.Split(argstring, " "))
+	err = l.cmdClient.Run(args)
 
 	if err != nil {
 		return "", "", err
@@ -125,9 +130,33 @@ func (l *LegoCMD) RenewCert(domain, email, certMode, provider string, DNSEnv map
 	}
 	return CertPath, KeyPath, nil
 }
+
+// args returns the command line of lego for the domain, a wildcard domain also takes its base domain as a SAN
+func (l *LegoCMD) args(domain string, email string, command ...string) []string {
+	args := []string{"lego", "-a", "-d", domain}
+	if isWildcard(domain) {
+		args = append(args, "-d", strings.TrimPrefix(domain, "*."))
+	}
+	args = append(args, "-m", email)
+	if l.Server != "" {
+		args = append(args, "-s", l.Server)
+	}
+	return append(args, command...)
+}
+
+func isWildcard(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+func wildcardError(domain string) error {
+	return fmt.Errorf("Wildcard domain %s needs the dns cert mode, the HTTP-01 challenge can not issue a wildcard cert", domain)
+}
+
+// checkCertfile returns the cert files of the domain, lego names the ones of a wildcard domain with _ for *
 func checkCertfile(domain string) (string, string, error) {
-	keyPath := path.Join(".lego", "certificates", fmt.Sprintf("%s.key", domain))
-	certPath := path.Join(".lego", "certificates", fmt.Sprintf("%s.crt", domain))
+	fileName := strings.ReplaceAll(domain, "*", "_")
+	keyPath := path.Join(".lego", "certificates", fmt.Sprintf("%s.key", fileName))
+	certPath := path.Join(".lego", "certificates", fmt.Sprintf("%s.crt", fileName))
 	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
 		return "", "", fmt.Errorf("Cert key failed: %s", domain)
 	}
@@ -1,9 +1,21 @@
 package legocmd_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/XrayR-project/XrayR/common/legocmd"
+	legolog "github.com/go-acme/lego/v4/log"
 )
 
 func TestLegoClient(t *testing.T) {
@@ -80,3 +92,120 @@ func TestLegoRenewCert(t *testing.T) {
 	t.Log(certPath)
 	t.Log(keyPath)
 }
+
+// fatalLogger panics instead of exiting on the fatal errors of lego
+type fatalLogger struct{}
+
+func (fatalLogger) Fatal(args ...interface{})                 { panic(fmt.Sprint(args...)) }
+func (fatalLogger) Fatalln(args ...interface{})               { panic(fmt.Sprint(args...)) }
+func (fatalLogger) Fatalf(format string, args ...interface{}) { panic(fmt.Sprintf(format, args...)) }
+func (fatalLogger) Print(args ...interface{})                 {}
+func (fatalLogger) Println(args ...interface{})               {}
+func (fatalLogger) Printf(format string, args ...interface{}) {}
+
+// mockACME is an ACME server which registers the accounts and records the identifiers of the orders, and then rejects them
+func mockACME(t *testing.T) (*httptest.Server, func() []string) {
+	var access sync.Mutex
+	var identifiers []string
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"newNonce":   server.URL + "/nonce",
+				"newAccount": server.URL + "/account",
+				"newOrder":   server.URL + "/order",
+				"revokeCert": server.URL + "/revoke",
+				"keyChange":  server.URL + "/key",
+			})
+		case "/nonce":
+			w.WriteHeader(http.StatusOK)
+		case "/account":
+			w.Header().Set("Location", server.URL+"/account/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"status":"valid"}`))
+		case "/order":
+			var jws struct {
+				Payload string `json:"payload"`
+			}
+			var order struct {
+				Identifiers []struct {
+					Value string `json:"value"`
+				} `json:"identifiers"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+				t.Error(err)
+			}
+			payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+			if err != nil {
+				t.Error(err)
+			}
+			if err := json.Unmarshal(payload, &order); err != nil {
+				t.Error(err)
+			}
+			access.Lock()
+			for _, identifier := range order.Identifiers {
+				identifiers = append(identifiers, identifier.Value)
+			}
+			access.Unlock()
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:rejectedIdentifier","detail":"mock"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server, func() []string {
+		access.Lock()
+		defer access.Unlock()
+		return identifiers
+	}
+}
+
+func TestLegoWildcardCert(t *testing.T) {
+	server, identifiers := mockACME(t)
+	defer server.Close()
+	dir := t.TempDir()
+	// Trust the mock server, and keep the lego data in the temp dir
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LEGO_CA_CERTIFICATES", caFile)
+	defer os.Unsetenv("LEGO_CA_CERTIFICATES")
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	logger := legolog.Logger
+	legolog.Logger = fatalLogger{}
+	defer func() { legolog.Logger = logger }()
+
+	lego, err := legocmd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lego.Server = server.URL + "/dir"
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "mock") {
+				t.Errorf("want the order rejected by the mock server, but got %v", r)
+			}
+		}()
+		lego.DNSCert("*.example.com", "test@example.com", "exec", map[string]string{"EXEC_PATH": "true"})
+	}()
+	os.Unsetenv("EXEC_PATH")
+	if got := strings.Join(identifiers(), ","); got != "*.example.com,example.com" {
+		t.Errorf("want the wildcard and its base domain requested, but got %s", got)
+	}
+
+	// HTTP-01 can not issue the wildcard cert
+	if _, _, err := lego.HTTPCert("*.example.com", "test@example.com"); err == nil {
+		t.Error("the wildcard cert of the http mode should fail")
+	}
+	if _, _, err := lego.RenewCert("*.example.com", "test@example.com", "http", "", nil); err == nil {
+		t.Error("the wildcard cert renewal of the http mode should fail")
+	}
+}
@@ -0,0 +1,61 @@
+package limiter
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+)
+
+// AcquireConn counts a new connection of the user, and rejects it if the user has reached the connection limit.
+// The release must be called once the connection is closed, it is nil if the user has no connection limit.
+func (l *Limiter) AcquireConn(tag string, email string) (release func(), ok bool) {
+	value, found := l.InboundInfo.Load(tag)
+	if !found {
+		return nil, true
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.RLock()
+	limit := inboundInfo.ConnLimit
+	inboundInfo.configAccess.RUnlock()
+	if v, found := inboundInfo.UserInfo.Load(email); found {
+		if u := v.(api.UserInfo); u.ConnLimit > 0 {
+			limit = u.ConnLimit
+		}
+	}
+	if limit <= 0 {
+		return nil, true
+	}
+	v, _ := inboundInfo.UserConnCount.LoadOrStore(email, new(int64))
+	count := v.(*int64)
+	if atomic.AddInt64(count, 1) > int64(limit) {
+		atomic.AddInt64(count, -1)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt64(count, -1) })
+	}, true
+}
+
+type releaseWriter struct {
+	buf.Writer
+	release func()
+}
+
+// ReleaseWriter calls the release when the writer is closed or interrupted, whichever comes first
+func (l *Limiter) ReleaseWriter(writer buf.Writer, release func()) buf.Writer {
+	return &releaseWriter{Writer: writer, release: release}
+}
+
+func (w *releaseWriter) Close() error {
+	w.release()
+	return common.Close(w.Writer)
+}
+
+func (w *releaseWriter) Interrupt() {
+	w.release()
+	common.Interrupt(w.Writer)
+}
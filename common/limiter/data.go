@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// UpdateDataUsed replaces the data used by the users with the counts of the panel, the users not in the list are
+// forgotten. It is called with every fetched user list, so the traffic added since is counted on top of the panel
+func (l *Limiter) UpdateDataUsed(tag string, userList *[]api.UserInfo) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	listed := make(map[string]bool)
+	if userList != nil {
+		for _, user := range *userList {
+			listed[user.Email] = true
+			inboundInfo.storeDataUsed(user)
+		}
+	}
+	inboundInfo.UserDataUsed.Range(func(key, value interface{}) bool {
+		if !listed[key.(string)] {
+			inboundInfo.UserDataUsed.Delete(key)
+		}
+		return true
+	})
+	return nil
+}
+
+// AddDataUsed counts the reported traffic of the user against its data limit, and returns the bytes left of it.
+// The remaining is 0 once the user is over the limit, limited is false if the user has no data limit.
+func (l *Limiter) AddDataUsed(tag string, email string, traffic int64) (remaining uint64, limited bool) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return 0, false
+	}
+	inboundInfo := value.(*InboundInfo)
+	if traffic > 0 {
+		if v, ok := inboundInfo.UserDataUsed.Load(email); ok {
+			atomic.AddUint64(v.(*uint64), uint64(traffic))
+		}
+	}
+	return inboundInfo.dataRemaining(email)
+}
+
+// OverDataLimit checks whether the user has used up its data limit, its new connections are refused until the panel
+// raises the limit or resets the data used
+func (l *Limiter) OverDataLimit(tag string, email string) bool {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return false
+	}
+	remaining, limited := value.(*InboundInfo).dataRemaining(email)
+	return limited && remaining == 0
+}
+
+// storeDataUsed sets the data used by the user to the count of the panel, if the user has a data limit
+func (i *InboundInfo) storeDataUsed(user api.UserInfo) {
+	if user.DataLimit == 0 {
+		i.UserDataUsed.Delete(user.Email)
+		return
+	}
+	used := user.DataUsed
+	if v, loaded := i.UserDataUsed.LoadOrStore(user.Email, &used); loaded {
+		atomic.StoreUint64(v.(*uint64), user.DataUsed)
+	}
+}
+
+// dataRemaining returns the bytes left of the data limit of the user, never below 0
+func (i *InboundInfo) dataRemaining(email string) (remaining uint64, limited bool) {
+	v, ok := i.UserInfo.Load(email)
+	if !ok || v.(api.UserInfo).DataLimit == 0 {
+		return 0, false
+	}
+	limit := v.(api.UserInfo).DataLimit
+	var used uint64
+	if v, ok := i.UserDataUsed.Load(email); ok {
+		used = atomic.LoadUint64(v.(*uint64))
+	}
+	if used >= limit {
+		return 0, true
+	}
+	return limit - used, true
+}
+
+// newDataUsed returns the data used by the users of the list with a data limit
+func newDataUsed(userList *[]api.UserInfo) *sync.Map {
+	dataUsed := new(sync.Map)
+	if userList == nil {
+		return dataUsed
+	}
+	for _, user := range *userList {
+		if user.DataLimit > 0 {
+			used := user.DataUsed
+			dataUsed.Store(user.Email, &used)
+		}
+	}
+	return dataUsed
+}
@@ -3,6 +3,8 @@ package limiter
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	sync "sync"
 	"time"
 
@@ -10,36 +12,97 @@ import (
 	"github.com/juju/ratelimit"
 )
 
+// Config is the local limiter configuration of an inbound
+type Config struct {
+	ProtocolSpeedLimit map[string]uint64  `mapstructure:"ProtocolSpeedLimit"` // Key: network (tcp, udp), Value: Bps
+	LevelSpeedLimit    map[int]uint64     `mapstructure:"LevelSpeedLimit"`    // Key: user level, Value: Bps
+	IPSpeedLimit       uint64             `mapstructure:"IPSpeedLimit"`       // Bps of each source IP of a user, on top of the user speed limit. 0 means unlimited
+	UploadSpeedLimit   uint64             `mapstructure:"UploadSpeedLimit"`   // Bps of the upload of each user, on top of the user speed limit. 0 means unlimited
+	DownloadSpeedLimit uint64             `mapstructure:"DownloadSpeedLimit"` // Bps of the download of each user, on top of the user speed limit. 0 means unlimited
+	ConnLimit          int                `mapstructure:"ConnLimit"`          // Max connections of a user across all the IPs, 0 means unlimited
+	DeviceWindow       int                `mapstructure:"DeviceWindow"`       // Seconds an IP counts as an online device after its last connection, 0 means until the next report
+	DeviceReset        *DeviceResetConfig `mapstructure:"DeviceReset"`
+	BurstMultiplier    float64            `mapstructure:"BurstMultiplier"` // Bucket size in seconds of the speed limit, which allows short bursts above the limit. 0 or 1 means no burst
+	RecordSNI          bool               `mapstructure:"-"`               // Record the sniffed TLS server names of the users, set by the controller
+}
+
 type InboundInfo struct {
-	Tag            string
-	NodeSpeedLimit uint64
-	UserInfo       *sync.Map // Key: Email value: api.UserInfo
-	BucketHub      *sync.Map // key: Email, value: *ratelimit.Bucket
-	UserOnlineIP   *sync.Map // Key: Email Value: *sync.Map: Key: IP, Value: UID
+	Tag                string
+	NodeSpeedLimit     uint64
+	ProtocolSpeedLimit map[string]uint64 // Key: network, Value: Bps
+	LevelSpeedLimit    map[int]uint64    // Key: user level, Value: Bps
+	IPSpeedLimit       uint64            // Bps of each source IP of a user
+	UploadSpeedLimit   uint64            // Bps of the upload of each user
+	DownloadSpeedLimit uint64            // Bps of the download of each user
+	ConnLimit          int               // Max connections of a user
+	BurstMultiplier    float64           // Bucket size in seconds of the speed limit
+	LoadMultiplier     float64           // The speed limits of the users are multiplied by it while the node is under load, 0 means 1
+	UserInfo           *sync.Map         // Key: Email value: api.UserInfo
+	BucketHub          *sync.Map         // key: Email or Email>>>network, with >>>uplink or >>>downlink if the directions are limited apart, value: *ratelimit.Bucket
+	UserOnlineIP       *sync.Map         // Key: Email Value: *sync.Map: Key: IP, Value: UID
+	UserWhitelist      *sync.Map         // Key: Email Value: []*net.IPNet, the devices not counted in the device limit
+	IPBucketHub        *sync.Map         // Key: Email Value: *sync.Map: Key: IP, Value: *ipBucket
+	UserConnCount      *sync.Map         // Key: Email Value: *int64, the open connections of the user
+	UserSNI            *sync.Map         // Key: Email Value: *userSNI, nil if the server names are not recorded
+	DeviceWindow       time.Duration     // How long an IP counts as an online device after its last connection, 0 means until the next report
+	UserIPLastSeen     *sync.Map         // Key: Email Value: *sync.Map: Key: IP, Value: time.Time of the last connection, used with the DeviceWindow
+	UserDataUsed       *sync.Map         // Key: Email Value: *uint64, the bytes used against the DataLimit of the user
+	peakAccess         sync.Mutex
+	peakOnlineDevice   int // The most online devices sampled since the last report
+	// configAccess guards the limits, the BucketHub, the IPBucketHub and the UserSNI, which the updates replace
+	// while the connections read them
+	configAccess sync.RWMutex
+	// ipBucketAccess guards the open connections of the IP buckets, so a bucket is not dropped while a new
+	// connection takes it
+	ipBucketAccess sync.Mutex
 }
 
 type Limiter struct {
-	InboundInfo *sync.Map // Key: Tag, Value: *InboundInfo
+	InboundInfo *sync.Map        // Key: Tag, Value: *InboundInfo
+	Now         func() time.Time // Clock of the device window, can be replaced in tests
 }
 
 func New() *Limiter {
 	return &Limiter{
 		InboundInfo: new(sync.Map),
+		Now:         time.Now,
 	}
 }
 
-func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo) error {
+func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, config *Config) error {
 	inboundInfo := &InboundInfo{
 		Tag:            tag,
 		NodeSpeedLimit: nodeSpeedLimit,
 		BucketHub:      new(sync.Map),
 		UserOnlineIP:   new(sync.Map),
+		UserWhitelist:  new(sync.Map),
+		IPBucketHub:    new(sync.Map),
+		UserConnCount:  new(sync.Map),
+		UserIPLastSeen: new(sync.Map),
 	}
+	if config != nil {
+		inboundInfo.ProtocolSpeedLimit = config.ProtocolSpeedLimit
+		inboundInfo.LevelSpeedLimit = config.LevelSpeedLimit
+		inboundInfo.IPSpeedLimit = config.IPSpeedLimit
+		inboundInfo.UploadSpeedLimit = config.UploadSpeedLimit
+		inboundInfo.DownloadSpeedLimit = config.DownloadSpeedLimit
+		inboundInfo.ConnLimit = config.ConnLimit
+		inboundInfo.BurstMultiplier = config.BurstMultiplier
+		inboundInfo.DeviceWindow = time.Duration(config.DeviceWindow) * time.Second
+		if config.RecordSNI {
+			inboundInfo.UserSNI = new(sync.Map)
+		}
+	}
+	// The inbound of a node without users yet is limited too, the users are added to it by UpdateInboundLimiter
 	userMap := new(sync.Map)
-	for _, user := range *userList {
-		userMap.Store(user.Email, user)
+	if userList != nil {
+		for _, user := range *userList {
+			userMap.Store(user.Email, user)
+			inboundInfo.storeWhitelist(user)
+		}
 	}
 	inboundInfo.UserInfo = userMap
+	inboundInfo.UserDataUsed = newDataUsed(userList)
 	l.InboundInfo.Store(tag, inboundInfo) // Replace the old inbound info
 	return nil
 }
@@ -48,17 +111,23 @@ func (l *Limiter) UpdateInboundLimiter(tag string, updatedNodeSpeedLimit uint64,
 
 	if value, ok := l.InboundInfo.Load(tag); ok {
 		inboundInfo := value.(*InboundInfo)
+		inboundInfo.configAccess.Lock()
+		defer inboundInfo.configAccess.Unlock()
 		// Update Node info
 		if inboundInfo.NodeSpeedLimit != updatedNodeSpeedLimit {
 			inboundInfo.BucketHub = new(sync.Map)
 		}
 		inboundInfo.NodeSpeedLimit = updatedNodeSpeedLimit
-		// Update User info
+		if updatedUserList == nil {
+			return nil
+		}
+		// Update User info, the buckets will be rebuilt on the next fetch
 		for _, u := range *updatedUserList {
 			inboundInfo.UserInfo.Store(u.Email, u)
-			limit := determineRate(updatedNodeSpeedLimit, u.SpeedLimit)                                              // If need the limit
-			limiter := ratelimit.NewBucketWithQuantum(time.Duration(int64(time.Second)), int64(limit), int64(limit)) // Byte/s
-			inboundInfo.BucketHub.Store(u.Email, limiter)
+			inboundInfo.storeWhitelist(u)
+			inboundInfo.storeDataUsed(u)
+			inboundInfo.deleteUserBucket(u.Email)
+			inboundInfo.IPBucketHub.Delete(u.Email)
 		}
 	} else {
 		return fmt.Errorf("no such inbound in limiter: %s", tag)
@@ -66,8 +135,96 @@ func (l *Limiter) UpdateInboundLimiter(tag string, updatedNodeSpeedLimit uint64,
 	return nil
 }
 
+// UpdateLevelSpeedLimit replaces the speed limit of the user levels, the buckets will be rebuilt on the next fetch
+func (l *Limiter) UpdateLevelSpeedLimit(tag string, levelSpeedLimit map[int]uint64) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.Lock()
+	defer inboundInfo.configAccess.Unlock()
+	inboundInfo.LevelSpeedLimit = levelSpeedLimit
+	inboundInfo.BucketHub = new(sync.Map)
+	return nil
+}
+
+// UpdateLoadMultiplier multiplies the speed limits of the users by the multiplier of the load of the node, 1 restores
+// them. The buckets will be rebuilt on the next fetch, so the new connections take the new limits
+func (l *Limiter) UpdateLoadMultiplier(tag string, multiplier float64) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	if multiplier == 1 {
+		multiplier = 0
+	}
+	inboundInfo.configAccess.Lock()
+	defer inboundInfo.configAccess.Unlock()
+	if inboundInfo.LoadMultiplier == multiplier {
+		return nil
+	}
+	inboundInfo.LoadMultiplier = multiplier
+	inboundInfo.BucketHub = new(sync.Map)
+	return nil
+}
+
+// UpdateInboundConfig replaces the limits of the config, the buckets will be rebuilt on the next fetch. The online
+// devices and the connection counts of the users are kept, so the reload does not reset them.
+func (l *Limiter) UpdateInboundConfig(tag string, config *Config) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	if config == nil {
+		config = &Config{}
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.Lock()
+	defer inboundInfo.configAccess.Unlock()
+	inboundInfo.ProtocolSpeedLimit = config.ProtocolSpeedLimit
+	inboundInfo.LevelSpeedLimit = config.LevelSpeedLimit
+	inboundInfo.IPSpeedLimit = config.IPSpeedLimit
+	inboundInfo.UploadSpeedLimit = config.UploadSpeedLimit
+	inboundInfo.DownloadSpeedLimit = config.DownloadSpeedLimit
+	inboundInfo.ConnLimit = config.ConnLimit
+	inboundInfo.BurstMultiplier = config.BurstMultiplier
+	inboundInfo.DeviceWindow = time.Duration(config.DeviceWindow) * time.Second
+	if !config.RecordSNI {
+		inboundInfo.UserSNI = nil
+	} else if inboundInfo.UserSNI == nil {
+		inboundInfo.UserSNI = new(sync.Map)
+	}
+	inboundInfo.BucketHub = new(sync.Map)
+	inboundInfo.IPBucketHub = new(sync.Map)
+	return nil
+}
+
+// AddInboundAlias lets another inbound share the limiter of the tag,
+// so the users of all the inbounds that back one node are limited and counted together.
+func (l *Limiter) AddInboundAlias(tag string, alias string) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	l.InboundInfo.Store(alias, value)
+	return nil
+}
+
+// DeleteInboundLimiter deletes the limiter of the inbound. The aliases of the inbound are deleted with it,
+// so the state of a removed node does not stay behind, while the limiters of the other inbounds are kept
 func (l *Limiter) DeleteInboundLimiter(tag string) error {
-	l.InboundInfo.Delete(tag)
+	value, ok := l.InboundInfo.LoadAndDelete(tag)
+	if !ok || value.(*InboundInfo).Tag != tag {
+		return nil
+	}
+	l.InboundInfo.Range(func(key, v interface{}) bool {
+		if v == value {
+			l.InboundInfo.Delete(key)
+		}
+		return true
+	})
 	return nil
 }
 
@@ -75,92 +232,453 @@ func (l *Limiter) GetOnlineDevice(tag string) (*[]api.OnlineUser, error) {
 	onlineUser := make([]api.OnlineUser, 0)
 	if value, ok := l.InboundInfo.Load(tag); ok {
 		inboundInfo := value.(*InboundInfo)
-
+		inboundInfo.configAccess.RLock()
+		defer inboundInfo.configAccess.RUnlock()
+		now := l.Now()
+		// The same UID and IP may be tracked under several keys, report it once
+		reported := make(map[api.OnlineUser]bool)
 		inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+			email := key.(string)
 			ipMap := value.(*sync.Map)
 			ipMap.Range(func(key, value interface{}) bool {
 				ip := key.(string)
 				uid := value.(int)
-				onlineUser = append(onlineUser, api.OnlineUser{UID: uid, IP: ip})
+				if !inboundInfo.active(email, ip, now) {
+					return true
+				}
+				user := api.OnlineUser{UID: uid, IP: ip}
+				if !reported[user] {
+					reported[user] = true
+					onlineUser = append(onlineUser, user)
+				}
 				return true
 			})
-			email := key.(string)
-			inboundInfo.UserOnlineIP.Delete(email) // Reset online device
+			// Reset online device, the devices within the window stay online
+			if inboundInfo.DeviceWindow == 0 {
+				inboundInfo.UserOnlineIP.Delete(email)
+			} else {
+				inboundInfo.expireOnlineIP(email, ipMap, now)
+			}
 			return true
 		})
+		inboundInfo.dropIdleIPBuckets()
 	} else {
 		return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
 	}
 	return &onlineUser, nil
 }
 
-func (l *Limiter) GetUserBucket(tag string, email string, ip string) (limiter *ratelimit.Bucket, SpeedLimit bool, Reject bool) {
+// SampleOnlineDevice counts the online devices of the inbound, and keeps the peak until it is reported
+func (l *Limiter) SampleOnlineDevice(tag string) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	value.(*InboundInfo).sampleOnlineDevice(l.Now())
+	return nil
+}
+
+// GetOnlineDeviceCount returns the online devices now and the peak since the last call, then resets the peak.
+// Call it before GetOnlineDevice, which resets the online devices.
+func (l *Limiter) GetOnlineDeviceCount(tag string) (current int, peak int, err error) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return 0, 0, fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	current = inboundInfo.sampleOnlineDevice(l.Now())
+	inboundInfo.peakAccess.Lock()
+	defer inboundInfo.peakAccess.Unlock()
+	peak = inboundInfo.peakOnlineDevice
+	inboundInfo.peakOnlineDevice = 0
+	return current, peak, nil
+}
+
+// sampleOnlineDevice counts each UID and IP once, as GetOnlineDevice reports them
+func (i *InboundInfo) sampleOnlineDevice(now time.Time) int {
+	counted := len(i.listOnlineDevice(now))
+	i.peakAccess.Lock()
+	defer i.peakAccess.Unlock()
+	if counted > i.peakOnlineDevice {
+		i.peakOnlineDevice = counted
+	}
+	return counted
+}
+
+// listOnlineDevice returns each online UID and IP once
+func (i *InboundInfo) listOnlineDevice(now time.Time) []api.OnlineUser {
+	i.configAccess.RLock()
+	defer i.configAccess.RUnlock()
+	onlineUser := make([]api.OnlineUser, 0)
+	listed := make(map[api.OnlineUser]bool)
+	i.UserOnlineIP.Range(func(key, value interface{}) bool {
+		email := key.(string)
+		value.(*sync.Map).Range(func(key, value interface{}) bool {
+			user := api.OnlineUser{UID: value.(int), IP: key.(string)}
+			if i.active(email, user.IP, now) && !listed[user] {
+				listed[user] = true
+				onlineUser = append(onlineUser, user)
+			}
+			return true
+		})
+		return true
+	})
+	return onlineUser
+}
+
+// ResetOnlineIP clears the online ips of the user, or of all the users if the email is empty.
+// It is safe to call together with GetUserBucket.
+func (l *Limiter) ResetOnlineIP(tag string, email string) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	if email != "" {
+		inboundInfo.UserOnlineIP.Delete(email)
+		inboundInfo.UserIPLastSeen.Delete(email)
+		return nil
+	}
+	inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+		inboundInfo.UserOnlineIP.Delete(key)
+		return true
+	})
+	inboundInfo.UserIPLastSeen.Range(func(key, value interface{}) bool {
+		inboundInfo.UserIPLastSeen.Delete(key)
+		return true
+	})
+	return nil
+}
+
+// GetUserBucket returns the rate bucket of a user for the given network (tcp, udp),
+// and checks whether the device limit is reached. It is the bucket of the download if the directions are limited apart.
+func (l *Limiter) GetUserBucket(tag string, email string, ip string, network string) (limiter *ratelimit.Bucket, SpeedLimit bool, Reject bool) {
+	_, downloadBucket, reject := l.GetUserBuckets(tag, email, ip, network)
+	return downloadBucket, downloadBucket != nil, reject
+}
+
+// GetUserBuckets returns the rate buckets of the upload and the download of a user for the given network (tcp, udp),
+// and checks whether the device limit is reached. Both directions share one bucket unless an upload or download
+// limit applies to the user, then each direction has its own bucket. A nil bucket means the direction is unlimited.
+func (l *Limiter) GetUserBuckets(tag string, email string, ip string, network string) (uploadBucket *ratelimit.Bucket, downloadBucket *ratelimit.Bucket, Reject bool) {
 	if value, ok := l.InboundInfo.Load(tag); ok {
 		inboundInfo := value.(*InboundInfo)
-		nodeLimit := inboundInfo.NodeSpeedLimit
-		var userLimit uint64 = 0
+		// The buckets are loaded from the hub of the limits they are built with
+		inboundInfo.configAccess.RLock()
+		defer inboundInfo.configAccess.RUnlock()
 		var deviceLimit int = 0
 		var uid int = 0
+		var whitelisted bool = false
+		if v, ok := inboundInfo.UserWhitelist.Load(email); ok {
+			whitelisted = containsIP(v.([]*net.IPNet), ip)
+		}
 		if v, ok := inboundInfo.UserInfo.Load(email); ok {
 			u := v.(api.UserInfo)
 			uid = u.UID
-			userLimit = u.SpeedLimit
 			deviceLimit = u.DeviceLimit
+			if u.UnlimitedDevices {
+				deviceLimit = 0
+			}
 		}
-		// Report online device
-		ipMap := new(sync.Map)
-		ipMap.Store(ip, uid)
-		// If any device is online
-		if v, ok := inboundInfo.UserOnlineIP.LoadOrStore(email, ipMap); ok {
-			ipMap := v.(*sync.Map)
-			// If this ip is a new device
-			if _, ok := ipMap.LoadOrStore(ip, uid); !ok {
-				counter := 0
-				ipMap.Range(func(key, value interface{}) bool {
-					counter++
-					return true
-				})
-				if counter > deviceLimit && deviceLimit > 0 {
-					ipMap.Delete(ip)
-					return nil, false, true
+		// Report online device, the whitelisted devices are always allowed and not counted
+		if !whitelisted {
+			if inboundInfo.DeviceWindow > 0 {
+				inboundInfo.touchOnlineIP(email, ip, l.Now())
+			}
+			ipMap := new(sync.Map)
+			ipMap.Store(ip, uid)
+			// If any device is online
+			if v, ok := inboundInfo.UserOnlineIP.LoadOrStore(email, ipMap); ok {
+				ipMap := v.(*sync.Map)
+				// The devices out of the window are not online any more
+				if inboundInfo.DeviceWindow > 0 {
+					inboundInfo.expireOnlineIP(email, ipMap, l.Now())
+				}
+				// If this ip is a new device
+				if _, ok := ipMap.LoadOrStore(ip, uid); !ok {
+					counter := 0
+					ipMap.Range(func(key, value interface{}) bool {
+						counter++
+						return true
+					})
+					if counter > deviceLimit && deviceLimit > 0 {
+						ipMap.Delete(ip)
+						if v, ok := inboundInfo.UserIPLastSeen.Load(email); ok {
+							v.(*sync.Map).Delete(ip)
+						}
+						return nil, nil, true
+					}
 				}
 			}
 		}
-		limit := determineRate(nodeLimit, userLimit) // If need the Speed limit
-		if limit > 0 {
-			limiter := ratelimit.NewBucketWithQuantum(time.Duration(int64(time.Second)), int64(limit), int64(limit)) // Byte/s
-			if v, ok := inboundInfo.BucketHub.LoadOrStore(email, limiter); ok {
-				bucket := v.(*ratelimit.Bucket)
-				return bucket, true, false
-			} else {
-				return limiter, true, false
-			}
-		} else {
-			return nil, false, false
+		key, limit, uploadLimit, downloadLimit, burst := inboundInfo.userLimits(email, network)
+		// The directions share the bucket, so the limit is of the upload and the download together
+		if uploadLimit == 0 && downloadLimit == 0 {
+			bucket := inboundInfo.loadBucket(key, limit, burst)
+			return bucket, bucket, false
 		}
+		uploadBucket = inboundInfo.loadBucket(key+">>>uplink", minRate(limit, uploadLimit), burst)
+		downloadBucket = inboundInfo.loadBucket(key+">>>downlink", minRate(limit, downloadLimit), burst)
+		return uploadBucket, downloadBucket, false
 	} else {
 		newError("Get Inbound Limiter information failed").AtDebug().WriteToLog()
-		return nil, false, false
+		return nil, nil, false
 	}
 }
 
-// determineRate returns the minimum non-zero rate
-func determineRate(nodeLimit, userLimit uint64) (limit uint64) {
-	if nodeLimit == 0 || userLimit == 0 {
-		if nodeLimit > userLimit {
-			return nodeLimit
-		} else if nodeLimit < userLimit {
-			return userLimit
-		} else {
-			return 0
+// GetUserSpeedLimit returns the speed limits of a user for the given network (tcp, udp), without counting a device.
+// The upload and the download share the limit if shared, each direction has its own limit otherwise. 0 means unlimited
+func (l *Limiter) GetUserSpeedLimit(tag string, email string, network string) (uploadLimit uint64, downloadLimit uint64, shared bool) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return 0, 0, true
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.RLock()
+	defer inboundInfo.configAccess.RUnlock()
+	_, limit, uploadLimit, downloadLimit, _ := inboundInfo.userLimits(email, network)
+	if uploadLimit == 0 && downloadLimit == 0 {
+		return limit, limit, true
+	}
+	return minRate(limit, uploadLimit), minRate(limit, downloadLimit), false
+}
+
+// userLimits returns the key of the buckets of the user for the network, the limit of the upload and the download
+// together, the limits of each direction, and the burst of the buckets. The configAccess must be held
+func (i *InboundInfo) userLimits(email string, network string) (key string, limit uint64, uploadLimit uint64, downloadLimit uint64, burst float64) {
+	var userLimit, levelLimit uint64
+	uploadLimit, downloadLimit = i.UploadSpeedLimit, i.DownloadSpeedLimit
+	burst = i.BurstMultiplier
+	if v, ok := i.UserInfo.Load(email); ok {
+		u := v.(api.UserInfo)
+		userLimit = u.SpeedLimit
+		levelLimit = i.LevelSpeedLimit[u.Level]
+		if u.BurstMultiplier > 0 {
+			burst = u.BurstMultiplier
 		}
-	} else {
-		if nodeLimit > userLimit {
-			return userLimit
-		} else if nodeLimit < userLimit {
-			return nodeLimit
-		} else {
-			return nodeLimit
+		if u.UploadSpeedLimit > 0 {
+			uploadLimit = u.UploadSpeedLimit
+		}
+		if u.DownloadSpeedLimit > 0 {
+			downloadLimit = u.DownloadSpeedLimit
+		}
+	}
+	// The user gets the lowest of the user, level and node limits, a limit of 0 inherits the others
+	limit = minRate(userLimit, levelLimit, i.NodeSpeedLimit)
+	key = email
+	// Use a separate bucket if this network has its own limit
+	if protocolLimit, ok := i.ProtocolSpeedLimit[network]; ok && protocolLimit > 0 {
+		limit = minRate(limit, protocolLimit)
+		key = bucketKey(email, network)
+	}
+	// The node under load tightens the limits, the unlimited users stay unlimited
+	if multiplier := i.LoadMultiplier; multiplier > 0 {
+		limit, uploadLimit, downloadLimit = scaleRate(limit, multiplier), scaleRate(uploadLimit, multiplier), scaleRate(downloadLimit, multiplier)
+	}
+	return key, limit, uploadLimit, downloadLimit, burst
+}
+
+// loadBucket returns the bucket of the key at the limit, nil if the limit is 0
+func (i *InboundInfo) loadBucket(key string, limit uint64, burst float64) *ratelimit.Bucket {
+	if limit == 0 {
+		return nil
+	}
+	limiter := newBucket(limit, burst)
+	if v, ok := i.BucketHub.LoadOrStore(key, limiter); ok {
+		return v.(*ratelimit.Bucket)
+	}
+	return limiter
+}
+
+// deleteUserBucket deletes the buckets of the user, of all the networks and directions
+func (i *InboundInfo) deleteUserBucket(email string) {
+	keys := []string{email}
+	for network := range i.ProtocolSpeedLimit {
+		keys = append(keys, bucketKey(email, network))
+	}
+	for _, key := range keys {
+		i.BucketHub.Delete(key)
+		i.BucketHub.Delete(key + ">>>uplink")
+		i.BucketHub.Delete(key + ">>>downlink")
+	}
+}
+
+// GetIPBucket returns the rate bucket of a source IP of the user, which is used together with the user bucket,
+// so a single device cannot take all the bandwidth of the user. The connections of the IP share the bucket until
+// the release of the last one is called, so the release must be called once the connection is closed.
+func (l *Limiter) GetIPBucket(tag string, email string, ip string) (limiter *ratelimit.Bucket, release func(), SpeedLimit bool) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil, nil, false
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.RLock()
+	defer inboundInfo.configAccess.RUnlock()
+	limit := inboundInfo.IPSpeedLimit
+	burst := inboundInfo.BurstMultiplier
+	if v, ok := inboundInfo.UserInfo.Load(email); ok {
+		u := v.(api.UserInfo)
+		if u.IPSpeedLimit > 0 {
+			limit = u.IPSpeedLimit
+		}
+		if u.BurstMultiplier > 0 {
+			burst = u.BurstMultiplier
+		}
+	}
+	if limit == 0 {
+		return nil, nil, false
+	}
+	inboundInfo.ipBucketAccess.Lock()
+	defer inboundInfo.ipBucketAccess.Unlock()
+	v, _ := inboundInfo.IPBucketHub.LoadOrStore(email, new(sync.Map))
+	v, _ = v.(*sync.Map).LoadOrStore(ip, &ipBucket{bucket: newBucket(limit, burst)})
+	b := v.(*ipBucket)
+	b.conns++
+	var once sync.Once
+	return b.bucket, func() {
+		once.Do(func() {
+			inboundInfo.ipBucketAccess.Lock()
+			b.conns--
+			inboundInfo.ipBucketAccess.Unlock()
+		})
+	}, true
+}
+
+// ipBucket is the rate bucket of a source IP of the user, shared by the connections of the IP
+type ipBucket struct {
+	bucket *ratelimit.Bucket
+	conns  int // The open connections holding the bucket
+}
+
+// dropIdleIPBuckets drops the buckets of the IPs without open connections. The IPs with open connections keep
+// their bucket, so their new connections share it with the old ones instead of getting a full bucket
+func (i *InboundInfo) dropIdleIPBuckets() {
+	i.ipBucketAccess.Lock()
+	defer i.ipBucketAccess.Unlock()
+	i.IPBucketHub.Range(func(key, value interface{}) bool {
+		email := key.(string)
+		ipBuckets := value.(*sync.Map)
+		empty := true
+		ipBuckets.Range(func(key, value interface{}) bool {
+			if value.(*ipBucket).conns == 0 {
+				ipBuckets.Delete(key)
+			} else {
+				empty = false
+			}
+			return true
+		})
+		if empty {
+			i.IPBucketHub.Delete(email)
 		}
+		return true
+	})
+}
+
+// newBucket creates the bucket filled at limit Byte/s, which holds burst seconds of the limit,
+// so a short burst above the limit passes at once while the average stays at the limit
+func newBucket(limit uint64, burst float64) *ratelimit.Bucket {
+	capacity := int64(limit)
+	if burst > 1 {
+		capacity = int64(float64(limit) * burst)
+	}
+	return ratelimit.NewBucketWithQuantum(time.Second, capacity, int64(limit))
+}
+
+// touchOnlineIP records the connection of the IP, which keeps it online for the DeviceWindow
+func (i *InboundInfo) touchOnlineIP(email string, ip string, now time.Time) {
+	v, _ := i.UserIPLastSeen.LoadOrStore(email, new(sync.Map))
+	v.(*sync.Map).Store(ip, now)
+}
+
+// active reports whether the IP of the user is an online device at the time
+func (i *InboundInfo) active(email string, ip string, now time.Time) bool {
+	if i.DeviceWindow == 0 {
+		return true
+	}
+	v, ok := i.UserIPLastSeen.Load(email)
+	if !ok {
+		return false
+	}
+	lastSeen, ok := v.(*sync.Map).Load(ip)
+	return ok && now.Before(lastSeen.(time.Time).Add(i.DeviceWindow))
+}
+
+// expireOnlineIP removes the IPs of the user out of the DeviceWindow
+func (i *InboundInfo) expireOnlineIP(email string, ipMap *sync.Map, now time.Time) {
+	ipMap.Range(func(key, value interface{}) bool {
+		if !i.active(email, key.(string), now) {
+			ipMap.Delete(key)
+			if v, ok := i.UserIPLastSeen.Load(email); ok {
+				v.(*sync.Map).Delete(key)
+			}
+		}
+		return true
+	})
+}
+
+// storeWhitelist parses the device whitelist of the user once, so the check on each connection is cheap
+func (i *InboundInfo) storeWhitelist(user api.UserInfo) {
+	if user.DeviceWhitelist == "" {
+		i.UserWhitelist.Delete(user.Email)
+		return
+	}
+	var whitelist []*net.IPNet
+	for _, s := range strings.Split(user.DeviceWhitelist, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			newError("Invalid device whitelist of user ", user.Email, ": ", s).AtWarning().WriteToLog()
+			continue
+		}
+		whitelist = append(whitelist, ipNet)
+	}
+	i.UserWhitelist.Store(user.Email, whitelist)
+}
+
+func containsIP(whitelist []*net.IPNet, ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, ipNet := range whitelist {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func bucketKey(email string, network string) string {
+	return email + ">>>" + network
+}
+
+// minRate returns the minimum non-zero rate, 0 means unlimited
+func minRate(rates ...uint64) (limit uint64) {
+	for _, rate := range rates {
+		if rate > 0 && (limit == 0 || rate < limit) {
+			limit = rate
+		}
+	}
+	return limit
+}
+
+// scaleRate returns the rate multiplied by the multiplier, at least 1 Bps so a limit is never lifted. 0 means unlimited
+func scaleRate(rate uint64, multiplier float64) uint64 {
+	if rate == 0 {
+		return 0
+	}
+	if scaled := uint64(float64(rate) * multiplier); scaled > 0 {
+		return scaled
 	}
+	return 1
 }
@@ -0,0 +1,1016 @@
+package limiter_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+)
+
+func TestProtocolSpeedLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", SpeedLimit: 1000000},
+	}
+	config := &limiter.Config{
+		ProtocolSpeedLimit: map[string]uint64{"udp": 100000},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, config); err != nil {
+		t.Fatal(err)
+	}
+	tcpBucket, ok, reject := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp")
+	if !ok || reject {
+		t.Fatal("tcp bucket should be limited and not rejected")
+	}
+	udpBucket, ok, reject := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "udp")
+	if !ok || reject {
+		t.Fatal("udp bucket should be limited and not rejected")
+	}
+	if tcpBucket == udpBucket {
+		t.Fatal("tcp and udp should use separate buckets")
+	}
+	if tcpBucket.Rate() != 1000000 {
+		t.Errorf("unexpected tcp rate. want 1000000, but got %f", tcpBucket.Rate())
+	}
+	if udpBucket.Rate() != 100000 {
+		t.Errorf("unexpected udp rate. want 100000, but got %f", udpBucket.Rate())
+	}
+	// The same network should reuse the bucket
+	if b, _, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "udp"); b != udpBucket {
+		t.Error("udp bucket should be reused")
+	}
+}
+
+func TestUploadDownloadSpeedLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com", SpeedLimit: 1000000},
+		{UID: 2, Email: "b@test.com", SpeedLimit: 1000000, UploadSpeedLimit: 50000, DownloadSpeedLimit: 2000000},
+	}
+	config := &limiter.Config{UploadSpeedLimit: 200000, DownloadSpeedLimit: 800000}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, config); err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[string][2]float64{
+		// The node limits of the directions apply on top of the user limit
+		"a@test.com": {200000, 800000},
+		// The user limits of the directions override the node ones, the user limit still caps them
+		"b@test.com": {50000, 1000000},
+	}
+	for email, want := range testCases {
+		uploadBucket, downloadBucket, reject := l.GetUserBuckets("V2ray_1145", email, "1.1.1.1", "tcp")
+		if reject || uploadBucket == nil || downloadBucket == nil {
+			t.Fatalf("%s: both directions should be limited and not rejected", email)
+		}
+		if uploadBucket == downloadBucket {
+			t.Fatalf("%s: upload and download should use separate buckets", email)
+		}
+		if uploadBucket.Rate() != want[0] || downloadBucket.Rate() != want[1] {
+			t.Errorf("%s: unexpected rates, want %v, but got %f and %f", email, want, uploadBucket.Rate(), downloadBucket.Rate())
+		}
+		// The buckets are reused by the connections of the user
+		if b, _, _ := l.GetUserBuckets("V2ray_1145", email, "1.1.1.1", "tcp"); b != uploadBucket {
+			t.Errorf("%s: upload bucket should be reused", email)
+		}
+	}
+}
+
+func TestGetUserSpeedLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com", SpeedLimit: 1000000},
+		{UID: 2, Email: "b@test.com", SpeedLimit: 1000000, UploadSpeedLimit: 50000},
+	}
+	if err := l.AddInboundLimiter("Hysteria2_1145", 0, &userList, &limiter.Config{ProtocolSpeedLimit: map[string]uint64{"udp": 800000}}); err != nil {
+		t.Fatal(err)
+	}
+	if upload, download, shared := l.GetUserSpeedLimit("Hysteria2_1145", "a@test.com", "udp"); !shared || upload != 800000 || download != 800000 {
+		t.Errorf("a@test.com: want the shared limit 800000, but got %d %d %v", upload, download, shared)
+	}
+	if upload, download, shared := l.GetUserSpeedLimit("Hysteria2_1145", "b@test.com", "udp"); shared || upload != 50000 || download != 800000 {
+		t.Errorf("b@test.com: want the limits 50000 and 800000, but got %d %d %v", upload, download, shared)
+	}
+	if upload, _, _ := l.GetUserSpeedLimit("NoSuchNode", "a@test.com", "udp"); upload != 0 {
+		t.Errorf("the users of an unknown node should be unlimited, got %d", upload)
+	}
+}
+
+func TestUploadDownloadSpeedLimitSymmetric(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com", SpeedLimit: 1000000},
+		{UID: 2, Email: "b@test.com", UploadSpeedLimit: 50000},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Without the limits of the directions, they share the bucket of the single limit
+	uploadBucket, downloadBucket, _ := l.GetUserBuckets("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+	if uploadBucket == nil || uploadBucket != downloadBucket || uploadBucket.Rate() != 1000000 {
+		t.Errorf("upload and download should share the bucket of the speed limit, got %v and %v", uploadBucket, downloadBucket)
+	}
+	if bucket, ok, _ := l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp"); !ok || bucket != uploadBucket {
+		t.Error("GetUserBucket should return the shared bucket")
+	}
+	// Only the limited direction has a bucket
+	uploadBucket, downloadBucket, _ = l.GetUserBuckets("V2ray_1145", "b@test.com", "1.1.1.1", "tcp")
+	if uploadBucket == nil || uploadBucket.Rate() != 50000 || downloadBucket != nil {
+		t.Errorf("only the upload should be limited, got %v and %v", uploadBucket, downloadBucket)
+	}
+}
+
+func TestProtocolSpeedLimitUnset(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com"},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 500000, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	tcpBucket, _, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp")
+	udpBucket, _, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "udp")
+	if tcpBucket != udpBucket {
+		t.Error("tcp and udp should share the node bucket when no protocol limit is set")
+	}
+	if tcpBucket.Rate() != 500000 {
+		t.Errorf("unexpected rate. want 500000, but got %f", tcpBucket.Rate())
+	}
+}
+
+func TestInboundAlias(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", DeviceLimit: 1},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddInboundAlias("V2ray_1145", "V2ray_8443"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp"); reject {
+		t.Fatal("the first ip should not be rejected")
+	}
+	// The device limit is counted across the inbounds of the node
+	if _, _, reject := l.GetUserBucket("V2ray_8443", "test@test.com", "2.2.2.2", "tcp"); !reject {
+		t.Error("the second ip on the extra port should be rejected")
+	}
+	if err := l.AddInboundAlias("V2ray_2233", "V2ray_8443"); err == nil {
+		t.Error("alias of an unknown inbound should fail")
+	}
+}
+
+func TestDeleteInboundLimiterIsolated(t *testing.T) {
+	l := limiter.New()
+	// The nodes share the user, as on a panel serving both
+	userList := []api.UserInfo{{UID: 1, Email: "test@test.com", SpeedLimit: 1000, DeviceLimit: 1}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddInboundAlias("V2ray_1145", "V2ray_8443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddInboundLimiter("Trojan_2233", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The device limit of each node is counted apart
+	bucket1, _, reject := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp")
+	if reject {
+		t.Fatal("the first device on the first node should be allowed")
+	}
+	bucket2, _, reject := l.GetUserBucket("Trojan_2233", "test@test.com", "2.2.2.2", "tcp")
+	if reject {
+		t.Fatal("the first device on the second node should be allowed")
+	}
+	if bucket1 == bucket2 {
+		t.Error("the nodes should not share the speed limit of the user")
+	}
+	if _, _, reject := l.GetUserBucket("Trojan_2233", "test@test.com", "3.3.3.3", "tcp"); !reject {
+		t.Error("the second device on the second node should be rejected")
+	}
+
+	// Deleting the first node removes its alias, the second node keeps its state
+	if err := l.DeleteInboundLimiter("V2ray_1145"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"V2ray_1145", "V2ray_8443"} {
+		if _, ok := l.InboundInfo.Load(tag); ok {
+			t.Errorf("the limiter of %s should be deleted", tag)
+		}
+	}
+	if bucket, _, _ := l.GetUserBucket("Trojan_2233", "test@test.com", "2.2.2.2", "tcp"); bucket != bucket2 {
+		t.Error("the bucket of the second node should be kept")
+	}
+	onlineDevice, err := l.GetOnlineDevice("Trojan_2233")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*onlineDevice) != 1 || (*onlineDevice)[0].IP != "2.2.2.2" {
+		t.Errorf("the online devices of the second node should be kept, got %v", *onlineDevice)
+	}
+
+	// Deleting an alias only removes the alias
+	if err := l.AddInboundAlias("Trojan_2233", "Trojan_8443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.DeleteInboundLimiter("Trojan_8443"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.InboundInfo.Load("Trojan_2233"); !ok {
+		t.Error("deleting the alias should keep the inbound")
+	}
+}
+
+func TestUserSpeedLimit(t *testing.T) {
+	testCases := []struct {
+		name      string
+		nodeLimit uint64
+		userLimit uint64
+		want      float64
+	}{
+		{"user below node", 200000, 100000, 100000},
+		{"user above node", 200000, 300000, 200000},
+		{"user inherits node", 200000, 0, 200000},
+		{"node unlimited", 0, 100000, 100000},
+	}
+	for _, testCase := range testCases {
+		l := limiter.New()
+		userList := []api.UserInfo{{UID: 1, Email: "test@test.com", SpeedLimit: testCase.userLimit}}
+		if err := l.AddInboundLimiter("V2ray_1145", testCase.nodeLimit, &userList, nil); err != nil {
+			t.Fatal(err)
+		}
+		bucket, ok, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp")
+		if !ok {
+			t.Fatalf("%s: the user should be limited", testCase.name)
+		}
+		if bucket.Rate() != testCase.want {
+			t.Errorf("%s: want the rate %f, but got %f", testCase.name, testCase.want, bucket.Rate())
+		}
+	}
+	// No limit at all
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "test@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp"); ok {
+		t.Error("the user should not be limited without any limit")
+	}
+}
+
+func TestLevelSpeedLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "user@test.com", Level: 1, SpeedLimit: 100000},
+		{UID: 2, Email: "level@test.com", Level: 1, SpeedLimit: 300000},
+		{UID: 3, Email: "node@test.com", Level: 2},
+	}
+	config := &limiter.Config{
+		LevelSpeedLimit: map[int]uint64{1: 200000},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 400000, &userList, config); err != nil {
+		t.Fatal(err)
+	}
+	// The lowest of the user, level and node limits applies
+	cases := map[string]float64{
+		"user@test.com":  100000,
+		"level@test.com": 200000,
+		"node@test.com":  400000,
+	}
+	for email, want := range cases {
+		bucket, ok, _ := l.GetUserBucket("V2ray_1145", email, "1.1.1.1", "tcp")
+		if !ok {
+			t.Fatalf("%s should be limited", email)
+		}
+		if bucket.Rate() != want {
+			t.Errorf("unexpected rate of %s. want %f, but got %f", email, want, bucket.Rate())
+		}
+	}
+
+	// The changed level limit takes effect on the next fetch
+	if err := l.UpdateLevelSpeedLimit("V2ray_1145", map[int]uint64{1: 200000, 2: 250000}); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _, _ := l.GetUserBucket("V2ray_1145", "node@test.com", "1.1.1.1", "tcp")
+	if bucket.Rate() != 250000 {
+		t.Errorf("unexpected rate after level update. want 250000, but got %f", bucket.Rate())
+	}
+}
+
+func TestLoadMultiplier(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "user@test.com", SpeedLimit: 1000000},
+		{UID: 2, Email: "split@test.com", UploadSpeedLimit: 200000, DownloadSpeedLimit: 800000},
+		{UID: 3, Email: "unlimited@test.com"},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.UpdateLoadMultiplier("V2ray_1145", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _, _ := l.GetUserBucket("V2ray_1145", "user@test.com", "1.1.1.1", "tcp")
+	if bucket == nil || bucket.Rate() != 500000 {
+		t.Errorf("the speed limit should be halved under load, got %v", bucket)
+	}
+	uploadBucket, downloadBucket, _ := l.GetUserBuckets("V2ray_1145", "split@test.com", "1.1.1.1", "tcp")
+	if uploadBucket.Rate() != 100000 || downloadBucket.Rate() != 400000 {
+		t.Errorf("the limits of the directions should be halved under load, got %f and %f", uploadBucket.Rate(), downloadBucket.Rate())
+	}
+	if bucket, ok, _ := l.GetUserBucket("V2ray_1145", "unlimited@test.com", "1.1.1.1", "tcp"); ok {
+		t.Errorf("the unlimited user should stay unlimited under load, got %f", bucket.Rate())
+	}
+	// The limits are restored once the load drops
+	if err := l.UpdateLoadMultiplier("V2ray_1145", 1); err != nil {
+		t.Fatal(err)
+	}
+	if bucket, _, _ = l.GetUserBucket("V2ray_1145", "user@test.com", "1.1.1.1", "tcp"); bucket.Rate() != 1000000 {
+		t.Errorf("the speed limit should be restored, got %f", bucket.Rate())
+	}
+	if err := l.UpdateLoadMultiplier("V2ray_1146", 0.5); err == nil {
+		t.Error("the multiplier of an unknown inbound should fail")
+	}
+}
+
+func TestLoadMultiplierDuringGetUserBuckets(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "user@test.com", SpeedLimit: 1000000},
+		{UID: 2, Email: "split@test.com", UploadSpeedLimit: 200000, DownloadSpeedLimit: 800000},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{IPSpeedLimit: 500000}); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := fmt.Sprintf("1.1.1.%d", i)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l.GetUserBuckets("V2ray_1145", "user@test.com", ip, "tcp")
+				l.GetUserBuckets("V2ray_1145", "split@test.com", ip, "tcp")
+				l.GetIPBucket("V2ray_1145", "user@test.com", ip)
+				l.GetUserSpeedLimit("V2ray_1145", "split@test.com", "tcp")
+				l.GetBucketStatus("V2ray_1145")
+			}
+		}(i)
+	}
+	// The load periodic moves the node in and out of the tier while the connections fetch their buckets
+	for i, start := 0, time.Now(); time.Since(start) < 200*time.Millisecond || i%2 != 0; i++ {
+		if err := l.UpdateLoadMultiplier("V2ray_1145", []float64{0.5, 1}[i%2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if err := l.UpdateLoadMultiplier("V2ray_1145", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	uploadBucket, downloadBucket, _ := l.GetUserBuckets("V2ray_1145", "split@test.com", "1.1.1.1", "tcp")
+	if uploadBucket.Rate() != 100000 || downloadBucket.Rate() != 400000 {
+		t.Errorf("the limits should be halved by the last multiplier, got %f and %f", uploadBucket.Rate(), downloadBucket.Rate())
+	}
+}
+
+func TestUpdateInboundConfig(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "user@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := l.GetUserBucket("V2ray_1145", "user@test.com", "1.1.1.1", "tcp"); ok {
+		t.Fatal("the user should not be limited")
+	}
+	// The new limits take effect on the next fetch, and the online devices are kept
+	if err := l.UpdateInboundConfig("V2ray_1145", &limiter.Config{ProtocolSpeedLimit: map[string]uint64{"tcp": 100000}}); err != nil {
+		t.Fatal(err)
+	}
+	bucket, ok, _ := l.GetUserBucket("V2ray_1145", "user@test.com", "1.1.1.1", "tcp")
+	if !ok || bucket.Rate() != 100000 {
+		t.Errorf("the tcp of the user should be limited to 100000 after the update")
+	}
+	onlineDevice, err := l.GetOnlineDevice("V2ray_1145")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*onlineDevice) != 1 || (*onlineDevice)[0].IP != "1.1.1.1" {
+		t.Errorf("the online devices should be kept, got %v", *onlineDevice)
+	}
+	if err := l.UpdateInboundConfig("V2ray_8443", nil); err == nil {
+		t.Error("the unknown inbound should be an error")
+	}
+}
+
+func TestNoUsers(t *testing.T) {
+	for name, userList := range map[string]*[]api.UserInfo{"empty": {}, "nil": nil} {
+		l := limiter.New()
+		if err := l.AddInboundLimiter("V2ray_1145", 0, userList, nil); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if err := l.UpdateInboundLimiter("V2ray_1145", 0, nil); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		onlineDevice, err := l.GetOnlineDevice("V2ray_1145")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(*onlineDevice) != 0 {
+			t.Errorf("%s: no device should be online, got %v", name, *onlineDevice)
+		}
+		// The users added later are limited
+		userList := []api.UserInfo{{UID: 1, Email: "user@test.com", SpeedLimit: 1000000}}
+		if err := l.UpdateInboundLimiter("V2ray_1145", 0, &userList); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if bucket, ok, reject := l.GetUserBucket("V2ray_1145", "user@test.com", "1.1.1.1", "tcp"); !ok || reject || bucket.Rate() != 1000000 {
+			t.Errorf("%s: the user added later should be limited to 1000000", name)
+		}
+	}
+}
+
+func TestGetOnlineDeviceDeduplicate(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "1|a@test.com|1"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := l.InboundInfo.Load("V2ray_1145")
+	inboundInfo := value.(*limiter.InboundInfo)
+	// The same user and IP tracked under overlapping keys
+	for _, key := range []string{"1|a@test.com|1", "1|a@test.com|1>>>uplink", "1|a@test.com|1>>>downlink"} {
+		ipMap := new(sync.Map)
+		ipMap.Store("1.1.1.1", 1)
+		inboundInfo.UserOnlineIP.Store(key, ipMap)
+	}
+	onlineDevice, err := l.GetOnlineDevice("V2ray_1145")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*onlineDevice) != 1 {
+		t.Errorf("the same user and IP should be reported once, got %v", *onlineDevice)
+	}
+}
+
+func TestDeviceWhitelist(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", DeviceLimit: 2, DeviceWhitelist: "10.0.0.0/8, 2001:db8::/32,192.168.1.1"},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The whitelisted devices plus the limit of the other devices all connect
+	for _, ip := range []string{"10.1.2.3", "2001:db8::1", "192.168.1.1", "1.1.1.1", "2.2.2.2", "10.3.2.1"} {
+		if _, _, reject := l.GetUserBucket("V2ray_1145", "test@test.com", ip, "tcp"); reject {
+			t.Errorf("%s should be allowed", ip)
+		}
+	}
+	for _, ip := range []string{"3.3.3.3", "2001:db9::1", "192.168.1.2"} {
+		if _, _, reject := l.GetUserBucket("V2ray_1145", "test@test.com", ip, "tcp"); !reject {
+			t.Errorf("%s should be rejected by the device limit", ip)
+		}
+	}
+}
+
+func TestUnlimitedDevices(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "monitor@test.com", SpeedLimit: 1000, DeviceLimit: 2, UnlimitedDevices: true},
+		{UID: 2, Email: "test@test.com", DeviceLimit: 2},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 50; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		bucket, _, reject := l.GetUserBucket("V2ray_1145", "monitor@test.com", ip, "tcp")
+		if reject {
+			t.Fatalf("%s should be allowed for the user of unlimited devices", ip)
+		}
+		if bucket == nil || bucket.Rate() != 1000 {
+			t.Fatalf("the user of unlimited devices should still be speed limited, got %v", bucket)
+		}
+	}
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp"); reject {
+		t.Error("the first device of the other user should be allowed")
+	}
+	l.GetUserBucket("V2ray_1145", "test@test.com", "2.2.2.2", "tcp")
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "test@test.com", "3.3.3.3", "tcp"); !reject {
+		t.Error("the other user should still be device limited")
+	}
+	// The devices of the user are still reported online
+	onlineDevice, err := l.GetOnlineDevice("V2ray_1145")
+	if err != nil {
+		t.Fatal(err)
+	}
+	online := 0
+	for _, user := range *onlineDevice {
+		if user.UID == 1 {
+			online++
+		}
+	}
+	if online != 50 {
+		t.Errorf("all the devices of the user of unlimited devices should be online, got %d", online)
+	}
+}
+
+func TestIPSpeedLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", SpeedLimit: 1000},
+		{UID: 2, Email: "vip@test.com", SpeedLimit: 1000, IPSpeedLimit: 800},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{IPSpeedLimit: 600}); err != nil {
+		t.Fatal(err)
+	}
+	userBucket, _, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp")
+	ipBucket1, _, ok := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1")
+	if !ok || ipBucket1.Rate() != 600 {
+		t.Fatalf("ip should be limited by the node ip speed limit, got %v", ipBucket1)
+	}
+	ipBucket2, _, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "2.2.2.2")
+	if ipBucket1 == ipBucket2 {
+		t.Fatal("each ip should have its own bucket")
+	}
+	if b, _, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1"); b != ipBucket1 {
+		t.Error("the bucket of the same ip should be reused")
+	}
+	if b, _, _ := l.GetIPBucket("V2ray_1145", "vip@test.com", "1.1.1.1"); b.Rate() != 800 {
+		t.Errorf("the user ip speed limit should override the node one, got %f", b.Rate())
+	}
+
+	// The first ip is throttled by its own cap, and does not take the bucket of the second ip
+	writer1 := l.RateWriter(buf.Discard, userBucket, ipBucket1)
+	if err := writer1.WriteMultiBuffer(buf.MultiBuffer{newBuffer(600)}); err != nil {
+		t.Fatal(err)
+	}
+	if ipBucket1.Available() != 0 || ipBucket2.Available() != 600 {
+		t.Errorf("ip buckets should be throttled independently, got %d and %d", ipBucket1.Available(), ipBucket2.Available())
+	}
+	// Both ips still share the user cap
+	if userBucket.Available() != 400 {
+		t.Errorf("the traffic of the ip should also count against the user, got %d", userBucket.Available())
+	}
+	writer2 := l.RateWriter(buf.Discard, userBucket, ipBucket2)
+	if err := writer2.WriteMultiBuffer(buf.MultiBuffer{newBuffer(400)}); err != nil {
+		t.Fatal(err)
+	}
+	if userBucket.Available() != 0 || ipBucket2.Available() != 200 {
+		t.Errorf("the user cap should apply to all the ips, got user %d and ip %d", userBucket.Available(), ipBucket2.Available())
+	}
+}
+
+func TestIPSpeedLimitUnset(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", SpeedLimit: 1000},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1"); ok {
+		t.Error("ip should not be limited without an ip speed limit")
+	}
+}
+
+func TestIPSpeedLimitAcrossReports(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "test@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{IPSpeedLimit: 600}); err != nil {
+		t.Fatal(err)
+	}
+	// The connection stays open across the reports
+	bucket1, release1, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1")
+	if _, err := l.GetOnlineDevice("V2ray_1145"); err != nil {
+		t.Fatal(err)
+	}
+	bucket2, release2, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1")
+	if _, err := l.GetOnlineDevice("V2ray_1145"); err != nil {
+		t.Fatal(err)
+	}
+	bucket3, release3, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1")
+	if bucket2 != bucket1 || bucket3 != bucket1 {
+		t.Fatal("the connections of the ip should share the bucket across the reports")
+	}
+	// The connections together are held to the limit of the ip
+	writer1 := l.RateWriter(buf.Discard, bucket1)
+	if err := writer1.WriteMultiBuffer(buf.MultiBuffer{newBuffer(600)}); err != nil {
+		t.Fatal(err)
+	}
+	if bucket3.Available() != 0 {
+		t.Errorf("the new connection should see the bucket taken by the old one, got %d", bucket3.Available())
+	}
+	// The bucket is dropped by the report once the connections of the ip are closed
+	release1()
+	release1()
+	release2()
+	release3()
+	if _, err := l.GetOnlineDevice("V2ray_1145"); err != nil {
+		t.Fatal(err)
+	}
+	if bucket, _, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1"); bucket == bucket1 || bucket.Available() != 600 {
+		t.Error("the ip without open connections should get a new bucket after the report")
+	}
+}
+
+func TestBurstMultiplier(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", SpeedLimit: 1000},
+		{UID: 2, Email: "vip@test.com", SpeedLimit: 1000, BurstMultiplier: 8},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{BurstMultiplier: 4}); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp")
+	if bucket.Capacity() != 4000 || bucket.Rate() != 1000 {
+		t.Fatalf("the bucket should hold 4 seconds of the limit, got capacity %d and rate %f", bucket.Capacity(), bucket.Rate())
+	}
+	if b, _, _ := l.GetUserBucket("V2ray_1145", "vip@test.com", "1.1.1.1", "tcp"); b.Capacity() != 8000 {
+		t.Errorf("the user burst multiplier should override the node one, got %d", b.Capacity())
+	}
+
+	// A burst up to the bucket size passes at once
+	start := time.Now()
+	writer := l.RateWriter(buf.Discard, bucket)
+	if err := writer.WriteMultiBuffer(buf.MultiBuffer{newBuffer(2000), newBuffer(2000)}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the burst should not wait, but took %s", elapsed)
+	}
+	// After the burst the traffic is held to the limit
+	if wait := bucket.Take(2000); wait < 1900*time.Millisecond {
+		t.Errorf("the sustained traffic should be capped at the limit, but 2000 bytes only waited %s", wait)
+	}
+}
+
+func TestBurstMultiplierUnset(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "test@test.com", SpeedLimit: 1000},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{IPSpeedLimit: 600}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, _ := l.GetUserBucket("V2ray_1145", "test@test.com", "1.1.1.1", "tcp"); b.Capacity() != 1000 {
+		t.Errorf("the bucket should hold one second of the limit without a burst, got %d", b.Capacity())
+	}
+	if b, _, _ := l.GetIPBucket("V2ray_1145", "test@test.com", "1.1.1.1"); b.Capacity() != 600 {
+		t.Errorf("the ip bucket should hold one second of the limit without a burst, got %d", b.Capacity())
+	}
+}
+
+func newBuffer(size int32) *buf.Buffer {
+	b := buf.New()
+	b.Extend(size)
+	return b
+}
+
+func TestPeakOnlineDevice(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com"},
+		{UID: 2, Email: "b@test.com"},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	connect := func(email string, ips ...string) {
+		for _, ip := range ips {
+			l.GetUserBucket("V2ray_1145", email, ip, "tcp")
+		}
+	}
+	connect("a@test.com", "1.1.1.1", "1.1.1.2")
+	connect("b@test.com", "2.2.2.1")
+	l.SampleOnlineDevice("V2ray_1145") // 3
+	l.ResetOnlineIP("V2ray_1145", "a@test.com")
+	l.SampleOnlineDevice("V2ray_1145") // 1
+	connect("a@test.com", "1.1.1.3")
+	current, peak, err := l.GetOnlineDeviceCount("V2ray_1145")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != 2 || peak != 3 {
+		t.Errorf("want current 2 and peak 3, but got %d and %d", current, peak)
+	}
+	// The peak starts over after the report
+	l.GetOnlineDevice("V2ray_1145")
+	connect("b@test.com", "2.2.2.2")
+	if current, peak, _ := l.GetOnlineDeviceCount("V2ray_1145"); current != 1 || peak != 1 {
+		t.Errorf("want current 1 and peak 1 after the report, but got %d and %d", current, peak)
+	}
+	if _, _, err := l.GetOnlineDeviceCount("unknown"); err == nil {
+		t.Error("unknown inbound should fail")
+	}
+}
+
+func TestDataLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com", DataLimit: 1000, DataUsed: 900},
+		{UID: 2, Email: "b@test.com"},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, limited := l.AddDataUsed("V2ray_1145", "a@test.com", 60); !limited || remaining != 40 {
+		t.Errorf("a@test.com: want 40 bytes remaining, but got %d %v", remaining, limited)
+	}
+	if l.OverDataLimit("V2ray_1145", "a@test.com") {
+		t.Error("a@test.com should be under the data limit")
+	}
+	// The traffic over the limit does not take the remaining below 0
+	if remaining, limited := l.AddDataUsed("V2ray_1145", "a@test.com", 100); !limited || remaining != 0 {
+		t.Errorf("a@test.com: want 0 bytes remaining, but got %d %v", remaining, limited)
+	}
+	if !l.OverDataLimit("V2ray_1145", "a@test.com") {
+		t.Error("a@test.com should be over the data limit")
+	}
+	if _, limited := l.AddDataUsed("V2ray_1145", "b@test.com", 100); limited || l.OverDataLimit("V2ray_1145", "b@test.com") {
+		t.Error("b@test.com has no data limit")
+	}
+	// The panel resets the data used
+	userList[0].DataUsed = 0
+	if err := l.UpdateDataUsed("V2ray_1145", &userList); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := l.AddDataUsed("V2ray_1145", "a@test.com", 0); remaining != 1000 || l.OverDataLimit("V2ray_1145", "a@test.com") {
+		t.Errorf("a@test.com: want the whole limit after the reset, but got %d", remaining)
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com"},
+		{UID: 2, Email: "b@test.com", ConnLimit: 1},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{ConnLimit: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var writers []buf.Writer
+	for i := 0; i < 2; i++ {
+		release, ok := l.AcquireConn("V2ray_1145", "a@test.com")
+		if !ok || release == nil {
+			t.Fatalf("connection %d should be allowed", i+1)
+		}
+		writers = append(writers, l.ReleaseWriter(buf.Discard, release))
+	}
+	if _, ok := l.AcquireConn("V2ray_1145", "a@test.com"); ok {
+		t.Fatal("the connection over the limit should be rejected")
+	}
+	// The user limit overrides the node one
+	if _, ok := l.AcquireConn("V2ray_1145", "b@test.com"); !ok {
+		t.Fatal("the first connection of b should be allowed")
+	}
+	if _, ok := l.AcquireConn("V2ray_1145", "b@test.com"); ok {
+		t.Fatal("the second connection of b should be rejected")
+	}
+	// A closed connection frees its slot once, both on close and on interrupt
+	common.Close(writers[0])
+	common.Interrupt(writers[0])
+	release, ok := l.AcquireConn("V2ray_1145", "a@test.com")
+	if !ok {
+		t.Fatal("the connection should be allowed after one is closed")
+	}
+	if _, ok := l.AcquireConn("V2ray_1145", "a@test.com"); ok {
+		t.Fatal("a released connection should only free one slot")
+	}
+	common.Interrupt(writers[1])
+	release()
+	for i := 0; i < 2; i++ {
+		if _, ok := l.AcquireConn("V2ray_1145", "a@test.com"); !ok {
+			t.Fatalf("connection %d should be allowed after all are closed", i+1)
+		}
+	}
+}
+
+func TestConnLimitUnset(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if release, ok := l.AcquireConn("V2ray_1145", "a@test.com"); !ok || release != nil {
+			t.Fatal("the connections should not be counted without a limit")
+		}
+	}
+}
+
+func TestRecordSNI(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "test@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{RecordSNI: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sni := range []string{"www.b.com", "www.a.com", "www.b.com"} {
+		l.RecordSNI("V2ray_1145", "test@test.com", sni)
+	}
+	names := l.GetUserSNI("V2ray_1145", "test@test.com")
+	if len(names) != 2 || names[0] != "www.a.com" || names[1] != "www.b.com" {
+		t.Errorf("unexpected server names: %v", names)
+	}
+	if names := l.GetUserSNI("V2ray_1145", "test@test.com"); len(names) != 0 {
+		t.Errorf("the server names should be cleared after the report, got %v", names)
+	}
+}
+
+func TestRecordSNIDisabled(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "test@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.RecordSNI("V2ray_1145", "test@test.com", "www.a.com")
+	if names := l.GetUserSNI("V2ray_1145", "test@test.com"); len(names) != 0 {
+		t.Errorf("the server names should not be recorded unless enabled, got %v", names)
+	}
+}
+
+func TestDeviceWindow(t *testing.T) {
+	l := limiter.New()
+	now := time.Unix(1600000000, 0)
+	l.Now = func() time.Time { return now }
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", DeviceLimit: 1}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{DeviceWindow: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp"); reject {
+		t.Fatal("the first device should be allowed")
+	}
+	// The device stays online through the report within the window
+	now = now.Add(60*time.Second - time.Nanosecond)
+	if onlineUser, _ := l.GetOnlineDevice("V2ray_1145"); len(*onlineUser) != 1 {
+		t.Fatalf("want 1 online device within the window, but got %d", len(*onlineUser))
+	}
+	if current, _, _ := l.GetOnlineDeviceCount("V2ray_1145"); current != 1 {
+		t.Errorf("want 1 device counted within the window, but got %d", current)
+	}
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.2", "tcp"); !reject {
+		t.Fatal("the second device should be rejected within the window")
+	}
+	// The device ages out exactly at the window boundary
+	now = now.Add(time.Nanosecond)
+	if current, _, _ := l.GetOnlineDeviceCount("V2ray_1145"); current != 0 {
+		t.Errorf("want no device counted at the window boundary, but got %d", current)
+	}
+	if onlineUser, _ := l.GetOnlineDevice("V2ray_1145"); len(*onlineUser) != 0 {
+		t.Errorf("want no online device at the window boundary, but got %d", len(*onlineUser))
+	}
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.2", "tcp"); reject {
+		t.Fatal("the second device should be allowed after the first one ages out")
+	}
+	// A new connection keeps the device online for another window
+	now = now.Add(30 * time.Second)
+	l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.2", "tcp")
+	now = now.Add(59 * time.Second)
+	if onlineUser, _ := l.GetOnlineDevice("V2ray_1145"); len(*onlineUser) != 1 || (*onlineUser)[0].IP != "1.1.1.2" {
+		t.Errorf("want 1.1.1.2 online after the new connection, but got %v", *onlineUser)
+	}
+}
+
+func TestDeviceWindowUnset(t *testing.T) {
+	l := limiter.New()
+	now := time.Unix(1600000000, 0)
+	l.Now = func() time.Time { return now }
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+	// Without a window the device is online until the next report, however long ago it connected
+	now = now.Add(24 * time.Hour)
+	if onlineUser, _ := l.GetOnlineDevice("V2ray_1145"); len(*onlineUser) != 1 {
+		t.Fatalf("want 1 online device, but got %d", len(*onlineUser))
+	}
+	if onlineUser, _ := l.GetOnlineDevice("V2ray_1145"); len(*onlineUser) != 0 {
+		t.Errorf("want the devices reset after the report, but got %d", len(*onlineUser))
+	}
+}
+
+func TestListOnlineDevice(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+	for i := 0; i < 2; i++ {
+		onlineUser, err := l.ListOnlineDevice("V2ray_1145")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*onlineUser) != 1 || (*onlineUser)[0] != (api.OnlineUser{UID: 1, IP: "1.1.1.1"}) {
+			t.Fatalf("want the online device listed without a reset, but got %v", *onlineUser)
+		}
+	}
+	if _, err := l.ListOnlineDevice("unknown"); err == nil {
+		t.Error("unknown inbound should fail")
+	}
+}
+
+func TestGetBucketStatus(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", SpeedLimit: 1000, IPSpeedLimit: 500}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _, _ := l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+	bucket.TakeAvailable(400)
+	l.GetIPBucket("V2ray_1145", "a@test.com", "1.1.1.1")
+	status, err := l.GetBucketStatus("V2ray_1145")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []limiter.BucketStatus{
+		{Key: "a@test.com", Rate: 1000, Capacity: 1000, Available: 600},
+		{Key: "a@test.com", IP: "1.1.1.1", Rate: 500, Capacity: 500, Available: 500},
+	}
+	if len(status) != len(want) {
+		t.Fatalf("want %v, but got %v", want, status)
+	}
+	for i := range want {
+		if status[i] != want[i] {
+			t.Errorf("want %v, but got %v", want[i], status[i])
+		}
+	}
+}
+
+func TestUpdateConfigDuringGetUserBuckets(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com", SpeedLimit: 1000000, Level: 1}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, &limiter.Config{IPSpeedLimit: 500000, RecordSNI: true}); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := fmt.Sprintf("1.1.1.%d", i)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l.GetUserBuckets("V2ray_1145", "a@test.com", ip, "udp")
+				l.GetIPBucket("V2ray_1145", "a@test.com", ip)
+				l.GetUserSpeedLimit("V2ray_1145", "a@test.com", "tcp")
+				if release, _ := l.AcquireConn("V2ray_1145", "a@test.com"); release != nil {
+					release()
+				}
+				l.RecordSNI("V2ray_1145", "a@test.com", "example.com")
+				l.GetBucketStatus("V2ray_1145")
+				l.ListOnlineDevice("V2ray_1145")
+			}
+		}(i)
+	}
+	// The reloads replace the limits while the connections read them, they stop at the end of a round of ten
+	for i, start := 0, time.Now(); time.Since(start) < 200*time.Millisecond || i%10 != 0; i++ {
+		rate := uint64(100000 * (i%5 + 1))
+		if err := l.UpdateInboundConfig("V2ray_1145", &limiter.Config{
+			ProtocolSpeedLimit: map[string]uint64{"udp": rate},
+			IPSpeedLimit:       rate,
+			UploadSpeedLimit:   rate,
+			ConnLimit:          i%3 + 1,
+			BurstMultiplier:    2,
+			DeviceWindow:       i % 2,
+			RecordSNI:          i%2 == 0,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.UpdateLevelSpeedLimit("V2ray_1145", map[int]uint64{1: rate}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.UpdateLoadMultiplier("V2ray_1145", float64(i%2)+0.5); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.UpdateInboundLimiter("V2ray_1145", rate, &userList); err != nil {
+			t.Fatal(err)
+		}
+		l.GetOnlineDevice("V2ray_1145")
+	}
+	close(stop)
+	wg.Wait()
+	// The buckets are rebuilt at the limits of the last reload
+	if upload, _, _ := l.GetUserSpeedLimit("V2ray_1145", "a@test.com", "udp"); upload != 750000 {
+		t.Errorf("want the upload limit 750000 of the last reload, but got %d", upload)
+	}
+}
@@ -9,15 +9,16 @@ import (
 )
 
 type Writer struct {
-	writer  buf.Writer
-	limiter *ratelimit.Bucket
-	w       io.Writer
+	writer   buf.Writer
+	limiters []*ratelimit.Bucket
+	w        io.Writer
 }
 
-func (l *Limiter) RateWriter(writer buf.Writer, limiter *ratelimit.Bucket) buf.Writer {
+// RateWriter limits the writer by all the buckets, e.g. the user bucket and the source IP bucket
+func (l *Limiter) RateWriter(writer buf.Writer, limiters ...*ratelimit.Bucket) buf.Writer {
 	return &Writer{
-		writer:  writer,
-		limiter: limiter,
+		writer:   writer,
+		limiters: limiters,
 	}
 }
 
@@ -25,7 +26,13 @@ func (w *Writer) Close() error {
 	return common.Close(w.writer)
 }
 
+func (w *Writer) Interrupt() {
+	common.Interrupt(w.writer)
+}
+
 func (w *Writer) WriteMultiBuffer(mb buf.MultiBuffer) error {
-	w.limiter.Wait(int64(mb.Len()))
+	for _, limiter := range w.limiters {
+		limiter.Wait(int64(mb.Len()))
+	}
 	return w.writer.WriteMultiBuffer(mb)
 }
@@ -0,0 +1,78 @@
+package limiter
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeviceResetConfig is the schedule to clear the online ips of all the users
+type DeviceResetConfig struct {
+	Time     string `mapstructure:"Time"`     // Reset every day at the time, HH:MM
+	Timezone string `mapstructure:"Timezone"` // Timezone of the reset time, e.g. Asia/Shanghai. Default is the local timezone
+	Interval int    `mapstructure:"Interval"` // Reset every Interval seconds, used when Time is empty
+}
+
+// DeviceResetter calls the reset function on the schedule, its Execute is meant to be run by a task.Periodic
+type DeviceResetter struct {
+	Now      func() time.Time // Clock of the schedule, can be replaced in tests
+	location *time.Location
+	hour     int
+	minute   int
+	interval time.Duration
+	next     time.Time
+	reset    func()
+}
+
+func NewDeviceResetter(config *DeviceResetConfig, reset func()) (*DeviceResetter, error) {
+	r := &DeviceResetter{
+		Now:      time.Now,
+		location: time.Local,
+		reset:    reset,
+	}
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid device reset timezone %s: %s", config.Timezone, err)
+		}
+		r.location = location
+	}
+	if config.Time != "" {
+		t, err := time.Parse("15:04", config.Time)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid device reset time %s, it should be HH:MM", config.Time)
+		}
+		r.hour, r.minute = t.Hour(), t.Minute()
+	} else if config.Interval > 0 {
+		r.interval = time.Duration(config.Interval) * time.Second
+	} else {
+		return nil, fmt.Errorf("Device reset requires Time or Interval")
+	}
+	return r, nil
+}
+
+// Next returns the first reset time after t
+func (r *DeviceResetter) Next(t time.Time) time.Time {
+	if r.interval > 0 {
+		return t.Add(r.interval)
+	}
+	t = t.In(r.location)
+	next := time.Date(t.Year(), t.Month(), t.Day(), r.hour, r.minute, 0, 0, r.location)
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, r.hour, r.minute, 0, 0, r.location)
+	}
+	return next
+}
+
+// Execute resets if the reset time is reached
+func (r *DeviceResetter) Execute() error {
+	now := r.Now()
+	if r.next.IsZero() {
+		r.next = r.Next(now)
+		return nil
+	}
+	if !now.Before(r.next) {
+		r.reset()
+		r.next = r.Next(now)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package limiter_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/limiter"
+)
+
+func countOnlineIP(t *testing.T, l *limiter.Limiter, tag string) int {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		t.Fatalf("no such inbound in limiter: %s", tag)
+	}
+	counter := 0
+	value.(*limiter.InboundInfo).UserOnlineIP.Range(func(key, value interface{}) bool {
+		value.(*sync.Map).Range(func(key, value interface{}) bool {
+			counter++
+			return true
+		})
+		return true
+	})
+	return counter
+}
+
+func TestDeviceReset(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com", DeviceLimit: 2},
+		{UID: 2, Email: "b@test.com", DeviceLimit: 2},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+	l.GetUserBucket("V2ray_1145", "a@test.com", "2.2.2.2", "tcp")
+	l.GetUserBucket("V2ray_1145", "b@test.com", "3.3.3.3", "tcp")
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "a@test.com", "4.4.4.4", "tcp"); !reject {
+		t.Fatal("the third device should be rejected")
+	}
+
+	resetter, err := limiter.NewDeviceResetter(&limiter.DeviceResetConfig{Time: "00:00", Timezone: "Asia/Shanghai"}, func() {
+		l.ResetOnlineIP("V2ray_1145", "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:59:50 in Asia/Shanghai
+	now := time.Date(2021, 5, 1, 15, 59, 50, 0, time.UTC)
+	resetter.Now = func() time.Time { return now }
+	resetter.Execute()
+	if count := countOnlineIP(t, l, "V2ray_1145"); count != 3 {
+		t.Fatalf("online ips should be kept before the reset time, got %d", count)
+	}
+	now = now.Add(15 * time.Second)
+	resetter.Execute()
+	if count := countOnlineIP(t, l, "V2ray_1145"); count != 0 {
+		t.Errorf("online ips should be cleared at the reset time, got %d", count)
+	}
+	if _, _, reject := l.GetUserBucket("V2ray_1145", "a@test.com", "4.4.4.4", "tcp"); reject {
+		t.Error("a new device should be accepted after the reset")
+	}
+	if next := resetter.Next(now); !next.Equal(time.Date(2021, 5, 2, 16, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next reset time: %s", next)
+	}
+}
+
+func TestDeviceResetUser(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{
+		{UID: 1, Email: "a@test.com"},
+		{UID: 2, Email: "b@test.com"},
+	}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+	l.GetUserBucket("V2ray_1145", "b@test.com", "2.2.2.2", "tcp")
+	if err := l.ResetOnlineIP("V2ray_1145", "a@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if count := countOnlineIP(t, l, "V2ray_1145"); count != 1 {
+		t.Errorf("only the online ips of the user should be cleared, got %d left", count)
+	}
+}
+
+func TestDeviceResetConcurrent(t *testing.T) {
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "a@test.com"}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l.GetUserBucket("V2ray_1145", "a@test.com", "1.1.1.1", "tcp")
+			}
+		}()
+	}
+	for j := 0; j < 1000; j++ {
+		l.ResetOnlineIP("V2ray_1145", "")
+	}
+	wg.Wait()
+}
+
+func TestDeviceResetInvalidConfig(t *testing.T) {
+	for _, config := range []*limiter.DeviceResetConfig{
+		{},
+		{Time: "25:00"},
+		{Time: "00:00", Timezone: "Mars/Olympus"},
+	} {
+		if _, err := limiter.NewDeviceResetter(config, func() {}); err == nil {
+			t.Errorf("invalid config should be rejected: %+v", *config)
+		}
+	}
+}
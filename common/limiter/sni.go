@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"sort"
+	"sync"
+)
+
+// maxUserSNI is the max server names recorded for a user between the reports, the later ones are dropped
+const maxUserSNI = 64
+
+type userSNI struct {
+	access sync.Mutex
+	names  map[string]struct{}
+}
+
+// RecordSNI records the sniffed TLS server name the user connects to, if the inbound records them
+func (l *Limiter) RecordSNI(tag string, email string, sni string) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.RLock()
+	userSNIs := inboundInfo.UserSNI
+	inboundInfo.configAccess.RUnlock()
+	if userSNIs == nil || sni == "" {
+		return
+	}
+	v, _ := userSNIs.LoadOrStore(email, &userSNI{names: make(map[string]struct{})})
+	record := v.(*userSNI)
+	record.access.Lock()
+	defer record.access.Unlock()
+	if len(record.names) < maxUserSNI {
+		record.names[sni] = struct{}{}
+	}
+}
+
+// GetUserSNI returns the sorted server names recorded for the user, and clears them
+func (l *Limiter) GetUserSNI(tag string, email string) []string {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.RLock()
+	userSNIs := inboundInfo.UserSNI
+	inboundInfo.configAccess.RUnlock()
+	if userSNIs == nil {
+		return nil
+	}
+	v, ok := userSNIs.LoadAndDelete(email)
+	if !ok {
+		return nil
+	}
+	record := v.(*userSNI)
+	record.access.Lock()
+	defer record.access.Unlock()
+	names := make([]string, 0, len(record.names))
+	for name := range record.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
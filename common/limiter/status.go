@@ -0,0 +1,71 @@
+package limiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/juju/ratelimit"
+)
+
+// BucketStatus is the state of a speed limit bucket
+type BucketStatus struct {
+	Key       string  // Email, or Email>>>network for the bucket of a network
+	IP        string  // Source IP of the bucket limiting a single device, empty for the user buckets
+	Rate      float64 // Bytes per second
+	Capacity  int64
+	Available int64
+}
+
+// ListOnlineDevice returns the online devices of the inbound as GetOnlineDevice reports them, without resetting them
+func (l *Limiter) ListOnlineDevice(tag string) (*[]api.OnlineUser, error) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	onlineUser := value.(*InboundInfo).listOnlineDevice(l.Now())
+	return &onlineUser, nil
+}
+
+// GetBucketStatus returns the state of the speed limit buckets of the inbound, sorted by the key and the IP
+func (l *Limiter) GetBucketStatus(tag string) ([]BucketStatus, error) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.configAccess.RLock()
+	bucketHub, ipBucketHub := inboundInfo.BucketHub, inboundInfo.IPBucketHub
+	inboundInfo.configAccess.RUnlock()
+	status := make([]BucketStatus, 0)
+	bucketHub.Range(func(key, value interface{}) bool {
+		status = append(status, bucketStatus(key.(string), "", value.(*ratelimit.Bucket)))
+		return true
+	})
+	ipBucketHub.Range(func(key, value interface{}) bool {
+		email := key.(string)
+		value.(*sync.Map).Range(func(key, value interface{}) bool {
+			status = append(status, bucketStatus(email, key.(string), value.(*ipBucket).bucket))
+			return true
+		})
+		return true
+	})
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Key != status[j].Key {
+			return status[i].Key < status[j].Key
+		}
+		return status[i].IP < status[j].IP
+	})
+	return status, nil
+}
+
+func bucketStatus(key string, ip string, bucket *ratelimit.Bucket) BucketStatus {
+	return BucketStatus{
+		Key:       key,
+		IP:        ip,
+		Rate:      bucket.Rate(),
+		Capacity:  bucket.Capacity(),
+		Available: bucket.Available(),
+	}
+}
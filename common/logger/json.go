@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	xlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/serial"
+)
+
+type jsonEntry struct {
+	Time        string `json:"time"`
+	Level       string `json:"level"`
+	Message     string `json:"message,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Detour      string `json:"detour,omitempty"`
+	SNI         string `json:"sni,omitempty"`
+}
+
+func (e *jsonEntry) String() string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// JSONMessage wraps a log message, and formats it as a JSON object.
+type JSONMessage struct {
+	Message xlog.Message
+	Time    time.Time
+}
+
+// String implements Message.
+func (m *JSONMessage) String() string {
+	entry := &jsonEntry{Time: m.Time.Format(time.RFC3339)}
+	switch msg := m.Message.(type) {
+	case *xlog.AccessMessage:
+		entry.Level = "access"
+		entry.Email = msg.Email
+		entry.Source = serial.ToString(msg.From)
+		entry.Destination = serial.ToString(msg.To)
+		entry.Status = string(msg.Status)
+		entry.Reason = serial.ToString(msg.Reason)
+		entry.Detour = msg.Detour
+		// The dispatcher annotates the accepted TLS connections with the sniffed server name
+		if sni := strings.TrimPrefix(entry.Reason, "sni: "); sni != entry.Reason {
+			entry.SNI, entry.Reason = sni, ""
+		}
+	case *xlog.GeneralMessage:
+		entry.Level = strings.ToLower(msg.Severity.String())
+		entry.Message = serial.ToString(msg.Content)
+	default:
+		entry.Level = "info"
+		entry.Message = msg.String()
+	}
+	return entry.String()
+}
+
+type jsonLogger struct {
+	handler xlog.Handler
+}
+
+// NewJSONLogger returns a log handler that writes one JSON object per line.
+func NewJSONLogger(logWriterCreator xlog.WriterCreator) xlog.Handler {
+	return &jsonLogger{
+		handler: xlog.NewLogger(logWriterCreator),
+	}
+}
+
+func (l *jsonLogger) Handle(msg xlog.Message) {
+	l.handler.Handle(&JSONMessage{Message: msg, Time: time.Now()})
+}
+
+func (l *jsonLogger) Close() error {
+	return common.Close(l.handler)
+}
+
+// jsonWriter formats the output of the standard logger
+type jsonWriter struct {
+	writer io.Writer
+}
+
+func (w *jsonWriter) Write(p []byte) (int, error) {
+	entry := &jsonEntry{
+		Time:    time.Now().Format(time.RFC3339),
+		Level:   "info",
+		Message: strings.TrimSuffix(string(p), "\n"),
+	}
+	if _, err := io.WriteString(w.writer, entry.String()+"\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
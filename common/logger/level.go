@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xtls/xray-core/common"
+	xlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/serial"
+)
+
+// ParseLevel returns the severity of the log level of the config, the same as xray-core: debug, info, warning, error and none.
+// It defaults to warning.
+func ParseLevel(level string) xlog.Severity {
+	switch strings.ToLower(level) {
+	case "debug":
+		return xlog.Severity_Debug
+	case "info":
+		return xlog.Severity_Info
+	case "error":
+		return xlog.Severity_Error
+	case "none":
+		return xlog.Severity_Unknown
+	default:
+		return xlog.Severity_Warning
+	}
+}
+
+// NodeContent is the content of a log message of a node with a log level of its own
+type NodeContent struct {
+	Level     xlog.Severity
+	SessionID uint32 // The connection the message is about, 0 means none
+	Content   interface{}
+}
+
+// String implements fmt.Stringer, the same as the content written with the session of xray-core
+func (c *NodeContent) String() string {
+	if c.SessionID > 0 {
+		return fmt.Sprintf("[%d] %s", c.SessionID, serial.ToString(c.Content))
+	}
+	return serial.ToString(c.Content)
+}
+
+type levelFilter struct {
+	handler xlog.Handler
+	level   xlog.Severity
+}
+
+// NewLevelFilter returns a log handler that drops the general messages more verbose than the level,
+// or than the level of their node for the messages of the nodes. The other messages are passed through.
+func NewLevelFilter(handler xlog.Handler, level xlog.Severity) xlog.Handler {
+	return &levelFilter{
+		handler: handler,
+		level:   level,
+	}
+}
+
+func (f *levelFilter) Handle(msg xlog.Message) {
+	if msg, ok := msg.(*xlog.GeneralMessage); ok {
+		level := f.level
+		if content, ok := msg.Content.(*NodeContent); ok {
+			level = content.Level
+		}
+		if msg.Severity > level {
+			return
+		}
+	}
+	f.handler.Handle(msg)
+}
+
+func (f *levelFilter) Close() error {
+	return common.Close(f.handler)
+}
@@ -0,0 +1,137 @@
+// Package logger provides the log handlers used by the xray-core log app
+package logger
+
+import (
+	"log"
+	"os"
+
+	applog "github.com/xtls/xray-core/app/log"
+	"github.com/xtls/xray-core/common"
+	xlog "github.com/xtls/xray-core/common/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config is the output setting of the logs
+type Config struct {
+	Level      string // The level of the messages not of a node with a level of its own, the level of xray-core must be the most verbose one
+	Format     string // text, json
+	MaxSize    int    // Megabytes, 0 means no rotation
+	MaxAge     int    // Days
+	MaxBackups int
+}
+
+type fileLogWriter struct {
+	file   interface{ Close() error }
+	logger *log.Logger
+}
+
+func (w *fileLogWriter) Write(s string) error {
+	w.logger.Print(s)
+	return nil
+}
+
+func (w *fileLogWriter) Close() error {
+	return w.file.Close()
+}
+
+type consoleLogWriter struct {
+	logger *log.Logger
+}
+
+func (w *consoleLogWriter) Write(s string) error {
+	w.logger.Print(s)
+	return nil
+}
+
+func (w *consoleLogWriter) Close() error {
+	return nil
+}
+
+// CreateRotateLogWriter returns a WriterCreator that creates a size capped log writer for the given file.
+func CreateRotateLogWriter(path string, config *Config, flag int) xlog.WriterCreator {
+	file := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    config.MaxSize,
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+	}
+	return func() xlog.Writer {
+		return &fileLogWriter{
+			file:   file,
+			logger: log.New(file, "", flag),
+		}
+	}
+}
+
+func createFileLogWriter(path string, flag int) (xlog.WriterCreator, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return func() xlog.Writer {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return nil
+		}
+		return &fileLogWriter{
+			file:   file,
+			logger: log.New(file, "", flag),
+		}
+	}, nil
+}
+
+func createStdoutLogWriter(flag int) xlog.WriterCreator {
+	return func() xlog.Writer {
+		return &consoleLogWriter{
+			logger: log.New(os.Stdout, "", flag),
+		}
+	}
+}
+
+// RegisterHandlers replaces the console and file log handlers of xray-core with the given format and rotation,
+// filtered by the level of the config or of their node, and switches the standard logger to the same format. It must be called before the core instance is created.
+func RegisterHandlers(config *Config) {
+	jsonFormat := config.Format == FormatJSON
+	flag := log.Ldate | log.Ltime
+	if jsonFormat {
+		// The timestamp is a field of the JSON entry
+		flag = 0
+	}
+	level := ParseLevel(config.Level)
+	newHandler := func(creator xlog.WriterCreator) xlog.Handler {
+		if jsonFormat {
+			return NewLevelFilter(NewJSONLogger(creator), level)
+		}
+		return NewLevelFilter(xlog.NewLogger(creator), level)
+	}
+
+	common.Must(applog.RegisterHandlerCreator(applog.LogType_Console, func(lt applog.LogType, options applog.HandlerCreatorOptions) (xlog.Handler, error) {
+		return newHandler(createStdoutLogWriter(flag)), nil
+	}))
+
+	common.Must(applog.RegisterHandlerCreator(applog.LogType_File, func(lt applog.LogType, options applog.HandlerCreatorOptions) (xlog.Handler, error) {
+		if config.MaxSize > 0 {
+			return newHandler(CreateRotateLogWriter(options.Path, config, flag)), nil
+		}
+		creator, err := createFileLogWriter(options.Path, flag)
+		if err != nil {
+			return nil, err
+		}
+		return newHandler(creator), nil
+	}))
+
+	if jsonFormat {
+		log.SetFlags(0)
+		log.SetOutput(&jsonWriter{writer: os.Stderr})
+	} else {
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}
+}
@@ -0,0 +1,123 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/logger"
+	xlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+)
+
+func TestRotateLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xrayr-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	creator := logger.CreateRotateLogWriter(path, &logger.Config{MaxSize: 1, MaxBackups: 3}, log.LstdFlags)
+	writer := creator()
+	defer writer.Close()
+
+	line := strings.Repeat("a", 1023) + "\n"
+	// Write a little more than 1 MB
+	for i := 0; i < 1100; i++ {
+		if err := writer.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "access-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("want 1 rotated file, but got %d", len(files))
+	}
+}
+
+func TestJSONAccessMessage(t *testing.T) {
+	msg := &logger.JSONMessage{
+		Message: &xlog.AccessMessage{
+			From:   net.TCPDestination(net.ParseAddress("1.2.3.4"), 5678),
+			To:     net.TCPDestination(net.ParseAddress("www.google.com"), 443),
+			Status: xlog.AccessAccepted,
+			Email:  "test@test.com",
+			Detour: "V2ray_1145 -> V2ray_1145",
+		},
+		Time: time.Now(),
+	}
+	entry := make(map[string]string)
+	if err := json.Unmarshal([]byte(msg.String()), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"level":       "access",
+		"email":       "test@test.com",
+		"source":      "tcp:1.2.3.4:5678",
+		"destination": "tcp:www.google.com:443",
+		"status":      "accepted",
+		"detour":      "V2ray_1145 -> V2ray_1145",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("unexpected %s. want %s, but got %s", k, v, entry[k])
+		}
+	}
+	if entry["time"] == "" {
+		t.Error("time should not be empty")
+	}
+}
+
+func TestJSONAccessMessageSNI(t *testing.T) {
+	msg := &logger.JSONMessage{
+		Message: &xlog.AccessMessage{
+			From:   net.TCPDestination(net.ParseAddress("1.2.3.4"), 5678),
+			To:     net.TCPDestination(net.ParseAddress("www.google.com"), 443),
+			Status: xlog.AccessAccepted,
+			Reason: "sni: www.google.com",
+		},
+		Time: time.Now(),
+	}
+	entry := make(map[string]string)
+	if err := json.Unmarshal([]byte(msg.String()), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["sni"] != "www.google.com" || entry["reason"] != "" {
+		t.Errorf("the server name should be a field of its own, got %v", entry)
+	}
+}
+
+type captureHandler struct {
+	messages []string
+}
+
+func (h *captureHandler) Handle(msg xlog.Message) {
+	h.messages = append(h.messages, msg.String())
+}
+
+func TestLevelFilter(t *testing.T) {
+	capture := &captureHandler{}
+	handler := logger.NewLevelFilter(capture, logger.ParseLevel("warning"))
+	for _, msg := range []xlog.Message{
+		&xlog.GeneralMessage{Severity: xlog.Severity_Debug, Content: "global debug"},
+		&xlog.GeneralMessage{Severity: xlog.Severity_Warning, Content: "global warning"},
+		// The node at debug emits the messages the node at warning suppresses
+		&xlog.GeneralMessage{Severity: xlog.Severity_Debug, Content: &logger.NodeContent{Level: logger.ParseLevel("debug"), SessionID: 42, Content: "debug node"}},
+		&xlog.GeneralMessage{Severity: xlog.Severity_Debug, Content: &logger.NodeContent{Level: logger.ParseLevel("warning"), Content: "warning node"}},
+		&xlog.GeneralMessage{Severity: xlog.Severity_Error, Content: &logger.NodeContent{Level: logger.ParseLevel("none"), Content: "silent node"}},
+		&xlog.AccessMessage{From: "1.1.1.1", To: "example.com", Status: xlog.AccessAccepted},
+	} {
+		handler.Handle(msg)
+	}
+	want := []string{"[Warning] global warning", "[Debug] [42] debug node"}
+	if len(capture.messages) != 3 || capture.messages[0] != want[0] || capture.messages[1] != want[1] || !strings.Contains(capture.messages[2], "accepted") {
+		t.Errorf("unexpected messages: %q", capture.messages)
+	}
+}
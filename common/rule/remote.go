@@ -0,0 +1,145 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// RemoteConfig is the rule lists fetched from the remote URLs, they are merged with the rules of the panel
+type RemoteConfig struct {
+	URLs     []string `mapstructure:"URLs"`
+	Interval int      `mapstructure:"Interval"` // Seconds between the fetches, default 3600
+	Timeout  int      `mapstructure:"Timeout"`  // Seconds of one fetch, default 30
+}
+
+// FetchInterval returns the time between the fetches of the config
+func (c *RemoteConfig) FetchInterval() time.Duration {
+	if c.Interval <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// remoteRuleID is the ID of the rules of the remote lists, their hits are not reported to the panel
+const remoteRuleID = -2
+
+// RemoteFetcher fetches the remote rule lists, each list keeps its last good rules when a fetch fails
+type RemoteFetcher struct {
+	client *http.Client
+	access sync.Mutex
+	lists  []*remoteList
+}
+
+// remoteList is a rule list at a URL, it is only downloaded again when the server says it changed
+type remoteList struct {
+	url          string
+	etag         string
+	lastModified string
+	rules        []api.DetectRule
+}
+
+func NewRemoteFetcher(config *RemoteConfig) (*RemoteFetcher, error) {
+	if len(config.URLs) == 0 {
+		return nil, fmt.Errorf("Remote rule lists require URLs")
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 30
+	}
+	f := &RemoteFetcher{client: &http.Client{Timeout: time.Duration(timeout) * time.Second}}
+	for _, url := range config.URLs {
+		f.lists = append(f.lists, &remoteList{url: url})
+	}
+	return f, nil
+}
+
+// Fetch fetches the changed lists and returns the rules of all the lists. The failed lists are logged, and
+// their last good rules are returned instead, so a failure never empties the rules.
+func (f *RemoteFetcher) Fetch() []api.DetectRule {
+	f.access.Lock()
+	defer f.access.Unlock()
+	var rules []api.DetectRule
+	for _, list := range f.lists {
+		if err := list.fetch(f.client); err != nil {
+			newError(fmt.Sprintf("Fetch rule list %s failed, keep the last %d rules: %s", list.url, len(list.rules), err)).AtWarning().WriteToLog()
+		}
+		rules = append(rules, list.rules...)
+	}
+	return rules
+}
+
+func (l *remoteList) fetch(client *http.Client) error {
+	req, err := http.NewRequest(http.MethodGet, l.url, nil)
+	if err != nil {
+		return err
+	}
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	if l.lastModified != "" {
+		req.Header.Set("If-Modified-Since", l.lastModified)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	rules := ParseRuleList(data)
+	// An empty list is more likely a broken publish than the wish to drop all the rules
+	if len(rules) == 0 {
+		return fmt.Errorf("no rule found")
+	}
+	l.rules = rules
+	l.etag, l.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return nil
+}
+
+// ParseRuleList parses a rule list of one pattern a line, the empty lines and the lines starting with # are skipped.
+// A pattern is a regular expression, a CIDR or a port: rule as the rules of the panel, or a domain with the
+// domain: or full: prefix. The invalid patterns are skipped.
+func ParseRuleList(data []byte) []api.DetectRule {
+	var rules []api.DetectRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := line
+		switch {
+		case strings.HasPrefix(line, "domain:"):
+			pattern = `[:.]` + regexp.QuoteMeta(line[len("domain:"):]) + `:[0-9]+$`
+		case strings.HasPrefix(line, "full:"):
+			pattern = `^(tcp|udp):` + regexp.QuoteMeta(line[len("full:"):]) + `:[0-9]+$`
+		case strings.HasPrefix(line, "regexp:"):
+			pattern = line[len("regexp:"):]
+		}
+		if !strings.HasPrefix(pattern, portRulePrefix) {
+			if _, err := regexp.Compile(pattern); err != nil {
+				newError(fmt.Sprintf("Skip the invalid rule %s: %s", line, err)).AtWarning().WriteToLog()
+				continue
+			}
+		}
+		rules = append(rules, api.DetectRule{ID: remoteRuleID, Pattern: pattern})
+	}
+	return rules
+}
@@ -0,0 +1,134 @@
+package rule_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/rule"
+)
+
+func TestParseRuleList(t *testing.T) {
+	rules := rule.ParseRuleList([]byte(`# community blocklist
+domain:blocked.com
+full:exact.example.com
+
+regexp:^tcp:.*\.torrent:
+10.0.0.0/8
+port:25,465
+invalid(
+`))
+	if len(rules) != 5 {
+		t.Fatalf("expected 5 rules, got %v", rules)
+	}
+	r := rule.New()
+	r.UpdateRemoteRule("V2ray_1145", rules)
+	testCases := map[string]bool{
+		"tcp:blocked.com:443":           true,
+		"tcp:www.blocked.com:443":       true,
+		"tcp:notblocked.com:443":        false,
+		"udp:exact.example.com:443":     true,
+		"tcp:www.exact.example.com:443": false,
+		"tcp:linux.torrent:80":          true,
+		"tcp:10.1.2.3:80":               true,
+		"tcp:1.1.1.1:465":               true,
+		"tcp:1.1.1.1:443":               false,
+	}
+	for destination, want := range testCases {
+		if reject := r.Detect("V2ray_1145", destination, "1|a@test.com|1"); reject != want {
+			t.Errorf("%s: want reject %v, but got %v", destination, want, reject)
+		}
+	}
+	// The hits of the remote lists are not reported to the panel
+	if detectResult, _ := r.GetDetectResult("V2ray_1145"); len(*detectResult) != 0 {
+		t.Errorf("the remote rules should not be recorded, got %v", *detectResult)
+	}
+}
+
+func TestRemoteFetcher(t *testing.T) {
+	var access sync.Mutex
+	status, requests := http.StatusOK, 0
+	var ifNoneMatch string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access.Lock()
+		defer access.Unlock()
+		requests++
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		if ifNoneMatch == `"v1"` && status == http.StatusOK {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("domain:blocked.com\ndomain:ads.example.com\n"))
+	}))
+	defer server.Close()
+	fetcher, err := rule.NewRemoteFetcher(&rule.RemoteConfig{URLs: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := fetcher.Fetch(); len(rules) != 2 {
+		t.Fatalf("expected the 2 rules of the list, got %v", rules)
+	}
+	// The unchanged list is not downloaded again
+	if rules := fetcher.Fetch(); len(rules) != 2 || ifNoneMatch != `"v1"` {
+		t.Errorf("the 304 should keep the rules, got %v with If-None-Match %s", rules, ifNoneMatch)
+	}
+	// A failed fetch keeps the last good rules
+	access.Lock()
+	status = http.StatusInternalServerError
+	access.Unlock()
+	if rules := fetcher.Fetch(); len(rules) != 2 {
+		t.Errorf("the failed fetch should keep the rules, got %v", rules)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestRemoteFetcherEmptyList(t *testing.T) {
+	body := "domain:blocked.com\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	fetcher, err := rule.NewRemoteFetcher(&rule.RemoteConfig{URLs: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher.Fetch()
+	body = "# nothing\n"
+	if rules := fetcher.Fetch(); len(rules) != 1 {
+		t.Errorf("an empty list should not empty the rules, got %v", rules)
+	}
+}
+
+func TestUpdateRemoteRuleMerge(t *testing.T) {
+	r := rule.New()
+	r.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 7, Pattern: "panel.com"}})
+	r.UpdateRemoteRule("V2ray_1145", rule.ParseRuleList([]byte("domain:remote.com")))
+	for _, destination := range []string{"tcp:panel.com:443", "tcp:remote.com:443"} {
+		if !r.Detect("V2ray_1145", destination, "1|a@test.com|1") {
+			t.Errorf("%s should be rejected by the merged rules", destination)
+		}
+	}
+	detectResult, _ := r.GetDetectResult("V2ray_1145")
+	if len(*detectResult) != 1 || (*detectResult)[0] != (api.DetectResult{UID: 1, RuleID: 7}) {
+		t.Errorf("only the panel rule should be recorded, got %v", *detectResult)
+	}
+	// The panel update keeps the remote rules, and the other way around
+	r.UpdateRule("V2ray_1145", nil)
+	if !r.Detect("V2ray_1145", "tcp:remote.com:443", "1|a@test.com|1") || r.Detect("V2ray_1145", "tcp:panel.com:443", "1|a@test.com|1") {
+		t.Error("the remote rules should be kept by the panel update")
+	}
+	r.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 7, Pattern: "panel.com"}})
+	r.UpdateRemoteRule("V2ray_1145", nil)
+	if r.Detect("V2ray_1145", "tcp:remote.com:443", "1|a@test.com|1") || !r.Detect("V2ray_1145", "tcp:panel.com:443", "1|a@test.com|1") {
+		t.Error("the panel rules should be kept by the remote update")
+	}
+}
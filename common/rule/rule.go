@@ -3,38 +3,228 @@ package rule
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/geodata"
 	mapset "github.com/deckarep/golang-set"
 )
 
 type RuleManager struct {
-	InboundRule         *sync.Map // Key: Tag, Value: []api.DetectRule
-	InboundDetectResult *sync.Map // key: Tag, Value: mapset.NewSet []api.DetectResult
+	InboundRule         *sync.Map        // Key: Tag, Value: []api.DetectRule, the rules of the panel and the remote lists
+	InboundPanelRule    *sync.Map        // Key: Tag, Value: []api.DetectRule, the rules of the panel
+	InboundRemoteRule   *sync.Map        // Key: Tag, Value: []api.DetectRule, the rules of the remote lists
+	InboundDetectResult *sync.Map        // key: Tag, Value: mapset.NewSet []api.DetectResult
+	InboundProtocolRule *sync.Map        // Key: Tag, Value: []string, the blocked sniffed protocols
+	InboundRegexRule    *sync.Map        // Key: Tag, Value: []regexRule, the compiled patterns of the rules but the port rules
+	InboundCIDRRule     *sync.Map        // Key: Tag, Value: []cidrRule, the rules with a CIDR pattern
+	InboundPortRule     *sync.Map        // Key: Tag, Value: []portRule, the rules with a port: pattern
+	InboundRuleSchedule *sync.Map        // Key: Tag, Value: map[int]*ruleSchedule, the time windows of the rules by ID
+	GeoData             *geodata.GeoData // The geoip and geosite lookups shared with the dispatcher if set
+	Now                 func() time.Time // Clock of the rule schedules, can be replaced in tests
+	access              sync.Mutex       // Serializes the merges of the panel and remote rules
 }
 
+// regexRule is a detect rule whose pattern is compiled as a regular expression, it matches the destination
+type regexRule struct {
+	ID     int
+	Regexp *regexp.Regexp
+}
+
+// cidrRule is a detect rule whose pattern is an IPv4 or IPv6 CIDR, it matches the destination IP in the range
+type cidrRule struct {
+	ID    int
+	IPNet *net.IPNet
+}
+
+// portRule is a detect rule whose pattern is port: followed by ports and port ranges, e.g. port:25,465,6881-6889.
+// It matches the destination port in the ranges.
+type portRule struct {
+	ID     int
+	Ranges [][2]uint16
+}
+
+// portRulePrefix is the prefix of the port rule patterns, which are not regular expressions
+const portRulePrefix = "port:"
+
 func New() *RuleManager {
 	return &RuleManager{
 		InboundRule:         new(sync.Map),
+		InboundPanelRule:    new(sync.Map),
+		InboundRemoteRule:   new(sync.Map),
 		InboundDetectResult: new(sync.Map),
+		InboundProtocolRule: new(sync.Map),
+		InboundRegexRule:    new(sync.Map),
+		InboundCIDRRule:     new(sync.Map),
+		InboundPortRule:     new(sync.Map),
+		InboundRuleSchedule: new(sync.Map),
+		Now:                 time.Now,
 	}
 }
 
 func (r *RuleManager) UpdateRule(tag string, newRuleList []api.DetectRule) error {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.InboundPanelRule.Store(tag, newRuleList)
+	return r.mergeRule(tag)
+}
+
+// UpdateRemoteRule sets the rules of the remote lists of the inbound, an empty list removes them
+func (r *RuleManager) UpdateRemoteRule(tag string, ruleList []api.DetectRule) error {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if len(ruleList) == 0 {
+		if _, ok := r.InboundRemoteRule.LoadAndDelete(tag); !ok {
+			return nil
+		}
+	} else {
+		r.InboundRemoteRule.Store(tag, ruleList)
+	}
+	return r.mergeRule(tag)
+}
+
+// DeleteRule removes all the rules and the detect results of the inbound, the other inbounds keep theirs
+func (r *RuleManager) DeleteRule(tag string) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	for _, m := range []*sync.Map{
+		r.InboundRule,
+		r.InboundPanelRule,
+		r.InboundRemoteRule,
+		r.InboundDetectResult,
+		r.InboundProtocolRule,
+		r.InboundRegexRule,
+		r.InboundCIDRRule,
+		r.InboundPortRule,
+		r.InboundRuleSchedule,
+	} {
+		m.Delete(tag)
+	}
+}
+
+// mergeRule compiles the rules of the panel and the remote lists of the inbound, the rules of the panel go first
+func (r *RuleManager) mergeRule(tag string) error {
+	var newRuleList []api.DetectRule
+	if value, ok := r.InboundPanelRule.Load(tag); ok {
+		newRuleList = value.([]api.DetectRule)
+	}
+	if value, ok := r.InboundRemoteRule.Load(tag); ok {
+		newRuleList = append(append([]api.DetectRule(nil), newRuleList...), value.([]api.DetectRule)...)
+	}
 	if value, ok := r.InboundRule.LoadOrStore(tag, newRuleList); ok {
 		oldRuleList := value.([]api.DetectRule)
-		if !reflect.DeepEqual(oldRuleList, newRuleList) {
-			r.InboundRule.Store(tag, newRuleList)
+		if reflect.DeepEqual(oldRuleList, newRuleList) {
+			return nil
+		}
+		r.InboundRule.Store(tag, newRuleList)
+	}
+	// Compile the patterns once, instead of on each connection
+	var regexRules []regexRule
+	for _, rule := range newRuleList {
+		if strings.HasPrefix(rule.Pattern, portRulePrefix) {
+			continue
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			newError(fmt.Sprintf("Skip rule %d: %s", rule.ID, err)).AtWarning().WriteToLog()
+			continue
 		}
+		regexRules = append(regexRules, regexRule{ID: rule.ID, Regexp: re})
+	}
+	if len(regexRules) > 0 {
+		r.InboundRegexRule.Store(tag, regexRules)
+	} else {
+		r.InboundRegexRule.Delete(tag)
+	}
+	var cidrRules []cidrRule
+	for _, rule := range newRuleList {
+		if _, ipNet, err := net.ParseCIDR(rule.Pattern); err == nil {
+			cidrRules = append(cidrRules, cidrRule{ID: rule.ID, IPNet: ipNet})
+		}
+	}
+	if len(cidrRules) > 0 {
+		r.InboundCIDRRule.Store(tag, cidrRules)
+	} else {
+		r.InboundCIDRRule.Delete(tag)
+	}
+	var portRules []portRule
+	for _, rule := range newRuleList {
+		if !strings.HasPrefix(rule.Pattern, portRulePrefix) {
+			continue
+		}
+		ranges, err := parsePortRanges(rule.Pattern[len(portRulePrefix):])
+		if err != nil {
+			newError(fmt.Sprintf("Skip rule %d: %s", rule.ID, err)).AtWarning().WriteToLog()
+			continue
+		}
+		portRules = append(portRules, portRule{ID: rule.ID, Ranges: ranges})
+	}
+	if len(portRules) > 0 {
+		r.InboundPortRule.Store(tag, portRules)
+	} else {
+		r.InboundPortRule.Delete(tag)
+	}
+	schedules := make(map[int]*ruleSchedule)
+	for _, rule := range newRuleList {
+		if rule.Schedule == nil {
+			continue
+		}
+		schedule, err := compileSchedule(rule.Schedule)
+		if err != nil {
+			newError(fmt.Sprintf("Rule %d is inert for its invalid schedule: %s", rule.ID, err)).AtWarning().WriteToLog()
+			schedule = &ruleSchedule{}
+		}
+		schedules[rule.ID] = schedule
+	}
+	if len(schedules) > 0 {
+		r.InboundRuleSchedule.Store(tag, schedules)
+	} else {
+		r.InboundRuleSchedule.Delete(tag)
 	}
 	return nil
 }
 
+// parsePortRanges parses the comma separated ports and port ranges like 25,6881-6889
+func parsePortRanges(ports string) ([][2]uint16, error) {
+	var ranges [][2]uint16
+	for _, item := range strings.Split(ports, ",") {
+		item = strings.TrimSpace(item)
+		bounds := strings.SplitN(item, "-", 2)
+		from, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", item)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.ParseUint(bounds[1], 10, 16); err != nil || to < from {
+				return nil, fmt.Errorf("invalid port range %s", item)
+			}
+		}
+		ranges = append(ranges, [2]uint16{uint16(from), uint16(to)})
+	}
+	return ranges, nil
+}
+
+// UpdateProtocolRule sets the blocked sniffed protocols of the inbound, an empty list removes them
+func (r *RuleManager) UpdateProtocolRule(tag string, protocols []string) error {
+	if len(protocols) == 0 {
+		r.InboundProtocolRule.Delete(tag)
+		return nil
+	}
+	blocked := make([]string, len(protocols))
+	for i, protocol := range protocols {
+		blocked[i] = strings.ToLower(protocol)
+	}
+	r.InboundProtocolRule.Store(tag, blocked)
+	return nil
+}
+
 func (r *RuleManager) GetDetectResult(tag string) (*[]api.DetectResult, error) {
 	detectResult := make([]api.DetectResult, 0)
 	if value, ok := r.InboundDetectResult.LoadAndDelete(tag); ok {
@@ -51,42 +241,137 @@ func (r *RuleManager) Detect(tag string, destination string, email string) (reje
 	reject = false
 	var hitRuleID int = -1
 	// If we have some rule for this inbound
-	if value, ok := r.InboundRule.Load(tag); ok {
-		ruleList := value.([]api.DetectRule)
-		for _, r := range ruleList {
-			if matchRule(r.Pattern, destination) {
-				hitRuleID = r.ID
-				reject = true
-				break
+	if _, ok := r.InboundRule.Load(tag); ok {
+		// The rules out of their time window are skipped
+		var schedules map[int]*ruleSchedule
+		if v, ok := r.InboundRuleSchedule.Load(tag); ok {
+			schedules = v.(map[int]*ruleSchedule)
+		}
+		if v, ok := r.InboundRegexRule.Load(tag); ok {
+			for _, rule := range v.([]regexRule) {
+				if rule.Regexp.MatchString(destination) && r.ruleActive(schedules, rule.ID) {
+					hitRuleID = rule.ID
+					reject = true
+					break
+				}
 			}
 		}
-		// If we hit some rule
-		if reject && hitRuleID != -1 {
-			l := strings.Split(email, "|")
-			uid, err := strconv.Atoi(l[len(l)-1])
-			if err != nil {
-				newError(fmt.Sprintf("Record illegal behavior failed! Cannot find user's uid: %s", email)).AtDebug().WriteToLog()
-				return reject
+		// The CIDR rules only match the destinations of raw IP
+		if v, ok := r.InboundCIDRRule.Load(tag); ok && !reject {
+			if ip := destinationIP(destination); ip != nil {
+				for _, rule := range v.([]cidrRule) {
+					if rule.IPNet.Contains(ip) && r.ruleActive(schedules, rule.ID) {
+						hitRuleID = rule.ID
+						reject = true
+						break
+					}
+				}
 			}
-			newSet := mapset.NewSetWith(api.DetectResult{UID: uid, RuleID: hitRuleID})
-			// If there are any hit history
-			if v, ok := r.InboundDetectResult.LoadOrStore(tag, newSet); ok {
-				resultSet := v.(mapset.Set)
-				// If this is a new record
-				if resultSet.Add(api.DetectResult{UID: uid, RuleID: hitRuleID}) {
-					r.InboundDetectResult.Store(tag, resultSet)
+		}
+		// The port rules match the port of any destination, together with the rules above
+		if v, ok := r.InboundPortRule.Load(tag); ok && !reject {
+			if port, ok := destinationPort(destination); ok {
+				for _, rule := range v.([]portRule) {
+					if rule.match(port) && r.ruleActive(schedules, rule.ID) {
+						newError(fmt.Sprintf("User %s access port %d of %s reject by port rule %d", email, port, destination, rule.ID)).AtWarning().WriteToLog()
+						hitRuleID = rule.ID
+						reject = true
+						break
+					}
 				}
 			}
 		}
+		// If we hit some rule
+		if reject && hitRuleID != -1 {
+			r.recordDetectResult(tag, email, hitRuleID)
+		}
+	}
+	return reject
+}
+
+// DetectProtocol checks whether the sniffed protocol is blocked on the inbound.
+// The block is recorded as a detect result if a rule of the panel matches the protocol name.
+func (r *RuleManager) DetectProtocol(tag string, protocol string, email string) (reject bool) {
+	value, ok := r.InboundProtocolRule.Load(tag)
+	if !ok {
+		return false
+	}
+	protocol = strings.ToLower(protocol)
+	for _, blocked := range value.([]string) {
+		if protocol == blocked {
+			reject = true
+			break
+		}
+	}
+	if !reject {
+		return false
+	}
+	if value, ok := r.InboundRegexRule.Load(tag); ok {
+		for _, rule := range value.([]regexRule) {
+			if rule.Regexp.MatchString(protocol) {
+				r.recordDetectResult(tag, email, rule.ID)
+				break
+			}
+		}
 	}
 	return reject
 }
 
-func matchRule(rule string, destination string) (hit bool) {
-	hit = false
-	// Check Regex
-	if regexp.MustCompile(rule).Match([]byte(destination)) {
-		return true
+func (r *RuleManager) recordDetectResult(tag string, email string, ruleID int) {
+	if ruleID == remoteRuleID {
+		return
+	}
+	l := strings.Split(email, "|")
+	uid, err := strconv.Atoi(l[len(l)-1])
+	if err != nil {
+		newError(fmt.Sprintf("Record illegal behavior failed! Cannot find user's uid: %s", email)).AtDebug().WriteToLog()
+		return
+	}
+	newSet := mapset.NewSetWith(api.DetectResult{UID: uid, RuleID: ruleID})
+	// If there are any hit history
+	if v, ok := r.InboundDetectResult.LoadOrStore(tag, newSet); ok {
+		resultSet := v.(mapset.Set)
+		// If this is a new record
+		if resultSet.Add(api.DetectResult{UID: uid, RuleID: ruleID}) {
+			r.InboundDetectResult.Store(tag, resultSet)
+		}
+	}
+}
+
+func (r *portRule) match(port uint16) bool {
+	for _, portRange := range r.Ranges {
+		if port >= portRange[0] && port <= portRange[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// splitDestination splits the destination like tcp:1.1.1.1:443 or udp:[2001:db8::1]:53 into the host and port,
+// the port is empty if the destination has none
+func splitDestination(destination string) (host string, port string) {
+	if i := strings.Index(destination, ":"); i >= 0 && (destination[:i] == "tcp" || destination[:i] == "udp") {
+		destination = destination[i+1:]
+	}
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return destination, ""
+	}
+	return host, port
+}
+
+// destinationIP returns the IP of the destination, nil if it is a domain
+func destinationIP(destination string) net.IP {
+	host, _ := splitDestination(destination)
+	return net.ParseIP(host)
+}
+
+// destinationPort returns the port of the destination
+func destinationPort(destination string) (uint16, bool) {
+	_, port := splitDestination(destination)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, false
 	}
-	return hit
+	return uint16(p), true
 }
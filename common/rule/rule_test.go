@@ -0,0 +1,204 @@
+package rule_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/rule"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	r := rule.New()
+	r.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 7, Pattern: "bittorrent"}})
+	r.UpdateProtocolRule("V2ray_1145", []string{"BitTorrent"})
+	if !r.DetectProtocol("V2ray_1145", "bittorrent", "1|a@test.com|1") {
+		t.Fatal("bittorrent should be blocked")
+	}
+	if r.DetectProtocol("V2ray_1145", "tls", "1|a@test.com|1") {
+		t.Error("tls should not be blocked")
+	}
+	detectResult, _ := r.GetDetectResult("V2ray_1145")
+	if len(*detectResult) != 1 || (*detectResult)[0] != (api.DetectResult{UID: 1, RuleID: 7}) {
+		t.Errorf("the block should be recorded with the matched rule, got %v", *detectResult)
+	}
+}
+
+func TestDetectProtocolWithoutRule(t *testing.T) {
+	r := rule.New()
+	r.UpdateProtocolRule("V2ray_1145", []string{"bittorrent"})
+	if !r.DetectProtocol("V2ray_1145", "bittorrent", "1|a@test.com|1") {
+		t.Fatal("bittorrent should be blocked")
+	}
+	detectResult, _ := r.GetDetectResult("V2ray_1145")
+	if len(*detectResult) != 0 {
+		t.Errorf("no result should be recorded without a matched rule, got %v", *detectResult)
+	}
+	r.UpdateProtocolRule("V2ray_1145", nil)
+	if r.DetectProtocol("V2ray_1145", "bittorrent", "1|a@test.com|1") {
+		t.Error("bittorrent should not be blocked after the rule is removed")
+	}
+}
+
+func TestDetectCIDR(t *testing.T) {
+	r := rule.New()
+	r.UpdateRule("V2ray_1145", []api.DetectRule{
+		{ID: 1, Pattern: "(.*.|)example.com"},
+		{ID: 2, Pattern: "192.0.2.0/24"},
+		{ID: 3, Pattern: "2001:db8::/32"},
+	})
+	cases := map[string]bool{
+		"tcp:192.0.2.10:443":          true,
+		"udp:[2001:db8::1]:53":        true,
+		"tcp:198.51.100.1:443":        false,
+		"tcp:[2001:db9::1]:443":       false,
+		"tcp:www.example.com:443":     true,
+		"tcp:192.0.2.10.nip.io:443":   false,
+		"tcp:www.example.org:443":     false,
+		"tcp:[::ffff:192.0.2.10]:443": true,
+	}
+	for destination, want := range cases {
+		if got := r.Detect("V2ray_1145", destination, "1|a@test.com|1"); got != want {
+			t.Errorf("unexpected detect of %s. want %v, but got %v", destination, want, got)
+		}
+	}
+	detectResult, _ := r.GetDetectResult("V2ray_1145")
+	hitRules := make(map[int]bool)
+	for _, result := range *detectResult {
+		hitRules[result.RuleID] = true
+	}
+	if !hitRules[2] || !hitRules[3] {
+		t.Errorf("the CIDR rules should be recorded, got %v", *detectResult)
+	}
+
+	// The CIDR rules are replaced with the rule list
+	r.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 1, Pattern: "(.*.|)example.com"}})
+	if r.Detect("V2ray_1145", "tcp:192.0.2.10:443", "1|a@test.com|1") {
+		t.Error("the removed CIDR rule should not block")
+	}
+}
+
+func TestDetectPort(t *testing.T) {
+	r := rule.New()
+	r.UpdateRule("V2ray_1145", []api.DetectRule{
+		{ID: 1, Pattern: "(.*.|)example.com"},
+		{ID: 2, Pattern: "port:25,465"},
+		{ID: 3, Pattern: "port:6881-6889"},
+		{ID: 4, Pattern: "port:abc"},
+	})
+	cases := map[string]bool{
+		"tcp:smtp.gmail.com:25":   true,
+		"tcp:192.0.2.10:465":      true,
+		"udp:[2001:db8::1]:6885":  true,
+		"tcp:smtp.gmail.com:587":  false,
+		"tcp:192.0.2.10:6890":     false,
+		"tcp:www.example.com:443": true,
+		"tcp:www.example.org:443": false,
+	}
+	for destination, want := range cases {
+		if got := r.Detect("V2ray_1145", destination, "1|a@test.com|1"); got != want {
+			t.Errorf("unexpected detect of %s. want %v, but got %v", destination, want, got)
+		}
+	}
+	detectResult, _ := r.GetDetectResult("V2ray_1145")
+	hitRules := make(map[int]bool)
+	for _, result := range *detectResult {
+		hitRules[result.RuleID] = true
+	}
+	if !hitRules[1] || !hitRules[2] || !hitRules[3] || hitRules[4] {
+		t.Errorf("the domain and port rules should be recorded, got %v", *detectResult)
+	}
+}
+
+func TestDetectSchedule(t *testing.T) {
+	r := rule.New()
+	r.UpdateRule("V2ray_1145", []api.DetectRule{
+		// School hours in Tokyo on the weekdays
+		{ID: 1, Pattern: "(.*.|)game.com", Schedule: &api.RuleSchedule{Days: []int{1, 2, 3, 4, 5}, Start: "08:00", End: "15:00", Timezone: "Asia/Tokyo"}},
+		// Friday night past midnight
+		{ID: 2, Pattern: "port:6881", Schedule: &api.RuleSchedule{Days: []int{5}, Start: "22:00", End: "06:00", Timezone: "UTC"}},
+		{ID: 3, Pattern: "(.*.|)video.com", Schedule: &api.RuleSchedule{Start: "8am", End: "5pm"}},
+		{ID: 4, Pattern: "(.*.|)example.com"},
+	})
+	cases := []struct {
+		now         time.Time
+		destination string
+		want        bool
+	}{
+		// Monday 10:00 and 16:00 in Tokyo
+		{time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC), "tcp:www.game.com:443", true},
+		{time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), "tcp:www.game.com:443", false},
+		// Saturday 10:00 in Tokyo
+		{time.Date(2026, 10, 24, 1, 0, 0, 0, time.UTC), "tcp:www.game.com:443", false},
+		// Sunday 23:00 in UTC is Monday 08:00 in Tokyo
+		{time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC), "tcp:www.game.com:443", true},
+		{time.Date(2026, 10, 23, 23, 0, 0, 0, time.UTC), "tcp:1.1.1.1:6881", true},
+		{time.Date(2026, 10, 24, 5, 59, 0, 0, time.UTC), "tcp:1.1.1.1:6881", true},
+		{time.Date(2026, 10, 24, 6, 0, 0, 0, time.UTC), "tcp:1.1.1.1:6881", false},
+		{time.Date(2026, 10, 24, 23, 0, 0, 0, time.UTC), "tcp:1.1.1.1:6881", false},
+		{time.Date(2026, 10, 23, 1, 0, 0, 0, time.UTC), "tcp:1.1.1.1:6881", false},
+		// The rule with an invalid schedule is inert, and the one without a schedule is always active
+		{time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC), "tcp:www.video.com:443", false},
+		{time.Date(2026, 10, 24, 1, 0, 0, 0, time.UTC), "tcp:www.example.com:443", true},
+	}
+	for _, c := range cases {
+		r.Now = func() time.Time { return c.now }
+		if got := r.Detect("V2ray_1145", c.destination, "1|a@test.com|1"); got != c.want {
+			t.Errorf("unexpected detect of %s at %s. want %v, but got %v", c.destination, c.now, c.want, got)
+		}
+	}
+}
+
+func TestDetectInvalidPattern(t *testing.T) {
+	r := rule.New()
+	r.UpdateRule("V2ray_1145", []api.DetectRule{{ID: 1, Pattern: "(example"}, {ID: 2, Pattern: "(.*.|)example.com"}})
+	// The invalid pattern is skipped, the other rules still match
+	if !r.Detect("V2ray_1145", "tcp:www.example.com:443", "1|a@test.com|1") {
+		t.Error("the valid rule should still reject the destination")
+	}
+	if r.Detect("V2ray_1145", "tcp:(example.org:443", "1|a@test.com|1") {
+		t.Error("the invalid pattern should not match")
+	}
+}
+
+func BenchmarkDetectRemoteRules(b *testing.B) {
+	r := rule.New()
+	var data []byte
+	for i := 0; i < 5000; i++ {
+		data = append(data, fmt.Sprintf("domain:blocked%d.example.com\n", i)...)
+	}
+	r.UpdateRemoteRule("V2ray_1145", rule.ParseRuleList(data))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Detect("V2ray_1145", "tcp:www.example.org:443", "1|a@test.com|1")
+	}
+}
+
+func TestDeleteRule(t *testing.T) {
+	r := rule.New()
+	for _, tag := range []string{"V2ray_1145", "Trojan_2233"} {
+		r.UpdateRule(tag, []api.DetectRule{{ID: 1, Pattern: "(.*.|)example.com"}, {ID: 2, Pattern: "192.0.2.0/24"}, {ID: 3, Pattern: "port:25"}})
+		r.UpdateRemoteRule(tag, []api.DetectRule{{ID: 4, Pattern: "(.*.|)example.org"}})
+		r.UpdateProtocolRule(tag, []string{"bittorrent"})
+		r.Detect(tag, "tcp:www.example.com:443", "1|a@test.com|1")
+	}
+	r.DeleteRule("V2ray_1145")
+	for _, destination := range []string{"tcp:www.example.com:443", "tcp:192.0.2.1:443", "tcp:mail.test.com:25", "tcp:www.example.org:443"} {
+		if r.Detect("V2ray_1145", destination, "1|a@test.com|1") {
+			t.Errorf("%s should not be rejected on the deleted inbound", destination)
+		}
+		if !r.Detect("Trojan_2233", destination, "1|a@test.com|1") {
+			t.Errorf("%s should still be rejected on the other inbound", destination)
+		}
+	}
+	if r.DetectProtocol("V2ray_1145", "bittorrent", "1|a@test.com|1") || !r.DetectProtocol("Trojan_2233", "bittorrent", "1|a@test.com|1") {
+		t.Error("only the protocol rule of the deleted inbound should be removed")
+	}
+	if detectResult, _ := r.GetDetectResult("V2ray_1145"); len(*detectResult) != 0 {
+		t.Errorf("the detect results of the deleted inbound should be removed, got %v", *detectResult)
+	}
+	if detectResult, _ := r.GetDetectResult("Trojan_2233"); len(*detectResult) == 0 {
+		t.Error("the detect results of the other inbound should be kept")
+	}
+}
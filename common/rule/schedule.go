@@ -0,0 +1,83 @@
+package rule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// everyDay is the day mask of a schedule without days
+const everyDay = 1<<7 - 1
+
+// ruleSchedule is the compiled time window of a rule, a schedule without days is never active,
+// which keeps a rule with an invalid schedule inert
+type ruleSchedule struct {
+	days     uint8 // Bit n is set if the window starts on the weekday n
+	start    int   // Minutes of the day
+	end      int
+	location *time.Location
+}
+
+// compileSchedule parses the time window of the rule
+func compileSchedule(schedule *api.RuleSchedule) (*ruleSchedule, error) {
+	compiled := &ruleSchedule{location: time.Local}
+	if schedule.Timezone != "" {
+		location, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %s", schedule.Timezone)
+		}
+		compiled.location = location
+	}
+	var err error
+	if compiled.start, err = parseClock(schedule.Start); err != nil {
+		return nil, err
+	}
+	if compiled.end, err = parseClock(schedule.End); err != nil {
+		return nil, err
+	}
+	if len(schedule.Days) == 0 {
+		compiled.days = everyDay
+	}
+	for _, day := range schedule.Days {
+		if day < 0 || day > 6 {
+			return nil, fmt.Errorf("invalid day %d, the days are 0 (Sunday) to 6", day)
+		}
+		compiled.days |= 1 << day
+	}
+	return compiled, nil
+}
+
+// parseClock returns the minutes of the day of a time like 08:30
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, it should be like 08:30", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether the time is in the window, a window past midnight belongs to the day it starts on
+func (s *ruleSchedule) active(now time.Time) bool {
+	if s.days == 0 {
+		return false
+	}
+	now = now.In(s.location)
+	minute := now.Hour()*60 + now.Minute()
+	today := s.days&(1<<now.Weekday()) != 0
+	switch {
+	case s.start == s.end:
+		return today
+	case s.start < s.end:
+		return today && minute >= s.start && minute < s.end
+	default:
+		yesterday := s.days&(1<<((now.Weekday()+6)%7)) != 0
+		return today && minute >= s.start || yesterday && minute < s.end
+	}
+}
+
+// ruleActive reports whether the rule is in its time window, the rules without a schedule are always active
+func (r *RuleManager) ruleActive(schedules map[int]*ruleSchedule, id int) bool {
+	schedule, ok := schedules[id]
+	return !ok || schedule.active(r.Now())
+}
@@ -0,0 +1,117 @@
+package serverstatus
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cgroupCPU is the cpu quota of the cgroup in cores, and the cpu time it used
+type cgroupCPU struct {
+	quota float64
+	usage time.Duration
+}
+
+// cgroupCPUSampler samples the cpu usage of the cgroup in percent of its quota between two calls of sample
+type cgroupCPUSampler struct {
+	root      string
+	cores     int // Cores of the host, 0 means runtime.NumCPU
+	access    sync.Mutex
+	lastUsage time.Duration
+	lastAt    time.Time
+}
+
+var defaultCPUSampler = &cgroupCPUSampler{root: "/"}
+
+// sample returns the usage since the last call, the first call only starts the sampling and returns zero.
+// ok is false if the cgroup has no quota lower than the cores of the host, so the host usage applies.
+func (s *cgroupCPUSampler) sample(now time.Time) (percent float64, ok bool) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	cores := s.cores
+	if cores == 0 {
+		cores = runtime.NumCPU()
+	}
+	cpu, ok := readCgroupCPU(filepath.Join(s.root, "sys/fs/cgroup"))
+	if !ok || cpu.quota >= float64(cores) {
+		s.lastAt = time.Time{}
+		return 0, false
+	}
+	// The usage restarts with the cgroup, so a decrease starts the sampling again
+	if elapsed := now.Sub(s.lastAt); !s.lastAt.IsZero() && elapsed > 0 && cpu.usage >= s.lastUsage {
+		percent = float64(cpu.usage-s.lastUsage) / float64(elapsed) / cpu.quota * 100
+		if percent > 100 {
+			percent = 100
+		}
+	}
+	s.lastUsage, s.lastAt = cpu.usage, now
+	return percent, true
+}
+
+// readCgroupCPU reads the quota and the usage of the cgroup, ok is false if the cpu of the cgroup is unlimited or unknown
+func readCgroupCPU(dir string) (cpu cgroupCPU, ok bool) {
+	// cgroup v2
+	if value, err := readFileString(filepath.Join(dir, "cpu.max")); err == nil {
+		fields := strings.Fields(value)
+		if len(fields) != 2 || fields[0] == "max" {
+			return cpu, false
+		}
+		if cpu.quota, ok = parseCPUQuota(fields[0], fields[1]); !ok {
+			return cpu, false
+		}
+		stat, err := readKeyValues(filepath.Join(dir, "cpu.stat"), "")
+		if err != nil {
+			return cpu, false
+		}
+		usage, found := stat["usage_usec"]
+		cpu.usage = time.Duration(usage) * time.Microsecond
+		return cpu, found
+	}
+	// cgroup v1, the cpu and cpuacct controllers are usually mounted together and linked by their own names
+	for _, controller := range []string{"cpu,cpuacct", "cpu"} {
+		quota, err := readFileString(filepath.Join(dir, controller, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := readFileString(filepath.Join(dir, controller, "cpu.cfs_period_us"))
+		if err != nil {
+			return cpu, false
+		}
+		if cpu.quota, ok = parseCPUQuota(quota, period); !ok {
+			return cpu, false
+		}
+		break
+	}
+	if !ok {
+		return cpu, false
+	}
+	for _, controller := range []string{"cpu,cpuacct", "cpuacct"} {
+		value, err := readFileString(filepath.Join(dir, controller, "cpuacct.usage"))
+		if err != nil {
+			continue
+		}
+		usage, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return cpu, false
+		}
+		cpu.usage = time.Duration(usage)
+		return cpu, true
+	}
+	return cpu, false
+}
+
+// parseCPUQuota returns the cores of the quota in the period, the negative quota of cgroup v1 is unlimited
+func parseCPUQuota(quotaValue string, periodValue string) (float64, bool) {
+	quota, err := strconv.ParseInt(quotaValue, 10, 64)
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := strconv.ParseInt(periodValue, 10, 64)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+	return float64(quota) / float64(period), true
+}
@@ -0,0 +1,82 @@
+package serverstatus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadCgroupCPU(t *testing.T) {
+	testCases := []struct {
+		root string
+		want cgroupCPU
+		ok   bool
+	}{
+		// The container has half a core for 3 seconds of cpu time
+		{"testdata/cgroupv2", cgroupCPU{quota: 0.5, usage: 3 * time.Second}, true},
+		// The cpu and cpuacct controllers are mounted together
+		{"testdata/cgroupv1", cgroupCPU{quota: 1, usage: 2 * time.Second}, true},
+		// Not in a container
+		{"testdata/host", cgroupCPU{}, false},
+	}
+	for _, testCase := range testCases {
+		cpu, ok := readCgroupCPU(filepath.Join(testCase.root, "sys/fs/cgroup"))
+		if ok != testCase.ok || (ok && cpu != testCase.want) {
+			t.Errorf("%s: want %+v %v, but got %+v %v", testCase.root, testCase.want, testCase.ok, cpu, ok)
+		}
+	}
+}
+
+func TestReadCgroupCPUUnlimited(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "cpu.max"), "max 100000\n")
+	writeFile(t, filepath.Join(dir, "cpu.stat"), "usage_usec 3000000\n")
+	if cpu, ok := readCgroupCPU(dir); ok {
+		t.Errorf("cgroup v2 without a quota should be unlimited, got %+v", cpu)
+	}
+	dir = t.TempDir()
+	writeFile(t, filepath.Join(dir, "cpu", "cpu.cfs_quota_us"), "-1\n")
+	writeFile(t, filepath.Join(dir, "cpu", "cpu.cfs_period_us"), "100000\n")
+	writeFile(t, filepath.Join(dir, "cpuacct", "cpuacct.usage"), "2000000000\n")
+	if cpu, ok := readCgroupCPU(dir); ok {
+		t.Errorf("cgroup v1 without a quota should be unlimited, got %+v", cpu)
+	}
+	// The separately mounted controllers are read too
+	writeFile(t, filepath.Join(dir, "cpu", "cpu.cfs_quota_us"), "150000\n")
+	if cpu, ok := readCgroupCPU(dir); !ok || cpu != (cgroupCPU{quota: 1.5, usage: 2 * time.Second}) {
+		t.Errorf("unexpected cpu of cgroup v1: %+v %v", cpu, ok)
+	}
+}
+
+func TestCgroupCPUSampler(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "sys/fs/cgroup")
+	writeFile(t, filepath.Join(dir, "cpu.max"), "50000 100000\n")
+	writeFile(t, filepath.Join(dir, "cpu.stat"), "usage_usec 3000000\n")
+	s := &cgroupCPUSampler{root: root, cores: 4}
+	now := time.Now()
+	if percent, ok := s.sample(now); !ok || percent != 0 {
+		t.Errorf("the first sample should only start the sampling, got %f %v", percent, ok)
+	}
+	// 0.25 seconds of cpu time in a second is half of the quota of half a core
+	writeFile(t, filepath.Join(dir, "cpu.stat"), "usage_usec 3250000\n")
+	if percent, ok := s.sample(now.Add(time.Second)); !ok || percent != 50 {
+		t.Errorf("want 50%% of the quota, but got %f %v", percent, ok)
+	}
+	// The quota not lower than the host cores is left to the host usage
+	writeFile(t, filepath.Join(dir, "cpu.max"), "400000 100000\n")
+	if _, ok := s.sample(now.Add(2 * time.Second)); ok {
+		t.Error("the quota of the whole host should fall back to the host usage")
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+package serverstatus
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sectors of /proc/diskstats are always 512 bytes, whatever the sector size of the disk
+const diskSectorSize = 512
+
+// DiskIO is the disk throughput of the node in bytes per second
+type DiskIO struct {
+	Device     string // The device sampled, or the whole disks joined by commas
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+type diskCounter struct {
+	number     string // major:minor
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// DiskIOSampler samples the disk throughput between two calls of Sample
+type DiskIOSampler struct {
+	root    string
+	device  string
+	access  sync.Mutex
+	last    map[string]diskCounter
+	lastAt  time.Time
+	devices []string
+}
+
+// NewDiskIOSampler creates the sampler of the device, e.g. sda. Empty device means the device of the root filesystem,
+// or all the whole disks if it is not a disk of its own, such as the overlay root of a container.
+func NewDiskIOSampler(device string) *DiskIOSampler {
+	return &DiskIOSampler{root: "/", device: strings.TrimPrefix(device, "/dev/")}
+}
+
+// Sample returns the throughput since the last call, the first call only starts the sampling and returns zero
+func (s *DiskIOSampler) Sample() (*DiskIO, error) {
+	return s.sample(time.Now())
+}
+
+func (s *DiskIOSampler) sample(now time.Time) (*DiskIO, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	stats, err := readDiskStats(filepath.Join(s.root, "proc/diskstats"))
+	if os.IsNotExist(err) {
+		// Not Linux, the disk io is not sampled
+		return &DiskIO{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get disk io failed: %s", err)
+	}
+	if s.devices == nil {
+		if s.devices, err = s.findDevices(stats); err != nil {
+			return nil, err
+		}
+	}
+	diskIO := &DiskIO{Device: strings.Join(s.devices, ",")}
+	elapsed := now.Sub(s.lastAt).Seconds()
+	for _, device := range s.devices {
+		counter, ok := stats[device]
+		if !ok {
+			continue
+		}
+		// The counters restart with the device, so a decrease is skipped
+		if last, ok := s.last[device]; ok && elapsed > 0 && counter.readBytes >= last.readBytes && counter.writeBytes >= last.writeBytes {
+			diskIO.ReadBytes += uint64(float64(counter.readBytes-last.readBytes) / elapsed)
+			diskIO.WriteBytes += uint64(float64(counter.writeBytes-last.writeBytes) / elapsed)
+		}
+	}
+	s.last, s.lastAt = stats, now
+	return diskIO, nil
+}
+
+// findDevices returns the configured device, the device of the root filesystem, or the whole disks
+func (s *DiskIOSampler) findDevices(stats map[string]diskCounter) ([]string, error) {
+	if s.device != "" {
+		if _, ok := stats[s.device]; !ok {
+			return nil, fmt.Errorf("disk %s not found in diskstats", s.device)
+		}
+		return []string{s.device}, nil
+	}
+	if number, err := s.rootDevice(); err == nil {
+		for device, counter := range stats {
+			if counter.number == number {
+				return []string{device}, nil
+			}
+		}
+	}
+	// The partitions are counted in their disks, and the virtual devices have no disk io of their own
+	var devices []string
+	for device := range stats {
+		if _, err := os.Stat(filepath.Join(s.root, "sys/block", device, "device")); err == nil {
+			devices = append(devices, device)
+		}
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no disk found in diskstats")
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// rootDevice returns the major:minor of the device mounted on / in mountinfo
+func (s *DiskIOSampler) rootDevice() (string, error) {
+	file, err := os.Open(filepath.Join(s.root, "proc/self/mountinfo"))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	var number string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 29 1 252:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[4] == "/" {
+			number = fields[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if number == "" {
+		return "", fmt.Errorf("root filesystem not found in mountinfo")
+	}
+	return number, nil
+}
+
+// readDiskStats reads the bytes read and written of the devices
+func readDiskStats(name string) (map[string]diskCounter, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]diskCounter)
+	for _, line := range strings.Split(string(content), "\n") {
+		// major minor name reads merged sectors_read ms writes merged sectors_written ...
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		sectorsRead, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			continue
+		}
+		sectorsWritten, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[2]] = diskCounter{
+			number:     fields[0] + ":" + fields[1],
+			readBytes:  sectorsRead * diskSectorSize,
+			writeBytes: sectorsWritten * diskSectorSize,
+		}
+	}
+	return stats, nil
+}
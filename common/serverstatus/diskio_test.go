@@ -0,0 +1,48 @@
+package serverstatus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiskIOSample(t *testing.T) {
+	testCases := []struct {
+		root   string
+		device string
+		want   DiskIO
+	}{
+		// The partition of the root filesystem
+		{"testdata/diskio/vm", "", DiskIO{Device: "vda1", ReadBytes: 1 << 20, WriteBytes: 2 << 20}},
+		// The overlay root of a container is not a disk, so all the whole disks are summed without the partitions and loops
+		{"testdata/diskio/container", "", DiskIO{Device: "vda,vdb", ReadBytes: 1<<20 + 512<<10, WriteBytes: 2 << 20}},
+		{"testdata/diskio/vm", "/dev/vdb", DiskIO{Device: "vdb", ReadBytes: 512 << 10, WriteBytes: 0}},
+	}
+	for _, testCase := range testCases {
+		s := NewDiskIOSampler(testCase.device)
+		s.root = testCase.root
+		now := time.Now()
+		diskIO, err := s.sample(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diskIO.ReadBytes != 0 || diskIO.WriteBytes != 0 {
+			t.Errorf("%s: the first sample should be zero, but got %+v", testCase.root, *diskIO)
+		}
+		s.root = "testdata/diskio/after"
+		diskIO, err = s.sample(now.Add(10 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *diskIO != testCase.want {
+			t.Errorf("%s %s: want %+v, but got %+v", testCase.root, testCase.device, testCase.want, *diskIO)
+		}
+	}
+}
+
+func TestDiskIOUnknownDevice(t *testing.T) {
+	s := NewDiskIOSampler("sdz")
+	s.root = "testdata/diskio/vm"
+	if _, err := s.Sample(); err == nil {
+		t.Error("the device not in diskstats should fail")
+	}
+}
@@ -0,0 +1,140 @@
+package serverstatus
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+// MemoryInfo is the memory of the node in bytes, limited to the cgroup of the container if it has a lower limit
+type MemoryInfo struct {
+	Total     uint64
+	Used      uint64 // Total - Available, the page cache that can be reclaimed is not used
+	Available uint64
+}
+
+// UsedPercent is the used memory in percent of the total
+func (m *MemoryInfo) UsedPercent() float64 {
+	if m.Total == 0 {
+		return 0
+	}
+	return float64(m.Used) / float64(m.Total) * 100
+}
+
+// GetMemoryInfo gets the memory of the node based on MemAvailable
+func GetMemoryInfo() (*MemoryInfo, error) {
+	info, err := readMemoryInfo("/")
+	if os.IsNotExist(err) {
+		// Not Linux, there is no meminfo and cgroup
+		memUsage, err := mem.VirtualMemory()
+		if err != nil {
+			return nil, fmt.Errorf("get mem usage failed: %s", err)
+		}
+		return newMemoryInfo(memUsage.Total, memUsage.Available), nil
+	}
+	return info, err
+}
+
+func newMemoryInfo(total uint64, available uint64) *MemoryInfo {
+	if available > total {
+		available = total
+	}
+	return &MemoryInfo{Total: total, Used: total - available, Available: available}
+}
+
+// readMemoryInfo reads the meminfo and the cgroup memory under root
+func readMemoryInfo(root string) (*MemoryInfo, error) {
+	meminfo, err := readKeyValues(filepath.Join(root, "proc/meminfo"), ":")
+	if err != nil {
+		return nil, err
+	}
+	total := meminfo["MemTotal"] * 1024
+	available, ok := meminfo["MemAvailable"]
+	if !ok {
+		// The kernels before 3.14 have no MemAvailable
+		available = meminfo["MemFree"] + meminfo["Buffers"] + meminfo["Cached"]
+	}
+	info := newMemoryInfo(total, available*1024)
+	if limit, usage, ok := readCgroupMemory(filepath.Join(root, "sys/fs/cgroup")); ok && limit < total {
+		info = newMemoryInfo(limit, limit-minUint64(usage, limit))
+	}
+	return info, nil
+}
+
+// readCgroupMemory returns the limit of the cgroup and its usage without the inactive page cache.
+// ok is false if the memory of the cgroup is unlimited or unknown.
+func readCgroupMemory(dir string) (limit uint64, usage uint64, ok bool) {
+	// cgroup v2
+	if value, err := readFileString(filepath.Join(dir, "memory.max")); err == nil {
+		if value == "max" {
+			return 0, 0, false
+		}
+		return parseCgroupMemory(value, filepath.Join(dir, "memory.current"), filepath.Join(dir, "memory.stat"), "inactive_file")
+	}
+	// cgroup v1
+	dir = filepath.Join(dir, "memory")
+	if value, err := readFileString(filepath.Join(dir, "memory.limit_in_bytes")); err == nil {
+		return parseCgroupMemory(value, filepath.Join(dir, "memory.usage_in_bytes"), filepath.Join(dir, "memory.stat"), "total_inactive_file")
+	}
+	return 0, 0, false
+}
+
+func parseCgroupMemory(limitValue string, usageFile string, statFile string, inactiveKey string) (limit uint64, usage uint64, ok bool) {
+	limit, err := strconv.ParseUint(limitValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	usageValue, err := readFileString(usageFile)
+	if err != nil {
+		return 0, 0, false
+	}
+	if usage, err = strconv.ParseUint(usageValue, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	if stat, err := readKeyValues(statFile, ""); err == nil {
+		usage -= minUint64(stat[inactiveKey], usage)
+	}
+	return limit, usage, true
+}
+
+func readFileString(name string) (string, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readKeyValues reads the lines of "key<sep> value [unit]"
+func readKeyValues(name string, sep string) (map[string]uint64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[strings.TrimSuffix(fields[0], sep)] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,32 @@
+package serverstatus
+
+import (
+	"testing"
+)
+
+func TestReadMemoryInfo(t *testing.T) {
+	testCases := []struct {
+		root string
+		want MemoryInfo
+	}{
+		// The page cache is available, so it is not used
+		{"testdata/host", MemoryInfo{Total: 8000000 * 1024, Used: 2000000 * 1024, Available: 6000000 * 1024}},
+		// The container is limited to 1 GiB, and its inactive page cache is available
+		{"testdata/cgroupv2", MemoryInfo{Total: 1 << 30, Used: 512 << 20, Available: 512 << 20}},
+		// The cgroup is unlimited, so the host memory is the limit
+		{"testdata/cgroupv1", MemoryInfo{Total: 8000000 * 1024, Used: 2000000 * 1024, Available: 6000000 * 1024}},
+	}
+	for _, testCase := range testCases {
+		info, err := readMemoryInfo(testCase.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *info != testCase.want {
+			t.Errorf("%s: want %+v, but got %+v", testCase.root, testCase.want, *info)
+		}
+	}
+	info, _ := readMemoryInfo("testdata/cgroupv2")
+	if percent := info.UsedPercent(); percent != 50 {
+		t.Errorf("want 50%% used, but got %f", percent)
+	}
+}
@@ -7,21 +7,20 @@ import (
 
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
-	"github.com/shirou/gopsutil/mem"
 )
 
 // GetSystemInfo get the system info of a given periodic
 func GetSystemInfo() (Cpu float64, Mem float64, Disk float64, Uptime int, err error) {
 
 	upTime := time.Now()
-	cpuUsage, err := cpu.Percent(0, false)
+	cpuUsage, err := GetCPUPercent()
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("get cpu usage failed: %s", err)
+		return 0, 0, 0, 0, err
 	}
 
-	memUsage, err := mem.VirtualMemory()
+	memUsage, err := GetMemoryInfo()
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("get mem usage failed: %s", err)
+		return 0, 0, 0, 0, err
 	}
 
 	diskUsage, err := disk.Usage("/")
@@ -30,5 +29,17 @@ func GetSystemInfo() (Cpu float64, Mem float64, Disk float64, Uptime int, err er
 	}
 
 	Uptime = int(time.Since(upTime).Seconds())
-	return cpuUsage[0], memUsage.UsedPercent, diskUsage.UsedPercent, Uptime, nil
+	return cpuUsage, memUsage.UsedPercent(), diskUsage.UsedPercent, Uptime, nil
+}
+
+// GetCPUPercent returns the cpu usage since the last call, the usage of the container is relative to its cpu quota
+func GetCPUPercent() (float64, error) {
+	cpuUsage, err := cpu.Percent(0, false)
+	if err != nil {
+		return 0, fmt.Errorf("get cpu usage failed: %s", err)
+	}
+	if percent, ok := defaultCPUSampler.sample(time.Now()); ok {
+		return percent, nil
+	}
+	return cpuUsage[0], nil
 }
@@ -0,0 +1,13 @@
+// Package version is the version of XrayR and the xray-core it is built with
+package version
+
+import "github.com/xtls/xray-core/core"
+
+// Version is the version of XrayR, set at build time with
+// -ldflags "-X github.com/XrayR-project/XrayR/common/version.Version=0.3.2"
+var Version = "0.3.2"
+
+// Core returns the version of xray-core
+func Core() string {
+	return core.Version()
+}
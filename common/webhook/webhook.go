@@ -0,0 +1,101 @@
+// Package webhook posts the node events to a webhook
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Config is the webhook configuration
+type Config struct {
+	URL      string `mapstructure:"URL"`
+	Interval int    `mapstructure:"Interval"` // Seconds to suppress the same type of event, default 600
+	Timeout  int    `mapstructure:"Timeout"`  // Seconds of one post, default 10
+}
+
+// The event types
+const (
+	EventAPIUnreachable      = "api_unreachable"
+	EventAPIRecovered        = "api_recovered"
+	EventCertRenewFailed     = "cert_renew_failed"
+	EventNodeInfoChanged     = "node_info_changed"
+	EventUserSyncFailed      = "user_sync_failed"
+	EventBandwidthCapReached = "bandwidth_cap_reached"
+)
+
+// Event is the json body posted to the webhook
+type Event struct {
+	Type     string    `json:"type"`
+	NodeType string    `json:"node_type"`
+	NodeID   int       `json:"node_id"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+type Notifier struct {
+	Now      func() time.Time // Clock of the rate limit, can be replaced in tests
+	url      string
+	interval time.Duration
+	client   *http.Client
+	access   sync.Mutex
+	lastSent map[string]time.Time // Key: event type
+}
+
+func New(config *Config) (*Notifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("Webhook requires URL")
+	}
+	interval, timeout := config.Interval, config.Timeout
+	if interval <= 0 {
+		interval = 600
+	}
+	if timeout <= 0 {
+		timeout = 10
+	}
+	return &Notifier{
+		Now:      time.Now,
+		url:      config.URL,
+		interval: time.Duration(interval) * time.Second,
+		client:   &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		lastSent: make(map[string]time.Time),
+	}, nil
+}
+
+// Notify posts the event in the background, unless the same type of event was posted within the interval
+func (n *Notifier) Notify(event *Event) {
+	now := n.Now()
+	n.access.Lock()
+	if last, ok := n.lastSent[event.Type]; ok && now.Sub(last) < n.interval {
+		n.access.Unlock()
+		return
+	}
+	n.lastSent[event.Type] = now
+	n.access.Unlock()
+	event.Time = now
+	go func() {
+		if err := n.post(event); err != nil {
+			log.Print(err)
+		}
+	}()
+}
+
+func (n *Notifier) post(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	res, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post %s event to webhook failed: %s", event.Type, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("post %s event to webhook failed: %s", event.Type, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/webhook"
+)
+
+func TestNotifyRateLimit(t *testing.T) {
+	events := make(chan *webhook.Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := new(webhook.Event)
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	notifier, err := webhook.New(&webhook.Config{URL: server.URL, Interval: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1620000000, 0)
+	notifier.Now = func() time.Time { return now }
+	notifier.Notify(&webhook.Event{Type: webhook.EventCertRenewFailed, Message: "first"})
+	// The same type within the interval is suppressed, other types are not
+	notifier.Notify(&webhook.Event{Type: webhook.EventCertRenewFailed, Message: "second"})
+	notifier.Notify(&webhook.Event{Type: webhook.EventUserSyncFailed, Message: "other"})
+	now = now.Add(61 * time.Second)
+	notifier.Notify(&webhook.Event{Type: webhook.EventCertRenewFailed, Message: "third"})
+
+	received := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-events:
+			received[event.Message] = true
+		case <-time.After(time.Second):
+			t.Fatalf("only %d events are posted", i)
+		}
+	}
+	if !received["first"] || !received["other"] || !received["third"] {
+		t.Errorf("unexpected events: %v", received)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("the event %s should be suppressed", event.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/XrayR-project/XrayR/common/version"
 	"github.com/XrayR-project/XrayR/panel"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
@@ -19,16 +21,17 @@ import (
 var (
 	configFile   = flag.String("config", "", "Config file for XrayR.")
 	printVersion = flag.Bool("version", false, "show version")
+	checkAPI     = flag.Bool("check", false, "Check the api of all the nodes and exit.")
+	dumpConfig   = flag.Bool("dump", false, "Print the xray config built for all the nodes with the secrets masked and exit.")
 )
 
 var (
-	version  = "0.3.2"
 	codename = "XrayR"
 	intro    = "A Xray backend that supports many panels"
 )
 
 func showVersion() {
-	fmt.Printf("%s %s (%s) \n", codename, version, intro)
+	fmt.Printf("%s %s (%s) \n", codename, version.Version, intro)
 }
 
 func getConfig() *viper.Viper {
@@ -70,24 +73,68 @@ func main() {
 	config := getConfig()
 	panelConfig := &panel.Config{}
 	config.Unmarshal(panelConfig)
+	if *checkAPI {
+		if err := panel.Check(panelConfig, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *dumpConfig {
+		if err := panel.Dump(panelConfig, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	p := panel.New(panelConfig)
+	var reloadAccess sync.Mutex
+	// Apply the changed config to the running nodes, or restart the panel if a change needs it
+	reload := func() {
+		reloadAccess.Lock()
+		defer reloadAccess.Unlock()
+		newConfig := &panel.Config{}
+		if err := config.Unmarshal(newConfig); err != nil {
+			log.Printf("Parse the config failed: %s, keep the running config", err)
+			return
+		}
+		if err := p.Reload(newConfig); err != nil {
+			log.Printf("%s, restart the panel", err)
+			p.Close()
+			p = panel.New(newConfig)
+			p.Start()
+			return
+		}
+		log.Print("Config reloaded")
+	}
 	config.OnConfigChange(func(e fsnotify.Event) {
 		// Hot reload function
 		fmt.Println("Config file changed:", e.Name)
-		p.Close()
-		config.Unmarshal(panelConfig)
-		p = panel.New(panelConfig)
-		p.Start()
+		reload()
 	})
 	p.Start()
-	defer p.Close()
+	defer func() {
+		reloadAccess.Lock()
+		defer reloadAccess.Unlock()
+		p.Close()
+	}()
 
 	//Explicitly triggering GC to remove garbage from config loading.
 	runtime.GC()
-	// Running backend
+	// Running backend, SIGHUP reloads the config
 	{
 		osSignals := make(chan os.Signal, 1)
-		signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM)
-		<-osSignals
+		signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range osSignals {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			log.Print("SIGHUP received, reload the config")
+			if err := config.ReadInConfig(); err != nil {
+				log.Printf("Read the config failed: %s, keep the running config", err)
+				continue
+			}
+			reload()
+		}
 	}
 }
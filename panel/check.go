@@ -0,0 +1,29 @@
+package panel
+
+import (
+	"fmt"
+	"io"
+)
+
+// Check verifies the api config of all the nodes without starting the core, and writes a summary of each node.
+// It returns the first error it meets.
+func Check(panelConfig *Config, w io.Writer) error {
+	for _, nodeConfig := range panelConfig.NodesConfig {
+		apiClient, err := newAPIClient(nodeConfig)
+		if err != nil {
+			return err
+		}
+		clientInfo := apiClient.Describe()
+		nodeInfo, err := apiClient.GetNodeInfo()
+		if err != nil {
+			return fmt.Errorf("Get node info of %s node %d from %s failed: %s", clientInfo.NodeType, clientInfo.NodeID, clientInfo.APIHost, err)
+		}
+		userList, err := apiClient.GetUserList()
+		if err != nil {
+			return fmt.Errorf("Get user list of %s node %d from %s failed: %s", clientInfo.NodeType, clientInfo.NodeID, clientInfo.APIHost, err)
+		}
+		fmt.Fprintf(w, "%s node %d: port %d, transport %s, %d users\n",
+			nodeInfo.NodeType, nodeInfo.NodeID, nodeInfo.Port, nodeInfo.TransportProtocol, len(*userList))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package panel_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/panel"
+	"github.com/XrayR-project/XrayR/service/controller"
+)
+
+func TestCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mod_mu/nodes/41/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ret":1,"data":{"node_speedlimit":0,"server":"1.1.1.1;443;0;ws;tls;path=/v2ray|host=test.test.tk"}}`))
+	})
+	mux.HandleFunc("/mod_mu/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ret":1,"data":[{"id":1,"email":"a@test.com","uuid":"a"},{"id":2,"email":"b@test.com","uuid":"b"}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	panelConfig := &panel.Config{
+		NodesConfig: []*panel.NodesConfig{
+			{
+				PanelType: "SSpanel",
+				ApiConfig: &api.Config{APIHost: server.URL, Key: "123", NodeID: 41, NodeType: "V2ray"},
+			},
+		},
+	}
+	out := new(bytes.Buffer)
+	if err := panel.Check(panelConfig, out); err != nil {
+		t.Fatal(err)
+	}
+	want := "V2ray node 41: port 443, transport ws, 2 users\n"
+	if out.String() != want {
+		t.Errorf("unexpected summary. want %q, but got %q", want, out.String())
+	}
+
+	// The node does not exist
+	panelConfig.NodesConfig[0].ApiConfig.NodeID = 42
+	if err := panel.Check(panelConfig, out); err == nil {
+		t.Error("check should fail for a missing node")
+	}
+}
+
+func TestDump(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mod_mu/nodes/41/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ret":1,"data":{"node_speedlimit":0,"server":"1.1.1.1;443;0;ws;;path=/v2ray|host=test.test.tk"}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	panelConfig := &panel.Config{
+		NodesConfig: []*panel.NodesConfig{
+			{
+				PanelType:        "SSpanel",
+				ApiConfig:        &api.Config{APIHost: server.URL, Key: "123", NodeID: 41, NodeType: "V2ray"},
+				ControllerConfig: &controller.Config{ListenIP: "0.0.0.0", CertConfig: &controller.CertConfig{CertMode: "none"}},
+			},
+		},
+	}
+	out := new(bytes.Buffer)
+	if err := panel.Dump(panelConfig, out); err != nil {
+		t.Fatal(err)
+	}
+	dumps := make(map[string]*controller.ConfigDump)
+	if err := json.Unmarshal(out.Bytes(), &dumps); err != nil {
+		t.Fatal(err)
+	}
+	if dump, ok := dumps["V2ray_443"]; !ok || len(dump.Inbounds) != 1 || !strings.Contains(out.String(), `"path": "/v2ray"`) {
+		t.Errorf("the config of the node should be dumped, got %s", out.String())
+	}
+}
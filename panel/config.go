@@ -2,12 +2,21 @@ package panel
 
 import (
 	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/geodata"
+	"github.com/XrayR-project/XrayR/service/admin"
 	"github.com/XrayR-project/XrayR/service/controller"
 )
 
 type Config struct {
-	LogConfig   *LogConfig     `mapstructure:"Log"`
-	NodesConfig []*NodesConfig `mapstructure:"Nodes"`
+	LogConfig     *LogConfig                    `mapstructure:"Log"`
+	NodesConfig   []*NodesConfig                `mapstructure:"Nodes"`
+	SNIRoute      []*mydispatcher.SNIRoute      `mapstructure:"SNIRoute"`
+	ProtocolRoute []*mydispatcher.ProtocolRoute `mapstructure:"ProtocolRoute"`
+	DNSCache      *mydispatcher.DNSCacheConfig  `mapstructure:"DNSCache"`
+	IPBan         *mydispatcher.IPBanConfig     `mapstructure:"IPBan"`
+	AdminConfig   *admin.Config                 `mapstructure:"Admin"`
+	GeoData       *geodata.Config               `mapstructure:"GeoData"`
 }
 
 type NodesConfig struct {
@@ -20,4 +29,8 @@ type LogConfig struct {
 	Level      string `mapstructure:"Level"`
 	AccessPath string `mapstructure:"AccessPath"`
 	ErrorPath  string `mapstructure:"ErrorPath"`
+	Format     string `mapstructure:"Format"`  // text, json
+	MaxSize    int    `mapstructure:"MaxSize"` // Megabytes, 0 means no rotation
+	MaxAge     int    `mapstructure:"MaxAge"`  // Days
+	MaxBackups int    `mapstructure:"MaxBackups"`
 }
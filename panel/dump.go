@@ -0,0 +1,34 @@
+package panel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/XrayR-project/XrayR/service/controller"
+)
+
+// Dump writes the xray config built for all the nodes from their node info and local config, without starting the core.
+// The configs are keyed by the tags of the nodes, and the secrets are masked.
+func Dump(panelConfig *Config, w io.Writer) error {
+	dumps := make(map[string]*controller.ConfigDump, len(panelConfig.NodesConfig))
+	for _, nodeConfig := range panelConfig.NodesConfig {
+		apiClient, err := newAPIClient(nodeConfig)
+		if err != nil {
+			return err
+		}
+		clientInfo := apiClient.Describe()
+		nodeInfo, err := apiClient.GetNodeInfo()
+		if err != nil {
+			return fmt.Errorf("Get node info of %s node %d from %s failed: %s", clientInfo.NodeType, clientInfo.NodeID, clientInfo.APIHost, err)
+		}
+		dump, err := controller.BuildConfigDump(nodeConfig.ControllerConfig, nodeInfo)
+		if err != nil {
+			return fmt.Errorf("Build config of %s node %d failed: %s", clientInfo.NodeType, clientInfo.NodeID, err)
+		}
+		dumps[fmt.Sprintf("%s_%d", nodeInfo.NodeType, nodeInfo.Port)] = dump
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dumps)
+}
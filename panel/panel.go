@@ -1,19 +1,26 @@
 package panel
 
 import (
+	"fmt"
 	"log"
+	"strings"
 	"sync"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/api/sspanel"
 	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/geodata"
+	"github.com/XrayR-project/XrayR/common/logger"
 	_ "github.com/XrayR-project/XrayR/main/distro/all"
 	"github.com/XrayR-project/XrayR/service"
+	"github.com/XrayR-project/XrayR/service/admin"
 	"github.com/XrayR-project/XrayR/service/controller"
 	"github.com/xtls/xray-core/app/proxyman"
 	"github.com/xtls/xray-core/app/stats"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/routing"
 	"github.com/xtls/xray-core/infra/conf"
 )
 
@@ -24,6 +31,7 @@ type Panel struct {
 	Server      *core.Instance
 	Service     []service.Service
 	Running     bool
+	controllers []*controller.Controller // The nodes in the order of the config, reloaded in place
 }
 
 func New(panelConfig *Config) *Panel {
@@ -31,10 +39,33 @@ func New(panelConfig *Config) *Panel {
 	return p
 }
 
+// verboseLogLevel returns the most verbose of the global log level and the ones of the nodes for xray-core,
+// the log handlers filter the messages down to the level of their node. none disables all the logs.
+func verboseLogLevel(level string, nodesConfig []*NodesConfig) string {
+	if strings.ToLower(level) == "none" {
+		return level
+	}
+	for _, nodeConfig := range nodesConfig {
+		nodeLevel := nodeConfig.ControllerConfig.LogLevel
+		if nodeLevel != "" && logger.ParseLevel(nodeLevel) > logger.ParseLevel(level) {
+			level = nodeLevel
+		}
+	}
+	return level
+}
+
 func (p *Panel) loadCore(c *LogConfig) *core.Instance {
+	// Log format and rotation
+	logger.RegisterHandlers(&logger.Config{
+		Level:      c.Level,
+		Format:     c.Format,
+		MaxSize:    c.MaxSize,
+		MaxAge:     c.MaxAge,
+		MaxBackups: c.MaxBackups,
+	})
 	// Log Config
 	logConfig := &conf.LogConfig{
-		LogLevel:  c.Level,
+		LogLevel:  verboseLogLevel(c.Level, p.panelConfig.NodesConfig),
 		AccessLog: c.AccessPath,
 		ErrorLog:  c.ErrorPath,
 	}
@@ -43,6 +74,22 @@ func (p *Panel) loadCore(c *LogConfig) *core.Instance {
 		StatsUserUplink:   true,
 		StatsUserDownlink: true,
 	}}
+	// The nodes with their own timeouts get a user level of their own
+	for i, nodeConfig := range p.panelConfig.NodesConfig {
+		if nodeConfig.ControllerConfig.TimeoutConfig != nil {
+			nodeConfig.ControllerConfig.PolicyLevel = uint32(i + 1)
+			policyConfig.Levels[uint32(i+1)] = controller.PolicyBuilder(nodeConfig.ControllerConfig)
+		}
+	}
+	// The transparent proxy inbounds have no users, their traffic is counted on the inbounds
+	for _, nodeConfig := range p.panelConfig.NodesConfig {
+		if nodeConfig.ControllerConfig.TProxyConfig != nil {
+			policyConfig.System = &conf.SystemPolicy{
+				StatsInboundUplink:   true,
+				StatsInboundDownlink: true,
+			}
+		}
+	}
 	pConfig, _ := policyConfig.Build()
 	config := &core.Config{
 		App: []*serial.TypedMessage{
@@ -54,6 +101,34 @@ func (p *Panel) loadCore(c *LogConfig) *core.Instance {
 			serial.ToTypedMessage(pConfig),
 		},
 	}
+	// The DoH servers of the nodes resolve the destinations of their outbounds
+	controllerConfigs := make([]*controller.Config, 0, len(p.panelConfig.NodesConfig))
+	for _, nodeConfig := range p.panelConfig.NodesConfig {
+		controllerConfigs = append(controllerConfigs, nodeConfig.ControllerConfig)
+	}
+	// The FakeDNS pool is added before the DNS answering with it
+	fakeDNSConfig, err := controller.FakeDNSBuilder(controllerConfigs)
+	if err != nil {
+		log.Panicf("Failed to build FakeDNS config: %s", err)
+	}
+	if fakeDNSConfig != nil {
+		fConfig, err := fakeDNSConfig.Build()
+		if err != nil {
+			log.Panicf("Failed to build FakeDNS config: %s", err)
+		}
+		config.App = append(config.App, serial.ToTypedMessage(fConfig))
+	}
+	dnsConfig, err := controller.DNSBuilder(controllerConfigs)
+	if err != nil {
+		log.Panicf("Failed to build DNS config: %s", err)
+	}
+	if dnsConfig != nil {
+		dConfig, err := dnsConfig.Build()
+		if err != nil {
+			log.Panicf("Failed to build DNS config: %s", err)
+		}
+		config.App = append(config.App, serial.ToTypedMessage(dConfig))
+	}
 	server, err := core.New(config)
 	if err != nil {
 		log.Panicf("failed to create instance: %s", err)
@@ -63,6 +138,28 @@ func (p *Panel) loadCore(c *LogConfig) *core.Instance {
 	return server
 }
 
+func newAPIClient(nodeConfig *NodesConfig) (api.API, error) {
+	apiClient, err := newPanelClient(nodeConfig.PanelType, nodeConfig.ApiConfig)
+	if err != nil || nodeConfig.ApiConfig.SecondaryAPIHost == "" {
+		return apiClient, err
+	}
+	// The standby panel shares the config of the primary one except the host
+	secondaryConfig := *nodeConfig.ApiConfig
+	secondaryConfig.APIHost = secondaryConfig.SecondaryAPIHost
+	secondaryClient, err := newPanelClient(nodeConfig.PanelType, &secondaryConfig)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewFailover(apiClient, secondaryClient), nil
+}
+
+func newPanelClient(panelType string, apiConfig *api.Config) (api.API, error) {
+	if panelType == "SSpanel" {
+		return sspanel.New(apiConfig), nil
+	}
+	return nil, fmt.Errorf("Unsupport panel type: %s", panelType)
+}
+
 // Start Start the panel
 func (p *Panel) Start() {
 	p.access.Lock()
@@ -74,20 +171,58 @@ func (p *Panel) Start() {
 		log.Panicf("Failed to start instance: %s", err)
 	}
 	p.Server = server
+	// Load SNI routes
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	if err := dispatcher.SNIRouter.Update(p.panelConfig.SNIRoute); err != nil {
+		log.Panic(err)
+	}
+	// Load protocol routes
+	if err := dispatcher.ProtocolRouter.Update(p.panelConfig.ProtocolRoute); err != nil {
+		log.Panic(err)
+	}
+	// Cache the domains resolved for the outbounds
+	if p.panelConfig.DNSCache != nil {
+		resolver, err := mydispatcher.NewSystemResolver()
+		if err != nil {
+			log.Panic(err)
+		}
+		dispatcher.DNSCache = mydispatcher.NewDNSCache(p.panelConfig.DNSCache, resolver)
+	}
+	// Map the fake IPs back to their domains
+	if fakeDNS, ok := server.GetFeature((*dns.FakeDNSEngine)(nil)).(dns.FakeDNSEngine); ok {
+		dispatcher.FakeDNS = fakeDNS
+	}
+	// Ban the source IPs rejected by the rules too often
+	if p.panelConfig.IPBan != nil {
+		dispatcher.IPBanner = mydispatcher.NewIPBanner(p.panelConfig.IPBan)
+	}
+	// Load the geo databases once for all the features using them
+	if p.panelConfig.GeoData != nil {
+		geoData := geodata.New(p.panelConfig.GeoData)
+		dispatcher.GeoData = geoData
+		dispatcher.RuleManager.GeoData = geoData
+		p.Service = append(p.Service, geoData)
+	}
 	// Load Nodes config
+	var adminNodes []admin.Node
 	for _, nodeConfig := range p.panelConfig.NodesConfig {
-		var apiClient api.API
-		if nodeConfig.PanelType == "SSpanel" {
-			apiClient = sspanel.New(nodeConfig.ApiConfig)
-		} else {
-			log.Panicf("Unsupport panel type: %s", nodeConfig.PanelType)
+		apiClient, err := newAPIClient(nodeConfig)
+		if err != nil {
+			log.Panic(err)
 		}
 		var controllerService service.Service
 		// Regist controller service
-		controllerService = controller.New(server, apiClient, nodeConfig.ControllerConfig)
+		nodeController := controller.New(server, apiClient, nodeConfig.ControllerConfig)
+		controllerService = nodeController
 		p.Service = append(p.Service, controllerService)
+		p.controllers = append(p.controllers, nodeController)
+		adminNodes = append(adminNodes, nodeController)
 
 	}
+	// The admin API starts after the nodes it serves
+	if p.panelConfig.AdminConfig != nil {
+		p.Service = append(p.Service, admin.New(p.panelConfig.AdminConfig, adminNodes))
+	}
 
 	// Start all the service
 	for _, s := range p.Service {
@@ -0,0 +1,81 @@
+package panel
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/XrayR-project/XrayR/service/controller"
+)
+
+// Reload applies the changed config to the running nodes, so their connections stay up. It returns an error
+// without changing the nodes if a change needs the panel restarted: the global settings, the nodes added or
+// removed, their panels, or a change of a node it cannot apply in place.
+func (p *Panel) Reload(panelConfig *Config) error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if !p.Running {
+		return fmt.Errorf("The panel is not running")
+	}
+	if changed := globalConfigChange(p.panelConfig, panelConfig); changed != "" {
+		return fmt.Errorf("%s changed, restart the panel to apply", changed)
+	}
+	// Prepare all the nodes first, so either all of them or none is reloaded
+	prepared := make([]*controller.PreparedReload, len(panelConfig.NodesConfig))
+	for i, nodeConfig := range panelConfig.NodesConfig {
+		r, err := p.controllers[i].PrepareReload(nodeConfig.ControllerConfig)
+		if err != nil {
+			return err
+		}
+		prepared[i] = r
+	}
+	for i, r := range prepared {
+		if err := r.Apply(); err != nil {
+			// The failed node keeps its config, the nodes applied before it go back to theirs
+			p.rollback(i)
+			return err
+		}
+	}
+	p.panelConfig = panelConfig
+	return nil
+}
+
+// rollback reloads the running config to the first n nodes, which have applied the new one
+func (p *Panel) rollback(n int) {
+	for i := n - 1; i >= 0; i-- {
+		if err := p.controllers[i].Reload(p.panelConfig.NodesConfig[i].ControllerConfig); err != nil {
+			log.Printf("Roll back the config of node %d failed: %s", i+1, err)
+		}
+	}
+}
+
+// globalConfigChange returns the changed settings which are built into the core or started with the panel, or
+// empty if there is none
+func globalConfigChange(oldConfig *Config, newConfig *Config) string {
+	if len(oldConfig.NodesConfig) != len(newConfig.NodesConfig) {
+		return "Nodes"
+	}
+	for i, oldNode := range oldConfig.NodesConfig {
+		newNode := newConfig.NodesConfig[i]
+		if oldNode.PanelType != newNode.PanelType || !reflect.DeepEqual(oldNode.ApiConfig, newNode.ApiConfig) {
+			return fmt.Sprintf("ApiConfig of node %d", i+1)
+		}
+		if newNode.ControllerConfig == nil {
+			return fmt.Sprintf("ControllerConfig of node %d", i+1)
+		}
+	}
+	// The core logs at the most verbose level of the nodes
+	if !reflect.DeepEqual(oldConfig.LogConfig, newConfig.LogConfig) {
+		return "Log"
+	}
+	if oldConfig.LogConfig != nil && verboseLogLevel(oldConfig.LogConfig.Level, oldConfig.NodesConfig) != verboseLogLevel(newConfig.LogConfig.Level, newConfig.NodesConfig) {
+		return "Log level of the nodes"
+	}
+	oldGlobal, newGlobal := *oldConfig, *newConfig
+	oldGlobal.LogConfig, newGlobal.LogConfig = nil, nil
+	oldGlobal.NodesConfig, newGlobal.NodesConfig = nil, nil
+	if !reflect.DeepEqual(oldGlobal, newGlobal) {
+		return "The global config"
+	}
+	return ""
+}
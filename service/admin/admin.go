@@ -0,0 +1,163 @@
+// Package admin serves the live state of the nodes on a local read-only HTTP API, for debugging without the panel
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/XrayR-project/XrayR/service/controller"
+)
+
+const defaultListen = "127.0.0.1:10086"
+
+type Config struct {
+	Listen string `mapstructure:"Listen"` // Address to listen on, default 127.0.0.1:10086
+	Token  string `mapstructure:"Token"`  // Required, sent in the header "Authorization: Bearer <Token>"
+}
+
+// Node is the live state of a node, implemented by the controller
+type Node interface {
+	Tag() string
+	NodeInfo() *api.NodeInfo
+	OnlineUsers() (*[]api.OnlineUser, error)
+	UserSpeed() []controller.UserSpeed
+	BucketStatus() ([]limiter.BucketStatus, error)
+	OutboundHealth() mydispatcher.OutboundHealth
+	ConfigDump() (*controller.ConfigDump, error)
+	Health() controller.NodeHealth
+}
+
+// Server is the admin API service. Each endpoint returns a JSON object keyed by the node tags:
+// /config the node info, /online the online users and their IPs, /speed the live speed of the users,
+// /buckets the speed limit buckets, /health the last health check of the outbound,
+// /dump the xray config built for the node with the secrets masked.
+// /healthz and /readyz are the probes of the orchestration, answered without the token: they return the health of
+// the nodes, with 503 if a node is not live or not ready.
+type Server struct {
+	config   *Config
+	nodes    []Node
+	listener net.Listener
+	server   *http.Server
+}
+
+func New(config *Config, nodes []Node) *Server {
+	return &Server{config: config, nodes: nodes}
+}
+
+// Start implement the Start() function of the service interface
+func (s *Server) Start() error {
+	if s.config.Token == "" {
+		return fmt.Errorf("Token is required by the admin API")
+	}
+	listen := s.config.Listen
+	if listen == "" {
+		listen = defaultListen
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("Admin API listen failed: %s", err)
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: s.handler()}
+	go s.server.Serve(listener)
+	log.Printf("Admin API listening on %s", listener.Addr())
+	return nil
+}
+
+// Close implement the Close() function of the service interface
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// Addr returns the address the admin API listens on, once started
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", s.serve(func(node Node) (interface{}, error) {
+		return node.NodeInfo(), nil
+	}))
+	mux.HandleFunc("/online", s.serve(func(node Node) (interface{}, error) {
+		return node.OnlineUsers()
+	}))
+	mux.HandleFunc("/speed", s.serve(func(node Node) (interface{}, error) {
+		return node.UserSpeed(), nil
+	}))
+	mux.HandleFunc("/buckets", s.serve(func(node Node) (interface{}, error) {
+		return node.BucketStatus()
+	}))
+	mux.HandleFunc("/health", s.serve(func(node Node) (interface{}, error) {
+		return node.OutboundHealth(), nil
+	}))
+	mux.HandleFunc("/dump", s.serve(func(node Node) (interface{}, error) {
+		return node.ConfigDump()
+	}))
+	mux.HandleFunc("/healthz", s.probe(func(health controller.NodeHealth) bool { return health.Live }))
+	mux.HandleFunc("/readyz", s.probe(func(health controller.NodeHealth) bool { return health.Ready }))
+	return mux
+}
+
+// serve answers the authorized GET requests with the state of all the nodes
+func (s *Server) serve(get func(Node) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.config.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+		state := make(map[string]interface{}, len(s.nodes))
+		for _, node := range s.nodes {
+			tag := node.Tag()
+			value, err := get(node)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("%s: %s", tag, err))
+				return
+			}
+			state[tag] = value
+		}
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// probe answers the GET requests with the health of all the nodes, 503 if the check fails for any of them
+func (s *Server) probe(check func(controller.NodeHealth) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+		code := http.StatusOK
+		state := make(map[string]controller.NodeHealth, len(s.nodes))
+		for _, node := range s.nodes {
+			health := node.Health()
+			if !check(health) {
+				code = http.StatusServiceUnavailable
+			}
+			state[node.Tag()] = health
+		}
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,165 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/XrayR-project/XrayR/service/admin"
+	"github.com/XrayR-project/XrayR/service/controller"
+)
+
+type fakeNode struct {
+	tag       string
+	onlineErr error
+	health    controller.NodeHealth
+}
+
+func (n *fakeNode) Tag() string             { return n.tag }
+func (n *fakeNode) NodeInfo() *api.NodeInfo { return &api.NodeInfo{NodeID: 1, NodeType: "V2ray"} }
+func (n *fakeNode) OnlineUsers() (*[]api.OnlineUser, error) {
+	return &[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}, n.onlineErr
+}
+func (n *fakeNode) UserSpeed() []controller.UserSpeed             { return nil }
+func (n *fakeNode) BucketStatus() ([]limiter.BucketStatus, error) { return nil, nil }
+func (n *fakeNode) OutboundHealth() mydispatcher.OutboundHealth {
+	return mydispatcher.OutboundHealth{Tag: n.tag, Healthy: false, Failures: 3, Error: "timeout"}
+}
+func (n *fakeNode) ConfigDump() (*controller.ConfigDump, error) {
+	return &controller.ConfigDump{Inbounds: []interface{}{map[string]interface{}{"tag": n.tag}}}, nil
+}
+
+func (n *fakeNode) Health() controller.NodeHealth { return n.health }
+
+func startServer(t *testing.T, nodes ...admin.Node) *admin.Server {
+	s := admin.New(&admin.Config{Listen: "127.0.0.1:0", Token: "secret"}, nodes)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func request(t *testing.T, s *admin.Server, method string, path string, token string) (int, map[string]json.RawMessage) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", s.Addr(), path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestAdminToken(t *testing.T) {
+	if err := admin.New(&admin.Config{Listen: "127.0.0.1:0"}, nil).Start(); err == nil {
+		t.Error("start without a token should fail")
+	}
+	s := startServer(t, &fakeNode{tag: "V2ray_1145"})
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := request(t, s, http.MethodGet, "/online", token); code != http.StatusUnauthorized {
+			t.Errorf("want %d with the token %q, but got %d", http.StatusUnauthorized, token, code)
+		}
+	}
+	if code, body := request(t, s, http.MethodGet, "/online", "secret"); code != http.StatusOK || string(body["V2ray_1145"]) != `[{"UID":1,"IP":"1.1.1.1"}]` {
+		t.Errorf("want the online users, but got %d %s", code, body["V2ray_1145"])
+	}
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	s := startServer(t, &fakeNode{tag: "V2ray_1145"})
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		if code, _ := request(t, s, method, "/config", "secret"); code != http.StatusMethodNotAllowed {
+			t.Errorf("want %d for %s, but got %d", http.StatusMethodNotAllowed, method, code)
+		}
+	}
+}
+
+func TestAdminNodeError(t *testing.T) {
+	s := startServer(t, &fakeNode{tag: "V2ray_1145"}, &fakeNode{tag: "Trojan_1146", onlineErr: errors.New("no such inbound")})
+	code, body := request(t, s, http.MethodGet, "/online", "secret")
+	if code != http.StatusInternalServerError || string(body["error"]) != `"Trojan_1146: no such inbound"` {
+		t.Errorf("want the error of the node, but got %d %v", code, body)
+	}
+	if code, body := request(t, s, http.MethodGet, "/config", "secret"); code != http.StatusOK || len(body) != 2 {
+		t.Errorf("want the config of both nodes, but got %d %v", code, body)
+	}
+}
+
+func TestAdminOutboundHealth(t *testing.T) {
+	s := startServer(t, &fakeNode{tag: "V2ray_1145"})
+	code, body := request(t, s, http.MethodGet, "/health", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, code)
+	}
+	health := mydispatcher.OutboundHealth{}
+	if err := json.Unmarshal(body["V2ray_1145"], &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Healthy || health.Failures != 3 || health.Error != "timeout" {
+		t.Errorf("want the unhealthy outbound, but got %+v", health)
+	}
+}
+
+func TestAdminConfigDump(t *testing.T) {
+	s := startServer(t, &fakeNode{tag: "V2ray_1145"})
+	code, body := request(t, s, http.MethodGet, "/dump", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, code)
+	}
+	dump := controller.ConfigDump{}
+	if err := json.Unmarshal(body["V2ray_1145"], &dump); err != nil {
+		t.Fatal(err)
+	}
+	if len(dump.Inbounds) != 1 {
+		t.Errorf("want the inbound of the node, but got %+v", dump)
+	}
+}
+
+func TestAdminProbes(t *testing.T) {
+	ready := &fakeNode{tag: "V2ray_1145", health: controller.NodeHealth{Live: true, Ready: true, Up: true}}
+	stale := &fakeNode{tag: "Trojan_1146", health: controller.NodeHealth{Live: true, Up: true, Reason: "the node info has not been fetched from the panel for 6m0s"}}
+	// The probes are answered without the token
+	s := startServer(t, ready)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code, body := request(t, s, http.MethodGet, path, ""); code != http.StatusOK || len(body) != 1 {
+			t.Errorf("want %s of the ready node, but got %d %v", path, code, body)
+		}
+	}
+	s = startServer(t, ready, stale)
+	if code, _ := request(t, s, http.MethodGet, "/healthz", ""); code != http.StatusOK {
+		t.Errorf("want the nodes live, but got %d", code)
+	}
+	code, body := request(t, s, http.MethodGet, "/readyz", "")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("want %d with a node not ready, but got %d", http.StatusServiceUnavailable, code)
+	}
+	health := controller.NodeHealth{}
+	if err := json.Unmarshal(body["Trojan_1146"], &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Ready || health.Reason != stale.health.Reason {
+		t.Errorf("want the reason of the node not ready, but got %+v", health)
+	}
+	stale.health.Live = false
+	if code, _ := request(t, s, http.MethodGet, "/healthz", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("want %d with a node not live, but got %d", http.StatusServiceUnavailable, code)
+	}
+	if code, _ := request(t, s, http.MethodPost, "/readyz", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("want %d for POST, but got %d", http.StatusMethodNotAllowed, code)
+	}
+}
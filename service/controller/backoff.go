@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"log"
+	"time"
+)
+
+// defaultMaxBackoff is the max interval of the node info fetches while the panel is failing
+const defaultMaxBackoff = 10 * time.Minute
+
+// pollBackoff doubles the interval of a polling periodic on each consecutive failure up to the max,
+// and goes back to the base interval on the first success
+type pollBackoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+}
+
+// next returns the interval before the next poll
+func (b *pollBackoff) next(ok bool) time.Duration {
+	if ok {
+		b.failures = 0
+		return b.base
+	}
+	b.failures++
+	interval := b.base
+	for i := 0; i < b.failures && interval < b.max; i++ {
+		interval *= 2
+	}
+	if interval > b.max {
+		interval = b.max
+	}
+	if interval < b.base {
+		interval = b.base
+	}
+	return interval
+}
+
+// maxBackoff returns the max interval of the node info fetches while the panel is failing
+func (c *Controller) maxBackoff() time.Duration {
+	if c.config.MaxBackoff > 0 {
+		return time.Duration(c.config.MaxBackoff) * time.Second
+	}
+	return defaultMaxBackoff
+}
+
+// backoffNodeInfo sets the interval of the next node info fetch by the result of this one.
+// It is called from the fetch, which runs before the periodic reads the interval.
+func (c *Controller) backoffNodeInfo(ok bool) {
+	interval := c.nodeInfoBackoff.next(ok)
+	if c.nodeInfoMonitorPeriodic == nil || c.nodeInfoMonitorPeriodic.Interval == interval {
+		return
+	}
+	if ok {
+		log.Printf("Fetch the node info every %s again", interval)
+	} else {
+		log.Printf("Fetch the node info again in %s", interval)
+	}
+	c.nodeInfoMonitorPeriodic.Interval = interval
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/common/task"
+)
+
+// nodeInfoAPI only serves the node info, or fails with the error
+type nodeInfoAPI struct {
+	api.API
+	nodeInfo *api.NodeInfo
+	err      error
+}
+
+func (a *nodeInfoAPI) GetNodeInfo() (*api.NodeInfo, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	nodeInfo := *a.nodeInfo
+	return &nodeInfo, nil
+}
+
+func TestNodeInfoBackoff(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "V2ray", NodeID: 1, Port: 1145}
+	apiClient := &nodeInfoAPI{nodeInfo: nodeInfo, err: errors.New("panel is down")}
+	c := New(nil, apiClient, &Config{UpdatePeriodic: 60, MaxBackoff: 300})
+	c.nodeInfo = nodeInfo
+	c.nodeInfoBackoff = pollBackoff{base: c.interval(c.config.NodeInfoPeriodic), max: c.maxBackoff()}
+	c.nodeInfoMonitorPeriodic = &task.Periodic{Interval: c.nodeInfoBackoff.base, Execute: c.nodeInfoMonitor}
+
+	// The interval doubles on each failure, up to the max
+	for _, want := range []time.Duration{120 * time.Second, 240 * time.Second, 300 * time.Second, 300 * time.Second} {
+		if err := c.nodeInfoMonitor(); err != nil {
+			t.Fatal(err)
+		}
+		if interval := c.nodeInfoMonitorPeriodic.Interval; interval != want {
+			t.Errorf("want the interval %s after a failure, but got %s", want, interval)
+		}
+	}
+	// The first success resets it
+	apiClient.err = nil
+	if err := c.nodeInfoMonitor(); err != nil {
+		t.Fatal(err)
+	}
+	if interval := c.nodeInfoMonitorPeriodic.Interval; interval != time.Minute {
+		t.Errorf("want the interval reset to 1m0s after a success, but got %s", interval)
+	}
+	apiClient.err = errors.New("panel is down")
+	if err := c.nodeInfoMonitor(); err != nil {
+		t.Fatal(err)
+	}
+	if interval := c.nodeInfoMonitorPeriodic.Interval; interval != 120*time.Second {
+		t.Errorf("want the backoff to start over, but got %s", interval)
+	}
+}
+
+func TestPollBackoffDefault(t *testing.T) {
+	c := New(nil, nil, &Config{UpdatePeriodic: 60})
+	b := pollBackoff{base: time.Minute, max: c.maxBackoff()}
+	var interval time.Duration
+	for i := 0; i < 100; i++ {
+		interval = b.next(false)
+	}
+	if interval != defaultMaxBackoff {
+		t.Errorf("want the default max %s after many failures, but got %s", defaultMaxBackoff, interval)
+	}
+	// A max below the base keeps the base
+	b = pollBackoff{base: time.Minute, max: 30 * time.Second}
+	if interval := b.next(false); interval != time.Minute {
+		t.Errorf("want the base interval with a lower max, but got %s", interval)
+	}
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/webhook"
+)
+
+// bandwidthCap counts the traffic of the node since the last reset day, the new connections of the node are
+// refused once it reaches the limit
+type bandwidthCap struct {
+	config *BandwidthCapConfig
+	access sync.Mutex
+	state  bandwidthCapState
+}
+
+// bandwidthCapState is the traffic of the current period, kept in the StateFile across restarts
+type bandwidthCapState struct {
+	PeriodStart time.Time `json:"period_start"`
+	Used        int64     `json:"used"`
+}
+
+func newBandwidthCap(config *BandwidthCapConfig) (*bandwidthCap, error) {
+	if config.Limit <= 0 {
+		return nil, fmt.Errorf("BandwidthCapConfig requires a Limit")
+	}
+	if config.ResetDay < 0 || config.ResetDay > 31 {
+		return nil, fmt.Errorf("Invalid ResetDay %d of the bandwidth cap, it should be 1 to 31", config.ResetDay)
+	}
+	b := &bandwidthCap{config: config}
+	if config.StateFile == "" {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(config.StateFile)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil {
+		log.Printf("Ignore the invalid bandwidth cap state %s: %s", config.StateFile, err)
+		b.state = bandwidthCapState{}
+	}
+	return b, nil
+}
+
+// limit returns the cap in bytes
+func (b *bandwidthCap) limit() int64 {
+	return b.config.Limit << 30
+}
+
+// add counts the traffic at now, and returns the traffic of the period. The count restarts from 0 on the reset day
+func (b *bandwidthCap) add(traffic int64, now time.Time) int64 {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if start := capPeriodStart(now, b.config.ResetDay); !start.Equal(b.state.PeriodStart) {
+		if !b.state.PeriodStart.IsZero() {
+			log.Printf("Reset the bandwidth cap, %d bytes were used since %s", b.state.Used, b.state.PeriodStart.Format("2006-01-02"))
+		}
+		b.state = bandwidthCapState{PeriodStart: start}
+	}
+	b.state.Used += traffic
+	if b.config.StateFile != "" {
+		data, err := json.Marshal(b.state)
+		if err == nil {
+			err = writeFileAtomic(b.config.StateFile, data)
+		}
+		if err != nil {
+			log.Printf("Save the bandwidth cap state failed: %s", err)
+		}
+	}
+	return b.state.Used
+}
+
+// capPeriodStart returns the start of the period now is in, the last reset day before now. The reset day falls on
+// the last day of the months shorter than it
+func capPeriodStart(now time.Time, resetDay int) time.Time {
+	if resetDay <= 0 {
+		resetDay = 1
+	}
+	year, month, _ := now.Date()
+	start := resetDate(year, month, resetDay, now.Location())
+	if now.Before(start) {
+		start = resetDate(year, month-1, resetDay, now.Location())
+	}
+	return start
+}
+
+func resetDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	// The day 0 of the next month is the last day of the month
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// updateBandwidthCap counts the traffic of the node, and refuses the new connections of the node while its
+// traffic of the period is over the cap. The established connections go on
+func (c *Controller) updateBandwidthCap(traffic int64) {
+	used := c.bandwidthCap.add(traffic, time.Now())
+	over := used >= c.bandwidthCap.limit()
+	c.access.Lock()
+	defer c.access.Unlock()
+	if over == c.overCap {
+		return
+	}
+	c.overCap = over
+	if over {
+		message := fmt.Sprintf("the node used %d bytes, over the cap of %d GB, the new connections are refused until the reset day", used, c.config.BandwidthCapConfig.Limit)
+		log.Printf("Node %d: %s", c.clientInfo.NodeID, message)
+		c.notify(webhook.EventBandwidthCapReached, message)
+	} else {
+		log.Printf("Node %d is under the bandwidth cap, accept the new connections", c.clientInfo.NodeID)
+	}
+	for _, tag := range c.inboundTags {
+		c.UpdateOverCap(tag, over)
+	}
+	// The Hysteria2 node has no inbound in xray-core, its auth refuses the new connections
+	if c.hysteria2 != nil {
+		c.hysteria2.setOverCap(over)
+	}
+}
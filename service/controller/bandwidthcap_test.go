@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestCapPeriodStart(t *testing.T) {
+	testCases := []struct {
+		now      time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC), 0, time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC), 15, time.Date(2021, 5, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2021, 5, 10, 12, 0, 0, 0, time.UTC), 15, time.Date(2021, 4, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC), 15, time.Date(2020, 12, 15, 0, 0, 0, 0, time.UTC)},
+		// The reset day 31 falls on the last day of the shorter months
+		{time.Date(2021, 2, 28, 12, 0, 0, 0, time.UTC), 31, time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2021, 3, 15, 12, 0, 0, 0, time.UTC), 31, time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		if start := capPeriodStart(tc.now, tc.resetDay); !start.Equal(tc.want) {
+			t.Errorf("%s with reset day %d: want the period start %s, but got %s", tc.now, tc.resetDay, tc.want, start)
+		}
+	}
+}
+
+func TestBandwidthCapReset(t *testing.T) {
+	config := &BandwidthCapConfig{Limit: 1, ResetDay: 15, StateFile: filepath.Join(t.TempDir(), "bandwidth.json")}
+	b, err := newBandwidthCap(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := b.add(1<<30, time.Date(2021, 5, 14, 12, 0, 0, 0, time.UTC)); used < b.limit() {
+		t.Errorf("the node should be over the cap, used %d", used)
+	}
+	// The traffic is kept across restarts
+	if b, err = newBandwidthCap(config); err != nil {
+		t.Fatal(err)
+	}
+	if used := b.add(100, time.Date(2021, 5, 14, 13, 0, 0, 0, time.UTC)); used != 1<<30+100 {
+		t.Errorf("the traffic of the period should be loaded, used %d", used)
+	}
+	// The count restarts on the reset day
+	if used := b.add(100, time.Date(2021, 5, 15, 0, 0, 0, 0, time.UTC)); used != 100 {
+		t.Errorf("the traffic should be reset on the reset day, used %d", used)
+	}
+	// The state is replaced atomically, no temporary file is left
+	if files, err := ioutil.ReadDir(filepath.Dir(config.StateFile)); err != nil || len(files) != 1 {
+		t.Errorf("only the state file should be left, got %d files: %v", len(files), err)
+	}
+	if _, err := newBandwidthCap(&BandwidthCapConfig{Limit: 1, ResetDay: 32}); err == nil {
+		t.Error("the invalid reset day should be refused")
+	}
+}
+
+func TestBandwidthCapHysteria2(t *testing.T) {
+	config := &BandwidthCapConfig{Limit: 1}
+	b, err := newBandwidthCap(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newHysteria2Server(&Hysteria2Config{ConfigPath: filepath.Join(t.TempDir(), "hysteria2.json")}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AddUsers(&[]api.UserInfo{{UID: 1, Email: "1|a@test.com|1", UUID: "a-password"}})
+	c := &Controller{config: &Config{BandwidthCapConfig: config}, bandwidthCap: b, hysteria2: s}
+	auth := func() bool {
+		body, _ := json.Marshal(map[string]interface{}{"addr": "1.2.3.4:5678", "auth": "a-password", "tx": 0})
+		res, err := http.Post(s.authURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		response := struct{ OK bool }{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.OK
+	}
+	c.updateBandwidthCap(100)
+	if !auth() {
+		t.Fatal("the user should be accepted under the cap")
+	}
+	// The Hysteria2 node has no inbound to refuse the connections, its auth does
+	c.updateBandwidthCap(1 << 30)
+	if auth() {
+		t.Error("the user should be refused over the cap")
+	}
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// nodeCache is the last node info and user list fetched from the panel
+type nodeCache struct {
+	NodeInfo *api.NodeInfo   `json:"node_info"`
+	UserList *[]api.UserInfo `json:"user_list"`
+	Time     time.Time       `json:"time"`
+}
+
+// saveCache writes the cache atomically, so a crash never leaves a partial cache
+func saveCache(path string, nodeInfo *api.NodeInfo, userList *[]api.UserInfo) error {
+	data, err := json.Marshal(&nodeCache{NodeInfo: nodeInfo, UserList: userList, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("Save node cache failed: %s", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temp file and renames it to the path, so the file is either the old or the new one
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// loadCache reads the cache and checks that it belongs to this node
+func loadCache(path string, clientInfo api.ClientInfo) (*api.NodeInfo, *[]api.UserInfo, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("Load node cache failed: %s", err)
+	}
+	cache := new(nodeCache)
+	if err := json.Unmarshal(data, cache); err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("Load node cache %s failed: %s", path, err)
+	}
+	if cache.NodeInfo == nil || cache.UserList == nil {
+		return nil, nil, time.Time{}, fmt.Errorf("Invalid node cache %s: missing node info or user list", path)
+	}
+	if cache.NodeInfo.NodeID != clientInfo.NodeID || cache.NodeInfo.NodeType != clientInfo.NodeType {
+		return nil, nil, time.Time{}, fmt.Errorf("Invalid node cache %s: it is of %s node %d, but this is %s node %d",
+			path, cache.NodeInfo.NodeType, cache.NodeInfo.NodeID, clientInfo.NodeType, clientInfo.NodeID)
+	}
+	if cache.NodeInfo.Port <= 0 || cache.NodeInfo.Port > 65535 {
+		return nil, nil, time.Time{}, fmt.Errorf("Invalid node cache %s: invalid port %d", path, cache.NodeInfo.Port)
+	}
+	return cache.NodeInfo, cache.UserList, cache.Time, nil
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// certSecret is the secrets file of the secret cert mode
+type certSecret struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// readCertSecret reads the key pair of the secret cert mode from the secrets file, or else from the environment variables
+func readCertSecret(certConfig *CertConfig) (cert []byte, key []byte, err error) {
+	var certValue, keyValue string
+	if certConfig.SecretFile != "" {
+		data, err := ioutil.ReadFile(certConfig.SecretFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Read cert secret file failed: %s", err)
+		}
+		secret := new(certSecret)
+		if err := json.Unmarshal(data, secret); err != nil {
+			return nil, nil, fmt.Errorf("Parse cert secret file %s failed: %s", certConfig.SecretFile, err)
+		}
+		certValue, keyValue = secret.Cert, secret.Key
+	} else {
+		if certConfig.CertEnv == "" || certConfig.KeyEnv == "" {
+			return nil, nil, fmt.Errorf("CertEnv and KeyEnv or SecretFile are required by the secret cert mode")
+		}
+		certValue, keyValue = os.Getenv(certConfig.CertEnv), os.Getenv(certConfig.KeyEnv)
+	}
+	if cert, err = decodeSecretPEM(certValue); err != nil {
+		return nil, nil, fmt.Errorf("Invalid cert secret: %s", err)
+	}
+	if key, err = decodeSecretPEM(keyValue); err != nil {
+		return nil, nil, fmt.Errorf("Invalid key secret: %s", err)
+	}
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return nil, nil, fmt.Errorf("Invalid cert secret: %s", err)
+	}
+	return cert, key, nil
+}
+
+// decodeSecretPEM takes the PEM as it is, with the line breaks escaped as \n, or encoded in base64
+func decodeSecretPEM(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("empty secret")
+	}
+	if strings.HasPrefix(value, "-----BEGIN") {
+		return []byte(strings.ReplaceAll(value, `\n`, "\n")), nil
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
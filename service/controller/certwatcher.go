@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloadDelay is the time to wait for the other file of the key pair after a change
+const certReloadDelay = time.Second
+
+// certHotReloadInterval is how often xray-core reads the cert files of the running TLS inbounds again
+const certHotReloadInterval = time.Hour
+
+// certWatcher calls onChange with the old and new key pair when the content of the cert file or key file changes.
+// It watches the directories instead of the files, so the files replaced by rename or symlink swap are seen too.
+type certWatcher struct {
+	certFile string
+	keyFile  string
+	cert     []byte
+	key      []byte
+	onChange func(oldCert []byte, oldKey []byte, cert []byte, key []byte)
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+}
+
+func newCertWatcher(certFile string, keyFile string, onChange func(oldCert []byte, oldKey []byte, cert []byte, key []byte)) (*certWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &certWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		onChange: onChange,
+		watcher:  watcher,
+		done:     make(chan struct{}),
+	}
+	w.cert, w.key, _ = w.read()
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *certWatcher) read() (cert []byte, key []byte, err error) {
+	return readKeyPair(w.certFile, w.keyFile)
+}
+
+func readKeyPair(certFile string, keyFile string) (cert []byte, key []byte, err error) {
+	if cert, err = ioutil.ReadFile(certFile); err != nil {
+		return nil, nil, err
+	}
+	if key, err = ioutil.ReadFile(keyFile); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (w *certWatcher) run() {
+	reload := time.NewTimer(certReloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			reload.Reset(certReloadDelay)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watch cert file failed: %s", err)
+		case <-reload.C:
+			cert, key, err := w.read()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if bytes.Equal(cert, w.cert) && bytes.Equal(key, w.key) {
+				continue
+			}
+			oldCert, oldKey := w.cert, w.key
+			w.cert, w.key = cert, key
+			w.onChange(oldCert, oldKey, cert, key)
+		}
+	}
+}
+
+func (w *certWatcher) Close() error {
+	close(w.done)
+	return w.watcher.Close()
+}
+
+// checkCertHotReload checks whether xray-core can pick up the new key pair in the running inbounds on its next read:
+// xray-core only takes it if both the cert and the key change, the new cert must serve the same names,
+// and the old one must stay valid until then.
+func checkCertHotReload(oldCert []byte, oldKey []byte, cert []byte, key []byte, now time.Time) error {
+	if bytes.Equal(oldKey, key) || bytes.Equal(oldCert, cert) {
+		return fmt.Errorf("xray-core does not reload the cert with the same cert or key")
+	}
+	oldLeaf, err := parseLeafCert(oldCert)
+	if err != nil {
+		return err
+	}
+	leaf, err := parseLeafCert(cert)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(certNames(oldLeaf), certNames(leaf)) {
+		return fmt.Errorf("the names of the cert changed")
+	}
+	if oldLeaf.NotAfter.Before(now.Add(certHotReloadInterval)) {
+		return fmt.Errorf("the old cert expires at %s", oldLeaf.NotAfter)
+	}
+	return nil
+}
+
+func parseLeafCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM cert found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certNames returns the sorted names the cert serves
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	sort.Strings(names)
+	return names
+}
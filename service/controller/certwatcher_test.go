@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/protocol/tls/cert"
+)
+
+func generateKeyPair(t *testing.T, commonName string, notAfter time.Time) (certPEM []byte, keyPEM []byte) {
+	certificate, err := cert.Generate(nil, cert.CommonName(commonName), cert.DNSNames(commonName), cert.NotAfter(notAfter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate.ToPEM()
+}
+
+func TestCheckCertHotReload(t *testing.T) {
+	now := time.Now()
+	oldCert, oldKey := generateKeyPair(t, "a.test.tk", now.Add(24*time.Hour))
+	newCert, newKey := generateKeyPair(t, "a.test.tk", now.Add(48*time.Hour))
+	if err := checkCertHotReload(oldCert, oldKey, newCert, newKey, now); err != nil {
+		t.Errorf("the rotation of the same name should be hot reloaded: %s", err)
+	}
+	if err := checkCertHotReload(oldCert, oldKey, newCert, oldKey, now); err == nil {
+		t.Error("the cert with the same key should not be hot reloaded")
+	}
+	otherCert, otherKey := generateKeyPair(t, "b.test.tk", now.Add(48*time.Hour))
+	if err := checkCertHotReload(oldCert, oldKey, otherCert, otherKey, now); err == nil {
+		t.Error("the cert of the other name should not be hot reloaded")
+	}
+	expiringCert, expiringKey := generateKeyPair(t, "a.test.tk", now.Add(time.Minute))
+	if err := checkCertHotReload(expiringCert, expiringKey, newCert, newKey, now); err == nil {
+		t.Error("the expiring cert should not wait for the hot reload")
+	}
+}
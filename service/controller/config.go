@@ -1,17 +1,179 @@
 package controller
 
+import (
+	"github.com/XrayR-project/XrayR/common/influxdb"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/XrayR-project/XrayR/common/rule"
+	"github.com/XrayR-project/XrayR/common/webhook"
+)
+
 type Config struct {
-	ListenIP string `mapstructure:"ListenIP"`
-	UpdatePeriodic int `mapstructure:"UpdatePeriodic"`
-	CertConfig     *CertConfig `mapstructure:"CertConfig"`
+	ListenIP             string                 `mapstructure:"ListenIP"`
+	ListenIP6            string                 `mapstructure:"ListenIP6"`      // Also listen on this IPv6 address with a second inbound of each port, for the dual stack with an IPv4 ListenIP
+	SendThrough          string                 `mapstructure:"SendThrough"`    // Send the outbound traffic of the node from this local IP, or the first IP of this interface
+	DomainStrategy       string                 `mapstructure:"DomainStrategy"` // How the outbound of the node resolves the domain destinations: AsIs, UseIP, UseIPv4 or UseIPv6
+	UpdatePeriodic       int                    `mapstructure:"UpdatePeriodic"`
+	NodeInfoPeriodic     int                    `mapstructure:"NodeInfoPeriodic"` // Seconds between the node info fetches, default UpdatePeriodic
+	UserListPeriodic     int                    `mapstructure:"UserListPeriodic"` // Seconds between the user list fetches, default UpdatePeriodic
+	ReportPeriodic       int                    `mapstructure:"ReportPeriodic"`   // Seconds between the traffic and online reports, default UpdatePeriodic
+	MaxBackoff           int                    `mapstructure:"MaxBackoff"`       // Max seconds between the node info fetches while the panel is failing, default 600
+	ReadyTimeout         int                    `mapstructure:"ReadyTimeout"`     // Seconds the panel may be unreachable before the node is not ready, default 300 and at least 3 node info fetches
+	ErrorLogWindow       int                    `mapstructure:"ErrorLogWindow"`   // Seconds the repeats of an error of the monitors are collapsed into one summary for, the first one is logged at once. 0 logs every error
+	CertConfig           *CertConfig            `mapstructure:"CertConfig"`
+	LimitConfig          *limiter.Config        `mapstructure:"LimitConfig"`
+	ReportBatchSize      int                    `mapstructure:"ReportBatchSize"`      // Max number of users in one traffic report, 0 means unlimited
+	RequeueFailedTraffic bool                   `mapstructure:"RequeueFailedTraffic"` // Report the traffic of the failed batches again in the next cycle. Always so for a panel which cannot be reached, or with a TrafficBufferPath
+	TrafficBufferPath    string                 `mapstructure:"TrafficBufferPath"`    // File the traffic is kept in until it is reported, so it is reported after a restart. Empty means no buffer
+	BandwidthCapConfig   *BandwidthCapConfig    `mapstructure:"BandwidthCapConfig"`   // Refuse the new connections of the node once its traffic of the month reaches the cap
+	LoadLimitConfig      *LoadLimitConfig       `mapstructure:"LoadLimitConfig"`      // Tighten the speed limits of the users while the node is under load
+	MinUserListRatio     float64                `mapstructure:"MinUserListRatio"`     // Keep the missing users for a cycle if the user list shrinks below this ratio of the last one, e.g. 0.5. 0 disables it
+	SniffingConfig       *SniffingConfig        `mapstructure:"SniffingConfig"`       // Sniffing of the connections of the node, nil passes them through unsniffed
+	SniffExcludeDomains  []string               `mapstructure:"SniffExcludeDomains"`  // Domains not to override the destination with, supports domain:, regexp: and full: prefixes
+	SniffIncludeDomains  []string               `mapstructure:"SniffIncludeDomains"`  // Only override the destination with these domains, supports the same prefixes and *.example.com. Empty means all
+	Sniffers             []string               `mapstructure:"Sniffers"`             // Sniffers run on the connections: http, tls, bittorrent. Empty means all
+	BlockProtocols       []string               `mapstructure:"BlockProtocols"`       // Reject the connections of the sniffed protocols, e.g. bittorrent
+	VMessAEADOnly        bool                   `mapstructure:"VMessAEADOnly"`        // Build the VMess users with AlterID 0 (AEAD) whatever the panel sends
+	RejectVMessAlterID   bool                   `mapstructure:"RejectVMessAlterID"`   // With VMessAEADOnly, refuse the node instead if the panel sends a nonzero AlterID
+	ReportSNI            bool                   `mapstructure:"ReportSNI"`            // Report the sniffed TLS server names of the users with their traffic
+	ReportLastSeen       bool                   `mapstructure:"ReportLastSeen"`       // Report the last seen time of the users active in each report cycle
+	ReportFailures       bool                   `mapstructure:"ReportFailures"`       // Report the failed dispatches of the connections by the category with the node status
+	LogLevel             string                 `mapstructure:"LogLevel"`             // Log level of the connections of the node: debug, info, warning, error, none. Empty means the global level
+	DiskDevice           string                 `mapstructure:"DiskDevice"`           // Disk to report the throughput of, e.g. sda. Empty means the device of the root filesystem, or all the disks
+	InfluxDBConfig       *influxdb.Config       `mapstructure:"InfluxDBConfig"`       // Also write the traffic and node status to InfluxDB
+	WebhookConfig        *webhook.Config        `mapstructure:"WebhookConfig"`        // Post the node events to the webhook
+	RemoteRuleConfig     *rule.RemoteConfig     `mapstructure:"RemoteRuleConfig"`     // Merge the rule lists fetched from the URLs with the rules of the panel
+	Hysteria2Config      *Hysteria2Config       `mapstructure:"Hysteria2Config"`      // The hysteria server of the Hysteria2 node
+	CachePath            string                 `mapstructure:"CachePath"`            // File to cache the node info and user list, start with it when the panel is down. Empty means no cache
+	TimeoutConfig        *TimeoutConfig         `mapstructure:"TimeoutConfig"`        // Timeouts of the connections of the node
+	DialLimitConfig      *DialLimitConfig       `mapstructure:"DialLimitConfig"`      // Bound the outbound dials in flight of the node
+	HealthCheckConfig    *HealthCheckConfig     `mapstructure:"HealthCheckConfig"`    // Check the latency and health of the outbound of the node periodically
+	TProxyConfig         *TProxyConfig          `mapstructure:"TProxyConfig"`         // Also serve the transparent proxy of the gateway on the ListenIP, linux only
+	UDPInboundConfig     *UDPInboundConfig      `mapstructure:"UDPInboundConfig"`     // Also serve the UDP of the Shadowsocks node with an inbound of its own settings
+	DoHConfig            *DoHConfig             `mapstructure:"DoHConfig"`            // Resolve the destinations of the outbound of the node with a DNS-over-HTTPS server
+	DNSHosts             map[string][]string    `mapstructure:"DNSHosts"`             // Pin the domain destinations of the node to the IPs, instead of resolving them
+	OnlineIPLocation     bool                   `mapstructure:"OnlineIPLocation"`     // Annotate the online IPs with their country and ASN from the GeoData, off by default
+	AcceptProxyProtocol  bool                   `mapstructure:"AcceptProxyProtocol"`  // Take the client IPs from the PROXY protocol v1 or v2 of the load balancer in front, the connections without it are rejected
+	FakeDNSConfig        *FakeDNSConfig         `mapstructure:"FakeDNSConfig"`        // Answer the DNS queries of the clients with fake IPs, and map the connections to them back to their domains
+	RejectResponseConfig *RejectResponseConfig  `mapstructure:"RejectResponseConfig"` // Answer the HTTP requests blocked by the rules with a response instead of a reset
+	OutboundChains       []*OutboundChainConfig `mapstructure:"OutboundChains"`       // Named chains of relays, the SNIRoute and ProtocolRoute send the traffic through all the relays of a chain by its name
+	RelayConfigPath      string                 `mapstructure:"RelayConfigPath"`      // JSON file of the relays of the OutboundChains, an array of the outbounds of the xray config
+	PolicyLevel          uint32                 `mapstructure:"-"`                    // User level of the policy of the node, set by the panel
+}
+
+// BandwidthCapConfig is the monthly traffic cap of the node, for the metered servers
+type BandwidthCapConfig struct {
+	Limit     int64  `mapstructure:"Limit"`     // GB (1024^3 bytes) of the upload and download of the users in a month
+	ResetDay  int    `mapstructure:"ResetDay"`  // Day of the month the traffic is counted from 0 again, default 1. The last day of the shorter months if they have no such day
+	StateFile string `mapstructure:"StateFile"` // File keeping the traffic of the month across restarts. Empty means the count restarts with XrayR
+}
+
+// LoadLimitConfig tightens the speed limits of the users by the tier of the load of the node, for the oversold nodes
+type LoadLimitConfig struct {
+	Interval   int         `mapstructure:"Interval"`   // Seconds between the checks of the load, default 10
+	Hysteresis float64     `mapstructure:"Hysteresis"` // Percent below its thresholds the load has to drop to leave a tier, default 10
+	Tiers      []*LoadTier `mapstructure:"Tiers"`
+}
+
+// LoadTier is a tier of the load, the node enters it once the CPU or the throughput reaches the threshold set
+type LoadTier struct {
+	CPU        float64 `mapstructure:"CPU"`        // Percent of the CPU usage, 0 means the CPU does not count
+	Throughput uint64  `mapstructure:"Throughput"` // Bps of the upload and download of the users together, 0 means the throughput does not count
+	Multiplier float64 `mapstructure:"Multiplier"` // The speed limits of the users are multiplied by it in the tier, within (0, 1)
+}
+
+// TimeoutConfig is the timeouts of the connections of the node in seconds, 0 means the default of xray-core
+type TimeoutConfig struct {
+	ConnIdle     uint32 `mapstructure:"ConnIdle"`     // Close the connection idle for this long, default 300
+	UplinkOnly   uint32 `mapstructure:"UplinkOnly"`   // Close the connection this long after the downlink is closed, default 1
+	DownlinkOnly uint32 `mapstructure:"DownlinkOnly"` // Close the connection this long after the uplink is closed, default 1
+	Connect      uint32 `mapstructure:"Connect"`      // Close the connection if the outbound does not reach the destination in this long, 0 means no limit
+}
+
+// DialLimitConfig bounds the outbound dials in flight of the node, the connections beyond it wait for a slot or are closed
+type DialLimitConfig struct {
+	MaxDials     int `mapstructure:"MaxDials"`     // Max outbound dials in flight across the inbounds of the node, 0 means unlimited
+	QueueTimeout int `mapstructure:"QueueTimeout"` // Milliseconds a connection waits for a slot before it is closed, 0 closes it at once
+}
+
+// HealthCheckConfig is the periodic health check of the outbound of the node
+type HealthCheckConfig struct {
+	Target        string `mapstructure:"Target"`        // URL requested through the outbound, default http://www.gstatic.com/generate_204
+	Interval      int    `mapstructure:"Interval"`      // Seconds between the checks, default 60
+	Timeout       int    `mapstructure:"Timeout"`       // Seconds of one check, default 5
+	Failures      int    `mapstructure:"Failures"`      // Consecutive failed checks to mark the outbound unhealthy, default 3
+	SkipUnhealthy bool   `mapstructure:"SkipUnhealthy"` // Route the connections sniffed to the unhealthy outbound to the default one
+}
+
+// SniffingConfig is the sniffing of the connections of the node, all off by default
+type SniffingConfig struct {
+	Enabled      bool     `mapstructure:"Enabled"`      // Sniff the connections. Off passes them through unseen by the routes by protocol or server name, BlockProtocols and ReportSNI
+	DestOverride []string `mapstructure:"DestOverride"` // Override the destination with the sniffed domain of these protocols: http, tls. Empty keeps the destination
+}
+
+// RejectResponseConfig is the HTTP response to the HTTP requests blocked by the rules, the other connections are reset
+type RejectResponseConfig struct {
+	StatusCode  int    `mapstructure:"StatusCode"`  // Status of the response, default 403. 3xx redirects to the Location
+	Location    string `mapstructure:"Location"`    // Absolute URL the blocked requests are redirected to
+	ContentType string `mapstructure:"ContentType"` // Type of the Body, default text/html; charset=utf-8
+	Body        string `mapstructure:"Body"`        // Body of the response, default a short page telling the site is blocked. Empty for the redirects
+}
+
+// OutboundChainConfig is a named chain of relays: the node dials the first hop, and the traffic leaves from the last one
+type OutboundChainConfig struct {
+	Name string   `mapstructure:"Name"` // Outbound tag of the chain, unique across the nodes
+	Hops []string `mapstructure:"Hops"` // Tags of the relays or names of the other chains in order
+}
+
+// UDPInboundConfig is the companion UDP inbound of a Shadowsocks node. Its users, limiter and traffic are the ones of the node
+type UDPInboundConfig struct {
+	Port            uint32   `mapstructure:"Port"`            // Port of the UDP inbound, 0 means the port of the node
+	DisableSniffing bool     `mapstructure:"DisableSniffing"` // Do not sniff the UDP connections
+	Sniffers        []string `mapstructure:"Sniffers"`        // Sniffers run on the UDP connections, empty means the Sniffers of the node
+	SpeedLimit      uint64   `mapstructure:"SpeedLimit"`      // Bps of the UDP traffic of each user, on top of the user speed limit. 0 means the udp ProtocolSpeedLimit
+}
+
+// TProxyConfig is the transparent proxy inbound of the node, for the connections redirected by iptables or nftables
+type TProxyConfig struct {
+	Port uint32 `mapstructure:"Port"` // Port the firewall redirects the connections to
+	Mode string `mapstructure:"Mode"` // tproxy or redirect, default tproxy. redirect only works with tcp
+	Mark int32  `mapstructure:"Mark"` // SO_MARK of the sockets of the inbound, 0 means unset
 }
 
 type CertConfig struct {
-	CertMode   string            `mapstructure:"CertMode"` // none, file, http, dns
-	CertDomain string            `mapstructure:"CertDomain"`
-	CertFile   string            `mapstructure:"CertFile"`
-	KeyFile    string            `mapstructure:"KeyFile"`
-	Provider   string            `mapstructure:"Provider"` // alidns, cloudflare, gandi, godaddy....
-	Email      string            `mapstructure:"Email"`
-	DNSEnv     map[string]string `mapstructure:"DNSEnv"`
+	CertMode            string            `mapstructure:"CertMode"` // none, file, secret, http, dns
+	CertDomain          string            `mapstructure:"CertDomain"`
+	CertFile            string            `mapstructure:"CertFile"`
+	KeyFile             string            `mapstructure:"KeyFile"`
+	Provider            string            `mapstructure:"Provider"` // alidns, cloudflare, gandi, godaddy....
+	Email               string            `mapstructure:"Email"`
+	DNSEnv              map[string]string `mapstructure:"DNSEnv"`
+	DisableOCSPStapling bool              `mapstructure:"DisableOCSPStapling"` // Do not staple the OCSP response, for the nodes that cannot reach the OCSP responder
+	CertEnv             string            `mapstructure:"CertEnv"`             // Environment variable holding the cert of the secret mode, PEM or base64 encoded PEM
+	KeyEnv              string            `mapstructure:"KeyEnv"`              // Environment variable holding the key of the secret mode, PEM or base64 encoded PEM
+	SecretFile          string            `mapstructure:"SecretFile"`          // JSON file holding the cert and key of the secret mode instead, {"cert": "...", "key": "..."}, reloaded on change
+	MinTLSVersion       string            `mapstructure:"MinTLSVersion"`       // Minimum TLS version of the inbound, 1.0, 1.1, 1.2 or 1.3, default the one of xray-core
+	MaxTLSVersion       string            `mapstructure:"MaxTLSVersion"`       // Maximum TLS version of the inbound, as MinTLSVersion
+	CipherSuites        []string          `mapstructure:"CipherSuites"`        // Allowed TLS 1.2 and below cipher suites by the Go name, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, default all
+}
+
+// Hysteria2Config is the local settings of the Hysteria2 server run by the controller.
+// xray-core does not speak Hysteria2, so the node is served by the hysteria binary,
+// which authenticates the users against the controller and exposes the user traffic to it.
+type Hysteria2Config struct {
+	BinaryPath  string `mapstructure:"BinaryPath"`  // Path of the hysteria binary, default hysteria in PATH
+	ConfigPath  string `mapstructure:"ConfigPath"`  // File to write the generated server config to, default hysteria2_<NodeID>.json in the temp dir
+	StatsListen string `mapstructure:"StatsListen"` // Address of the traffic stats API of the server, default a free local port
+}
+
+// FakeDNSConfig is the FakeDNS of the core, the nodes using it share the pool
+type FakeDNSConfig struct {
+	IPPool         string   `mapstructure:"IPPool"`         // CIDR of the fake IPs, default 198.18.0.0/16
+	PoolSize       int64    `mapstructure:"PoolSize"`       // Max domains with a fake IP, the least recently handed out one is dropped, default 65535
+	ExcludeDomains []string `mapstructure:"ExcludeDomains"` // Domains resolved to their real IPs, supports domain:, regexp:, full: and geosite: prefixes
+}
+
+// DoHConfig is the DNS-over-HTTPS server resolving the domain destinations of the outbound of the node
+type DoHConfig struct {
+	URL         string `mapstructure:"URL"`         // URL of the server, e.g. https://dns.google/dns-query. https+local:// queries it directly instead of through the outbound
+	BootstrapIP string `mapstructure:"BootstrapIP"` // IP to reach the host of the URL at, so resolving it needs no other DNS server
 }
@@ -3,9 +3,13 @@ package controller
 import (
 	"context"
 	"fmt"
+	"log"
+	"net"
+	"time"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/limiter"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/features/inbound"
@@ -18,6 +22,9 @@ import (
 func (c *Controller) removeInbound(tag string) error {
 	inboundManager := c.server.GetFeature(inbound.ManagerType()).(inbound.Manager)
 	err := inboundManager.RemoveHandler(context.Background(), tag)
+	if err == nil {
+		getPortRegistry(c.server).release(tag)
+	}
 	return err
 }
 
@@ -27,17 +34,36 @@ func (c *Controller) removeOutbound(tag string) error {
 	return err
 }
 
+// addInbound adds the inbound after checking its port is not used by the other nodes or processes,
+// which xray would only report as an opaque error of listening
 func (c *Controller) addInbound(config *core.InboundHandlerConfig) error {
+	port, err := inboundPort(config)
+	if err != nil {
+		return err
+	}
+	registry := getPortRegistry(c.server)
+	if err := registry.reserve(port); err != nil {
+		log.Printf("Port conflict: %s", err)
+		return err
+	}
+	if err := checkPortFree(port); err != nil {
+		registry.release(port.tag)
+		log.Printf("Port conflict: %s", err)
+		return err
+	}
 	inboundManager := c.server.GetFeature(inbound.ManagerType()).(inbound.Manager)
 	rawHandler, err := core.CreateObject(c.server, config)
 	if err != nil {
+		registry.release(port.tag)
 		return err
 	}
 	handler, ok := rawHandler.(inbound.Handler)
 	if !ok {
+		registry.release(port.tag)
 		return fmt.Errorf("not an InboundHandler: %s", err)
 	}
 	if err := inboundManager.AddHandler(context.Background(), handler); err != nil {
+		registry.release(port.tag)
 		return err
 	}
 	return nil
@@ -75,7 +101,7 @@ func (c *Controller) addUsers(users []*protocol.User, tag string) error {
 		return fmt.Errorf("handler %s is not implement proxy.UserManager", err)
 	}
 	for _, item := range users {
-		mUser, err := item.ToMemoryUser()
+		mUser, err := c.userCache.toMemoryUser(item)
 		if err != nil {
 			return err
 		}
@@ -111,36 +137,161 @@ func (c *Controller) removeUsers(users []string, tag string) error {
 	return nil
 }
 
-func (c *Controller) getTraffic(email string) (up int64, down int64) {
-	upName := "user>>>" + email + ">>>traffic>>>uplink"
-	downName := "user>>>" + email + ">>>traffic>>>downlink"
+// readUserTraffic reads the traffic counters of the users without resetting them
+func (c *Controller) readUserTraffic(userList *[]api.UserInfo) map[string]trafficCount {
 	statsManager := c.server.GetFeature(stats.ManagerType()).(stats.Manager)
-	upCounter := statsManager.GetCounter(upName)
-	downCounter := statsManager.GetCounter(downName)
-	if upCounter != nil {
-		up = upCounter.Value()
-		upCounter.Set(0)
+	counters := make(map[string]trafficCount)
+	if userList == nil {
+		return counters
 	}
-	if downCounter != nil {
-		down = downCounter.Value()
-		downCounter.Set(0)
+	for _, user := range *userList {
+		count := trafficCount{uid: user.UID}
+		if upCounter := statsManager.GetCounter("user>>>" + user.Email + ">>>traffic>>>uplink"); upCounter != nil {
+			count.up = upCounter.Value()
+		}
+		if downCounter := statsManager.GetCounter("user>>>" + user.Email + ">>>traffic>>>downlink"); downCounter != nil {
+			count.down = downCounter.Value()
+		}
+		counters[user.Email] = count
+	}
+	return counters
+}
+
+// getOutboundTraffic gets and resets the traffic counted by the dispatcher for the outbound
+func (c *Controller) getOutboundTraffic(tag string) (up int64, down int64) {
+	statsManager := c.server.GetFeature(stats.ManagerType()).(stats.Manager)
+	if upCounter := statsManager.GetCounter("outbound>>>" + tag + ">>>traffic>>>uplink"); upCounter != nil {
+		up = upCounter.Set(0)
+	}
+	if downCounter := statsManager.GetCounter("outbound>>>" + tag + ">>>traffic>>>downlink"); downCounter != nil {
+		down = downCounter.Set(0)
 	}
 	return up, down
+}
 
+// getInboundTraffic returns the traffic of the inbound counted since the last call, only counted with the inbound stats enabled
+func (c *Controller) getInboundTraffic(tag string) (up int64, down int64) {
+	statsManager := c.server.GetFeature(stats.ManagerType()).(stats.Manager)
+	if upCounter := statsManager.GetCounter("inbound>>>" + tag + ">>>traffic>>>uplink"); upCounter != nil {
+		up = upCounter.Set(0)
+	}
+	if downCounter := statsManager.GetCounter("inbound>>>" + tag + ">>>traffic>>>downlink"); downCounter != nil {
+		down = downCounter.Set(0)
+	}
+	return up, down
+}
+
+// getSniffingCount returns the sniffing outcomes of the inbounds counted since the last call, by the outcome
+func (c *Controller) getSniffingCount(tags []string) map[string]int64 {
+	statsManager := c.server.GetFeature(stats.ManagerType()).(stats.Manager)
+	count := make(map[string]int64)
+	for _, outcome := range []string{mydispatcher.SniffingSuccess, mydispatcher.SniffingTimeout, mydispatcher.SniffingUnknown} {
+		count[outcome] = 0
+		for _, tag := range tags {
+			if counter := statsManager.GetCounter(mydispatcher.SniffingCounterName(tag, outcome)); counter != nil {
+				count[outcome] += counter.Set(0)
+			}
+		}
+	}
+	return count
+}
+
+// getDispatchFailures returns the failed dispatches of the inbounds counted since the last call, by the category
+func (c *Controller) getDispatchFailures(tags []string) map[string]int64 {
+	statsManager := c.server.GetFeature(stats.ManagerType()).(stats.Manager)
+	failures := make(map[string]int64)
+	for _, category := range mydispatcher.DispatchFailures {
+		failures[category] = 0
+		for _, tag := range tags {
+			if counter := statsManager.GetCounter(mydispatcher.FailureCounterName(tag, category)); counter != nil {
+				failures[category] += counter.Set(0)
+			}
+		}
+	}
+	return failures
 }
 
 func (c *Controller) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo) error {
 	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
-	err := dispather.Limiter.AddInboundLimiter(tag, nodeSpeedLimit, userList)
+	err := dispather.Limiter.AddInboundLimiter(tag, nodeSpeedLimit, userList, c.limitConfig())
+	return err
+}
+
+func (c *Controller) UpdateLoadMultiplier(tag string, multiplier float64) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.UpdateLoadMultiplier(tag, multiplier)
+}
+
+// getLimiter returns the limiter of the dispatcher, which also limits the users of the servers out of xray-core
+func (c *Controller) getLimiter() *limiter.Limiter {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter
+}
+
+func (c *Controller) UpdateInboundLimitConfig(tag string) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.UpdateInboundConfig(tag, c.limitConfig())
+}
+
+// limitConfig returns the limiter config of the node, which records the TLS server names for ReportSNI
+func (c *Controller) limitConfig() *limiter.Config {
+	limitConfig := c.config.LimitConfig
+	// The UDP inbound limits the udp of the users, which all goes through it
+	if udpConfig := c.config.UDPInboundConfig; udpConfig != nil && udpConfig.SpeedLimit > 0 {
+		udpLimitConfig := limiter.Config{}
+		if limitConfig != nil {
+			udpLimitConfig = *limitConfig
+		}
+		protocolSpeedLimit := map[string]uint64{"udp": udpConfig.SpeedLimit}
+		for network, limit := range udpLimitConfig.ProtocolSpeedLimit {
+			if network != "udp" || (limit > 0 && limit < udpConfig.SpeedLimit) {
+				protocolSpeedLimit[network] = limit
+			}
+		}
+		udpLimitConfig.ProtocolSpeedLimit = protocolSpeedLimit
+		limitConfig = &udpLimitConfig
+	}
+	if c.config.ReportSNI {
+		recordConfig := limiter.Config{}
+		if limitConfig != nil {
+			recordConfig = *limitConfig
+		}
+		recordConfig.RecordSNI = true
+		limitConfig = &recordConfig
+	}
+	return limitConfig
+}
+
+// GetUserSNI returns and clears the TLS server names the user connected to
+func (c *Controller) GetUserSNI(tag string, email string) []string {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.GetUserSNI(tag, email)
+}
+
+func (c *Controller) AddInboundAlias(tag string, alias string) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	err := dispather.Limiter.AddInboundAlias(tag, alias)
 	return err
 }
 
-func (c *Controller) UpdateInboundLimiter(tag string, updatedUserList *[]api.UserInfo) error {
+func (c *Controller) UpdateInboundLimiter(tag string, nodeSpeedLimit uint64, updatedUserList *[]api.UserInfo) error {
 	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
-	err := dispather.Limiter.UpdateInboundLimiter(tag, updatedUserList)
+	err := dispather.Limiter.UpdateInboundLimiter(tag, nodeSpeedLimit, updatedUserList)
 	return err
 }
 
+// UpdateDataUsed passes the data used by the users as counted by the panel to the limiter
+func (c *Controller) UpdateDataUsed(tag string, userList *[]api.UserInfo) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.UpdateDataUsed(tag, userList)
+}
+
+// AddDataUsed counts the reported traffic of the user against its data limit, and returns the bytes left of it
+func (c *Controller) AddDataUsed(tag string, email string, traffic int64) (remaining uint64, limited bool) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.AddDataUsed(tag, email, traffic)
+}
+
 func (c *Controller) DeleteInboundLimiter(tag string) error {
 	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
 	err := dispather.Limiter.DeleteInboundLimiter(tag)
@@ -149,7 +300,98 @@ func (c *Controller) DeleteInboundLimiter(tag string) error {
 
 func (c *Controller) GetOnlineDevice(tag string) (*[]api.OnlineUser, error) {
 	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
-	return dispather.Limiter.GetOnlineDevice(tag)
+	onlineDevice, err := dispather.Limiter.GetOnlineDevice(tag)
+	if err != nil || !c.config.OnlineIPLocation || dispather.GeoData == nil {
+		return onlineDevice, err
+	}
+	// The locations are cached by the geo data, so the reports do not look up the same IPs again
+	for i := range *onlineDevice {
+		user := &(*onlineDevice)[i]
+		location := dispather.GeoData.Locate(net.ParseIP(user.IP))
+		user.Country, user.ASN = location.Country, location.ASN
+	}
+	return onlineDevice, nil
+}
+
+// ListOnlineDevice returns the online devices without resetting them
+func (c *Controller) ListOnlineDevice(tag string) (*[]api.OnlineUser, error) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.ListOnlineDevice(tag)
+}
+
+func (c *Controller) GetBucketStatus(tag string) ([]limiter.BucketStatus, error) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.GetBucketStatus(tag)
+}
+
+func (c *Controller) SampleOnlineDevice(tag string) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.SampleOnlineDevice(tag)
+}
+
+func (c *Controller) GetOnlineDeviceCount(tag string) (current int, peak int, err error) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.GetOnlineDeviceCount(tag)
+}
+
+func (c *Controller) ResetOnlineIP(tag string, email string) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.Limiter.ResetOnlineIP(tag, email)
+}
+
+func (c *Controller) UpdateProtocolRule(tag string, protocols []string) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.RuleManager.UpdateProtocolRule(tag, protocols)
+}
+
+func (c *Controller) UpdateSniffIncludeDomains(tag string, domains []string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateSniffIncludeDomains(tag, domains)
+}
+
+func (c *Controller) UpdateSniffers(tag string, sniffers []string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateSniffers(tag, sniffers)
+}
+
+func (c *Controller) UpdateDNSOutbound(tag string, outboundTag string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateDNSOutbound(tag, outboundTag)
+}
+
+func (c *Controller) UpdateLogLevel(tag string, level string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateLogLevel(tag, level)
+}
+
+func (c *Controller) UpdateOverCap(tag string, over bool) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateOverCap(tag, over)
+}
+
+func (c *Controller) RemoveUserConnCounter(emails []string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.RemoveUserConnCounter(emails)
+}
+
+func (c *Controller) UpdateRejectResponse(tag string, response []byte) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateRejectResponse(tag, response)
+}
+
+func (c *Controller) UpdateDialLimit(tag string, limit *mydispatcher.DialLimit) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateDialLimit(tag, limit)
+}
+
+func (c *Controller) UpdateStaticHosts(tag string, hosts *mydispatcher.StaticHosts) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateStaticHosts(tag, hosts)
+}
+
+func (c *Controller) UpdateConnectTimeout(tag string, timeout time.Duration) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.UpdateConnectTimeout(tag, timeout)
 }
 
 func (c *Controller) UpdateRule(tag string, newRuleList []api.DetectRule) error {
@@ -158,7 +400,33 @@ func (c *Controller) UpdateRule(tag string, newRuleList []api.DetectRule) error
 	return err
 }
 
+func (c *Controller) DeleteRule(tag string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.RuleManager.DeleteRule(tag)
+}
+
+func (c *Controller) UpdateRemoteRule(tag string, ruleList []api.DetectRule) error {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.RuleManager.UpdateRemoteRule(tag, ruleList)
+}
+
 func (c *Controller) GetDetectResult(tag string) (*[]api.DetectResult, error) {
 	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
 	return dispather.RuleManager.GetDetectResult(tag)
 }
+
+// CheckOutbound checks the health of the outbound through the dispatcher
+func (c *Controller) CheckOutbound(tag string, check *mydispatcher.HealthCheck) mydispatcher.OutboundHealth {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.CheckOutbound(context.Background(), tag, check)
+}
+
+func (c *Controller) GetOutboundHealth(tag string) (mydispatcher.OutboundHealth, bool) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	return dispather.GetOutboundHealth(tag)
+}
+
+func (c *Controller) RemoveOutboundHealth(tag string) {
+	dispather := c.server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispather.RemoveOutboundHealth(tag)
+}
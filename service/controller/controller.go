@@ -1,90 +1,268 @@
 package controller
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/influxdb"
 	"github.com/XrayR-project/XrayR/common/legocmd"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/XrayR-project/XrayR/common/rule"
 	"github.com/XrayR-project/XrayR/common/serverstatus"
+	"github.com/XrayR-project/XrayR/common/version"
+	"github.com/XrayR-project/XrayR/common/webhook"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/task"
 	"github.com/xtls/xray-core/core"
 )
 
+// onlineSampleInterval is how often the online devices are counted for the peak of a report cycle
+const onlineSampleInterval = 10 * time.Second
+
 type Controller struct {
 	server                  *core.Instance
 	config                  *Config
 	clientInfo              api.ClientInfo
 	apiClient               api.API
 	nodeInfo                *api.NodeInfo
+	tag                     string
+	inboundTags             []string
+	chainTags               []string // The outbounds of the chains of the node
 	userList                *[]api.UserInfo
 	nodeStatus              *api.NodeStatus
 	onlineUsers             *[]api.OnlineUser
 	userTraffic             *[]api.UserTraffic
+	pendingTraffic          []api.UserTraffic
+	influxClient            *influxdb.Client
+	notifier                *webhook.Notifier
+	apiUnreachable          map[string]bool // The failing fetches, key: node info or user list
+	errorLog                logThrottle     // Collapses the repeated errors of the monitors
+	access                  sync.Mutex      // Serializes the monitors that change the inbounds and users
 	nodeInfoMonitorPeriodic *task.Periodic
+	nodeInfoBackoff         pollBackoff // Backs off the node info fetches while the panel is failing
+	userListMonitorPeriodic *task.Periodic
 	userReportPeriodic      *task.Periodic
+	deviceResetPeriodic     *task.Periodic
+	onlineSamplePeriodic    *task.Periodic
+	healthCheckPeriodic     *task.Periodic
+	remoteRulePeriodic      *task.Periodic
+	loadLimitPeriodic       *task.Periodic
+	loadCurve               *loadCurve // The tier of the load of the node with LoadLimitConfig
+	remoteRuleFetcher       *rule.RemoteFetcher
+	remoteRules             []api.DetectRule // The last rules of the remote lists, applied to the new inbounds
+	certWatcher             *certWatcher
+	hysteria2               *hysteria2Server // The hysteria server of the Hysteria2 node, which is not served by xray-core
+	speed                   speedMeter       // Live speed of the users, served by the admin API
+	userListGuard           userListGuard
+	diskIO                  *serverstatus.DiskIOSampler
+	userCache               memoryUserCache   // The accounts of the users, reused when the inbounds are rebuilt
+	trafficMultiplier       trafficMultiplier // The fractional bytes of the users with a traffic multiplier
+	lastSeen                lastSeenTracker   // The last time the users were active, reported with ReportLastSeen
+	bandwidthCap            *bandwidthCap     // The traffic of the node against the monthly cap if set
+	overCap                 bool              // The node is over the cap, its new connections are refused
+	startTime               time.Time         // The controller uptime is reported with the node status
+	probe                   nodeProbe         // The liveness and the readiness of the node, served by the admin API
 }
 
 // New return a Controller service with default parameters.
 func New(server *core.Instance, api api.API, config *Config) *Controller {
 	controller := &Controller{
-		server:    server,
-		config:    config,
-		apiClient: api,
+		server:        server,
+		config:        config,
+		apiClient:     api,
+		userListGuard: userListGuard{ratio: config.MinUserListRatio},
+		diskIO:        serverstatus.NewDiskIOSampler(config.DiskDevice),
+		errorLog:      logThrottle{window: time.Duration(config.ErrorLogWindow) * time.Second},
 	}
 	return controller
 }
 
 // Start implement the Start() function of the service interface
 func (c *Controller) Start() error {
+	c.startTime = time.Now()
 	c.clientInfo = c.apiClient.Describe()
-	// First fetch Node Info
-	newNodeInfo, err := c.apiClient.GetNodeInfo()
+	// Check the cert provided by the user before serving
+	if certConfig := c.config.CertConfig; certConfig.CertMode == "file" {
+		if err := checkCertFile(certConfig.CertFile, certConfig.KeyFile); err != nil {
+			return err
+		}
+	} else if certConfig.CertMode == "secret" {
+		if _, _, err := readCertSecret(certConfig); err != nil {
+			return err
+		}
+	}
+	if c.config.BandwidthCapConfig != nil {
+		bandwidthCap, err := newBandwidthCap(c.config.BandwidthCapConfig)
+		if err != nil {
+			return err
+		}
+		c.bandwidthCap = bandwidthCap
+	}
+	if c.config.LoadLimitConfig != nil {
+		curve, err := newLoadCurve(c.config.LoadLimitConfig)
+		if err != nil {
+			return err
+		}
+		c.loadCurve = curve
+	}
+	// First fetch Node Info and user list
+	newNodeInfo, userInfo, err := c.fetchNodeInfoAndUserList()
 	if err != nil {
-		return err
+		if c.config.CachePath == "" {
+			return err
+		}
+		// Serve the last known config, and retry the panel in the monitor
+		log.Printf("Get node info and user list failed: %s, start with the cache %s", err, c.config.CachePath)
+		var cacheTime time.Time
+		var cacheErr error
+		newNodeInfo, userInfo, cacheTime, cacheErr = loadCache(c.config.CachePath, c.clientInfo)
+		if cacheErr != nil {
+			log.Print(cacheErr)
+			return err
+		}
+		log.Printf("Loaded the node info and %d users cached at %s", len(*userInfo), cacheTime.Format(time.RFC3339))
+		c.apiUnreachable = map[string]bool{"node info": true, "user list": true}
+	} else {
+		c.saveCache(newNodeInfo, userInfo)
+		c.probe.synced()
 	}
 	// Add new tag
 	err = c.addNewTag(newNodeInfo)
 	if err != nil {
-		log.Panic(err)
+		log.Print(err)
 		return err
 	}
 	// Update user
-	userInfo, err := c.apiClient.GetUserList()
-	if err != nil {
-		return err
-	}
 	err = c.addNewUser(userInfo, newNodeInfo)
 	if err != nil {
 		return err
 	}
 	c.nodeInfo = newNodeInfo
 	c.userList = userInfo
-	tag := fmt.Sprintf("%s_%d", c.nodeInfo.NodeType, c.nodeInfo.Port)
 	// Add Limiter
-	if err := c.AddInboundLimiter(tag, newNodeInfo.SpeedLimit, userInfo); err != nil {
-		log.Print(err)
+	c.addLimiter(newNodeInfo, userInfo)
+	c.sampleUserSpeed()
+	c.loadTrafficBuffer()
+	// The node may be over the cap with the traffic counted before the restart
+	if c.bandwidthCap != nil {
+		c.updateBandwidthCap(0)
+	}
+	// Metrics sink
+	if c.config.InfluxDBConfig != nil {
+		influxClient, err := influxdb.New(c.config.InfluxDBConfig)
+		if err != nil {
+			return err
+		}
+		c.influxClient = influxClient
+	}
+	if c.config.WebhookConfig != nil {
+		notifier, err := webhook.New(c.config.WebhookConfig)
+		if err != nil {
+			return err
+		}
+		c.notifier = notifier
 	}
+	if c.config.RemoteRuleConfig != nil {
+		fetcher, err := rule.NewRemoteFetcher(c.config.RemoteRuleConfig)
+		if err != nil {
+			return err
+		}
+		c.remoteRuleFetcher = fetcher
+		c.remoteRulePeriodic = &task.Periodic{
+			Interval: c.config.RemoteRuleConfig.FetchInterval(),
+			Execute:  c.remoteRuleMonitor,
+		}
+	}
+	// Reset the online devices on schedule
+	if c.config.LimitConfig != nil && c.config.LimitConfig.DeviceReset != nil {
+		resetter, err := limiter.NewDeviceResetter(c.config.LimitConfig.DeviceReset, c.resetOnlineIP)
+		if err != nil {
+			return err
+		}
+		c.deviceResetPeriodic = &task.Periodic{
+			Interval: 10 * time.Second,
+			Execute:  resetter.Execute,
+		}
+	}
+	c.nodeInfoBackoff = pollBackoff{base: c.interval(c.config.NodeInfoPeriodic), max: c.maxBackoff()}
+	c.probe.setReadyTimeout(readyTimeout(c.config, c.nodeInfoBackoff.base))
+	c.probe.setUp(true)
 	c.nodeInfoMonitorPeriodic = &task.Periodic{
-		Interval: time.Duration(c.config.UpdatePeriodic) * time.Second,
+		Interval: c.nodeInfoBackoff.base,
 		Execute:  c.nodeInfoMonitor,
 	}
+	c.userListMonitorPeriodic = &task.Periodic{
+		Interval: c.interval(c.config.UserListPeriodic),
+		Execute:  c.userListMonitor,
+	}
 	c.userReportPeriodic = &task.Periodic{
-		Interval: time.Duration(c.config.UpdatePeriodic) * time.Second,
+		Interval: c.interval(c.config.ReportPeriodic),
 		Execute:  c.userInfoMonitor,
 	}
+	c.onlineSamplePeriodic = &task.Periodic{
+		Interval: onlineSampleInterval,
+		Execute:  c.sampleOnlineDevice,
+	}
 	log.Print("Start monitor node status")
 	c.nodeInfoMonitorPeriodic.Start()
+	log.Print("Start monitor user list")
+	c.userListMonitorPeriodic.Start()
 	log.Print("Start report node status")
 	c.userReportPeriodic.Start()
+	c.onlineSamplePeriodic.Start()
+	if c.deviceResetPeriodic != nil {
+		log.Print("Start device reset schedule")
+		c.deviceResetPeriodic.Start()
+	}
+	if c.config.HealthCheckConfig != nil {
+		c.healthCheckPeriodic = &task.Periodic{
+			Interval: c.healthCheckInterval(),
+			Execute:  c.outboundHealthCheck,
+		}
+		log.Print("Start outbound health check")
+		c.healthCheckPeriodic.Start()
+	}
+	if c.remoteRulePeriodic != nil {
+		log.Print("Start fetching remote rule lists")
+		c.remoteRulePeriodic.Start()
+	}
+	if c.loadCurve != nil {
+		c.loadLimitPeriodic = &task.Periodic{
+			Interval: c.loadInterval(),
+			Execute:  c.loadLimitMonitor,
+		}
+		log.Print("Start load limit check")
+		c.loadLimitPeriodic.Start()
+	}
+	// Reload the cert provided by the user on change
+	if certConfig := c.config.CertConfig; certConfig.CertMode == "file" {
+		c.certWatcher, err = newCertWatcher(certConfig.CertFile, certConfig.KeyFile, c.reloadCert)
+		if err != nil {
+			return fmt.Errorf("Watch cert file failed: %s", err)
+		}
+		log.Printf("Start watching cert file %s", certConfig.CertFile)
+	} else if certConfig.CertMode == "secret" && certConfig.SecretFile != "" {
+		c.certWatcher, err = newCertWatcher(certConfig.SecretFile, certConfig.SecretFile, c.reloadCertSecret)
+		if err != nil {
+			return fmt.Errorf("Watch cert secret file failed: %s", err)
+		}
+		log.Printf("Start watching cert secret file %s", certConfig.SecretFile)
+	}
 	return nil
 }
 
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
+	c.probe.setUp(false)
 	if c.nodeInfoMonitorPeriodic != nil {
 		err := c.nodeInfoMonitorPeriodic.Close()
 		if err != nil {
@@ -92,171 +270,718 @@ func (c *Controller) Close() error {
 		}
 	}
 
-	if c.nodeInfoMonitorPeriodic != nil {
+	if c.userListMonitorPeriodic != nil {
+		err := c.userListMonitorPeriodic.Close()
+		if err != nil {
+			log.Panicf("user list periodic close failed: %s", err)
+		}
+	}
+
+	if c.userReportPeriodic != nil {
 		err := c.userReportPeriodic.Close()
 		if err != nil {
 			log.Panicf("user report periodic close failed: %s", err)
 		}
 	}
+
+	if c.deviceResetPeriodic != nil {
+		err := c.deviceResetPeriodic.Close()
+		if err != nil {
+			log.Panicf("device reset periodic close failed: %s", err)
+		}
+	}
+
+	if c.onlineSamplePeriodic != nil {
+		err := c.onlineSamplePeriodic.Close()
+		if err != nil {
+			log.Panicf("online sample periodic close failed: %s", err)
+		}
+	}
+
+	if c.healthCheckPeriodic != nil {
+		err := c.healthCheckPeriodic.Close()
+		if err != nil {
+			log.Panicf("health check periodic close failed: %s", err)
+		}
+	}
+
+	if c.remoteRulePeriodic != nil {
+		err := c.remoteRulePeriodic.Close()
+		if err != nil {
+			log.Panicf("remote rule periodic close failed: %s", err)
+		}
+	}
+
+	if c.loadLimitPeriodic != nil {
+		err := c.loadLimitPeriodic.Close()
+		if err != nil {
+			log.Panicf("load limit periodic close failed: %s", err)
+		}
+	}
+
+	if c.certWatcher != nil {
+		if err := c.certWatcher.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	// The other nodes of the process keep running, so the node leaves nothing behind in the shared core
+	c.access.Lock()
+	if c.nodeInfo != nil {
+		c.removeNode()
+	}
+	c.access.Unlock()
+
+	if c.hysteria2 != nil {
+		if err := c.hysteria2.Close(); err != nil {
+			log.Print(err)
+		}
+	}
 	return nil
 }
 
+// fetchNodeInfoAndUserList fetches the node info and the user list concurrently. The API client takes no context to
+// cancel a request with, so a failed fetch waits for the other instead of leaving it running behind.
+// The error of the node info goes first, as the node info is applied first
+func (c *Controller) fetchNodeInfoAndUserList() (*api.NodeInfo, *[]api.UserInfo, error) {
+	var nodeInfo *api.NodeInfo
+	var userList *[]api.UserInfo
+	var nodeInfoErr, userListErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		nodeInfo, nodeInfoErr = c.apiClient.GetNodeInfo()
+	}()
+	go func() {
+		defer wg.Done()
+		userList, userListErr = c.apiClient.GetUserList()
+	}()
+	wg.Wait()
+	if nodeInfoErr != nil {
+		return nil, nil, nodeInfoErr
+	}
+	if userListErr != nil {
+		return nil, nil, userListErr
+	}
+	return nodeInfo, deduplicateUserList(userList), nil
+}
+
+// deduplicateUserList keeps the first user of each email, since the email is the key of the inbound users, stats and limiter
+func deduplicateUserList(userList *[]api.UserInfo) *[]api.UserInfo {
+	// The panel may send no list for a node without users
+	if userList == nil {
+		return &[]api.UserInfo{}
+	}
+	users := make([]api.UserInfo, 0, len(*userList))
+	firstUID := make(map[string]int)
+	for _, user := range *userList {
+		if uid, exist := firstUID[user.Email]; exist {
+			log.Printf("Duplicate user email %s: UID %d and UID %d, keep UID %d", user.Email, uid, user.UID, uid)
+			continue
+		}
+		firstUID[user.Email] = user.UID
+		users = append(users, user)
+	}
+	return &users
+}
+
+// interval returns the interval of a periodic, which defaults to UpdatePeriodic
+func (c *Controller) interval(periodic int) time.Duration {
+	if periodic <= 0 {
+		periodic = c.config.UpdatePeriodic
+	}
+	return time.Duration(periodic) * time.Second
+}
+
+// checkAPI logs the fetch error and posts the changes of the api reachability, it returns whether the fetch succeeded.
+// The api is reachable again only when both the node info and the user list are fetched.
+func (c *Controller) checkAPI(fetch string, err error) bool {
+	if err != nil {
+		c.errorLog.Print(err)
+		if len(c.apiUnreachable) == 0 {
+			c.notify(webhook.EventAPIUnreachable, err.Error())
+		}
+		if c.apiUnreachable == nil {
+			c.apiUnreachable = make(map[string]bool)
+		}
+		c.apiUnreachable[fetch] = true
+		return false
+	}
+	if c.apiUnreachable[fetch] {
+		delete(c.apiUnreachable, fetch)
+		if len(c.apiUnreachable) == 0 {
+			c.notify(webhook.EventAPIRecovered, "the panel api is reachable again")
+		}
+	}
+	return true
+}
+
 func (c *Controller) nodeInfoMonitor() (err error) {
-	// First fetch Node Info
+	// First fetch Node Info, skip this cycle if the panel is not available
 	newNodeInfo, err := c.apiClient.GetNodeInfo()
-	if err != nil {
-		return err
+	c.access.Lock()
+	defer c.access.Unlock()
+	// The interval is read at the end of the run, after the backoff
+	defer func() { c.probe.ran("node info", c.nodeInfoMonitorPeriodic.Interval) }()
+	if !c.checkAPI("node info", err) {
+		c.backoffNodeInfo(false)
+		return nil
 	}
-	var nodeInfoChanged bool = false
+	c.backoffNodeInfo(true)
+	c.probe.synced()
 	// If nodeInfo changed
 	if !reflect.DeepEqual(c.nodeInfo, newNodeInfo) {
-		// Remove old tag
-		oldtag := fmt.Sprintf("%s_%d", c.nodeInfo.NodeType, c.nodeInfo.Port)
-		err := c.removeOldTag(oldtag)
-		if err != nil {
-			log.Print(err)
+		// Retry on the next cycle if the new node info is broken, the old inbounds are gone meanwhile
+		if err := c.rebuildInbounds(newNodeInfo); err != nil {
+			c.errorLog.Print(err)
+			c.probe.setUp(false)
+			return nil
 		}
-		// Add new tag
-		err = c.addNewTag(newNodeInfo)
-		if err != nil {
-			log.Panic(err)
-		}
-		nodeInfoChanged = true
+		c.probe.setUp(true)
+		change := api.NewNodeInfoChange(c.nodeInfo, newNodeInfo)
 		c.nodeInfo = newNodeInfo
-		// Remove Old limiter
-		if err = c.DeleteInboundLimiter(oldtag); err != nil {
-			log.Print(err)
+		log.Printf("Node info changed: %s", change.Summary)
+		if err := c.apiClient.ReportNodeInfoChange(change); err != nil {
+			c.errorLog.Printf("Report the node info change failed: %s", err)
 		}
+		c.notify(webhook.EventNodeInfoChanged, fmt.Sprintf("the node is serving %s on port %d now", newNodeInfo.TransportProtocol, newNodeInfo.Port))
+		c.saveCache(c.nodeInfo, c.userList)
 	}
 	// Check Cert
 	if c.nodeInfo.EnableTLS && (c.config.CertConfig.CertMode == "dns" || c.config.CertConfig.CertMode == "http") {
 		lego, err := legocmd.New()
 		if err != nil {
-			log.Print(err)
+			c.errorLog.Print(err)
 		}
-		// Xray-core supports the OcspStapling certification hot renew
-		_, _, err = lego.RenewCert(c.config.CertConfig.CertDomain, c.config.CertConfig.Email, c.config.CertConfig.CertMode, c.config.CertConfig.Provider, c.config.CertConfig.DNSEnv)
+		// Only a renew which actually replaces the cert is reloaded
+		oldCert, oldKey, _ := readCertConfigKeyPair(c.config.CertConfig)
+		certFile, keyFile, err := lego.RenewCert(c.config.CertConfig.CertDomain, c.config.CertConfig.Email, c.config.CertConfig.CertMode, c.config.CertConfig.Provider, c.config.CertConfig.DNSEnv)
 		if err != nil {
-			log.Print(err)
+			c.errorLog.Print(err)
+			c.notify(webhook.EventCertRenewFailed, err.Error())
+		} else if cert, key, err := readKeyPair(certFile, keyFile); err != nil {
+			c.errorLog.Print(err)
+		} else if oldCert != nil && (!bytes.Equal(oldCert, cert) || !bytes.Equal(oldKey, key)) {
+			log.Printf("Cert of %s renewed", c.config.CertConfig.CertDomain)
+			c.applyCert(oldCert, oldKey, cert, key)
 		}
 	}
-	// Update User
-	newUserInfo, err := c.apiClient.GetUserList()
+	return nil
+}
+
+// readCertConfigKeyPair reads the key pair served by the inbounds
+func readCertConfigKeyPair(certConfig *CertConfig) (cert []byte, key []byte, err error) {
+	certFile, keyFile, err := getCertFile(certConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readKeyPair(certFile, keyFile)
+}
+
+// rebuildInbounds replaces the inbounds with the ones of the node info, and adds the current users to them
+func (c *Controller) rebuildInbounds(nodeInfo *api.NodeInfo) error {
+	// Remove old tag
+	oldTags := c.inboundTags
+	err := c.removeOldTag()
 	if err != nil {
 		log.Print(err)
 	}
-	if nodeInfoChanged {
-		err = c.addNewUser(newUserInfo, newNodeInfo)
-		if err != nil {
+	// Add new tag
+	err = c.addNewTag(nodeInfo)
+	if err != nil {
+		return err
+	}
+	// Remove Old limiter, and the rules of the inbounds gone with the node info
+	for _, oldTag := range oldTags {
+		if err = c.DeleteInboundLimiter(oldTag); err != nil {
 			log.Print(err)
 		}
-		// Add Limiter
-		tag := fmt.Sprintf("%s_%d", c.nodeInfo.NodeType, c.nodeInfo.Port)
-		if err := c.AddInboundLimiter(tag, newNodeInfo.SpeedLimit, newUserInfo); err != nil {
-			log.Print(err)
+		if !hasTag(c.inboundTags, oldTag) {
+			c.DeleteRule(oldTag)
 		}
-	} else {
-		deleted, added := compareUserList(c.userList, newUserInfo)
-		if len(deleted) > 0 {
-			deletedEmail := make([]string, len(deleted))
-			for i, u := range deleted {
-				deletedEmail[i] = u.Email
-			}
-			tag := fmt.Sprintf("%s_%d", c.nodeInfo.NodeType, c.nodeInfo.Port)
-			err := c.removeUsers(deletedEmail, tag)
-			if err != nil {
-				log.Print(err)
-			}
+	}
+	// Add the current users to the new inbounds
+	err = c.addNewUser(c.userList, nodeInfo)
+	if err != nil {
+		log.Print(err)
+		c.notify(webhook.EventUserSyncFailed, err.Error())
+	}
+	// Add Limiter
+	c.addLimiter(nodeInfo, c.userList)
+	return nil
+}
+
+// reloadCert reloads the changed cert file into the TLS inbounds, the old cert is kept if the new one is invalid
+func (c *Controller) reloadCert(oldCert []byte, oldKey []byte, cert []byte, key []byte) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	certConfig := c.config.CertConfig
+	if err := checkCertFile(certConfig.CertFile, certConfig.KeyFile); err != nil {
+		log.Printf("Keep the old cert: %s", err)
+		return
+	}
+	log.Printf("Cert file %s changed", certConfig.CertFile)
+	c.applyCert(oldCert, oldKey, cert, key)
+}
+
+// reloadCertSecret rebuilds the TLS inbounds to serve the changed secrets file, xray-core does not reload the inline cert
+func (c *Controller) reloadCertSecret(_ []byte, _ []byte, _ []byte, _ []byte) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	certConfig := c.config.CertConfig
+	if _, _, err := readCertSecret(certConfig); err != nil {
+		log.Printf("Keep the old cert: %s", err)
+		return
+	}
+	log.Printf("Cert secret file %s changed", certConfig.SecretFile)
+	if !c.nodeInfo.EnableTLS {
+		return
+	}
+	if err := c.rebuildInbounds(c.nodeInfo); err != nil {
+		log.Print(err)
+	}
+}
+
+// applyCert leaves the new cert to the hot reload of xray-core when it can, which keeps the connections,
+// or rebuilds the TLS inbounds to serve it at once
+func (c *Controller) applyCert(oldCert []byte, oldKey []byte, cert []byte, key []byte) {
+	if !c.nodeInfo.EnableTLS {
+		return
+	}
+	err := checkCertHotReload(oldCert, oldKey, cert, key, time.Now())
+	if err == nil {
+		log.Printf("The inbounds reload the cert in place within %s", certHotReloadInterval)
+		return
+	}
+	log.Printf("Rebuild the inbounds to reload the cert: %s", err)
+	if err := c.rebuildInbounds(c.nodeInfo); err != nil {
+		log.Print(err)
+	}
+}
+
+func (c *Controller) userListMonitor() (err error) {
+	// First fetch the user list, skip this cycle if the panel is not available
+	newUserInfo, err := c.apiClient.GetUserList()
+	c.access.Lock()
+	defer c.access.Unlock()
+	defer c.probe.ran("user list", c.userListMonitorPeriodic.Interval)
+	if !c.checkAPI("user list", err) {
+		return nil
+	}
+	newUserInfo = deduplicateUserList(newUserInfo)
+	deleted, added := compareUserList(c.userList, newUserInfo)
+	// The users missing from a suspect list stay until the next fetch, the additions are applied anyway
+	deleted, kept := c.userListGuard.keep(c.userList, newUserInfo, deleted)
+	if len(kept) > 0 {
+		userList := append(append([]api.UserInfo{}, *newUserInfo...), kept...)
+		newUserInfo = &userList
+	}
+	if len(deleted) > 0 {
+		deletedEmail := make([]string, len(deleted))
+		for i, u := range deleted {
+			deletedEmail[i] = u.Email
 		}
-		if len(added) > 0 {
-			err = c.addNewUser(&added, c.nodeInfo)
-			if err != nil {
-				log.Print(err)
-			}
-			// Update Limiter
-			tag := fmt.Sprintf("%s_%d", c.nodeInfo.NodeType, c.nodeInfo.Port)
-			if err := c.AddInboundLimiter(tag, newNodeInfo.SpeedLimit, &added); err != nil {
+		for _, tag := range c.inboundTags {
+			if err := c.removeUsers(deletedEmail, tag); err != nil {
 				log.Print(err)
+				c.notify(webhook.EventUserSyncFailed, err.Error())
 			}
 		}
-		log.Printf("%d user deleted, %d user added", len(deleted), len(added))
+		// The changed users are deleted and added back, only the users gone from the node drop their state
+		gone := goneUsers(deleted, added)
+		goneEmail := make([]string, len(gone))
+		for i, u := range gone {
+			goneEmail[i] = u.Email
+		}
+		c.userCache.remove(goneEmail)
+		c.RemoveUserConnCounter(goneEmail)
+		c.trafficMultiplier.remove(goneEmail)
+		c.lastSeen.remove(gone)
+		if c.hysteria2 != nil {
+			c.hysteria2.RemoveUsers(deletedEmail)
+		}
+	}
+	if len(added) > 0 {
+		err = c.addNewUser(&added, c.nodeInfo)
+		if err != nil {
+			log.Print(err)
+			c.notify(webhook.EventUserSyncFailed, err.Error())
+		}
+		// Update Limiter
+		if err := c.UpdateInboundLimiter(c.tag, c.nodeInfo.SpeedLimit, &added); err != nil {
+			log.Print(err)
+		}
+	}
+	log.Printf("%d user deleted, %d user added", len(deleted), len(added))
+	if !reflect.DeepEqual(c.userList, newUserInfo) {
+		c.saveCache(c.nodeInfo, newUserInfo)
 	}
 	c.userList = newUserInfo
+	if err := c.UpdateDataUsed(c.tag, newUserInfo); err != nil {
+		log.Print(err)
+	}
 	return nil
 }
 
-func (c *Controller) removeOldTag(oldtag string) (err error) {
-	err = c.removeInbound(oldtag)
-	if err != nil {
-		return err
+// saveCache saves the node info and user list if the cache is enabled
+func (c *Controller) saveCache(nodeInfo *api.NodeInfo, userList *[]api.UserInfo) {
+	if c.config.CachePath == "" {
+		return
+	}
+	if err := saveCache(c.config.CachePath, nodeInfo, userList); err != nil {
+		log.Print(err)
+	}
+}
+
+// notify posts the event to the webhook if it is configured
+func (c *Controller) notify(eventType string, message string) {
+	if c.notifier == nil {
+		return
 	}
-	err = c.removeOutbound(oldtag)
+	c.notifier.Notify(&webhook.Event{
+		Type:     eventType,
+		NodeType: c.clientInfo.NodeType,
+		NodeID:   c.clientInfo.NodeID,
+		Message:  message,
+	})
+}
+
+func (c *Controller) removeOldTag() (err error) {
+	if c.nodeInfo.NodeType == "Hysteria2" {
+		c.hysteria2.Stop()
+		return nil
+	}
+	for _, tag := range c.inboundTags {
+		if err = c.removeInbound(tag); err != nil {
+			return err
+		}
+		if err = c.resetInbound(tag); err != nil {
+			return err
+		}
+	}
+	c.inboundTags = nil
+	c.RemoveOutboundHealth(c.tag)
+	err = c.removeOutbound(c.tag)
 	if err != nil {
 		return err
 	}
+	for _, tag := range c.chainTags {
+		if err = c.removeOutbound(tag); err != nil {
+			return err
+		}
+	}
+	c.chainTags = nil
+	if c.config.FakeDNSConfig != nil {
+		return c.removeOutbound(dnsOutboundTag(c.tag))
+	}
 	return nil
 }
 
+// resetInbound drops the rules and the dispatcher settings of the inbound
+func (c *Controller) resetInbound(tag string) error {
+	if err := c.UpdateProtocolRule(tag, nil); err != nil {
+		return err
+	}
+	c.UpdateSniffIncludeDomains(tag, nil)
+	c.UpdateSniffers(tag, nil)
+	c.UpdateLogLevel(tag, "")
+	c.UpdateConnectTimeout(tag, 0)
+	c.UpdateDNSOutbound(tag, "")
+	c.UpdateOverCap(tag, false)
+	c.UpdateRejectResponse(tag, nil)
+	c.UpdateDialLimit(tag, nil)
+	c.UpdateStaticHosts(tag, nil)
+	return c.UpdateRemoteRule(tag, nil)
+}
+
+// removeNode removes the inbounds, the outbounds, the limiter and the rules of the node
+func (c *Controller) removeNode() {
+	tags := append([]string{c.tag}, c.inboundTags...)
+	if err := c.removeOldTag(); err != nil {
+		log.Print(err)
+	}
+	for _, tag := range tags {
+		if err := c.DeleteInboundLimiter(tag); err != nil {
+			log.Print(err)
+		}
+		c.DeleteRule(tag)
+	}
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// addNewTag adds the inbounds of the main port and the extra ports of the node, and the outbound of the node
 func (c *Controller) addNewTag(newNodeInfo *api.NodeInfo) (err error) {
-	inboundConfig, err := InboundBuilder(newNodeInfo, c.config.CertConfig)
+	if newNodeInfo.NodeType == "Hysteria2" {
+		return c.addHysteria2(newNodeInfo)
+	}
+	if newNodeInfo.NodeType == "V2ray" && !newNodeInfo.EnableVless {
+		alterID, err := vmessAlterID(c.config, newNodeInfo)
+		if err != nil {
+			return err
+		}
+		if alterID != newNodeInfo.AlterID {
+			log.Printf("The panel requests AlterID %d for VMess node %d, build the users with AEAD (AlterID 0) instead", newNodeInfo.AlterID, newNodeInfo.NodeID)
+		}
+	}
+	inboundConfigs, err := nodeInboundsBuilder(c.config, newNodeInfo)
 	if err != nil {
 		return err
 	}
-	err = c.addInbound(inboundConfig)
+	inboundConfig := inboundConfigs[0]
+	inboundTags := make([]string, 0, len(inboundConfigs))
+	var outboundTags, chainTags []string
+	// Roll back all that is added on any failure, so the server is left with the tags of the controller
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, tag := range inboundTags {
+			if err := c.removeInbound(tag); err != nil {
+				log.Print(err)
+			}
+			if err := c.resetInbound(tag); err != nil {
+				log.Print(err)
+			}
+		}
+		for _, tag := range append(outboundTags, chainTags...) {
+			if err := c.removeOutbound(tag); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+	for _, config := range inboundConfigs {
+		if err = c.addInbound(config); err != nil {
+			return err
+		}
+		inboundTags = append(inboundTags, config.Tag)
+	}
+	outBoundConfig, err := OutboundBuilder(c.config, newNodeInfo)
 	if err != nil {
-
 		return err
 	}
-	outBoundConfig, err := OutboundBuilder(newNodeInfo)
+	err = c.addOutbound(outBoundConfig)
 	if err != nil {
-
 		return err
 	}
-	err = c.addOutbound(outBoundConfig)
+	outboundTags = append(outboundTags, outBoundConfig.Tag)
+	// The DNS queries of the node get the fake IPs from the DNS of the core
+	if c.config.FakeDNSConfig != nil {
+		dnsOutboundConfig, err := DNSOutboundBuilder(newNodeInfo)
+		if err != nil {
+			return err
+		}
+		if err = c.addOutbound(dnsOutboundConfig); err != nil {
+			return err
+		}
+		outboundTags = append(outboundTags, dnsOutboundConfig.Tag)
+	}
+	// The routes send the traffic to the chains by their names
+	chainConfigs, err := OutboundChainsBuilder(c.config)
 	if err != nil {
+		return err
+	}
+	for _, config := range chainConfigs {
+		if err = c.addOutbound(config); err != nil {
+			return err
+		}
+		chainTags = append(chainTags, config.Tag)
+	}
+	rejectResponse, err := RejectResponseBuilder(c.config.RejectResponseConfig)
+	if err != nil {
+		return err
+	}
+	hosts, err := StaticHostsBuilder(c.config.DNSHosts)
+	if err != nil {
+		return err
+	}
+	// The inbounds of the node share the bound of its dials
+	var dialLimit *mydispatcher.DialLimit
+	if dialLimitConfig := c.config.DialLimitConfig; dialLimitConfig != nil {
+		dialLimit = mydispatcher.NewDialLimit(dialLimitConfig.MaxDials, time.Duration(dialLimitConfig.QueueTimeout)*time.Millisecond)
+	}
+	// Block the sniffed protocols, and limit the domains to override the destination with
+	for _, tag := range inboundTags {
+		if err = c.UpdateProtocolRule(tag, c.config.BlockProtocols); err != nil {
+			return err
+		}
+		if err = c.UpdateRemoteRule(tag, c.remoteRules); err != nil {
+			return err
+		}
+		c.UpdateSniffIncludeDomains(tag, c.config.SniffIncludeDomains)
+		c.UpdateSniffers(tag, c.sniffersOf(tag))
+		c.UpdateLogLevel(tag, c.config.LogLevel)
+		c.UpdateOverCap(tag, c.overCap)
+		c.UpdateRejectResponse(tag, rejectResponse)
+		c.UpdateDialLimit(tag, dialLimit)
+		c.UpdateStaticHosts(tag, hosts)
+		if c.config.FakeDNSConfig != nil {
+			c.UpdateDNSOutbound(tag, dnsOutboundTag(inboundConfig.Tag))
+		}
+		if c.config.TimeoutConfig != nil {
+			c.UpdateConnectTimeout(tag, time.Duration(c.config.TimeoutConfig.Connect)*time.Second)
+		}
+	}
+	c.tag = inboundConfig.Tag
+	c.inboundTags = inboundTags
+	c.chainTags = append(c.chainTags, chainTags...)
+	return nil
+}
+
+// sniffersOf returns the sniffers of the inbound, the UDP inbound may have its own
+func (c *Controller) sniffersOf(tag string) []string {
+	if udpConfig := c.config.UDPInboundConfig; udpConfig != nil && len(udpConfig.Sniffers) > 0 && strings.HasSuffix(strings.TrimSuffix(tag, "_v6"), "_udp") {
+		return udpConfig.Sniffers
+	}
+	return c.config.Sniffers
+}
 
+// addHysteria2 starts the hysteria server of the node, the users are added to its auth endpoint
+func (c *Controller) addHysteria2(nodeInfo *api.NodeInfo) (err error) {
+	if c.hysteria2 == nil {
+		c.hysteria2, err = newHysteria2Server(c.config.Hysteria2Config, nodeInfo.NodeID)
+		if err != nil {
+			return err
+		}
+	}
+	tag := fmt.Sprintf("%s_%d", nodeInfo.NodeType, nodeInfo.Port)
+	c.hysteria2.setLimiter(c.getLimiter(), tag)
+	c.hysteria2.setOverCap(c.overCap)
+	if err = c.hysteria2.Start(c.config, nodeInfo); err != nil {
 		return err
 	}
+	c.tag = tag
+	c.inboundTags = nil
 	return nil
 }
 
+// addLimiter adds the limiter of the node, the inbounds of the extra ports share it with the main inbound
+func (c *Controller) addLimiter(nodeInfo *api.NodeInfo, userList *[]api.UserInfo) {
+	if err := c.AddInboundLimiter(c.tag, nodeInfo.SpeedLimit, userList); err != nil {
+		log.Print(err)
+		return
+	}
+	// The new limiter of the node under load keeps the limits of the tier
+	if c.loadCurve != nil {
+		if err := c.UpdateLoadMultiplier(c.tag, c.loadCurve.multiplier()); err != nil {
+			log.Print(err)
+		}
+	}
+	for _, tag := range c.inboundTags {
+		if tag == c.tag {
+			continue
+		}
+		if err := c.AddInboundAlias(c.tag, tag); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
 func (c *Controller) addNewUser(userInfo *[]api.UserInfo, nodeInfo *api.NodeInfo) (err error) {
+	// A new node has no users until the panel assigns them, the user list monitor adds them then
+	if len(*userInfo) == 0 {
+		log.Printf("No users on %s node %d yet", nodeInfo.NodeType, nodeInfo.NodeID)
+		return nil
+	}
 	users := make([]*protocol.User, 0)
 	if nodeInfo.NodeType == "V2ray" {
 		if nodeInfo.EnableVless {
 			users = buildVlessUser(userInfo)
 		} else {
-			users = buildVmessUser(userInfo, nodeInfo.AlterID)
+			alterID, err := vmessAlterID(c.config, nodeInfo)
+			if err != nil {
+				return err
+			}
+			users = buildVmessUser(userInfo, alterID)
 		}
 	} else if nodeInfo.NodeType == "Trojan" {
 		users = buildTrojanUser(userInfo)
 	} else if nodeInfo.NodeType == "Shadowsocks" {
-		users = buildSSUser(userInfo)
+		users = buildSSUser(userInfo, nodeInfo.Method)
+	} else if nodeInfo.NodeType == "Hysteria2" {
+		log.Printf("Added %d new users", c.hysteria2.AddUsers(userInfo))
+		return nil
 	} else {
 		return fmt.Errorf("Unsupported node type: %s", nodeInfo.NodeType)
 	}
-	tag := fmt.Sprintf("%s_%d", nodeInfo.NodeType, nodeInfo.Port)
-	err = c.addUsers(users, tag)
-	if err != nil {
-		return err
+	for _, user := range users {
+		user.Level = c.config.PolicyLevel
+	}
+	for _, tag := range c.inboundTags {
+		err = c.addUsers(users, tag)
+		if err != nil {
+			return err
+		}
 	}
-	log.Printf("Added %d new users", len(*userInfo))
+	log.Printf("Added %d new users", len(users))
 	return nil
 }
 
+// userKey is the comparable form of a user, the pointer fields are compared by their values. The DataUsed is left
+// out, it changes with every report and is passed to the limiter on its own
+type userKey struct {
+	api.UserInfo
+	trafficMultiplier    float64
+	hasTrafficMultiplier bool
+}
+
+func newUserKey(user api.UserInfo) userKey {
+	key := userKey{UserInfo: user}
+	if user.TrafficMultiplier != nil {
+		key.trafficMultiplier, key.hasTrafficMultiplier = *user.TrafficMultiplier, true
+		key.UserInfo.TrafficMultiplier = nil
+	}
+	key.UserInfo.DataUsed = 0
+	return key
+}
+
+// goneUsers returns the deleted users not added back, compareUserList deletes and adds the changed users
+func goneUsers(deleted, added []api.UserInfo) []api.UserInfo {
+	addedEmail := make(map[string]bool, len(added))
+	for _, u := range added {
+		addedEmail[u.Email] = true
+	}
+	var gone []api.UserInfo
+	for _, u := range deleted {
+		if !addedEmail[u.Email] {
+			gone = append(gone, u)
+		}
+	}
+	return gone
+}
+
 func compareUserList(old, new *[]api.UserInfo) (deleted, added []api.UserInfo) {
-	msrc := make(map[api.UserInfo]byte) //按源数组建索引
-	mall := make(map[api.UserInfo]byte) //源+目所有元素建索引
+	if old == nil {
+		old = &[]api.UserInfo{}
+	}
+	if new == nil {
+		new = &[]api.UserInfo{}
+	}
+	msrc := make(map[userKey]byte) //按源数组建索引
+	mall := make(map[userKey]byte) //源+目所有元素建索引
+	users := make(map[userKey]api.UserInfo)
 
-	var set []api.UserInfo //交集
+	var set []userKey //交集
 
 	//1.源数组建立map
-	for _, v := range *old {
+	for _, u := range *old {
+		v := newUserKey(u)
+		users[v] = u
 		msrc[v] = 0
 		mall[v] = 0
 	}
 	//2.目数组中，存不进去，即重复元素，所有存不进去的集合就是并集
-	for _, v := range *new {
+	for _, u := range *new {
+		v := newUserKey(u)
+		users[v] = u
 		l := len(mall)
 		mall[v] = 1
 		if l != len(mall) { //长度变化，即可以存
@@ -273,60 +998,434 @@ func compareUserList(old, new *[]api.UserInfo) (deleted, added []api.UserInfo) {
 	for v := range mall {
 		_, exist := msrc[v]
 		if exist {
-			deleted = append(deleted, v)
+			deleted = append(deleted, users[v])
 		} else {
-			added = append(added, v)
+			added = append(added, users[v])
 		}
 	}
 
 	return deleted, added
 }
 
+// sampleOnlineDevice keeps the peak of the online devices between the reports, and samples the speed of the users
+func (c *Controller) sampleOnlineDevice() error {
+	c.access.Lock()
+	tag := c.tag
+	c.access.Unlock()
+	if err := c.SampleOnlineDevice(tag); err != nil {
+		log.Print(err)
+	}
+	c.sampleUserSpeed()
+	return nil
+}
+
+func (c *Controller) resetOnlineIP() {
+	c.access.Lock()
+	defer c.access.Unlock()
+	// Keep the devices in the peak of the cycle before they are gone
+	if err := c.SampleOnlineDevice(c.tag); err != nil {
+		log.Print(err)
+	}
+	if err := c.ResetOnlineIP(c.tag, ""); err != nil {
+		log.Print(err)
+		return
+	}
+	log.Printf("Reset online devices of %s", c.tag)
+}
+
+// logMultiCountryUsers logs the users online from more than one country, they may share their accounts
+func logMultiCountryUsers(onlineDevice *[]api.OnlineUser) {
+	countries := make(map[int]map[string]bool)
+	for _, user := range *onlineDevice {
+		if user.Country == "" {
+			continue
+		}
+		if countries[user.UID] == nil {
+			countries[user.UID] = make(map[string]bool)
+		}
+		countries[user.UID][user.Country] = true
+	}
+	for uid, seen := range countries {
+		if len(seen) > 1 {
+			codes := make([]string, 0, len(seen))
+			for code := range seen {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			log.Printf("User %d is online from %d countries: %s", uid, len(codes), strings.Join(codes, ", "))
+		}
+	}
+}
+
+// reportUserTraffic reports the traffic in batches, and returns the traffic of the failed batches to report again.
+// The batches failed as the panel is unavailable are always reported again, so are all the failed batches if
+// RequeueFailedTraffic is set or the traffic is buffered
+func (c *Controller) reportUserTraffic(userTraffic []api.UserTraffic) (requeue []api.UserTraffic) {
+	batches := splitUserTraffic(userTraffic, c.config.ReportBatchSize)
+	for i, batch := range batches {
+		if err := c.apiClient.ReportUserTraffic(&batch); err != nil {
+			c.errorLog.Printf("Report traffic batch %d/%d of %d users failed: %s", i+1, len(batches), len(batch), err)
+			if api.IsUnavailable(err) || c.config.RequeueFailedTraffic || c.config.TrafficBufferPath != "" {
+				requeue = append(requeue, batch...)
+			}
+		} else if i < len(batches)-1 {
+			// Drop the reported batch from the buffer, the last one is dropped with the requeue of the failed ones
+			remaining := append([]api.UserTraffic(nil), requeue...)
+			for _, next := range batches[i+1:] {
+				remaining = append(remaining, next...)
+			}
+			c.bufferTraffic(remaining)
+		}
+	}
+	return requeue
+}
+
+// splitUserTraffic splits the traffic into batches of at most batchSize users, batchSize 0 means no split
+func splitUserTraffic(userTraffic []api.UserTraffic, batchSize int) [][]api.UserTraffic {
+	if batchSize <= 0 || len(userTraffic) <= batchSize {
+		return [][]api.UserTraffic{userTraffic}
+	}
+	batches := make([][]api.UserTraffic, 0, (len(userTraffic)+batchSize-1)/batchSize)
+	for start := 0; start < len(userTraffic); start += batchSize {
+		end := start + batchSize
+		if end > len(userTraffic) {
+			end = len(userTraffic)
+		}
+		batches = append(batches, userTraffic[start:end])
+	}
+	return batches
+}
+
+// mergeUserTraffic adds the pending traffic to the traffic of the same user
+func mergeUserTraffic(pending, userTraffic []api.UserTraffic) []api.UserTraffic {
+	if len(pending) == 0 {
+		return userTraffic
+	}
+	index := make(map[int]int, len(userTraffic))
+	for i, traffic := range userTraffic {
+		index[traffic.UID] = i
+	}
+	for _, traffic := range pending {
+		if i, ok := index[traffic.UID]; ok {
+			userTraffic[i].Upload += traffic.Upload
+			userTraffic[i].Download += traffic.Download
+			userTraffic[i].TCPUpload += traffic.TCPUpload
+			userTraffic[i].TCPDownload += traffic.TCPDownload
+			userTraffic[i].UDPUpload += traffic.UDPUpload
+			userTraffic[i].UDPDownload += traffic.UDPDownload
+			userTraffic[i].SNI = mergeSNI(traffic.SNI, userTraffic[i].SNI)
+		} else {
+			index[traffic.UID] = len(userTraffic)
+			userTraffic = append(userTraffic, traffic)
+		}
+	}
+	return userTraffic
+}
+
+// mergeSNI merges the server names of the pending traffic into the new ones
+func mergeSNI(pending, names []string) []string {
+	if len(pending) == 0 {
+		return names
+	}
+	merged := append([]string(nil), names...)
+	for _, name := range pending {
+		found := false
+		for _, n := range names {
+			if n == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, name)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// getUserTraffic returns the traffic of the users since the last call, with the server names they connected to if reported
+func (c *Controller) getUserTraffic(nodeInfo *api.NodeInfo, userList *[]api.UserInfo, tag string) []api.UserTraffic {
+	userTraffic := make([]api.UserTraffic, 0)
+	// The traffic of the Hysteria2 node is counted by the hysteria server
+	var hysteria2Traffic map[string]api.UserTraffic
+	if nodeInfo.NodeType == "Hysteria2" {
+		var err error
+		if hysteria2Traffic, err = c.hysteria2.GetTraffic(); err != nil {
+			log.Print(err)
+			return userTraffic
+		}
+	}
+	var counters map[string]userTrafficCount
+	if hysteria2Traffic == nil {
+		counters = c.takeUserTraffic(userList)
+	}
+	var nodeTraffic int64
+	for _, user := range *userList {
+		var up, down, tcpUp, tcpDown, udpUp, udpDown int64
+		if hysteria2Traffic != nil {
+			up, down = hysteria2Traffic[user.Email].Upload, hysteria2Traffic[user.Email].Download
+		} else {
+			count := counters[user.Email]
+			up, down = count.up, count.down
+			tcpUp, tcpDown = count.tcpUp, count.tcpDown
+			udpUp, udpDown = count.udpUp, count.udpDown
+		}
+		// The cap counts the traffic of the node, not the traffic multiplied for the panel
+		nodeTraffic += up + down
+		up, down = c.trafficMultiplier.apply(user.Email, user.TrafficMultiplier, up, down)
+		// The data limit counts the traffic as the panel does
+		var dataRemaining *uint64
+		if remaining, limited := c.AddDataUsed(tag, user.Email, up+down); limited {
+			dataRemaining = &remaining
+		}
+		tcpUp, udpUp = splitTraffic(up, tcpUp, udpUp)
+		tcpDown, udpDown = splitTraffic(down, tcpDown, udpDown)
+		var sni []string
+		if c.config.ReportSNI {
+			sni = c.GetUserSNI(tag, user.Email)
+		}
+		if up > 0 || down > 0 {
+			userTraffic = append(userTraffic, api.UserTraffic{
+				UID:           user.UID,
+				Email:         user.Email,
+				Upload:        up,
+				Download:      down,
+				SNI:           sni,
+				TCPUpload:     tcpUp,
+				TCPDownload:   tcpDown,
+				UDPUpload:     udpUp,
+				UDPDownload:   udpDown,
+				DataRemaining: dataRemaining})
+		}
+	}
+	if c.bandwidthCap != nil {
+		c.updateBandwidthCap(nodeTraffic)
+	}
+	return userTraffic
+}
+
+// splitTraffic splits the reported traffic into TCP and UDP by the counted traffic of each, so the parts
+// still add up to the total after the traffic multiplier
+func splitTraffic(total int64, tcp int64, udp int64) (int64, int64) {
+	if tcp+udp <= 0 {
+		return 0, 0
+	}
+	tcpPart := int64(float64(total) * float64(tcp) / float64(tcp+udp))
+	return tcpPart, total - tcpPart
+}
+
+// remoteRuleMonitor fetches the remote rule lists, and merges them with the rules of the panel on the inbounds
+func (c *Controller) remoteRuleMonitor() error {
+	rules := c.remoteRuleFetcher.Fetch()
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.remoteRules = rules
+	for _, tag := range c.inboundTags {
+		if err := c.UpdateRemoteRule(tag, rules); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// buildMetricPoints builds the node status and the traffic of this cycle as InfluxDB points
+func buildMetricPoints(nodeInfo *api.NodeInfo, nodeStatus *api.NodeStatus, userTraffic []api.UserTraffic) []*influxdb.Point {
+	now := time.Now()
+	nodeTags := map[string]string{
+		"node_type": nodeInfo.NodeType,
+		"node_id":   strconv.Itoa(nodeInfo.NodeID),
+	}
+	points := make([]*influxdb.Point, 0, len(userTraffic)+1)
+	points = append(points, &influxdb.Point{
+		Measurement: "node_status",
+		Tags:        nodeTags,
+		Fields: map[string]interface{}{
+			"cpu":           nodeStatus.CPU,
+			"mem":           nodeStatus.Mem,
+			"mem_used":      nodeStatus.MemUsed,
+			"mem_available": nodeStatus.MemAvailable,
+			"disk_read":     nodeStatus.DiskRead,
+			"disk_write":    nodeStatus.DiskWrite,
+			"disk":          nodeStatus.Disk,
+			"uptime":        nodeStatus.Uptime,
+			"outbound_up":   nodeStatus.OutboundUpload,
+			"outbound_down": nodeStatus.OutboundDownload,
+		},
+		Time: now,
+	})
+	for _, traffic := range userTraffic {
+		points = append(points, &influxdb.Point{
+			Measurement: "user_traffic",
+			Tags: map[string]string{
+				"node_type": nodeInfo.NodeType,
+				"node_id":   strconv.Itoa(nodeInfo.NodeID),
+				"uid":       strconv.Itoa(traffic.UID),
+			},
+			Fields: map[string]interface{}{
+				"upload":       traffic.Upload,
+				"download":     traffic.Download,
+				"tcp_upload":   traffic.TCPUpload,
+				"tcp_download": traffic.TCPDownload,
+				"udp_upload":   traffic.UDPUpload,
+				"udp_download": traffic.UDPDownload,
+			},
+			Time: now,
+		})
+	}
+	return points
+}
+
+// tproxyTrafficPoint builds the traffic of the transparent proxy of this cycle as an InfluxDB point, it has no users to count it on
+func (c *Controller) tproxyTrafficPoint(nodeInfo *api.NodeInfo) *influxdb.Point {
+	if c.config.TProxyConfig == nil {
+		return nil
+	}
+	tag := tproxyInboundTag(c.config.TProxyConfig)
+	up, down := c.getInboundTraffic(tag)
+	return &influxdb.Point{
+		Measurement: "tproxy_traffic",
+		Tags: map[string]string{
+			"node_type": nodeInfo.NodeType,
+			"node_id":   strconv.Itoa(nodeInfo.NodeID),
+			"inbound":   tag,
+		},
+		Fields: map[string]interface{}{
+			"upload":   up,
+			"download": down,
+		},
+		Time: time.Now(),
+	}
+}
+
+// sniffingPoint returns the sniffing outcomes of the inbounds of the node since the last call, to tune the sniffing
+func (c *Controller) sniffingPoint(nodeInfo *api.NodeInfo, inboundTags []string) *influxdb.Point {
+	fields := make(map[string]interface{})
+	for outcome, count := range c.getSniffingCount(inboundTags) {
+		fields[outcome] = count
+	}
+	return &influxdb.Point{
+		Measurement: "sniffing",
+		Tags: map[string]string{
+			"node_type": nodeInfo.NodeType,
+			"node_id":   strconv.Itoa(nodeInfo.NodeID),
+		},
+		Fields: fields,
+		Time:   time.Now(),
+	}
+}
+
+// dispatchFailuresPoint returns the failed dispatches of the inbounds of the node since the last report, by the category
+func dispatchFailuresPoint(nodeInfo *api.NodeInfo, dispatchFailures map[string]int64) *influxdb.Point {
+	fields := make(map[string]interface{}, len(dispatchFailures))
+	for category, count := range dispatchFailures {
+		fields[category] = count
+	}
+	return &influxdb.Point{
+		Measurement: "dispatch_failures",
+		Tags: map[string]string{
+			"node_type": nodeInfo.NodeType,
+			"node_id":   strconv.Itoa(nodeInfo.NodeID),
+		},
+		Fields: fields,
+		Time:   time.Now(),
+	}
+}
+
 func (c *Controller) userInfoMonitor() (err error) {
+	// The summaries of the errors are logged even if the errors stopped
+	c.errorLog.flush()
+	// The other monitors may replace them meanwhile
+	c.access.Lock()
+	nodeInfo, userList, tag, inboundTags := c.nodeInfo, c.userList, c.tag, c.inboundTags
+	interval := c.userReportPeriodic.Interval
+	c.access.Unlock()
+	defer c.probe.ran("report", interval)
 	// Get server status
 	CPU, Mem, Disk, Uptime, err := serverstatus.GetSystemInfo()
 	if err != nil {
-		log.Print(err)
+		c.errorLog.Print(err)
 	}
-	err = c.apiClient.ReportNodeStatus(
-		&api.NodeStatus{
-			CPU:    CPU,
-			Mem:    Mem,
-			Disk:   Disk,
-			Uptime: Uptime,
-		})
+	nodeStatus := &api.NodeStatus{
+		CPU:              CPU,
+		Mem:              Mem,
+		Disk:             Disk,
+		Uptime:           Uptime,
+		Version:          version.Version,
+		CoreVersion:      version.Core(),
+		ControllerUptime: int(time.Since(c.startTime).Seconds()),
+	}
+	if memory, err := serverstatus.GetMemoryInfo(); err != nil {
+		c.errorLog.Print(err)
+	} else {
+		nodeStatus.MemTotal, nodeStatus.MemUsed, nodeStatus.MemAvailable = memory.Total, memory.Used, memory.Available
+	}
+	if diskIO, err := c.diskIO.Sample(); err != nil {
+		c.errorLog.Print(err)
+	} else {
+		nodeStatus.DiskRead, nodeStatus.DiskWrite = diskIO.ReadBytes, diskIO.WriteBytes
+	}
+	if nodeStatus.OnlineUsers, nodeStatus.PeakOnlineUsers, err = c.GetOnlineDeviceCount(tag); err != nil {
+		c.errorLog.Print(err)
+	}
+	nodeStatus.OutboundUpload, nodeStatus.OutboundDownload = c.getOutboundTraffic(tag)
+	dispatchFailures := c.getDispatchFailures(inboundTags)
+	if c.config.ReportFailures {
+		nodeStatus.DispatchFailures = dispatchFailures
+	}
+	err = c.apiClient.ReportNodeStatus(nodeStatus)
 	if err != nil {
-		log.Print(err)
+		c.errorLog.Print(err)
 	}
 	// Get User traffic
-	userTraffic := make([]api.UserTraffic, 0)
-	for _, user := range *c.userList {
-		up, down := c.getTraffic(user.Email)
-		if up > 0 || down > 0 {
-			userTraffic = append(userTraffic, api.UserTraffic{
-				UID:      user.UID,
-				Email:    user.Email,
-				Upload:   up,
-				Download: down})
+	userTraffic := c.getUserTraffic(nodeInfo, userList, tag)
+	if c.influxClient != nil {
+		points := buildMetricPoints(nodeInfo, nodeStatus, userTraffic)
+		if point := c.tproxyTrafficPoint(nodeInfo); point != nil {
+			points = append(points, point)
+		}
+		points = append(points, c.sniffingPoint(nodeInfo, inboundTags))
+		points = append(points, dispatchFailuresPoint(nodeInfo, dispatchFailures))
+		if err := c.influxClient.Write(points); err != nil {
+			c.errorLog.Print(err)
 		}
 	}
+	// The requeued traffic is not the activity of this cycle
+	activeTraffic := userTraffic
+	userTraffic = mergeUserTraffic(c.pendingTraffic, userTraffic)
+	c.pendingTraffic = nil
 	if len(userTraffic) > 0 {
-		err = c.apiClient.ReportUserTraffic(&userTraffic)
-		if err != nil {
-			log.Print(err)
+		// The counters are reset, the traffic is buffered until it is reported
+		c.bufferTraffic(userTraffic)
+		if requeue := c.reportUserTraffic(userTraffic); len(requeue) > 0 {
+			log.Printf("Requeue the traffic of %d users to the next report", len(requeue))
+			c.pendingTraffic = requeue
 		}
+		// The buffer keeps the requeued traffic until it is reported
+		c.bufferTraffic(c.pendingTraffic)
 	}
 
 	// Report Online info
-	tag := fmt.Sprintf("%s_%d", c.nodeInfo.NodeType, c.nodeInfo.Port)
 	onlineDevice, err := c.GetOnlineDevice(tag)
 	if err != nil {
-		log.Print(err)
-		return nil
+		c.errorLog.Print(err)
+	} else {
+		if c.config.OnlineIPLocation {
+			logMultiCountryUsers(onlineDevice)
+		}
+		if len(*onlineDevice) > 0 {
+			if err = c.apiClient.ReportNodeOnlineUsers(onlineDevice); err != nil {
+				c.errorLog.Print(err)
+			}
+		}
 	}
-	if len(*onlineDevice) > 0 {
-		if err = c.apiClient.ReportNodeOnlineUsers(onlineDevice); err != nil {
-			log.Print(err)
+
+	// Report the users active in this cycle with their last seen time
+	if c.config.ReportLastSeen {
+		if lastSeen := c.lastSeen.update(activeTraffic, onlineDevice, time.Now()); len(lastSeen) > 0 {
+			if err = c.apiClient.ReportUserLastSeen(&lastSeen); err != nil {
+				c.errorLog.Print(err)
+			}
 		}
 	}
 	return nil
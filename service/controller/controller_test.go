@@ -1,19 +1,64 @@
 package controller_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/api/sspanel"
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/geodata"
+	"github.com/XrayR-project/XrayR/common/influxdb"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/XrayR-project/XrayR/common/rule"
+	"github.com/XrayR-project/XrayR/common/version"
+	"github.com/XrayR-project/XrayR/common/webhook"
 	_ "github.com/XrayR-project/XrayR/main/distro/all"
+	"github.com/XrayR-project/XrayR/service/admin"
 	. "github.com/XrayR-project/XrayR/service/controller"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/protocol/tls/cert"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/common/session"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+	xstats "github.com/xtls/xray-core/features/stats"
 	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/shadowsocks"
+	"github.com/xtls/xray-core/proxy/vmess"
+	vmessinbound "github.com/xtls/xray-core/proxy/vmess/inbound"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestController(t *testing.T) {
@@ -77,3 +122,2280 @@ func TestController(t *testing.T) {
 		<-osSignals
 	}
 }
+
+type mockAPI struct {
+	nodeInfo      *api.NodeInfo
+	userList      *[]api.UserInfo
+	nodeInfoDelay time.Duration
+	userListDelay time.Duration
+	errAccess     sync.Mutex
+	nodeInfoErr   error
+	userListErr   error
+	nodeInfoCalls int
+	userListCalls int
+	statusCalls   int
+	onlineCalls   int
+	nodeStatus    *api.NodeStatus // The last reported node status
+	changes       []*api.NodeInfoChange
+	lastSeen      [][]api.UserLastSeen
+	// The calls of ReportUserTraffic fail on the given call numbers, starting from 1
+	reportFailAt  map[int]bool
+	reportFailErr error // The error of the failed calls, a 413 if nil
+	beforeReport func() // Called on each ReportUserTraffic before it is recorded
+	reportAccess sync.Mutex
+	reportCalls  int
+	reported     [][]api.UserTraffic
+}
+
+func (m *mockAPI) setNodeInfoErr(err error) {
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.nodeInfoErr = err
+}
+
+func (m *mockAPI) GetNodeInfo() (*api.NodeInfo, error) {
+	time.Sleep(m.nodeInfoDelay)
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.nodeInfoCalls++
+	if m.nodeInfoErr != nil {
+		return nil, m.nodeInfoErr
+	}
+	nodeInfo := *m.nodeInfo
+	return &nodeInfo, nil
+}
+
+func (m *mockAPI) GetUserList() (*[]api.UserInfo, error) {
+	time.Sleep(m.userListDelay)
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.userListCalls++
+	if m.userListErr != nil {
+		return nil, m.userListErr
+	}
+	userList := append([]api.UserInfo{}, *m.userList...)
+	return &userList, nil
+}
+
+func (m *mockAPI) ReportNodeStatus(nodeStatus *api.NodeStatus) error {
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.statusCalls++
+	m.nodeStatus = nodeStatus
+	return nil
+}
+
+func (m *mockAPI) ReportNodeOnlineUsers(onlineUser *[]api.OnlineUser) error {
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.onlineCalls++
+	return nil
+}
+func (m *mockAPI) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
+	if m.beforeReport != nil {
+		m.beforeReport()
+	}
+	m.reportAccess.Lock()
+	defer m.reportAccess.Unlock()
+	m.reportCalls++
+	if m.reportFailAt[m.reportCalls] {
+		if m.reportFailErr != nil {
+			return m.reportFailErr
+		}
+		return errors.New("413 Request Entity Too Large")
+	}
+	m.reported = append(m.reported, append([]api.UserTraffic{}, *userTraffic...))
+	return nil
+}
+func (m *mockAPI) GetNodeRule() (*[]api.DetectRule, error)                  { return &[]api.DetectRule{}, nil }
+func (m *mockAPI) ReportIllegal(detectResultList *[]api.DetectResult) error { return nil }
+func (m *mockAPI) Debug()                                                   {}
+func (m *mockAPI) ReportNodeInfoChange(change *api.NodeInfoChange) error {
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.changes = append(m.changes, change)
+	return nil
+}
+func (m *mockAPI) ReportUserLastSeen(lastSeen *[]api.UserLastSeen) error {
+	m.errAccess.Lock()
+	defer m.errAccess.Unlock()
+	m.lastSeen = append(m.lastSeen, append([]api.UserLastSeen{}, *lastSeen...))
+	return nil
+}
+func (m *mockAPI) Describe() api.ClientInfo {
+	return api.ClientInfo{NodeID: m.nodeInfo.NodeID, NodeType: m.nodeInfo.NodeType}
+}
+
+func createServer(t *testing.T) *core.Instance {
+	policyConfig := &conf.PolicyConfig{}
+	policyConfig.Levels = map[uint32]*conf.Policy{0: {
+		StatsUserUplink:   true,
+		StatsUserDownlink: true,
+	}}
+	pConfig, _ := policyConfig.Build()
+	config := &core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&mydispatcher.Config{}),
+			serial.ToTypedMessage(&stats.Config{}),
+			serial.ToTypedMessage(&proxyman.InboundConfig{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+			serial.ToTypedMessage(pConfig),
+		},
+	}
+	server, err := core.New(config)
+	if err != nil {
+		t.Fatalf("failed to create instance: %s", err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatalf("Failed to start instance: %s", err)
+	}
+	return server
+}
+
+func getFreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func createMockAPI(t *testing.T) *mockAPI {
+	return &mockAPI{
+		nodeInfo: &api.NodeInfo{
+			NodeType:          "V2ray",
+			NodeID:            1,
+			Port:              getFreePort(t),
+			TransportProtocol: "tcp",
+		},
+		userList: &[]api.UserInfo{
+			{UID: 1, Email: "1|a@test.com|1", UUID: "2b0a9cb3-4d6c-4b1e-8f1e-3c7d2f9a5e61"},
+			{UID: 2, Email: "2|b@test.com|2", UUID: "7f3c1a2e-9b8d-4c6f-a5e4-1d2c3b4a5f60"},
+		},
+	}
+}
+
+func TestControllerVMessAEADOnly(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.AlterID = 4
+	output := new(bytes.Buffer)
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}, VMessAEADOnly: true})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !strings.Contains(output.String(), "The panel requests AlterID 4 for VMess node 1") {
+		t.Errorf("the AlterID of the panel should be warned, got log: %s", output.String())
+	}
+	inboundManager := server.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	handler, err := inboundManager.GetHandler(context.Background(), c.Tag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmessInbound := handler.(proxy.GetInbound).GetInbound().(*vmessinbound.Handler)
+	for _, user := range *apiClient.userList {
+		memoryUser := vmessInbound.GetUser(user.Email)
+		if memoryUser == nil {
+			t.Fatalf("user %s is not added", user.Email)
+		}
+		if alterIDs := memoryUser.Account.(*vmess.MemoryAccount).AlterIDs; len(alterIDs) != 0 {
+			t.Errorf("user %s should be built with AlterID 0, got %d", user.Email, len(alterIDs))
+		}
+	}
+}
+
+func TestControllerRejectVMessAlterID(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.AlterID = 4
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}, VMessAEADOnly: true, RejectVMessAlterID: true})
+	if err := c.Start(); err == nil {
+		c.Close()
+		t.Fatal("the node with a nonzero AlterID should be refused")
+	}
+	// The AEAD node is served
+	apiClient.nodeInfo.AlterID = 0
+	c = New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}, VMessAEADOnly: true, RejectVMessAlterID: true})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestControllerConcurrentFetch(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfoDelay = 300 * time.Millisecond
+	apiClient.userListDelay = 300 * time.Millisecond
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Start fetches both concurrently for bring up, then once more in the first cycle of each monitor,
+	// it would take 1200ms if the bring up requests were sequential.
+	if elapsed := time.Since(start); elapsed >= 1100*time.Millisecond {
+		t.Errorf("node info and user list should be fetched concurrently, but start took %s", elapsed)
+	}
+}
+
+func TestControllerFetchFailed(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.userListErr = errors.New("panel is down")
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err == nil {
+		t.Error("start should fail if the user list is not available")
+	}
+	// The failure waits for the slow node info, so no fetch is left running behind
+	apiClient.nodeInfoDelay = time.Second
+	start := time.Now()
+	if err := c.Start(); err == nil {
+		t.Error("start should fail if the user list is not available")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("start should wait for the node info, but returned after %s", elapsed)
+	}
+}
+
+func TestControllerDuplicateEmail(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	userList := append(*apiClient.userList, api.UserInfo{UID: 3, Email: "1|a@test.com|1", UUID: "0e6f3b5c-1a2d-4e8f-9b7c-6d5a4f3e2c11"})
+	apiClient.userList = &userList
+	output := new(bytes.Buffer)
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !strings.Contains(output.String(), "Duplicate user email 1|a@test.com|1: UID 1 and UID 3") {
+		t.Errorf("duplicate email should be warned, got log: %s", output.String())
+	}
+	if !strings.Contains(output.String(), "Added 2 new users") {
+		t.Errorf("only the first user of the duplicate email should be added, got log: %s", output.String())
+	}
+}
+
+func TestControllerInvalidUUID(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	userList := append(*apiClient.userList, api.UserInfo{UID: 3, Email: "3|c@test.com|3", UUID: "zzzzzzzz-zzzz-zzzz-zzzz-zzzzzzzzzzzz"})
+	apiClient.userList = &userList
+	output := new(bytes.Buffer)
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !strings.Contains(output.String(), "Skip user 3|c@test.com|3 (UID 3): invalid UUID zzzzzzzz-zzzz-zzzz-zzzz-zzzzzzzzzzzz") {
+		t.Errorf("invalid user should be warned, got log: %s", output.String())
+	}
+	if !strings.Contains(output.String(), "Added 2 new users") {
+		t.Errorf("valid users should be added, got log: %s", output.String())
+	}
+}
+
+func TestControllerExtraPorts(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	extraPort := getFreePort(t)
+	apiClient.nodeInfo.ExtraPorts = fmt.Sprintf("%d,%d", apiClient.nodeInfo.Port, extraPort)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, port := range []int{apiClient.nodeInfo.Port, extraPort} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Errorf("port %d should be listened: %s", port, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestControllerDualStack(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	} else {
+		l.Close()
+	}
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{ListenIP: "127.0.0.1", ListenIP6: "::1", UpdatePeriodic: 60, NodeInfoPeriodic: 1, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	oldPort := apiClient.nodeInfo.Port
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(oldPort)))
+		if err != nil {
+			t.Fatalf("%s should be listened: %s", host, err)
+		}
+		conn.Close()
+	}
+	// Both inbounds move to the new port
+	apiClient.errAccess.Lock()
+	apiClient.nodeInfo.Port = getFreePort(t)
+	apiClient.errAccess.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		if conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(oldPort))); err == nil {
+			conn.Close()
+			t.Errorf("the old port of %s should be closed", host)
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(apiClient.nodeInfo.Port)))
+		if err != nil {
+			t.Errorf("the new port of %s should be listened: %s", host, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+// createTrafficMockAPI returns a mock api with n users, and adds 100 bytes of tcp uplink traffic for each of them
+func createTrafficMockAPI(t *testing.T, server *core.Instance, n int) *mockAPI {
+	apiClient := createMockAPI(t)
+	userList := make([]api.UserInfo, n)
+	statsManager := server.GetFeature(xstats.ManagerType()).(xstats.Manager)
+	for i := range userList {
+		email := fmt.Sprintf("%d|%d@test.com|%d", i+1, i+1, i+1)
+		userList[i] = api.UserInfo{UID: i + 1, Email: email, UUID: fmt.Sprintf("2b0a9cb3-4d6c-4b1e-8f1e-3c7d2f9a%04d", i)}
+		for _, name := range []string{"user>>>" + email + ">>>traffic>>>uplink", "user>>>" + email + ">>>traffic>>>tcp>>>uplink"} {
+			counter, err := xstats.GetOrRegisterCounter(statsManager, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter.Add(100)
+		}
+	}
+	apiClient.userList = &userList
+	return apiClient
+}
+
+func TestControllerReportBatch(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 5)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, ReportBatchSize: 2, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	apiClient.reportAccess.Lock()
+	defer apiClient.reportAccess.Unlock()
+	var sizes []int
+	for _, batch := range apiClient.reported {
+		sizes = append(sizes, len(batch))
+	}
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Errorf("5 users should be reported in batches of [2 2 1], got %v", sizes)
+	}
+}
+
+func TestControllerBandwidthCap(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 5)
+	// 50 bytes under the cap of 1 GB this month
+	now := time.Now()
+	state, err := json.Marshal(map[string]interface{}{
+		"period_start": time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local),
+		"used":         1<<30 - 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(t.TempDir(), "bandwidth.json")
+	if err := ioutil.WriteFile(stateFile, state, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}, BandwidthCapConfig: &BandwidthCapConfig{Limit: 1, StateFile: stateFile}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The 500 bytes of the first report cross the cap
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), fmt.Sprintf(`"used":%d`, 1<<30+450)) {
+		t.Errorf("the traffic of the report should be counted, got %s", data)
+	}
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:  c.Tag(),
+		User: &protocol.MemoryUser{Email: "1|1@test.com|1"},
+	})
+	if _, err := dispatcher.Dispatch(ctx, xnet.TCPDestination(xnet.ParseAddress("1.1.1.1"), 443)); err == nil {
+		t.Error("the new connection of the node over the cap should be refused")
+	}
+}
+
+func TestControllerDataLimit(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 3)
+	// The 100 bytes of the first report leave 50 bytes to the first user, and take the second one over the limit
+	(*apiClient.userList)[0].DataLimit, (*apiClient.userList)[0].DataUsed = 1000, 850
+	(*apiClient.userList)[1].DataLimit, (*apiClient.userList)[1].DataUsed = 1000, 950
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	apiClient.reportAccess.Lock()
+	remaining := make(map[int]string)
+	for _, batch := range apiClient.reported {
+		for _, traffic := range batch {
+			remaining[traffic.UID] = "nil"
+			if traffic.DataRemaining != nil {
+				remaining[traffic.UID] = fmt.Sprint(*traffic.DataRemaining)
+			}
+		}
+	}
+	apiClient.reportAccess.Unlock()
+	if fmt.Sprint(remaining) != "map[1:50 2:0 3:nil]" {
+		t.Errorf("want the remaining map[1:50 2:0 3:nil], but got %v", remaining)
+	}
+	// The reported remaining is what the limiter enforces
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	for _, user := range *apiClient.userList {
+		over := dispatcher.Limiter.OverDataLimit(c.Tag(), user.Email)
+		if want := remaining[user.UID] == "0"; over != want {
+			t.Errorf("%s: want over the data limit %v, but got %v", user.Email, want, over)
+		}
+	}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    c.Tag(),
+		Source: xnet.TCPDestination(xnet.ParseAddress("1.2.3.4"), 1234),
+		User:   &protocol.MemoryUser{Email: (*apiClient.userList)[1].Email},
+	})
+	link, err := dispatcher.Dispatch(ctx, xnet.TCPDestination(xnet.ParseAddress("1.1.1.1"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := link.Reader.ReadMultiBuffer(); err == nil {
+		t.Error("the connection of the user over the data limit should be closed")
+	}
+}
+
+func TestControllerReportVersion(t *testing.T) {
+	// As set by -ldflags -X at build time
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "1.2.3-test"
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	apiClient.errAccess.Lock()
+	defer apiClient.errAccess.Unlock()
+	nodeStatus := apiClient.nodeStatus
+	if nodeStatus == nil {
+		t.Fatal("the node status should be reported")
+	}
+	if nodeStatus.Version != "1.2.3-test" || nodeStatus.CoreVersion != core.Version() {
+		t.Errorf("the versions of the build should be reported, got %s and %s", nodeStatus.Version, nodeStatus.CoreVersion)
+	}
+	if nodeStatus.ControllerUptime < 0 || nodeStatus.ControllerUptime > 5 {
+		t.Errorf("the controller just started, got the uptime %d", nodeStatus.ControllerUptime)
+	}
+}
+
+func TestControllerReportBatchFailed(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 6)
+	apiClient.reportFailAt = map[int]bool{2: true}
+	c := New(server, apiClient, &Config{UpdatePeriodic: 1, ReportBatchSize: 2, RequeueFailedTraffic: true, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	apiClient.reportAccess.Lock()
+	if len(apiClient.reported) != 2 {
+		t.Errorf("the batches around the failed one should be reported, got %v", apiClient.reported)
+	}
+	apiClient.reportAccess.Unlock()
+
+	// The failed batch is reported in the next cycle
+	time.Sleep(1500 * time.Millisecond)
+	apiClient.reportAccess.Lock()
+	defer apiClient.reportAccess.Unlock()
+	uploads := make(map[int]int64)
+	for _, batch := range apiClient.reported {
+		for _, traffic := range batch {
+			uploads[traffic.UID] += traffic.Upload
+		}
+	}
+	for uid := 1; uid <= 6; uid++ {
+		if uploads[uid] != 100 {
+			t.Errorf("the traffic of UID %d should be reported once, got %d", uid, uploads[uid])
+		}
+	}
+}
+
+// reportedUploads sums the reported uploads of each user
+func reportedUploads(apiClient *mockAPI) map[int]int64 {
+	apiClient.reportAccess.Lock()
+	defer apiClient.reportAccess.Unlock()
+	uploads := make(map[int]int64)
+	for _, batch := range apiClient.reported {
+		for _, traffic := range batch {
+			uploads[traffic.UID] += traffic.Upload
+		}
+	}
+	return uploads
+}
+
+func TestControllerReportUnavailable(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 2)
+	apiClient.reportFailAt = map[int]bool{1: true}
+	apiClient.reportFailErr = &api.UnavailableError{Err: errors.New("connection refused")}
+	// The traffic of the panel which cannot be reached is reported again without RequeueFailedTraffic
+	c := New(server, apiClient, &Config{UpdatePeriodic: 1, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(1500 * time.Millisecond)
+	if uploads := reportedUploads(apiClient); uploads[1] != 100 || uploads[2] != 100 {
+		t.Errorf("the traffic should be reported in the next cycle, got %v", uploads)
+	}
+}
+
+func TestControllerTrafficBufferFailed(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 4)
+	apiClient.reportFailAt = map[int]bool{2: true}
+	bufferPath := filepath.Join(t.TempDir(), "traffic.json")
+	// The buffered traffic of the failed batch is kept without RequeueFailedTraffic
+	c := New(server, apiClient, &Config{UpdatePeriodic: 1, ReportBatchSize: 2, TrafficBufferPath: bufferPath, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	data, err := ioutil.ReadFile(bufferPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"UID":1,`) || !strings.Contains(string(data), `"UID":3,`) || !strings.Contains(string(data), `"UID":4,`) {
+		t.Errorf("only the failed batch should be left in the buffer, got %s", data)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if uploads := reportedUploads(apiClient); !reflect.DeepEqual(uploads, map[int]int64{1: 100, 2: 100, 3: 100, 4: 100}) {
+		t.Errorf("the failed batch should be reported once in the next cycle, got %v", uploads)
+	}
+	if data, err := ioutil.ReadFile(bufferPath); err != nil || strings.Contains(string(data), "UID") {
+		t.Errorf("the buffer should be empty after the report, got %s: %v", data, err)
+	}
+}
+
+func TestControllerTrafficBuffer(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 5)
+	bufferPath := filepath.Join(t.TempDir(), "traffic.json")
+	// The buffer as a crash in the middle of each batch of the report leaves it
+	var crashBuffers []string
+	apiClient.beforeReport = func() {
+		data, _ := ioutil.ReadFile(bufferPath)
+		crashBuffers = append(crashBuffers, string(data))
+	}
+	config := &Config{UpdatePeriodic: 60, ReportBatchSize: 2, TrafficBufferPath: bufferPath, CertConfig: &CertConfig{CertMode: "none"}}
+	c := New(server, apiClient, config)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(crashBuffers) != 3 {
+		t.Fatalf("want the traffic reported in 3 batches, got %d", len(crashBuffers))
+	}
+	crashBuffer := []byte(crashBuffers[0])
+	if !strings.Contains(crashBuffers[0], `"UID":1,`) || !strings.Contains(crashBuffers[0], `"UID":5,`) {
+		t.Fatalf("the traffic should be buffered before it is reported, got %s", crashBuffers[0])
+	}
+	// The reported batches are not reported again after a crash
+	if strings.Contains(crashBuffers[2], `"UID":4,`) || !strings.Contains(crashBuffers[2], `"UID":5,`) {
+		t.Errorf("only the last batch should be left in the buffer, got %s", crashBuffers[2])
+	}
+	// The reported traffic is dropped from the buffer
+	if data, err := ioutil.ReadFile(bufferPath); err != nil || strings.Contains(string(data), "UID") {
+		t.Errorf("the buffer should be empty after the report, got %s: %v", data, err)
+	}
+
+	// The traffic is reported once after the restart, on top of the traffic of the new counters
+	if err := ioutil.WriteFile(bufferPath, crashBuffer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server2 := createServer(t)
+	defer server2.Close()
+	apiClient2 := createTrafficMockAPI(t, server2, 1)
+	config.ReportPeriodic, config.ReportBatchSize = 1, 0
+	c = New(server2, apiClient2, config)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(1500 * time.Millisecond)
+	apiClient2.reportAccess.Lock()
+	defer apiClient2.reportAccess.Unlock()
+	if len(apiClient2.reported) != 1 {
+		t.Fatalf("only the first cycle has traffic to report, got %v", apiClient2.reported)
+	}
+	uploads := make(map[int]int64)
+	for _, traffic := range apiClient2.reported[0] {
+		uploads[traffic.UID] += traffic.Upload
+	}
+	want := map[int]int64{1: 200, 2: 100, 3: 100, 4: 100, 5: 100}
+	if !reflect.DeepEqual(uploads, want) {
+		t.Errorf("want the buffered traffic reported once with the new one %v, got %v", want, uploads)
+	}
+
+	// The buffer of another node is not reported
+	if err := ioutil.WriteFile(bufferPath, crashBuffer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	apiClient3 := createMockAPI(t)
+	apiClient3.nodeInfo.NodeID = 2
+	c3 := New(server2, apiClient3, config)
+	if err := c3.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	apiClient3.reportAccess.Lock()
+	if apiClient3.reportCalls != 0 {
+		t.Errorf("the traffic of another node should not be reported, got %v", apiClient3.reported)
+	}
+	apiClient3.reportAccess.Unlock()
+}
+
+func TestControllerSSMixedMethods(t *testing.T) {
+	userList := []api.UserInfo{
+		{UID: 1, Email: "1|a@test.com|1", Passwd: "password-a", Method: "aes-256-gcm"},
+		{UID: 2, Email: "2|b@test.com|2", Passwd: "password-b", Method: "chacha20-ietf-poly1305"},
+		{UID: 3, Email: "3|c@test.com|3", Passwd: "password-c", Method: "aead_aes_256_gcm"},
+		{UID: 4, Email: "4|d@test.com|4", Passwd: "password-d"},
+	}
+	testCases := []struct {
+		nodeMethod string
+		added      int
+		skipped    []string
+	}{
+		// Each user of the shared port uses its own cipher, the user without a method is skipped
+		{"", 3, []string{"Skip user 4|d@test.com|4 (UID 4): unsupported method , only AEAD methods are supported"}},
+		// The users of the single-port node use its cipher, the user without a method uses it too
+		{"aes-256-gcm", 3, []string{"Skip user 2|b@test.com|2 (UID 2): method chacha20-ietf-poly1305 does not match the method aes-256-gcm of the single-port node"}},
+	}
+	for _, testCase := range testCases {
+		server := createServer(t)
+		defer server.Close()
+		apiClient := createMockAPI(t)
+		apiClient.nodeInfo.NodeType = "Shadowsocks"
+		apiClient.nodeInfo.Method = testCase.nodeMethod
+		users := append([]api.UserInfo{}, userList...)
+		apiClient.userList = &users
+		output := new(bytes.Buffer)
+		log.SetOutput(output)
+		c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+		err := c.Start()
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for _, skipped := range testCase.skipped {
+			if !strings.Contains(output.String(), skipped) {
+				t.Errorf("node method %q: the user should be warned with %q, got log: %s", testCase.nodeMethod, skipped, output.String())
+			}
+		}
+		if added := fmt.Sprintf("Added %d new users", testCase.added); !strings.Contains(output.String(), added) {
+			t.Errorf("node method %q: want %q, got log: %s", testCase.nodeMethod, added, output.String())
+		}
+	}
+}
+
+func TestControllerDialLimit(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.ExtraPorts = strconv.Itoa(getFreePort(t))
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic:  60,
+		CertConfig:      &CertConfig{CertMode: "none"},
+		DialLimitConfig: &DialLimitConfig{MaxDials: 2, QueueTimeout: 100},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	// The inbounds of the node share one bound
+	var limits []interface{}
+	dispatcher.DialLimits.Range(func(tag, limit interface{}) bool {
+		limits = append(limits, limit)
+		return true
+	})
+	if len(limits) != 2 || limits[0] != limits[1] {
+		t.Errorf("want the bound shared by the 2 inbounds of the node, got %v", limits)
+	}
+	c.Close()
+	dispatcher.DialLimits.Range(func(tag, limit interface{}) bool {
+		t.Errorf("the bound of %s should be removed with the node", tag)
+		return true
+	})
+}
+
+func TestControllerRemoteRule(t *testing.T) {
+	ruleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("domain:blocked.com\n"))
+	}))
+	defer ruleServer.Close()
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic:   60,
+		CertConfig:       &CertConfig{CertMode: "none"},
+		RemoteRuleConfig: &rule.RemoteConfig{URLs: []string{ruleServer.URL}},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	if !dispatcher.RuleManager.Detect(c.Tag(), "tcp:www.blocked.com:443", "1|a@test.com|1") {
+		t.Error("the rules of the remote list should be applied to the inbound")
+	}
+}
+
+func TestControllerInfluxDB(t *testing.T) {
+	body := make(chan string, 1)
+	influxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body <- string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxServer.Close()
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createTrafficMockAPI(t, server, 2)
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic: 60,
+		CertConfig:     &CertConfig{CertMode: "none"},
+		InfluxDBConfig: &influxdb.Config{URL: influxServer.URL, Bucket: "xrayr"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case lines := <-body:
+		for _, want := range []string{
+			"node_status,node_id=1,node_type=V2ray cpu=",
+			"user_traffic,node_id=1,node_type=V2ray,uid=1 download=0i,tcp_download=0i,tcp_upload=100i,udp_download=0i,udp_upload=0i,upload=100i ",
+			"user_traffic,node_id=1,node_type=V2ray,uid=2 download=0i,tcp_download=0i,tcp_upload=100i,udp_download=0i,udp_upload=0i,upload=100i ",
+			"sniffing,node_id=1,node_type=V2ray success=0i,timeout=0i,unknown=0i ",
+		} {
+			if !strings.Contains(lines, want) {
+				t.Errorf("%q is not written, got:\n%s", want, lines)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Error("metrics are not written to InfluxDB")
+	}
+	// The panel report is not affected
+	apiClient.reportAccess.Lock()
+	defer apiClient.reportAccess.Unlock()
+	if len(apiClient.reported) != 1 {
+		t.Errorf("traffic should still be reported to the panel, got %v", apiClient.reported)
+	}
+}
+
+func TestControllerWebhook(t *testing.T) {
+	events := make(chan *webhook.Event, 10)
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := new(webhook.Event)
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer webhookServer.Close()
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic: 1,
+		CertConfig:     &CertConfig{CertMode: "none"},
+		WebhookConfig:  &webhook.Config{URL: webhookServer.URL},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	apiClient.setNodeInfoErr(errors.New("panel is down"))
+	select {
+	case event := <-events:
+		if event.Type != webhook.EventAPIUnreachable || event.NodeID != 1 || event.NodeType != "V2ray" || event.Message != "panel is down" {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("api unreachable event is not posted")
+	}
+	// The persistent failure is posted once, and the user list fetches alone do not recover it
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event: %+v", event)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	apiClient.setNodeInfoErr(nil)
+	select {
+	case event := <-events:
+		if event.Type != webhook.EventAPIRecovered {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("api recovered event is not posted")
+	}
+}
+
+func TestControllerStartWithCache(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "node.json")
+	apiClient := createMockAPI(t)
+	config := &Config{UpdatePeriodic: 60, CachePath: cachePath, CertConfig: &CertConfig{CertMode: "none"}}
+
+	// Fill the cache while the panel is up
+	server := createServer(t)
+	c := New(server, apiClient, config)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	server.Close()
+
+	// Cold start with the panel down
+	apiClient.setNodeInfoErr(errors.New("panel is down"))
+	server = createServer(t)
+	defer server.Close()
+	output := new(bytes.Buffer)
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+	c = New(server, apiClient, config)
+	if err := c.Start(); err != nil {
+		t.Fatalf("start should use the cache when the panel is down: %s", err)
+	}
+	defer c.Close()
+	if !strings.Contains(output.String(), "Added 2 new users") {
+		t.Errorf("the cached users should be added, got log: %s", output.String())
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", apiClient.nodeInfo.Port))
+	if err != nil {
+		t.Fatalf("the cached node should be served: %s", err)
+	}
+	conn.Close()
+}
+
+func TestControllerStartWithInvalidCache(t *testing.T) {
+	dir := t.TempDir()
+	apiClient := createMockAPI(t)
+	apiClient.setNodeInfoErr(errors.New("panel is down"))
+	otherNode := fmt.Sprintf(`{"node_info":{"NodeType":"V2ray","NodeID":2,"Port":%d},"user_list":[]}`, apiClient.nodeInfo.Port)
+	for name, content := range map[string]string{
+		"corrupt.json": `{"node_info":`,
+		"empty.json":   `{}`,
+		"other.json":   otherNode,
+	} {
+		cachePath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(cachePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		server := createServer(t)
+		c := New(server, apiClient, &Config{UpdatePeriodic: 60, CachePath: cachePath, CertConfig: &CertConfig{CertMode: "none"}})
+		if err := c.Start(); err == nil {
+			t.Errorf("start should fail with the invalid cache %s", name)
+			c.Close()
+		}
+		server.Close()
+	}
+}
+
+func TestControllerSeparatePeriodic(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic:   60,
+		NodeInfoPeriodic: 3,
+		UserListPeriodic: 1,
+		ReportPeriodic:   2,
+		CertConfig:       &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3500 * time.Millisecond)
+	c.Close()
+	apiClient.errAccess.Lock()
+	defer apiClient.errAccess.Unlock()
+	// Each monitor runs once on start, then on its own interval
+	if apiClient.nodeInfoCalls < 2 || apiClient.nodeInfoCalls > 3 {
+		t.Errorf("node info should be fetched every 3s, got %d fetches in 3.5s", apiClient.nodeInfoCalls)
+	}
+	if apiClient.userListCalls < 4 || apiClient.userListCalls > 5 {
+		t.Errorf("user list should be fetched every 1s, got %d fetches in 3.5s", apiClient.userListCalls)
+	}
+	if apiClient.statusCalls != 2 {
+		t.Errorf("node status should be reported every 2s, got %d reports in 3.5s", apiClient.statusCalls)
+	}
+}
+
+func TestControllerNoUsers(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	users := *apiClient.userList
+	for i := range users {
+		users[i].SpeedLimit = 1000000
+	}
+	apiClient.userList = &[]api.UserInfo{}
+	c := New(server, apiClient, &Config{
+		ListenIP:         "127.0.0.1",
+		UpdatePeriodic:   60,
+		NodeInfoPeriodic: 60,
+		UserListPeriodic: 1,
+		ReportPeriodic:   60,
+		ReportLastSeen:   true,
+		CertConfig:       &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The node comes up without users, and only the node status is reported
+	apiClient.errAccess.Lock()
+	if apiClient.statusCalls != 1 || apiClient.onlineCalls != 0 || len(apiClient.lastSeen) != 0 {
+		t.Errorf("only the node status should be reported, got %d status, %d online and %d last seen reports",
+			apiClient.statusCalls, apiClient.onlineCalls, len(apiClient.lastSeen))
+	}
+	apiClient.errAccess.Unlock()
+	apiClient.reportAccess.Lock()
+	if apiClient.reportCalls != 0 {
+		t.Errorf("no traffic should be reported without users, got %d reports", apiClient.reportCalls)
+	}
+	apiClient.reportAccess.Unlock()
+
+	// The users assigned later are added by the user list monitor
+	apiClient.errAccess.Lock()
+	apiClient.userList = &users
+	apiClient.errAccess.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	inboundManager := server.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	handler, err := inboundManager.GetHandler(context.Background(), c.Tag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmessInbound := handler.(proxy.GetInbound).GetInbound().(*vmessinbound.Handler)
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	for _, user := range users {
+		if vmessInbound.GetUser(user.Email) == nil {
+			t.Errorf("user %s should be added to the inbound", user.Email)
+		}
+		if bucket, limited, _ := dispatcher.Limiter.GetUserBucket(c.Tag(), user.Email, "1.1.1.1", "tcp"); !limited || bucket.Rate() != 1000000 {
+			t.Errorf("user %s should be added to the limiter", user.Email)
+		}
+	}
+
+	// The live connection counter of a removed user is unregistered with it, while the changed user keeps its own
+	statsManager := server.GetFeature(xstats.ManagerType()).(xstats.Manager)
+	connCounter := mydispatcher.UserConnCounterName(users[0].Email)
+	changedCounter := mydispatcher.UserConnCounterName(users[1].Email)
+	for _, name := range []string{connCounter, changedCounter} {
+		if _, err := xstats.GetOrRegisterCounter(statsManager, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apiClient.errAccess.Lock()
+	remaining := append([]api.UserInfo{}, users[1:]...)
+	remaining[0].SpeedLimit = 2000000
+	apiClient.userList = &remaining
+	apiClient.errAccess.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	if statsManager.GetCounter(connCounter) != nil {
+		t.Errorf("the live connection counter of the removed user %s should be unregistered", users[0].Email)
+	}
+	if statsManager.GetCounter(changedCounter) == nil {
+		t.Errorf("the live connection counter of the changed user %s should be kept", users[1].Email)
+	}
+	if bucket, _, _ := dispatcher.Limiter.GetUserBucket(c.Tag(), users[1].Email, "1.1.1.1", "tcp"); bucket == nil || bucket.Rate() != 2000000 {
+		t.Errorf("the changed user %s should get the new speed limit", users[1].Email)
+	}
+}
+
+// getPeerCertName returns the common name of the cert served on the port
+func getPeerCertName(port int) (string, error) {
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestControllerReloadFileCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFile(t, dir, "old.test.tk")
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.EnableTLS = true
+	apiClient.nodeInfo.TLSType = "tls"
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if name, err := getPeerCertName(apiClient.nodeInfo.Port); err != nil || name != "old.test.tk" {
+		t.Fatalf("the cert file should be served, got %s: %v", name, err)
+	}
+
+	writeCertFile(t, dir, "new.test.tk")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		name, _ := getPeerCertName(apiClient.nodeInfo.Port)
+		if name == "new.test.tk" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the changed cert file should be reloaded, still serving %s", name)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestControllerHotReloadFileCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFile(t, dir, "hot.test.tk", cert.NotAfter(time.Now().Add(24*time.Hour)))
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.EnableTLS = true
+	apiClient.nodeInfo.TLSType = "tls"
+	output := new(bytes.Buffer)
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tag := fmt.Sprintf("%s_%d", apiClient.nodeInfo.NodeType, apiClient.nodeInfo.Port)
+	inboundManager := server.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	handler, err := inboundManager.GetHandler(context.Background(), tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation of the same name is left to xray-core
+	writeCertFile(t, dir, "hot.test.tk", cert.NotAfter(time.Now().Add(48*time.Hour)))
+	time.Sleep(3 * time.Second)
+	if !strings.Contains(output.String(), "reload the cert in place") {
+		t.Fatalf("the changed cert should be reloaded in place, got log: %s", output.String())
+	}
+	if current, err := inboundManager.GetHandler(context.Background(), tag); err != nil || current != handler {
+		t.Errorf("the inbound should not be rebuilt: %v", err)
+	}
+	if name, err := getPeerCertName(apiClient.nodeInfo.Port); err != nil || name != "hot.test.tk" {
+		t.Errorf("the inbound should keep serving, got %s: %v", name, err)
+	}
+}
+
+// writeCertSecret generates a self signed cert of the common name, and writes it and its key to the secrets file
+func writeCertSecret(t *testing.T, secretFile string, commonName string) {
+	certificate, err := cert.Generate(nil, cert.CommonName(commonName), cert.DNSNames(commonName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := certificate.ToPEM()
+	data, err := json.Marshal(map[string]string{"cert": string(certPEM), "key": string(keyPEM)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(secretFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerReloadSecretCert(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "cert.json")
+	writeCertSecret(t, secretFile, "old.test.tk")
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.EnableTLS = true
+	apiClient.nodeInfo.TLSType = "tls"
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "secret", SecretFile: secretFile}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if name, err := getPeerCertName(apiClient.nodeInfo.Port); err != nil || name != "old.test.tk" {
+		t.Fatalf("the cert of the secrets file should be served, got %s: %v", name, err)
+	}
+
+	writeCertSecret(t, secretFile, "new.test.tk")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		name, _ := getPeerCertName(apiClient.nodeInfo.Port)
+		if name == "new.test.tk" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the changed secrets file should be reloaded, still serving %s", name)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestControllerInvalidFileCert(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	dir := t.TempDir()
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{
+		CertMode: "file",
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}})
+	if err := c.Start(); err == nil {
+		c.Close()
+		t.Error("start should fail if the cert file does not exist")
+	}
+}
+
+func TestControllerHysteria2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFile(t, dir, "hy2.test.tk")
+	// The fake hysteria binary records its pid and stays alive, the stats API is served by the test
+	binaryPath := filepath.Join(dir, "hysteria")
+	pidPath := filepath.Join(dir, "hysteria.pid")
+	if err := ioutil.WriteFile(binaryPath, []byte("#!/bin/sh\necho $$ >> "+pidPath+"\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	launches := func() []int {
+		data, _ := ioutil.ReadFile(pidPath)
+		var pids []int
+		for _, line := range strings.Fields(string(data)) {
+			pid, _ := strconv.Atoi(line)
+			pids = append(pids, pid)
+		}
+		return pids
+	}
+	configPath := filepath.Join(dir, "hysteria2.json")
+	serverConfig := struct {
+		Auth struct {
+			HTTP struct{ URL string }
+		}
+		TrafficStats struct{ Secret string }
+	}{}
+	var kickAccess sync.Mutex
+	var kicked []string
+	statsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadFile(configPath)
+		json.Unmarshal(data, &serverConfig)
+		if r.Header.Get("Authorization") != serverConfig.TrafficStats.Secret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/traffic":
+			w.Write([]byte(`{"1|a@test.com|1": {"tx": 300, "rx": 100}}`))
+		case "/kick":
+			kickAccess.Lock()
+			defer kickAccess.Unlock()
+			json.NewDecoder(r.Body).Decode(&kicked)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer statsServer.Close()
+
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.NodeType = "Hysteria2"
+	// The traffic of a is over its speed limit, b may connect from one device
+	(*apiClient.userList)[0].SpeedLimit = 100
+	(*apiClient.userList)[1].DeviceLimit = 1
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic: 60,
+		CertConfig:     &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile},
+		Hysteria2Config: &Hysteria2Config{
+			BinaryPath:  binaryPath,
+			ConfigPath:  configPath,
+			StatsListen: statsServer.Listener.Addr().String(),
+		},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			c.Close()
+		}
+	}()
+
+	// The traffic counted by the hysteria server is reported
+	apiClient.reportAccess.Lock()
+	if len(apiClient.reported) != 1 || len(apiClient.reported[0]) != 1 {
+		t.Fatalf("the traffic of one user should be reported, got %v", apiClient.reported)
+	}
+	if traffic := apiClient.reported[0][0]; traffic.UID != 1 || traffic.Upload != 100 || traffic.Download != 300 {
+		t.Errorf("unexpected traffic: %+v", traffic)
+	}
+	apiClient.reportAccess.Unlock()
+
+	// The users are authenticated by the controller within their limits
+	authURL := serverConfig.Auth.HTTP.URL
+	a, b := (*apiClient.userList)[0], (*apiClient.userList)[1]
+	for _, test := range []struct {
+		url  string
+		auth string
+		addr string
+		want string
+	}{
+		{url: authURL, auth: b.UUID, addr: "1.2.3.4:5678", want: `{"id":"2|b@test.com|2","ok":true}`},
+		{url: authURL, auth: b.UUID, addr: "1.2.3.4:5679", want: `{"id":"2|b@test.com|2","ok":true}`},
+		{url: authURL, auth: b.UUID, addr: "5.6.7.8:5678", want: `{"id":"2|b@test.com|2","ok":false}`},
+		{url: authURL, auth: a.UUID, addr: "1.2.3.4:5678", want: `{"id":"1|a@test.com|1","ok":false}`},
+		{url: authURL, auth: "wrong-password", addr: "1.2.3.4:5678", want: `{"id":"","ok":false}`},
+		// The other local processes do not know the secret of the endpoint
+		{url: strings.TrimSuffix(authURL, path.Base(authURL)), auth: b.UUID, addr: "1.2.3.4:5678", want: "404 page not found"},
+	} {
+		body, _ := json.Marshal(map[string]interface{}{"addr": test.addr, "auth": test.auth, "tx": 0})
+		res, err := http.Post(test.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if strings.TrimSpace(string(got)) != test.want {
+			t.Errorf("unexpected auth response of %s from %s at %s: %s", test.auth, test.addr, test.url, got)
+		}
+	}
+	// The user over its speed limit is kicked
+	kickAccess.Lock()
+	if len(kicked) != 1 || kicked[0] != a.Email {
+		t.Errorf("the user over its speed limit should be kicked, got %v", kicked)
+	}
+	kickAccess.Unlock()
+
+	// The crashed server is started again
+	pids := launches()
+	if len(pids) != 1 {
+		t.Fatalf("the server should be launched once, got %v", pids)
+	}
+	if err := syscall.Kill(pids[0], syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(launches()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if pids = launches(); len(pids) != 2 {
+		t.Fatalf("the crashed server should be launched again, got %v", pids)
+	}
+	// And stopped with the node
+	c.Close()
+	closed = true
+	if err := syscall.Kill(pids[1], 0); err == nil {
+		t.Error("the server should be stopped with the node")
+	}
+}
+
+func TestControllerAdmin(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	(*apiClient.userList)[0].SpeedLimit = 1000
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Seed a connection and some traffic of a
+	email := (*apiClient.userList)[0].Email
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispatcher.Limiter.GetUserBucket(c.Tag(), email, "1.1.1.1", "tcp")
+	statsManager := server.GetFeature(xstats.ManagerType()).(xstats.Manager)
+	counter, err := xstats.GetOrRegisterCounter(statsManager, "user>>>"+email+">>>traffic>>>downlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(1 << 20)
+	time.Sleep(10 * time.Millisecond)
+
+	s := admin.New(&admin.Config{Listen: "127.0.0.1:0", Token: "secret"}, []admin.Node{c})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	get := func(path string, state interface{}) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", s.Addr(), path), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status of %s: %d", path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var config map[string]api.NodeInfo
+	get("/config", &config)
+	if nodeInfo := config[c.Tag()]; nodeInfo.NodeID != 1 || nodeInfo.Port != apiClient.nodeInfo.Port {
+		t.Errorf("unexpected node info: %+v", nodeInfo)
+	}
+	// Listing the online users does not reset them for the report
+	for i := 0; i < 2; i++ {
+		var online map[string][]api.OnlineUser
+		get("/online", &online)
+		if users := online[c.Tag()]; len(users) != 1 || users[0] != (api.OnlineUser{UID: 1, IP: "1.1.1.1"}) {
+			t.Errorf("unexpected online users: %v", users)
+		}
+	}
+	var speed map[string][]UserSpeed
+	get("/speed", &speed)
+	if users := speed[c.Tag()]; len(users) != 1 || users[0].UID != 1 || users[0].Upload != 0 || users[0].Download <= 0 {
+		t.Errorf("unexpected user speed: %+v", users)
+	}
+	var buckets map[string][]limiter.BucketStatus
+	get("/buckets", &buckets)
+	if status := buckets[c.Tag()]; len(status) != 1 || status[0].Key != email || status[0].Rate != 1000 {
+		t.Errorf("unexpected buckets: %+v", status)
+	}
+}
+
+func TestControllerHealthCheck(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic:    60,
+		CertConfig:        &CertConfig{CertMode: "none"},
+		HealthCheckConfig: &HealthCheckConfig{Target: target.URL, Interval: 60, Timeout: 1, Failures: 1, SkipUnhealthy: true},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The first check runs on start
+	if health := c.OutboundHealth(); !health.Healthy || health.CheckedAt.IsZero() || health.Latency <= 0 {
+		t.Errorf("want the healthy outbound checked on start, but got %+v", health)
+	}
+	target.Close()
+	check := &mydispatcher.HealthCheck{Target: target.URL, Timeout: time.Second, Failures: 1}
+	if health := c.CheckOutbound(c.Tag(), check); health.Healthy || health.Error == "" {
+		t.Errorf("want the unhealthy outbound with the target down, but got %+v", health)
+	}
+}
+
+func TestControllerPortConflict(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The node of the same type on the same port has the same tag
+	sameTag := createMockAPI(t)
+	sameTag.nodeInfo.NodeID, sameTag.nodeInfo.Port = 2, apiClient.nodeInfo.Port
+	err := New(server, sameTag, &Config{UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}}).Start()
+	if err == nil || !strings.Contains(err.Error(), c.Tag()) {
+		t.Errorf("want the error naming the tag %s, but got %v", c.Tag(), err)
+	}
+	samePort := createMockAPI(t)
+	samePort.nodeInfo.NodeType, samePort.nodeInfo.NodeID, samePort.nodeInfo.Port = "Trojan", 3, apiClient.nodeInfo.Port
+	err = New(server, samePort, &Config{ListenIP: "127.0.0.1", UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}}).Start()
+	if err == nil || !strings.Contains(err.Error(), "used by inbound "+c.Tag()) {
+		t.Errorf("want the error naming the inbound %s, but got %v", c.Tag(), err)
+	}
+}
+
+func TestControllerPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.Port = listener.Addr().(*net.TCPAddr).Port
+	err = New(server, apiClient, &Config{ListenIP: "127.0.0.1", UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}}).Start()
+	if err == nil || !strings.Contains(err.Error(), "in use by another process") {
+		t.Errorf("want the error of the port in use, but got %v", err)
+	}
+
+	// The port is free again after the process exits
+	listener.Close()
+	c := New(server, apiClient, &Config{ListenIP: "127.0.0.1", UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestControllerReportNodeInfoChange(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, NodeInfoPeriodic: 1, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The unchanged node info is not reported
+	time.Sleep(1500 * time.Millisecond)
+	apiClient.errAccess.Lock()
+	if len(apiClient.changes) != 0 {
+		t.Errorf("the unchanged node info should not be reported, got %d changes", len(apiClient.changes))
+	}
+	oldPort := apiClient.nodeInfo.Port
+	apiClient.nodeInfo.Port = getFreePort(t)
+	newPort := apiClient.nodeInfo.Port
+	apiClient.errAccess.Unlock()
+	// The change is reported once, though the node info is fetched again after it
+	time.Sleep(2500 * time.Millisecond)
+	apiClient.errAccess.Lock()
+	defer apiClient.errAccess.Unlock()
+	if len(apiClient.changes) != 1 {
+		t.Fatalf("the change should be reported once, got %d changes", len(apiClient.changes))
+	}
+	change := apiClient.changes[0]
+	if change.Old.Port != oldPort || change.New.Port != newPort {
+		t.Errorf("unexpected change from port %d to %d", change.Old.Port, change.New.Port)
+	}
+	if want := fmt.Sprintf("Port: %d -> %d", oldPort, newPort); change.Summary != want {
+		t.Errorf("want the summary %q, but got %q", want, change.Summary)
+	}
+}
+
+func TestControllerOnlineIPLocation(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, OnlineIPLocation: true, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	dispatcher.GeoData = geodata.New(&geodata.Config{Path: "../../common/geodata/testdata"})
+	email := (*apiClient.userList)[0].Email
+	dispatcher.Limiter.GetUserBucket(c.Tag(), email, "1.0.1.1", "tcp")
+
+	onlineDevice, err := c.GetOnlineDevice(c.Tag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*onlineDevice) != 1 || (*onlineDevice)[0].Country != "CN" || (*onlineDevice)[0].ASN != "AS4134" {
+		t.Errorf("the online IP should be located in CN and AS4134: %+v", *onlineDevice)
+	}
+}
+
+func TestControllerProxyProtocol(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.NodeType = "Shadowsocks"
+	apiClient.userList = &[]api.UserInfo{{UID: 1, Email: "1|a@test.com|1", Passwd: "proxy-password", Method: "aes-128-gcm"}}
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, AcceptProxyProtocol: true, CertConfig: &CertConfig{CertMode: "none"}})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	// The load balancer in front sends the client address before the Shadowsocks request
+	port := apiClient.nodeInfo.Port
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 40000 %d\r\n", port); err != nil {
+		t.Fatal(err)
+	}
+	account, err := (&shadowsocks.Account{Password: "proxy-password", CipherType: shadowsocks.CipherType_AES_128_GCM}).AsAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := shadowsocks.WriteTCPRequest(&protocol.RequestHeader{
+		Version: shadowsocks.Version,
+		Command: protocol.RequestCommandTCP,
+		Address: xnet.LocalHostIP,
+		Port:    xnet.Port(target.Addr().(*net.TCPAddr).Port),
+		User:    &protocol.MemoryUser{Account: account},
+	}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := buf.New()
+	payload.WriteString("ping")
+	if err := writer.WriteMultiBuffer(buf.MultiBuffer{payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limiter sees the client behind the load balancer
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		online, err := c.ListOnlineDevice(c.Tag())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*online) == 1 && (*online)[0].IP == "203.0.113.7" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the source IP should be the client in the PROXY header, got %v", *online)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestControllerReload(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	config := &Config{UpdatePeriodic: 60, PolicyLevel: 2, CertConfig: &CertConfig{CertMode: "none"}}
+	c := New(server, apiClient, config)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	inboundManager := server.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	handler, err := inboundManager.GetHandler(context.Background(), c.Tag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A user is online
+	email := (*apiClient.userList)[0].Email
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	if _, limited, _ := dispatcher.Limiter.GetUserBucket(c.Tag(), email, "1.1.1.1", "tcp"); limited {
+		t.Fatal("the user should not be limited")
+	}
+
+	// The limits, rules and intervals are applied in place
+	newConfig := *config
+	newConfig.LimitConfig = &limiter.Config{ProtocolSpeedLimit: map[string]uint64{"tcp": 100000}}
+	newConfig.BlockProtocols = []string{"bittorrent"}
+	newConfig.ReportPeriodic = 30
+	newConfig.PolicyLevel = 0
+	if err := c.Reload(&newConfig); err != nil {
+		t.Fatal(err)
+	}
+	if newConfig.PolicyLevel != 0 {
+		t.Error("the reload should not change the config of the caller")
+	}
+	if current, err := inboundManager.GetHandler(context.Background(), c.Tag()); err != nil || current != handler {
+		t.Error("the inbound should be kept by the in place reload")
+	}
+	if bucket, limited, _ := dispatcher.Limiter.GetUserBucket(c.Tag(), email, "1.1.1.1", "tcp"); !limited || bucket.Rate() != 100000 {
+		t.Error("the new speed limit should be applied")
+	}
+	if onlineDevice, err := c.GetOnlineDevice(c.Tag()); err != nil || len(*onlineDevice) != 1 {
+		t.Errorf("the online user should be kept, got %v", onlineDevice)
+	}
+	if !dispatcher.RuleManager.DetectProtocol(c.Tag(), "bittorrent", email) {
+		t.Error("the new blocked protocols should be applied")
+	}
+	// A change built into the inbounds rebuilds them
+	rebuildConfig := newConfig
+	rebuildConfig.ListenIP = "127.0.0.1"
+	if err := c.Reload(&rebuildConfig); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := inboundManager.GetHandler(context.Background(), c.Tag()); err != nil || current == handler {
+		t.Error("the inbound should be rebuilt with the new listen IP")
+	}
+	// A change needing a restart leaves the node as it is
+	restartConfig := rebuildConfig
+	restartConfig.CachePath = filepath.Join(t.TempDir(), "cache.json")
+	restartConfig.BlockProtocols = nil
+	if err := c.Reload(&restartConfig); err == nil || !strings.Contains(err.Error(), "CachePath") {
+		t.Errorf("the change of CachePath should need a restart, got %v", err)
+	}
+	if !dispatcher.RuleManager.DetectProtocol(c.Tag(), "bittorrent", email) {
+		t.Error("the refused reload should not change the node")
+	}
+	// A config which cannot be built is refused by the prepare, before any change of the node
+	invalidConfig := rebuildConfig
+	invalidConfig.BlockProtocols = nil
+	invalidConfig.DNSHosts = map[string][]string{"example.com": {"not an address"}}
+	if _, err := c.PrepareReload(&invalidConfig); err == nil {
+		t.Error("the invalid DNSHosts should be refused")
+	}
+	if !dispatcher.RuleManager.DetectProtocol(c.Tag(), "bittorrent", email) {
+		t.Error("the refused reload should not change the node")
+	}
+	// The prepared reload changes the node once applied
+	rebuilt, err := inboundManager.GetHandler(context.Background(), c.Tag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepared, err := c.PrepareReload(&newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := inboundManager.GetHandler(context.Background(), c.Tag()); err != nil || current != rebuilt {
+		t.Error("the prepare should not change the node")
+	}
+	if err := prepared.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := inboundManager.GetHandler(context.Background(), c.Tag()); err != nil || current == rebuilt {
+		t.Error("the inbound should be rebuilt with the listen IP of the applied config")
+	}
+}
+
+func TestControllerUDPInbound(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	apiClient.nodeInfo.NodeType = "Shadowsocks"
+	apiClient.userList = &[]api.UserInfo{{UID: 1, Email: "1|a@test.com|1", Passwd: "password", Method: "aes-128-gcm"}}
+	c := New(server, apiClient, &Config{
+		ListenIP:         "127.0.0.1",
+		UpdatePeriodic:   60,
+		NodeInfoPeriodic: 1,
+		ReportPeriodic:   1,
+		CertConfig:       &CertConfig{CertMode: "none"},
+		UDPInboundConfig: &UDPInboundConfig{SpeedLimit: 1000, Sniffers: []string{"bittorrent"}},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	oldPort := apiClient.nodeInfo.Port
+	udpTag := fmt.Sprintf("Shadowsocks_%d_udp", oldPort)
+	inboundManager := server.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	if _, err := inboundManager.GetHandler(context.Background(), udpTag); err != nil {
+		t.Fatalf("the UDP inbound should be added: %s", err)
+	}
+	if conn, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", oldPort)); err == nil {
+		conn.Close()
+		t.Error("the UDP of the node port should be listened")
+	}
+	// The connections of the user over both inbounds are limited and counted together
+	email := (*apiClient.userList)[0].Email
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	send := func(tag string, source string, destination xnet.Destination, payload int) {
+		ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+			Tag:    tag,
+			Source: xnet.UDPDestination(xnet.ParseAddress(source), 1234),
+			User:   &protocol.MemoryUser{Email: email},
+		})
+		link, err := dispatcher.Dispatch(ctx, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, make([]byte, payload))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(c.Tag(), "1.1.1.1", xnet.TCPDestination(xnet.ParseAddress("127.0.0.1"), 9), 100)
+	send(udpTag, "2.2.2.2", xnet.UDPDestination(xnet.ParseAddress("127.0.0.1"), 9), 50)
+	if onlineDevice, err := c.GetOnlineDevice(c.Tag()); err != nil || len(*onlineDevice) != 2 {
+		t.Errorf("the devices of both inbounds should be online together, got %v", onlineDevice)
+	}
+	if uploadBucket, _, _ := dispatcher.Limiter.GetUserBuckets(udpTag, email, "2.2.2.2", "udp"); uploadBucket == nil || uploadBucket.Rate() != 1000 {
+		t.Errorf("the UDP speed limit should apply, got %v", uploadBucket)
+	}
+
+	// The UDP inbound moves with the node port
+	apiClient.errAccess.Lock()
+	apiClient.nodeInfo.Port = getFreePort(t)
+	apiClient.errAccess.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := inboundManager.GetHandler(context.Background(), udpTag); err == nil {
+		t.Error("the old UDP inbound should be removed")
+	}
+	if _, err := inboundManager.GetHandler(context.Background(), fmt.Sprintf("Shadowsocks_%d_udp", apiClient.nodeInfo.Port)); err != nil {
+		t.Errorf("the UDP inbound of the new port should be added: %s", err)
+	}
+	apiClient.reportAccess.Lock()
+	defer apiClient.reportAccess.Unlock()
+	var traffic api.UserTraffic
+	for _, batch := range apiClient.reported {
+		for _, userTraffic := range batch {
+			traffic.Upload += userTraffic.Upload
+			traffic.TCPUpload += userTraffic.TCPUpload
+			traffic.UDPUpload += userTraffic.UDPUpload
+		}
+	}
+	if traffic.Upload != 150 || traffic.TCPUpload != 100 || traffic.UDPUpload != 50 {
+		t.Errorf("the traffic of both inbounds should be reported together, got %+v", traffic)
+	}
+}
+
+func TestControllerReportLastSeen(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		ListenIP:         "127.0.0.1",
+		UpdatePeriodic:   60,
+		NodeInfoPeriodic: 60,
+		ReportPeriodic:   1,
+		ReportLastSeen:   true,
+		CertConfig:       &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The first user has traffic, the second one is idle
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    c.Tag(),
+		Source: xnet.TCPDestination(xnet.ParseAddress("1.1.1.1"), 1234),
+		User:   &protocol.MemoryUser{Email: (*apiClient.userList)[0].Email},
+	})
+	link, err := dispatcher.Dispatch(ctx, xnet.TCPDestination(xnet.ParseAddress("127.0.0.1"), 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, make([]byte, 100))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2500 * time.Millisecond)
+
+	apiClient.errAccess.Lock()
+	defer apiClient.errAccess.Unlock()
+	if len(apiClient.lastSeen) != 1 {
+		t.Fatalf("the last seen time should be reported once in the cycle of the activity, got %v", apiClient.lastSeen)
+	}
+	lastSeen := apiClient.lastSeen[0]
+	if len(lastSeen) != 1 || lastSeen[0].UID != 1 || time.Since(time.Unix(lastSeen[0].LastSeen, 0)) > 5*time.Second {
+		t.Errorf("only the active user should be reported with the time of the activity, got %v", lastSeen)
+	}
+}
+
+func TestControllerReportFailures(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		ListenIP:         "127.0.0.1",
+		UpdatePeriodic:   60,
+		NodeInfoPeriodic: 60,
+		ReportPeriodic:   1,
+		ReportFailures:   true,
+		CertConfig:       &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	statsManager := server.GetFeature(xstats.ManagerType()).(xstats.Manager)
+	counter, err := xstats.GetOrRegisterCounter(statsManager, mydispatcher.FailureCounterName(c.Tag(), mydispatcher.FailureRuleReject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(3)
+	time.Sleep(1500 * time.Millisecond)
+
+	apiClient.errAccess.Lock()
+	failures := apiClient.nodeStatus.DispatchFailures
+	apiClient.errAccess.Unlock()
+	if len(failures) != len(mydispatcher.DispatchFailures) || failures[mydispatcher.FailureRuleReject] != 3 || failures[mydispatcher.FailureDial] != 0 {
+		t.Errorf("all the categories should be reported with the failures counted, got %v", failures)
+	}
+	// The failures are reported once
+	time.Sleep(time.Second)
+	apiClient.errAccess.Lock()
+	defer apiClient.errAccess.Unlock()
+	if failures = apiClient.nodeStatus.DispatchFailures; failures[mydispatcher.FailureRuleReject] != 0 {
+		t.Errorf("the failures should be reset after the report, got %v", failures)
+	}
+}
+
+func TestControllerDNSHosts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		ListenIP:       "127.0.0.1",
+		UpdatePeriodic: 60,
+		DNSHosts:       map[string][]string{"pinned.invalid": {"127.0.0.1"}},
+		CertConfig:     &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The domain which resolves nowhere is dialed at the pinned IP
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    c.Tag(),
+		Source: xnet.TCPDestination(xnet.ParseAddress("1.1.1.1"), 1234),
+		User:   &protocol.MemoryUser{Email: (*apiClient.userList)[0].Email},
+	})
+	port := listener.Addr().(*net.TCPAddr).Port
+	link, err := dispatcher.Dispatch(ctx, xnet.TCPDestination(xnet.ParseAddress("pinned.invalid"), xnet.Port(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer common.Interrupt(link.Reader)
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pinned domain should be dialed at the IP of the hosts")
+	}
+}
+
+func TestControllerInvalidDNSHosts(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		UpdatePeriodic: 60,
+		DNSHosts:       map[string][]string{"pinned.invalid": {"not an IP"}},
+		CertConfig:     &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err == nil {
+		c.Close()
+		t.Fatal("the node should not start with an invalid IP of the hosts")
+	}
+	// The inbound and the outbound added before the hosts failed are rolled back
+	tag := fmt.Sprintf("%s_%d", apiClient.nodeInfo.NodeType, apiClient.nodeInfo.Port)
+	if _, err := server.GetFeature(inbound.ManagerType()).(inbound.Manager).GetHandler(context.Background(), tag); err == nil {
+		t.Errorf("the inbound %s should be removed", tag)
+	}
+	if handler := server.GetFeature(outbound.ManagerType()).(outbound.Manager).GetHandler(tag); handler != nil {
+		t.Errorf("the outbound %s should be removed", tag)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", apiClient.nodeInfo.Port))
+	if err != nil {
+		t.Fatalf("the port of the node should be free: %s", err)
+	}
+	listener.Close()
+}
+
+func TestControllerLoadLimit(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	c := New(server, createMockAPI(t), &Config{
+		UpdatePeriodic:  60,
+		LoadLimitConfig: &LoadLimitConfig{Interval: 1, Tiers: []*LoadTier{{CPU: 90, Multiplier: 0.5}}},
+		CertConfig:      &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// The tier without a threshold is refused
+	c = New(server, createMockAPI(t), &Config{
+		UpdatePeriodic:  60,
+		LoadLimitConfig: &LoadLimitConfig{Tiers: []*LoadTier{{Multiplier: 0.5}}},
+		CertConfig:      &CertConfig{CertMode: "none"},
+	})
+	if err := c.Start(); err == nil {
+		c.Close()
+		t.Error("the node should not start with an invalid load tier")
+	}
+}
+
+func TestControllerMultipleNodes(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	// The nodes of a panel share the users
+	v2rayAPI := createMockAPI(t)
+	ssAPI := createMockAPI(t)
+	ssAPI.nodeInfo.NodeType = "Shadowsocks"
+	ssAPI.nodeInfo.NodeID = 2
+	for _, apiClient := range []*mockAPI{v2rayAPI, ssAPI} {
+		for i := range *apiClient.userList {
+			user := &(*apiClient.userList)[i]
+			user.DeviceLimit, user.Passwd, user.Method = 1, "password", "aes-128-gcm"
+		}
+	}
+	config := func() *Config {
+		return &Config{ListenIP: "127.0.0.1", UpdatePeriodic: 60, CertConfig: &CertConfig{CertMode: "none"}}
+	}
+	v2rayNode, ssNode := New(server, v2rayAPI, config()), New(server, ssAPI, config())
+	var g errgroup.Group
+	g.Go(v2rayNode.Start)
+	g.Go(ssNode.Start)
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	defer ssNode.Close()
+	v2rayTag, ssTag := v2rayNode.Tag(), ssNode.Tag()
+	if v2rayTag == ssTag {
+		t.Fatalf("the nodes should have their own tags, got %s", v2rayTag)
+	}
+
+	// The device limits of the nodes are counted apart
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	email := (*v2rayAPI.userList)[0].Email
+	if _, _, reject := dispatcher.Limiter.GetUserBuckets(v2rayTag, email, "1.1.1.1", "tcp"); reject {
+		t.Fatal("the first device on the V2ray node should be allowed")
+	}
+	if _, _, reject := dispatcher.Limiter.GetUserBuckets(ssTag, email, "2.2.2.2", "tcp"); reject {
+		t.Fatal("the first device on the Shadowsocks node should be allowed")
+	}
+	if _, _, reject := dispatcher.Limiter.GetUserBuckets(ssTag, email, "3.3.3.3", "tcp"); !reject {
+		t.Error("the second device on the Shadowsocks node should be rejected")
+	}
+	// The rules of each node only apply to it
+	if err := v2rayNode.UpdateRule(v2rayTag, []api.DetectRule{{ID: 1, Pattern: "(.*.|)example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ssNode.UpdateRule(ssTag, []api.DetectRule{{ID: 2, Pattern: "(.*.|)example.org"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !dispatcher.RuleManager.Detect(v2rayTag, "tcp:www.example.com:443", email) || dispatcher.RuleManager.Detect(ssTag, "tcp:www.example.com:443", email) {
+		t.Error("the rule of the V2ray node should only apply to it")
+	}
+
+	// Closing a node removes its state, the other node keeps serving with its own
+	if err := v2rayNode.Close(); err != nil {
+		t.Fatal(err)
+	}
+	inboundManager := server.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	if _, err := inboundManager.GetHandler(context.Background(), v2rayTag); err == nil {
+		t.Error("the inbound of the closed node should be removed")
+	}
+	if _, ok := dispatcher.Limiter.InboundInfo.Load(v2rayTag); ok {
+		t.Error("the limiter of the closed node should be removed")
+	}
+	if _, ok := dispatcher.RuleManager.InboundRule.Load(v2rayTag); ok {
+		t.Error("the rules of the closed node should be removed")
+	}
+	if _, err := inboundManager.GetHandler(context.Background(), ssTag); err != nil {
+		t.Errorf("the inbound of the other node should be kept: %s", err)
+	}
+	if _, _, reject := dispatcher.Limiter.GetUserBuckets(ssTag, email, "2.2.2.2", "tcp"); reject {
+		t.Error("the online device of the other node should be kept")
+	}
+	if _, _, reject := dispatcher.Limiter.GetUserBuckets(ssTag, email, "3.3.3.3", "tcp"); !reject {
+		t.Error("the device limit of the other node should still apply")
+	}
+	if !dispatcher.RuleManager.Detect(ssTag, "tcp:www.example.org:443", email) {
+		t.Error("the rules of the other node should be kept")
+	}
+	// The port of the closed node is free for a new node
+	v2rayNode = New(server, v2rayAPI, config())
+	if err := v2rayNode.Start(); err != nil {
+		t.Fatalf("the node should start again on its port: %s", err)
+	}
+	v2rayNode.Close()
+}
+
+// startConnectProxy starts an HTTP CONNECT proxy, which sends its name and the target of each tunnel to the channel
+func startConnectProxy(t *testing.T, name string, tunnels chan<- string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				request, err := http.ReadRequest(reader)
+				if err != nil || request.Method != http.MethodConnect {
+					return
+				}
+				tunnels <- name + " " + request.Host
+				upstream, err := net.Dial("tcp", request.Host)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+					return
+				}
+				go io.Copy(upstream, reader)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestControllerOutboundChain(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chained"))
+	}))
+	defer destination.Close()
+	tunnels := make(chan string, 10)
+	portA := startConnectProxy(t, "relayA", tunnels)
+	portB := startConnectProxy(t, "relayB", tunnels)
+	relayConfigPath := filepath.Join(t.TempDir(), "relay.json")
+	relays := fmt.Sprintf(`[
+		{"tag": "relayA", "protocol": "http", "settings": {"servers": [{"address": "127.0.0.1", "port": %d}]}},
+		{"tag": "relayB", "protocol": "http", "settings": {"servers": [{"address": "127.0.0.1", "port": %d}]}}
+	]`, portA, portB)
+	if err := ioutil.WriteFile(relayConfigPath, []byte(relays), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{
+		ListenIP:         "127.0.0.1",
+		UpdatePeriodic:   60,
+		CertConfig:       &CertConfig{CertMode: "none"},
+		RelayConfigPath:  relayConfigPath,
+		OutboundChains:   []*OutboundChainConfig{{Name: "chainAB", Hops: []string{"relayA", "relayB"}}},
+		NodeInfoPeriodic: 60,
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The sniffed HTTP connections are routed to the chain
+	dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+	if err := dispatcher.ProtocolRouter.Update([]*mydispatcher.ProtocolRoute{{Protocol: "http", OutboundTag: "chainAB"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    c.Tag(),
+		Source: xnet.TCPDestination(xnet.ParseAddress("1.1.1.1"), 1234),
+		User:   &protocol.MemoryUser{Email: (*apiClient.userList)[0].Email},
+	})
+	ctx = session.ContextWithContent(ctx, &session.Content{SniffingRequest: session.SniffingRequest{Enabled: true}})
+	destinationAddr := destination.Listener.Addr().(*net.TCPAddr)
+	link, err := dispatcher.Dispatch(ctx, xnet.TCPDestination(xnet.IPAddress(destinationAddr.IP), xnet.Port(destinationAddr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", destinationAddr)
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte(request))); err != nil {
+		t.Fatal(err)
+	}
+	var response []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Contains(response, []byte("chained")) && time.Now().Before(deadline) {
+		mb, err := link.Reader.(buf.TimeoutReader).ReadMultiBufferTimeout(time.Second)
+		for _, b := range mb {
+			response = append(response, b.Bytes()...)
+		}
+		buf.ReleaseMulti(mb)
+		if err != nil && err != buf.ErrReadTimeout {
+			break
+		}
+	}
+	if !bytes.Contains(response, []byte("chained")) {
+		t.Fatalf("the destination should be reached through the chain, got %q", response)
+	}
+	// The node dials relay A, which tunnels to relay B, which tunnels to the destination
+	want := []string{fmt.Sprintf("relayA 127.0.0.1:%d", portB), fmt.Sprintf("relayB %s", destinationAddr)}
+	for _, tunnel := range want {
+		select {
+		case got := <-tunnels:
+			if got != tunnel {
+				t.Errorf("the traffic should go through %q, got %q", tunnel, got)
+			}
+		default:
+			t.Errorf("the traffic should go through %q", tunnel)
+		}
+	}
+
+	// The outbounds of the chain are removed with the node
+	c.Close()
+	if h := server.GetFeature(outbound.ManagerType()).(outbound.Manager).GetHandler("chainAB"); h != nil {
+		t.Error("the outbounds of the chain should be removed with the node")
+	}
+}
+
+// sendShadowsocks sends the payload to the destination through the Shadowsocks node of the aes-128-gcm password
+func sendShadowsocks(t *testing.T, port int, password string, destination *net.TCPAddr, payload string) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := (&shadowsocks.Account{Password: password, CipherType: shadowsocks.CipherType_AES_128_GCM}).AsAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := shadowsocks.WriteTCPRequest(&protocol.RequestHeader{
+		Version: shadowsocks.Version,
+		Command: protocol.RequestCommandTCP,
+		Address: xnet.IPAddress(destination.IP),
+		Port:    xnet.Port(destination.Port),
+		User:    &protocol.MemoryUser{Account: account},
+	}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte(payload))); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestControllerSniffingConfig(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err == nil {
+					received <- request.Host
+				}
+			}()
+		}
+	}()
+
+	statsManager := server.GetFeature(xstats.ManagerType()).(xstats.Manager)
+	for _, sniffingConfig := range []*SniffingConfig{{}, {Enabled: true}} {
+		apiClient := createMockAPI(t)
+		apiClient.nodeInfo.NodeType = "Shadowsocks"
+		apiClient.userList = &[]api.UserInfo{{UID: 1, Email: "1|a@test.com|1", Passwd: "sniff-password", Method: "aes-128-gcm"}}
+		c := New(server, apiClient, &Config{
+			ListenIP:       "127.0.0.1",
+			UpdatePeriodic: 60,
+			CertConfig:     &CertConfig{CertMode: "none"},
+			SniffingConfig: sniffingConfig,
+		})
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conn := sendShadowsocks(t, apiClient.nodeInfo.Port, "sniff-password", target.Addr().(*net.TCPAddr), "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		defer conn.Close()
+		// Both nodes pass the connection through
+		select {
+		case host := <-received:
+			if host != "www.example.com" {
+				t.Errorf("unexpected request of the node sniffing %v: %s", sniffingConfig.Enabled, host)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("the request through the node sniffing %v should reach the destination", sniffingConfig.Enabled)
+		}
+		// Only the connection of the sniffing node is sniffed
+		sniffed := false
+		for _, outcome := range []string{mydispatcher.SniffingSuccess, mydispatcher.SniffingTimeout, mydispatcher.SniffingUnknown} {
+			if statsManager.GetCounter(mydispatcher.SniffingCounterName(c.Tag(), outcome)) != nil {
+				sniffed = true
+			}
+		}
+		if sniffed != sniffingConfig.Enabled {
+			t.Errorf("the connection of the node sniffing %v was sniffed %v", sniffingConfig.Enabled, sniffed)
+		}
+	}
+}
+
+func TestControllerHealth(t *testing.T) {
+	server := createServer(t)
+	defer server.Close()
+	apiClient := createMockAPI(t)
+	c := New(server, apiClient, &Config{UpdatePeriodic: 60, NodeInfoPeriodic: 1, ReadyTimeout: 1, CertConfig: &CertConfig{CertMode: "none"}})
+	if health := c.Health(); health.Ready {
+		t.Errorf("the node should not be ready before the start, got %+v", health)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if health := c.Health(); !health.Live || !health.Ready || !health.Up || health.LastSync.IsZero() {
+		t.Errorf("the started node should be ready, got %+v", health)
+	}
+	// The node is not ready once the panel is unreachable beyond the timeout, but the monitors keep running
+	apiClient.setNodeInfoErr(errors.New("panel is down"))
+	time.Sleep(2500 * time.Millisecond)
+	health := c.Health()
+	if !health.Live || health.Ready || !strings.Contains(health.Reason, "has not been fetched from the panel") {
+		t.Errorf("the node should be live but not ready with the panel down, got %+v", health)
+	}
+	c.Close()
+	if health := c.Health(); health.Ready || health.Up {
+		t.Errorf("the closed node should not be ready, got %+v", health)
+	}
+}
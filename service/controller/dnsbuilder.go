@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	gonet "net"
+	"net/url"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// The default size of the FakeDNS pool, the least recently handed out domain is dropped once it is full
+const defaultFakeDNSPoolSize = 65535
+
+// DNSBuilder build the DNS of the core from the DoH servers and the FakeDNS of the nodes, nil if no node has one.
+// The DNS is shared by the core, the outbounds of the nodes with a DoH server resolve through it. xray-core creates
+// its DNS with the core and cannot add servers to it later, so it is built from all the nodes when the core is
+// loaded, not when a node adds its tag
+func DNSBuilder(configs []*Config) (*conf.DNSConfig, error) {
+	dnsConfig := &conf.DNSConfig{Hosts: make(map[string]*conf.Address)}
+	added := make(map[string]bool)
+	for _, config := range configs {
+		if config.DoHConfig == nil || added[config.DoHConfig.URL] {
+			continue
+		}
+		server, err := url.Parse(config.DoHConfig.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Parse DoH URL %s failed: %s", config.DoHConfig.URL, err)
+		}
+		if server.Scheme != "https" && server.Scheme != "https+local" {
+			return nil, fmt.Errorf("Unsupported DoH URL %s, only https:// and https+local:// are supported", config.DoHConfig.URL)
+		}
+		dnsConfig.Servers = append(dnsConfig.Servers, &conf.NameServerConfig{
+			Address: &conf.Address{Address: net.ParseAddress(config.DoHConfig.URL)},
+		})
+		added[config.DoHConfig.URL] = true
+		// Map the host of the server to the bootstrap IP, so it does not need another DNS server to be reached
+		if config.DoHConfig.BootstrapIP != "" && net.ParseAddress(server.Hostname()).Family().IsDomain() {
+			bootstrapIP := net.ParseAddress(config.DoHConfig.BootstrapIP)
+			if !bootstrapIP.Family().IsIP() {
+				return nil, fmt.Errorf("Invalid DoH bootstrap IP %s", config.DoHConfig.BootstrapIP)
+			}
+			dnsConfig.Hosts["full:"+server.Hostname()] = &conf.Address{Address: bootstrapIP}
+		}
+	}
+	addFakeDNSServers(dnsConfig, configs)
+	if len(dnsConfig.Servers) == 0 {
+		return nil, nil
+	}
+	return dnsConfig, nil
+}
+
+// addFakeDNSServers puts the FakeDNS before the real servers, so the DNS queries of the clients get the fake IPs.
+// The excluded domains are resolved by the real servers, and the core itself never resolves to the fake IPs
+func addFakeDNSServers(dnsConfig *conf.DNSConfig, configs []*Config) {
+	var excludeDomains []string
+	fakeDNS := false
+	for _, config := range configs {
+		if config.FakeDNSConfig != nil {
+			fakeDNS = true
+			excludeDomains = append(excludeDomains, config.FakeDNSConfig.ExcludeDomains...)
+		}
+	}
+	if !fakeDNS {
+		return
+	}
+	realServers := dnsConfig.Servers
+	if len(realServers) == 0 {
+		realServers = []*conf.NameServerConfig{{Address: &conf.Address{Address: net.ParseAddress("localhost")}}}
+	}
+	servers := []*conf.NameServerConfig{{Address: &conf.Address{Address: net.ParseAddress("fakedns")}}}
+	if len(excludeDomains) > 0 {
+		servers = append(servers, &conf.NameServerConfig{Address: realServers[0].Address, Domains: excludeDomains})
+	}
+	dnsConfig.Servers = append(servers, realServers...)
+}
+
+// FakeDNSBuilder build the FakeDNS pool of the core, nil if no node uses FakeDNS. The pool is shared by the nodes,
+// so they have to use the same one
+func FakeDNSBuilder(configs []*Config) (*conf.FakeDNSConfig, error) {
+	var pool *conf.FakeDNSConfig
+	for _, config := range configs {
+		if config.FakeDNSConfig == nil {
+			continue
+		}
+		nodePool := &conf.FakeDNSConfig{IPPool: config.FakeDNSConfig.IPPool, LruSize: config.FakeDNSConfig.PoolSize}
+		if nodePool.IPPool == "" {
+			nodePool.IPPool = dns.FakeIPPool
+		}
+		if nodePool.LruSize <= 0 {
+			nodePool.LruSize = defaultFakeDNSPoolSize
+		}
+		if _, _, err := gonet.ParseCIDR(nodePool.IPPool); err != nil {
+			return nil, fmt.Errorf("Invalid FakeDNS IP pool %s: %s", nodePool.IPPool, err)
+		}
+		if pool != nil && *pool != *nodePool {
+			return nil, fmt.Errorf("The nodes use different FakeDNS pools %s and %s, there is only one in the core", pool.IPPool, nodePool.IPPool)
+		}
+		pool = nodePool
+	}
+	return pool, nil
+}
+
+// StaticHostsBuilder build the hosts pinning the domain destinations of the node to the IPs, nil if none is configured.
+// The hosts are applied to the connections of the node by the dispatcher, so they are not shared with the other nodes
+// like the DNS of the core is
+func StaticHostsBuilder(hosts map[string][]string) (*mydispatcher.StaticHosts, error) {
+	staticHosts, err := mydispatcher.NewStaticHosts(hosts)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DNSHosts: %s", err)
+	}
+	return staticHosts, nil
+}
+
+// DNSOutboundBuilder build the dns outbound answering the DNS queries of the node with the DNS of the core
+func DNSOutboundBuilder(nodeInfo *api.NodeInfo) (*core.OutboundHandlerConfig, error) {
+	outboundDetourConfig := &conf.OutboundDetourConfig{}
+	outboundDetourConfig.Protocol = "dns"
+	outboundDetourConfig.Tag = dnsOutboundTag(fmt.Sprintf("%s_%d", nodeInfo.NodeType, nodeInfo.Port))
+	setting, err := json.Marshal(&conf.DNSOutboundConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("Marshal dns outbound config failed: %s", err)
+	}
+	rawSetting := json.RawMessage(setting)
+	outboundDetourConfig.Settings = &rawSetting
+	return outboundDetourConfig.Build()
+}
+
+func dnsOutboundTag(tag string) string {
+	return tag + "_dns"
+}
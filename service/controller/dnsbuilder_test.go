@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	mdns "github.com/miekg/dns"
+	"github.com/xtls/xray-core/app/dns"
+	"github.com/xtls/xray-core/app/proxyman"
+	_ "github.com/xtls/xray-core/app/proxyman/outbound"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	dnsfeature "github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/proxy/freedom"
+)
+
+func TestBuildDNSDoH(t *testing.T) {
+	configs := []*Config{
+		{DoHConfig: &DoHConfig{URL: "https://dns.google/dns-query", BootstrapIP: "8.8.8.8"}},
+		{},
+		{DoHConfig: &DoHConfig{URL: "https://dns.google/dns-query", BootstrapIP: "8.8.8.8"}},
+	}
+	dnsConfig, err := DNSBuilder(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := dnsConfig.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The nodes sharing a server get a single entry
+	if len(config.NameServer) != 1 {
+		t.Fatalf("expected one name server, got %d", len(config.NameServer))
+	}
+	if domain := config.NameServer[0].Address.Address.GetDomain(); domain != "https://dns.google/dns-query" {
+		t.Errorf("unexpected name server: %s", domain)
+	}
+	if len(config.StaticHosts) != 1 {
+		t.Fatalf("expected the bootstrap host, got %v", config.StaticHosts)
+	}
+	host := config.StaticHosts[0]
+	if host.Type != dns.DomainMatchingType_Full || host.Domain != "dns.google" || net.IPAddress(host.Ip[0]).String() != "8.8.8.8" {
+		t.Errorf("unexpected bootstrap host: %v", host)
+	}
+}
+
+func TestDNSDoHThroughDispatcher(t *testing.T) {
+	// The DoH server answers every A query with 10.0.0.1
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query := new(mdns.Msg)
+		if err := query.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reply := new(mdns.Msg)
+		reply.SetReply(query)
+		if query.Question[0].Qtype == mdns.TypeA {
+			reply.Answer = append(reply.Answer, &mdns.A{
+				Hdr: mdns.RR_Header{Name: query.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.0.0.1"),
+			})
+		}
+		packed, _ := reply.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer doh.Close()
+	// The DoH client of the core verifies the server with the system roots, which are read on their first use
+	certFile := filepath.Join(t.TempDir(), "doh.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: doh.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", certFile)
+
+	dnsConfig, err := DNSBuilder([]*Config{{DoHConfig: &DoHConfig{URL: doh.URL + "/dns-query"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dConfig, err := dnsConfig.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := core.New(&core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&mydispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+			serial.ToTypedMessage(dConfig),
+		},
+		Outbound: []*core.OutboundHandlerConfig{{ProxySettings: serial.ToTypedMessage(&freedom.Config{})}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// The queries of the DoH server are sent through the dispatcher, without the inbound of a node
+	client := server.GetFeature(dnsfeature.ClientType()).(dnsfeature.Client)
+	ips, err := client.LookupIP("example.test", dnsfeature.IPOption{IPv4Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Errorf("want 10.0.0.1 from the DoH server, but got %v", ips)
+	}
+}
+
+func TestBuildDNSDefault(t *testing.T) {
+	dnsConfig, err := DNSBuilder([]*Config{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dnsConfig != nil {
+		t.Errorf("no DNS should be built without DoHConfig: %v", dnsConfig)
+	}
+}
+
+func TestBuildDNSInvalidURL(t *testing.T) {
+	if _, err := DNSBuilder([]*Config{{DoHConfig: &DoHConfig{URL: "tcp://8.8.8.8:53"}}}); err == nil {
+		t.Error("non DoH URL should be rejected")
+	}
+}
+
+func TestBuildDNSFakeDNS(t *testing.T) {
+	configs := []*Config{
+		{FakeDNSConfig: &FakeDNSConfig{ExcludeDomains: []string{"domain:bank.com"}}},
+	}
+	dnsConfig, err := DNSBuilder(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := dnsConfig.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The FakeDNS answers first, the excluded domains and the core itself are resolved by the real server
+	if len(config.NameServer) != 3 {
+		t.Fatalf("expected three name servers, got %d", len(config.NameServer))
+	}
+	if domain := config.NameServer[0].Address.Address.GetDomain(); domain != "fakedns" {
+		t.Errorf("the first name server should be the FakeDNS, got %s", domain)
+	}
+	excluded := config.NameServer[1]
+	if excluded.Address.Address.GetDomain() != "localhost" || len(excluded.PrioritizedDomain) != 1 || excluded.PrioritizedDomain[0].Domain != "bank.com" {
+		t.Errorf("the excluded domains should be resolved by the real server: %v", excluded)
+	}
+	if domain := config.NameServer[2].Address.Address.GetDomain(); domain != "localhost" {
+		t.Errorf("the real server should follow the FakeDNS, got %s", domain)
+	}
+}
+
+func TestBuildDNSFakeDNSWithDoH(t *testing.T) {
+	configs := []*Config{
+		{FakeDNSConfig: &FakeDNSConfig{ExcludeDomains: []string{"full:bank.com"}}, DoHConfig: &DoHConfig{URL: "https://1.1.1.1/dns-query"}},
+	}
+	dnsConfig, err := DNSBuilder(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := dnsConfig.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.NameServer) != 3 {
+		t.Fatalf("expected three name servers, got %d", len(config.NameServer))
+	}
+	for _, i := range []int{1, 2} {
+		if domain := config.NameServer[i].Address.Address.GetDomain(); domain != "https://1.1.1.1/dns-query" {
+			t.Errorf("the DoH server should be the real server, got %s", domain)
+		}
+	}
+}
+
+func TestBuildFakeDNSPool(t *testing.T) {
+	pool, err := FakeDNSBuilder([]*Config{{}, {FakeDNSConfig: &FakeDNSConfig{}}, {FakeDNSConfig: &FakeDNSConfig{PoolSize: 65535}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.IPPool != "198.18.0.0/16" || pool.LruSize != 65535 {
+		t.Errorf("unexpected default pool: %+v", pool)
+	}
+	if _, err := pool.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if pool, err := FakeDNSBuilder([]*Config{{}}); err != nil || pool != nil {
+		t.Errorf("no pool should be built without FakeDNSConfig: %+v %v", pool, err)
+	}
+	// There is only one pool in the core
+	configs := []*Config{{FakeDNSConfig: &FakeDNSConfig{}}, {FakeDNSConfig: &FakeDNSConfig{IPPool: "198.19.0.0/16"}}}
+	if _, err := FakeDNSBuilder(configs); err == nil {
+		t.Error("different pools should be rejected")
+	}
+	if _, err := FakeDNSBuilder([]*Config{{FakeDNSConfig: &FakeDNSConfig{IPPool: "198.18.0.0"}}}); err == nil {
+		t.Error("invalid pool should be rejected")
+	}
+}
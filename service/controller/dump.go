@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+
+	"github.com/XrayR-project/XrayR/api"
+	protov1 "github.com/golang/protobuf/proto"
+	"github.com/xtls/xray-core/common/serial"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ConfigDump is the xray config built for the node, in JSON with the secrets masked. The nested messages of
+// the settings are expanded to their type and value.
+type ConfigDump struct {
+	Inbounds  []interface{} `json:"inbounds"`
+	Outbounds []interface{} `json:"outbounds"`
+	DNS       interface{}   `json:"dns,omitempty"`
+	Policy    interface{}   `json:"policy,omitempty"`
+}
+
+// maskedSecret replaces the secrets in the dump
+const maskedSecret = "******"
+
+// secretFields are the fields of the xray config holding the passwords, the user IDs and the private keys.
+// The key of the certificates is masked too, but not the key of the other objects like the headers
+var secretFields = map[string]bool{
+	"password":    true,
+	"id":          true,
+	"private_key": true,
+	"secret":      true,
+	"psk":         true,
+	"seed":        true,
+}
+
+// BuildConfigDump builds the xray config of the node as the controller does. The users are added to the
+// inbounds at run time, so they are not part of it
+func BuildConfigDump(config *Config, nodeInfo *api.NodeInfo) (*ConfigDump, error) {
+	dump := &ConfigDump{}
+	// The Hysteria2 node is not served by xray-core
+	if nodeInfo.NodeType == "Hysteria2" {
+		return dump, nil
+	}
+	inboundConfigs, err := nodeInboundsBuilder(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	for _, inboundConfig := range inboundConfigs {
+		inbound, err := dumpMessage(inboundConfig)
+		if err != nil {
+			return nil, err
+		}
+		dump.Inbounds = append(dump.Inbounds, inbound)
+	}
+	outboundConfig, err := OutboundBuilder(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	outbound, err := dumpMessage(outboundConfig)
+	if err != nil {
+		return nil, err
+	}
+	dump.Outbounds = append(dump.Outbounds, outbound)
+	if config.FakeDNSConfig != nil {
+		dnsOutboundConfig, err := DNSOutboundBuilder(nodeInfo)
+		if err != nil {
+			return nil, err
+		}
+		dnsOutbound, err := dumpMessage(dnsOutboundConfig)
+		if err != nil {
+			return nil, err
+		}
+		dump.Outbounds = append(dump.Outbounds, dnsOutbound)
+	}
+	dnsConfig, err := DNSBuilder([]*Config{config})
+	if err != nil {
+		return nil, err
+	}
+	if dnsConfig != nil {
+		dns, err := dnsConfig.Build()
+		if err != nil {
+			return nil, err
+		}
+		if dump.DNS, err = dumpMessage(dns); err != nil {
+			return nil, err
+		}
+	}
+	policy, err := PolicyBuilder(config).Build()
+	if err != nil {
+		return nil, err
+	}
+	if dump.Policy, err = dumpMessage(policy); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// dumpMessage converts the message to JSON values, expands its nested messages and masks its secrets
+func dumpMessage(message protov1.Message) (interface{}, error) {
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(protov1.MessageV2(message))
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return expandDump(value)
+}
+
+func expandDump(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if typedMessage, ok := typedMessageOf(v); ok {
+			if instance, err := typedMessage.GetInstance(); err == nil {
+				expanded, err := dumpMessage(instance)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]interface{}{"type": typedMessage.Type, "value": expanded}, nil
+			}
+		}
+		_, isCertificate := v["certificate"]
+		for key, field := range v {
+			if secretFields[key] || (key == "key" && isCertificate) {
+				v[key] = maskedSecret
+				continue
+			}
+			// The IPs are bytes in the messages
+			if encoded, ok := field.(string); ok && key == "ip" {
+				if ip, err := base64.StdEncoding.DecodeString(encoded); err == nil && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+					v[key] = net.IP(ip).String()
+					continue
+				}
+			}
+			expanded, err := expandDump(field)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		for i, item := range v {
+			expanded, err := expandDump(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return value, nil
+}
+
+// typedMessageOf returns the nested message of the JSON object, which has a type and the base64 encoded value
+func typedMessageOf(object map[string]interface{}) (*serial.TypedMessage, bool) {
+	messageType, ok := object["type"].(string)
+	if !ok || len(object) > 2 {
+		return nil, false
+	}
+	typedMessage := &serial.TypedMessage{Type: messageType}
+	if value, ok := object["value"]; ok {
+		encoded, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, false
+		}
+		typedMessage.Value = data
+	} else if len(object) > 1 {
+		return nil, false
+	}
+	return typedMessage, true
+}
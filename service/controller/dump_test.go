@@ -0,0 +1,84 @@
+package controller_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	. "github.com/XrayR-project/XrayR/service/controller"
+	"github.com/xtls/xray-core/common/protocol/tls/cert"
+)
+
+func TestBuildConfigDump(t *testing.T) {
+	certificate, err := cert.Generate(nil, cert.CommonName("dump.test.tk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := certificate.ToPEM()
+	t.Setenv("XRAYR_TEST_CERT", string(certPEM))
+	t.Setenv("XRAYR_TEST_KEY", string(keyPEM))
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "ws",
+		Path:              "/dump",
+		Host:              "dump.test.tk",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	config := &Config{
+		ListenIP:   "0.0.0.0",
+		CertConfig: &CertConfig{CertMode: "secret", CertEnv: "XRAYR_TEST_CERT", KeyEnv: "XRAYR_TEST_KEY"},
+		DoHConfig:  &DoHConfig{URL: "https://1.1.1.1/dns-query"},
+	}
+	dump, err := BuildConfigDump(config, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(data)
+	// The dump reflects the transport of the node
+	for _, want := range []string{
+		`"tag":"V2ray_1145"`,
+		`"type":"xray.transport.internet.websocket.Config"`,
+		`"path":"/dump"`,
+		`"key":"Host","value":"dump.test.tk"`,
+		`"ip":"0.0.0.0"`,
+		`"https://1.1.1.1/dns-query"`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("%s is not in the dump: %s", want, s)
+		}
+	}
+	if len(dump.Inbounds) != 1 || len(dump.Outbounds) != 1 || dump.DNS == nil || dump.Policy == nil {
+		t.Errorf("unexpected dump: %s", s)
+	}
+	// The private key is masked
+	if !strings.Contains(s, `"key":"******"`) {
+		t.Errorf("the key of the cert should be masked: %s", s)
+	}
+	if strings.Contains(s, base64.StdEncoding.EncodeToString(keyPEM)) {
+		t.Errorf("the private key is in the dump: %s", s)
+	}
+}
+
+func TestBuildConfigDumpPassword(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "Shadowsocks", NodeID: 1, Port: 1145, TransportProtocol: "tcp"}
+	dump, err := BuildConfigDump(&Config{ListenIP: "0.0.0.0", CertConfig: &CertConfig{CertMode: "none"}}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"type":"xray.proxy.shadowsocks.Account","value":{"cipher_type":"AES_128_GCM","password":"******"}`) {
+		t.Errorf("the password of the default user should be masked: %s", data)
+	}
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/influxdb"
+)
+
+const defaultHealthCheckTarget = "http://www.gstatic.com/generate_204"
+
+func (c *Controller) healthCheck() *mydispatcher.HealthCheck {
+	config := c.config.HealthCheckConfig
+	check := &mydispatcher.HealthCheck{
+		Target:   config.Target,
+		Timeout:  time.Duration(config.Timeout) * time.Second,
+		Failures: config.Failures,
+		Skip:     config.SkipUnhealthy,
+	}
+	if check.Target == "" {
+		check.Target = defaultHealthCheckTarget
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = 5 * time.Second
+	}
+	if check.Failures <= 0 {
+		check.Failures = 3
+	}
+	return check
+}
+
+func (c *Controller) healthCheckInterval() time.Duration {
+	if interval := c.config.HealthCheckConfig.Interval; interval > 0 {
+		return time.Duration(interval) * time.Second
+	}
+	return time.Minute
+}
+
+// outboundHealthCheck checks the outbound of the node, and logs the change of its health
+func (c *Controller) outboundHealthCheck() error {
+	c.access.Lock()
+	nodeInfo, tag := c.nodeInfo, c.tag
+	c.access.Unlock()
+	// The Hysteria2 node has no outbound in xray-core
+	if nodeInfo.NodeType == "Hysteria2" {
+		return nil
+	}
+	last, _ := c.GetOutboundHealth(tag)
+	health := c.CheckOutbound(tag, c.healthCheck())
+	switch {
+	case last.Healthy && !health.Healthy:
+		log.Printf("Outbound %s is unhealthy after %d failed checks: %s", tag, health.Failures, health.Error)
+	case !last.Healthy && health.Healthy:
+		log.Printf("Outbound %s is healthy again, latency %s", tag, health.Latency)
+	}
+	if c.influxClient != nil {
+		point := &influxdb.Point{
+			Measurement: "outbound_health",
+			Tags: map[string]string{
+				"node_type": nodeInfo.NodeType,
+				"node_id":   strconv.Itoa(nodeInfo.NodeID),
+				"outbound":  tag,
+			},
+			Fields: map[string]interface{}{
+				"healthy":    health.Healthy,
+				"latency_ms": health.Latency.Milliseconds(),
+				"failures":   health.Failures,
+			},
+			Time: health.CheckedAt,
+		}
+		if err := c.influxClient.Write([]*influxdb.Point{point}); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// OutboundHealth returns the result of the last health check of the outbound of the node
+func (c *Controller) OutboundHealth() mydispatcher.OutboundHealth {
+	health, _ := c.GetOutboundHealth(c.Tag())
+	return health
+}
@@ -0,0 +1,449 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/xtls/xray-core/common/uuid"
+)
+
+// The backoff of the restarts of the hysteria binary, a server which ran for hysteria2StableRun is restarted at once
+const (
+	hysteria2RestartDelay    = time.Second
+	hysteria2MaxRestartDelay = time.Minute
+	hysteria2StableRun       = time.Minute
+)
+
+// Hysteria2Builder builds the config of the hysteria server of the node, the users are authenticated by the auth url
+func Hysteria2Builder(config *Config, nodeInfo *api.NodeInfo, authURL string, statsListen string, statsSecret string) ([]byte, error) {
+	if config.CertConfig == nil || config.CertConfig.CertMode == "none" {
+		return nil, fmt.Errorf("Hysteria2 requires a TLS certificate, but the CertMode is none")
+	}
+	if config.CertConfig.CertMode == "secret" {
+		return nil, fmt.Errorf("Hysteria2 reads the TLS certificate from files, the CertMode secret is not supported")
+	}
+	certFile, keyFile, err := getCertFile(config.CertConfig)
+	if err != nil {
+		return nil, err
+	}
+	listen := fmt.Sprintf(":%d", nodeInfo.Port)
+	if config.ListenIP != "" {
+		ipAddress, err := parseListenIP(config.ListenIP)
+		if err != nil {
+			return nil, err
+		}
+		listen = net.JoinHostPort(ipAddress.IP().String(), strconv.Itoa(nodeInfo.Port))
+	}
+	serverConfig := map[string]interface{}{
+		"listen": listen,
+		"tls": map[string]string{
+			"cert": certFile,
+			"key":  keyFile,
+		},
+		"auth": map[string]interface{}{
+			"type": "http",
+			"http": map[string]string{"url": authURL},
+		},
+		"trafficStats": map[string]string{
+			"listen": statsListen,
+			"secret": statsSecret,
+		},
+	}
+	if h := nodeInfo.Hysteria2Config; h != nil {
+		bandwidth := make(map[string]string)
+		if h.UpMbps > 0 {
+			bandwidth["up"] = fmt.Sprintf("%d mbps", h.UpMbps)
+		}
+		if h.DownMbps > 0 {
+			bandwidth["down"] = fmt.Sprintf("%d mbps", h.DownMbps)
+		}
+		if len(bandwidth) > 0 {
+			serverConfig["bandwidth"] = bandwidth
+		}
+		if h.ObfsPassword != "" {
+			serverConfig["obfs"] = map[string]interface{}{
+				"type":       "salamander",
+				"salamander": map[string]string{"password": h.ObfsPassword},
+			}
+		}
+	}
+	return json.MarshalIndent(serverConfig, "", "  ")
+}
+
+// hysteria2Server runs the hysteria binary of the node, and serves the auth requests of it. The hysteria server
+// has no per-user limits, so the device limits are checked on the auth, and the speed limits on the traffic fetches
+type hysteria2Server struct {
+	config      *Hysteria2Config
+	configPath  string
+	statsSecret string
+	authURL     string // The secret is in the path, as the hysteria server cannot send a header with the auth
+	authPath    string
+	authServer  *http.Server
+	client      *http.Client
+	backoff     pollBackoff
+	access      sync.RWMutex
+	limiter     *limiter.Limiter     // The limiter of the node, nil means the users are not limited
+	tag         string               // The tag of the node in the limiter
+	statsListen string               // The traffic stats API of the running server
+	users       map[string]string    // Key: password, Value: email
+	throttled   map[string]time.Time // Key: email, Value: when the user over its speed limit is accepted again
+	overCap     bool                 // The node is over its bandwidth cap, the new connections are refused
+	lastFetch   time.Time            // The traffic of the users is counted since then
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newHysteria2Server(config *Hysteria2Config, nodeID int) (*hysteria2Server, error) {
+	if config == nil {
+		config = new(Hysteria2Config)
+	}
+	statsSecret, authSecret := uuid.New(), uuid.New()
+	s := &hysteria2Server{
+		config:      config,
+		configPath:  config.ConfigPath,
+		statsSecret: statsSecret.String(),
+		authPath:    "/auth/" + authSecret.String(),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		backoff:     pollBackoff{base: hysteria2RestartDelay, max: hysteria2MaxRestartDelay},
+		users:       make(map[string]string),
+		throttled:   make(map[string]time.Time),
+	}
+	if s.configPath == "" {
+		s.configPath = filepath.Join(os.TempDir(), fmt.Sprintf("hysteria2_%d.json", nodeID))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Listen Hysteria2 auth failed: %s", err)
+	}
+	s.authURL = fmt.Sprintf("http://%s%s", listener.Addr(), s.authPath)
+	s.authServer = &http.Server{Handler: http.HandlerFunc(s.handleAuth)}
+	go s.authServer.Serve(listener)
+	return s, nil
+}
+
+// handleAuth accepts the client if its auth is the password of a user within its limits, the email is the id of the
+// traffic stats. The other local processes do not know the secret path of the endpoint
+func (s *hysteria2Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.URL.Path), []byte(s.authPath)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	request := struct {
+		Addr string `json:"addr"`
+		Auth string `json:"auth"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.access.RLock()
+	email, ok := s.users[request.Auth]
+	throttled := time.Now().Before(s.throttled[email])
+	l, tag := s.limiter, s.tag
+	overCap := s.overCap
+	s.access.RUnlock()
+	if ok && throttled {
+		ok = false
+	}
+	if ok && overCap {
+		log.Printf("The node is over the bandwidth cap, refuse %s", email)
+		ok = false
+	}
+	if ok && l != nil {
+		ip, _, err := net.SplitHostPort(request.Addr)
+		if err != nil {
+			ip = request.Addr
+		}
+		if l.OverDataLimit(tag, email) {
+			log.Printf("%s has used up the data limit, refuse %s", email, ip)
+			ok = false
+		} else if _, _, reject := l.GetUserBuckets(tag, email, ip, "udp"); reject {
+			log.Printf("Devices of %s reach the limit, refuse %s", email, ip)
+			ok = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": ok, "id": email})
+}
+
+// setLimiter applies the limits of the node in the limiter to the users
+func (s *hysteria2Server) setLimiter(l *limiter.Limiter, tag string) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.limiter, s.tag = l, tag
+}
+
+// setOverCap refuses the new connections of the users while the node is over its bandwidth cap
+func (s *hysteria2Server) setOverCap(over bool) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.overCap = over
+}
+
+// Start writes the config of the node and starts the hysteria binary, which is started again if it exits
+func (s *hysteria2Server) Start(config *Config, nodeInfo *api.NodeInfo) error {
+	if _, err := Hysteria2Builder(config, nodeInfo, s.authURL, "", s.statsSecret); err != nil {
+		return err
+	}
+	launch := func() (*exec.Cmd, error) {
+		return s.launch(config, nodeInfo)
+	}
+	cmd, err := launch()
+	if err != nil {
+		return err
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.supervise(cmd, launch, s.stop, s.done)
+	return nil
+}
+
+// launch writes the config of the node and starts the hysteria binary. The hysteria binary cannot take over a
+// listener, so the free port of the traffic stats is held until right before the start. If another process takes
+// it meanwhile, the server exits and the next launch picks another one
+func (s *hysteria2Server) launch(config *Config, nodeInfo *api.NodeInfo) (*exec.Cmd, error) {
+	statsListen := s.config.StatsListen
+	var reserved net.Listener
+	if statsListen == "" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("Listen Hysteria2 traffic stats failed: %s", err)
+		}
+		reserved, statsListen = listener, listener.Addr().String()
+	}
+	serverConfig, err := Hysteria2Builder(config, nodeInfo, s.authURL, statsListen, s.statsSecret)
+	if err == nil {
+		if err = ioutil.WriteFile(s.configPath, serverConfig, 0600); err != nil {
+			err = fmt.Errorf("Write Hysteria2 config failed: %s", err)
+		}
+	}
+	if reserved != nil {
+		reserved.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	binaryPath := s.config.BinaryPath
+	if binaryPath == "" {
+		binaryPath = "hysteria"
+	}
+	cmd := exec.Command(binaryPath, "server", "-c", s.configPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Start Hysteria2 server failed: %s", err)
+	}
+	// The traffic of the new server is counted from its start
+	s.access.Lock()
+	s.statsListen, s.lastFetch = statsListen, time.Now()
+	s.access.Unlock()
+	return cmd, nil
+}
+
+// supervise waits for the hysteria binary, and starts it again with a backoff until stop is closed
+func (s *hysteria2Server) supervise(cmd *exec.Cmd, launch func() (*exec.Cmd, error), stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		started := time.Now()
+		select {
+		case <-stop:
+			cmd.Process.Kill()
+			<-exited
+			return
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("%s", cmd.ProcessState)
+			}
+			log.Printf("Hysteria2 server exited: %s", err)
+		}
+		stable := time.Since(started) >= hysteria2StableRun
+		for {
+			delay := s.backoff.next(stable)
+			stable = false
+			log.Printf("Restart Hysteria2 server in %s", delay)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			var err error
+			if cmd, err = launch(); err == nil {
+				break
+			}
+			log.Print(err)
+		}
+	}
+}
+
+// Stop kills the hysteria binary and waits for it to exit
+func (s *hysteria2Server) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop, s.done = nil, nil
+}
+
+// Close stops the hysteria binary and the auth endpoint
+func (s *hysteria2Server) Close() error {
+	s.Stop()
+	return s.authServer.Close()
+}
+
+// AddUsers allows the users to connect, the UUID is the password of a user, or the Passwd if the UUID is empty
+func (s *hysteria2Server) AddUsers(userInfo *[]api.UserInfo) int {
+	s.access.Lock()
+	defer s.access.Unlock()
+	added := 0
+	for _, user := range *userInfo {
+		password := user.UUID
+		if password == "" {
+			password = user.Passwd
+		}
+		if password == "" {
+			log.Printf("Skip user %s (UID %d): empty password", user.Email, user.UID)
+			continue
+		}
+		s.users[password] = user.Email
+		added++
+	}
+	return added
+}
+
+// RemoveUsers refuses the new connections of the users
+func (s *hysteria2Server) RemoveUsers(emails []string) {
+	removed := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		removed[email] = true
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	for password, email := range s.users {
+		if removed[email] {
+			delete(s.users, password)
+		}
+	}
+	for _, email := range emails {
+		delete(s.throttled, email)
+	}
+}
+
+// GetTraffic fetches and clears the traffic of the users since the last fetch, and throttles the users over their
+// speed limits. Key: email
+func (s *hysteria2Server) GetTraffic() (map[string]api.UserTraffic, error) {
+	s.access.RLock()
+	statsListen := s.statsListen
+	s.access.RUnlock()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/traffic?clear=1", statsListen), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", s.statsSecret)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Get Hysteria2 traffic failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Get Hysteria2 traffic failed: %s", res.Status)
+	}
+	stats := make(map[string]struct {
+		Tx int64 `json:"tx"` // Sent to the client
+		Rx int64 `json:"rx"` // Received from the client
+	})
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("Get Hysteria2 traffic failed: %s", err)
+	}
+	traffic := make(map[string]api.UserTraffic, len(stats))
+	for email, stat := range stats {
+		traffic[email] = api.UserTraffic{Email: email, Upload: stat.Rx, Download: stat.Tx}
+	}
+	s.limitSpeed(traffic, time.Now())
+	return traffic, nil
+}
+
+// limitSpeed throttles the users whose traffic since the last fetch is over their speed limits: they are kicked, and
+// refused until the excess would have been sent at the limit. So the limits are kept on average over the fetches
+func (s *hysteria2Server) limitSpeed(traffic map[string]api.UserTraffic, now time.Time) {
+	s.access.Lock()
+	elapsed := now.Sub(s.lastFetch).Seconds()
+	s.lastFetch = now
+	l, tag := s.limiter, s.tag
+	s.access.Unlock()
+	if l == nil {
+		return
+	}
+	var kicked []string
+	for email, t := range traffic {
+		var wait float64
+		uploadLimit, downloadLimit, shared := l.GetUserSpeedLimit(tag, email, "udp")
+		if shared {
+			wait = excessTime(t.Upload+t.Download, uploadLimit, elapsed)
+		} else if wait = excessTime(t.Upload, uploadLimit, elapsed); wait < excessTime(t.Download, downloadLimit, elapsed) {
+			wait = excessTime(t.Download, downloadLimit, elapsed)
+		}
+		if wait <= 0 {
+			continue
+		}
+		until := now.Add(time.Duration(wait * float64(time.Second)))
+		log.Printf("User %s is over its speed limit, refuse it until %s", email, until.Format(time.RFC3339))
+		s.access.Lock()
+		s.throttled[email] = until
+		s.access.Unlock()
+		kicked = append(kicked, email)
+	}
+	if len(kicked) > 0 {
+		if err := s.kick(kicked); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// excessTime returns the seconds it takes to send the bytes over the limit of the elapsed seconds at the limit
+func excessTime(bytes int64, limit uint64, elapsed float64) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return (float64(bytes) - float64(limit)*elapsed) / float64(limit)
+}
+
+// kick closes the connections of the users
+func (s *hysteria2Server) kick(emails []string) error {
+	body, err := json.Marshal(emails)
+	if err != nil {
+		return err
+	}
+	s.access.RLock()
+	statsListen := s.statsListen
+	s.access.RUnlock()
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/kick", statsListen), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", s.statsSecret)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Kick Hysteria2 users failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Kick Hysteria2 users failed: %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package controller_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	. "github.com/XrayR-project/XrayR/service/controller"
+)
+
+func TestBuildHysteria2(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "hy2.test.tk")
+	nodeInfo := &api.NodeInfo{
+		NodeType:        "Hysteria2",
+		NodeID:          1,
+		Port:            1145,
+		Hysteria2Config: &api.Hysteria2Config{UpMbps: 100, DownMbps: 50, ObfsPassword: "secret"},
+	}
+	config := &Config{ListenIP: "0.0.0.0", CertConfig: &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile}}
+	serverConfig, err := Hysteria2Builder(config, nodeInfo, "http://127.0.0.1:8080/auth", "127.0.0.1:9999", "stats-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := struct {
+		Listen string
+		TLS    struct{ Cert, Key string }
+		Auth   struct {
+			Type string
+			HTTP struct{ URL string }
+		}
+		TrafficStats struct{ Listen, Secret string }
+		Bandwidth    struct{ Up, Down string }
+		Obfs         struct {
+			Type       string
+			Salamander struct{ Password string }
+		}
+	}{}
+	if err := json.Unmarshal(serverConfig, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Listen != "0.0.0.0:1145" {
+		t.Errorf("unexpected listen: %s", got.Listen)
+	}
+	if got.TLS.Cert != certFile || got.TLS.Key != keyFile {
+		t.Errorf("unexpected tls: %+v", got.TLS)
+	}
+	if got.Auth.Type != "http" || got.Auth.HTTP.URL != "http://127.0.0.1:8080/auth" {
+		t.Errorf("unexpected auth: %+v", got.Auth)
+	}
+	if got.TrafficStats.Listen != "127.0.0.1:9999" || got.TrafficStats.Secret != "stats-secret" {
+		t.Errorf("unexpected traffic stats: %+v", got.TrafficStats)
+	}
+	if got.Bandwidth.Up != "100 mbps" || got.Bandwidth.Down != "50 mbps" {
+		t.Errorf("unexpected bandwidth: %+v", got.Bandwidth)
+	}
+	if got.Obfs.Type != "salamander" || got.Obfs.Salamander.Password != "secret" {
+		t.Errorf("unexpected obfs: %+v", got.Obfs)
+	}
+}
+
+func TestBuildHysteria2WithoutCert(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "Hysteria2", NodeID: 1, Port: 1145}
+	config := &Config{CertConfig: &CertConfig{CertMode: "none"}}
+	if _, err := Hysteria2Builder(config, nodeInfo, "http://127.0.0.1:8080/auth", "127.0.0.1:9999", "stats-secret"); err == nil {
+		t.Error("Hysteria2 without a cert should fail")
+	}
+	// The hysteria binary only reads the cert from files
+	config = &Config{CertConfig: &CertConfig{CertMode: "secret", CertEnv: "CERT", KeyEnv: "KEY"}}
+	if _, err := Hysteria2Builder(config, nodeInfo, "http://127.0.0.1:8080/auth", "127.0.0.1:9999", "stats-secret"); err == nil {
+		t.Error("Hysteria2 with the secret cert mode should fail")
+	}
+}
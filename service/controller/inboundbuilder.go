@@ -2,35 +2,314 @@
 package controller
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/common/legocmd"
+	"github.com/xtls/xray-core/app/proxyman"
 	"github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/common/uuid"
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport/internet"
 )
 
+var hostnameRe = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?)*$`)
+
 //InboundBuilder build Inbound config for different protocol
-func InboundBuilder(listenIP string, nodeInfo *api.NodeInfo, certConfig *CertConfig) (*core.InboundHandlerConfig, error) {
+func InboundBuilder(config *Config, nodeInfo *api.NodeInfo) (*core.InboundHandlerConfig, error) {
+	portRange := &conf.PortRange{From: uint32(nodeInfo.Port), To: uint32(nodeInfo.Port)}
+	return buildInbound(config, nodeInfo, portRange)
+}
+
+// nodeInboundsBuilder build all the inbounds of the node, the node inbound goes first
+func nodeInboundsBuilder(config *Config, nodeInfo *api.NodeInfo) ([]*core.InboundHandlerConfig, error) {
+	inboundConfig, err := InboundBuilder(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	extraInboundConfigs, err := ExtraInboundBuilder(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	ipv6InboundConfigs, err := IPv6InboundBuilder(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	udpInboundConfig, err := UDPInboundBuilder(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	tproxyInboundConfig, err := TProxyInboundBuilder(config)
+	if err != nil {
+		return nil, err
+	}
+	inboundConfigs := append([]*core.InboundHandlerConfig{inboundConfig}, extraInboundConfigs...)
+	if udpInboundConfig != nil {
+		inboundConfigs = append(inboundConfigs, udpInboundConfig)
+	}
+	inboundConfigs = append(inboundConfigs, ipv6InboundConfigs...)
+	if tproxyInboundConfig != nil {
+		inboundConfigs = append(inboundConfigs, tproxyInboundConfig)
+	}
+	return inboundConfigs, nil
+}
+
+// ExtraInboundBuilder build the Inbound configs for the extra ports of the node, one inbound for each port or port range
+func ExtraInboundBuilder(config *Config, nodeInfo *api.NodeInfo) ([]*core.InboundHandlerConfig, error) {
+	if nodeInfo.ExtraPorts == "" {
+		return nil, nil
+	}
+	portList := new(conf.PortList)
+	if err := json.Unmarshal([]byte(strconv.Quote(nodeInfo.ExtraPorts)), portList); err != nil {
+		return nil, fmt.Errorf("Invalid extra ports %s: %s", nodeInfo.ExtraPorts, err)
+	}
+	inboundConfigs := make([]*core.InboundHandlerConfig, 0, len(portList.Range))
+	for i := range portList.Range {
+		portRange := &portList.Range[i]
+		// The main port is served by the main inbound
+		if portRange.From == uint32(nodeInfo.Port) && portRange.To == uint32(nodeInfo.Port) {
+			continue
+		}
+		inboundConfig, err := buildInbound(config, nodeInfo, portRange)
+		if err != nil {
+			return nil, err
+		}
+		inboundConfigs = append(inboundConfigs, inboundConfig)
+	}
+	return inboundConfigs, nil
+}
+
+// IPv6InboundBuilder build the Inbound configs of the main port and the extra ports on the ListenIP6 of the dual stack node,
+// their tags are the ones of the IPv4 inbounds with a _v6 suffix
+func IPv6InboundBuilder(config *Config, nodeInfo *api.NodeInfo) ([]*core.InboundHandlerConfig, error) {
+	if config.ListenIP6 == "" {
+		return nil, nil
+	}
+	ipAddress, err := parseListenIP(config.ListenIP6)
+	if err != nil {
+		return nil, err
+	}
+	if !ipAddress.Family().IsIPv6() {
+		return nil, fmt.Errorf("Invalid ListenIP6 %s: not an IPv6 address", config.ListenIP6)
+	}
+	ipv6Config := *config
+	ipv6Config.ListenIP, ipv6Config.ListenIP6 = config.ListenIP6, ""
+	inboundConfig, err := InboundBuilder(&ipv6Config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	extraInboundConfigs, err := ExtraInboundBuilder(&ipv6Config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	inboundConfigs := append([]*core.InboundHandlerConfig{inboundConfig}, extraInboundConfigs...)
+	udpInboundConfig, err := UDPInboundBuilder(&ipv6Config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	if udpInboundConfig != nil {
+		inboundConfigs = append(inboundConfigs, udpInboundConfig)
+	}
+	for _, inboundConfig := range inboundConfigs {
+		inboundConfig.Tag += "_v6"
+	}
+	return inboundConfigs, nil
+}
+
+// UDPInboundBuilder build the companion UDP inbound of the Shadowsocks node, the main inbound serves the tcp only.
+// Its tag is the one of the main inbound with a _udp suffix
+func UDPInboundBuilder(config *Config, nodeInfo *api.NodeInfo) (*core.InboundHandlerConfig, error) {
+	udpConfig := config.UDPInboundConfig
+	if udpConfig == nil {
+		return nil, nil
+	}
+	// The other protocols carry the UDP in their tcp connections
+	if nodeInfo.NodeType != "Shadowsocks" {
+		return nil, fmt.Errorf("UDP inbound is only supported by the Shadowsocks node, not %s", nodeInfo.NodeType)
+	}
+	port := udpConfig.Port
+	if port == 0 {
+		port = uint32(nodeInfo.Port)
+	}
+	// The UDP is sniffed as the node, unless it is disabled for the UDP only
+	sniffingConfig, err := sniffingBuilder(config)
+	if err != nil {
+		return nil, err
+	}
+	sniffingConfig.Enabled = sniffingConfig.Enabled && !udpConfig.DisableSniffing
+	inboundDetourConfig := &conf.InboundDetourConfig{
+		Protocol:       "shadowsocks",
+		PortRange:      &conf.PortRange{From: port, To: port},
+		Tag:            udpInboundTag(nodeInfo, port),
+		SniffingConfig: sniffingConfig,
+	}
+	if config.ListenIP != "" {
+		ipAddress, err := parseListenIP(config.ListenIP)
+		if err != nil {
+			return nil, err
+		}
+		inboundDetourConfig.ListenOn = &conf.Address{Address: ipAddress}
+	}
+	randomPasswd := uuid.New()
+	setting, err := json.Marshal(&conf.ShadowsocksServerConfig{
+		Users: []*conf.ShadowsocksUserConfig{{
+			Cipher:   "aes-128-gcm",
+			Password: randomPasswd.String(),
+		}},
+		NetworkList: &conf.NetworkList{"udp"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Marshal UDP inbound config fialed: %s", err)
+	}
+	inboundDetourConfig.Settings = (*json.RawMessage)(&setting)
+	return inboundDetourConfig.Build()
+}
+
+func udpInboundTag(nodeInfo *api.NodeInfo, port uint32) string {
+	return fmt.Sprintf("%s_%d_udp", nodeInfo.NodeType, port)
+}
+
+// sniffingBuilder builds the sniffing of the inbounds of the node. Without the SniffingConfig the connections are
+// passed through unsniffed
+func sniffingBuilder(config *Config) (*conf.SniffingConfig, error) {
+	sniffingConfig := &conf.SniffingConfig{}
+	if config.SniffingConfig != nil {
+		destOverride := conf.StringList{}
+		for _, protocol := range config.SniffingConfig.DestOverride {
+			protocol = strings.ToLower(strings.TrimSpace(protocol))
+			if protocol != "http" && protocol != "tls" {
+				return nil, fmt.Errorf("Unsupported sniffing DestOverride: %s, Only support: http, tls", protocol)
+			}
+			destOverride = append(destOverride, protocol)
+		}
+		if len(destOverride) > 0 && !config.SniffingConfig.Enabled {
+			return nil, fmt.Errorf("Sniffing DestOverride %s requires the sniffing Enabled", strings.Join(destOverride, ", "))
+		}
+		sniffingConfig = &conf.SniffingConfig{
+			Enabled:      config.SniffingConfig.Enabled,
+			DestOverride: &destOverride,
+		}
+	}
+	if len(config.SniffExcludeDomains) > 0 {
+		domainsExcluded := conf.StringList(config.SniffExcludeDomains)
+		sniffingConfig.DomainsExcluded = &domainsExcluded
+	}
+	return sniffingConfig, nil
+}
+
+// parseListenIP parses the IPv4 or IPv6 address to listen on, the IPv6 one may be in brackets
+// TProxyInboundBuilder build the transparent proxy inbound of the node, a dokodemo-door accepting the tcp and udp
+// connections redirected by the firewall of the gateway. It has no users, so there is no user auth or limit on it.
+func TProxyInboundBuilder(config *Config) (*core.InboundHandlerConfig, error) {
+	tproxyConfig := config.TProxyConfig
+	if tproxyConfig == nil {
+		return nil, nil
+	}
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("Transparent proxy is only supported on linux, not %s", runtime.GOOS)
+	}
+	if tproxyConfig.Port == 0 {
+		return nil, fmt.Errorf("Transparent proxy needs a port")
+	}
+	mode := strings.ToLower(tproxyConfig.Mode)
+	if mode == "" {
+		mode = "tproxy"
+	}
+	if mode != "tproxy" && mode != "redirect" {
+		return nil, fmt.Errorf("Unsupported transparent proxy mode: %s, Only support: tproxy, redirect", tproxyConfig.Mode)
+	}
+	inboundDetourConfig := &conf.InboundDetourConfig{
+		Protocol:  "dokodemo-door",
+		PortRange: &conf.PortRange{From: tproxyConfig.Port, To: tproxyConfig.Port},
+		Tag:       tproxyInboundTag(tproxyConfig),
+		SniffingConfig: &conf.SniffingConfig{
+			Enabled:      true,
+			DestOverride: &conf.StringList{"http", "tls"},
+		},
+	}
+	if config.ListenIP != "" {
+		ipAddress, err := parseListenIP(config.ListenIP)
+		if err != nil {
+			return nil, err
+		}
+		inboundDetourConfig.ListenOn = &conf.Address{Address: ipAddress}
+	}
+	setting, err := json.Marshal(&conf.DokodemoConfig{
+		NetworkList: &conf.NetworkList{"tcp", "udp"},
+		Redirect:    true,
+		UserLevel:   config.PolicyLevel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Marshal transparent proxy config fialed: %s", err)
+	}
+	inboundDetourConfig.Settings = (*json.RawMessage)(&setting)
+	inboundDetourConfig.StreamSetting = &conf.StreamConfig{
+		SocketSettings: &conf.SocketConfig{
+			TProxy: mode,
+			Mark:   tproxyConfig.Mark,
+		},
+	}
+	inboundConfig, err := inboundDetourConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+	// The connections would be served as the ones to the gateway itself without the sockopt
+	receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	if sockopt := receiverSettings.(*proxyman.ReceiverConfig).StreamSettings.GetSocketSettings(); sockopt.GetTproxy() == internet.SocketConfig_Off {
+		return nil, fmt.Errorf("Transparent proxy inbound %s is built without the %s sockopt", inboundConfig.Tag, mode)
+	}
+	return inboundConfig, nil
+}
+
+func tproxyInboundTag(tproxyConfig *TProxyConfig) string {
+	return fmt.Sprintf("TProxy_%d", tproxyConfig.Port)
+}
+
+func parseListenIP(listenIP string) (net.Address, error) {
+	ipAddress := net.ParseAddress(listenIP)
+	if !ipAddress.Family().IsIP() {
+		return nil, fmt.Errorf("Invalid ListenIP %s: not an IP address", listenIP)
+	}
+	return ipAddress, nil
+}
+
+func buildInbound(config *Config, nodeInfo *api.NodeInfo, portRange *conf.PortRange) (*core.InboundHandlerConfig, error) {
 	inboundDetourConfig := &conf.InboundDetourConfig{}
 	// Build Listen IP address
-	if listenIP != "" {
-		ipAddress := net.ParseAddress(listenIP)
-		inboundDetourConfig.ListenOn = &conf.Address{ipAddress}
+	if config.ListenIP != "" {
+		ipAddress, err := parseListenIP(config.ListenIP)
+		if err != nil {
+			return nil, err
+		}
+		inboundDetourConfig.ListenOn = &conf.Address{Address: ipAddress}
 	}
 
 	// Build Port
-	portRange := &conf.PortRange{From: uint32(nodeInfo.Port), To: uint32(nodeInfo.Port)}
 	inboundDetourConfig.PortRange = portRange
 	// Build Tag
-	inboundDetourConfig.Tag = fmt.Sprintf("%s_%d", nodeInfo.NodeType, nodeInfo.Port)
+	if portRange.From == portRange.To {
+		inboundDetourConfig.Tag = fmt.Sprintf("%s_%d", nodeInfo.NodeType, portRange.From)
+	} else {
+		inboundDetourConfig.Tag = fmt.Sprintf("%s_%d-%d", nodeInfo.NodeType, portRange.From, portRange.To)
+	}
 	// SniffingConfig
-	sniffingConfig := &conf.SniffingConfig{
-		Enabled:      true,
-		DestOverride: &conf.StringList{"http", "tls"},
+	sniffingConfig, err := sniffingBuilder(config)
+	if err != nil {
+		return nil, err
 	}
 	inboundDetourConfig.SniffingConfig = sniffingConfig
 
@@ -58,9 +337,17 @@ func InboundBuilder(listenIP string, nodeInfo *api.NodeInfo, certConfig *CertCon
 	} else if nodeInfo.NodeType == "Shadowsocks" {
 		protocol = "shadowsocks"
 		proxySetting = &conf.ShadowsocksServerConfig{}
+		// All the users of the single-port node must use its method, each user uses its own otherwise
+		cipher := "aes-128-gcm"
+		if nodeInfo.Method != "" {
+			if !isAEADMethod(cipherFromString(nodeInfo.Method)) {
+				return nil, fmt.Errorf("Unsupported method %s of node %d, only AEAD methods are supported", nodeInfo.Method, nodeInfo.NodeID)
+			}
+			cipher = nodeInfo.Method
+		}
 		randomPasswd := uuid.New()
 		defaultSSuser := &conf.ShadowsocksUserConfig{
-			Cipher:   "aes-128-gcm",
+			Cipher:   cipher,
 			Password: randomPasswd.String(),
 		}
 		proxySetting, _ := proxySetting.(*conf.ShadowsocksServerConfig)
@@ -69,53 +356,445 @@ func InboundBuilder(listenIP string, nodeInfo *api.NodeInfo, certConfig *CertCon
 		return nil, fmt.Errorf("Unsupported node type: %s, Only support: V2ray, Trojan, and Shadowsocks", nodeInfo.NodeType)
 	}
 
-	setting, err := json.Marshal(proxySetting)
+	setting, err = json.Marshal(proxySetting)
 	if err != nil {
 		return nil, fmt.Errorf("Marshal proxy %s config fialed: %s", nodeInfo.NodeType, err)
 	}
 
 	// Build streamSettings
-	streamSetting = new(conf.StreamConfig)
+	streamSetting, err = buildTransportSettings(nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	// The plugin of a Shadowsocks node replaces its transport
+	if nodeInfo.NodeType == "Shadowsocks" && nodeInfo.SSPluginConfig != nil {
+		pluginSetting, err := buildSSPluginSettings(nodeInfo.SSPluginConfig)
+		if err != nil {
+			return nil, err
+		}
+		if pluginSetting != nil {
+			streamSetting = pluginSetting
+		}
+	}
+	// Take the client IPs from the PROXY protocol of the load balancer in front
+	if config.AcceptProxyProtocol {
+		if err := setAcceptProxyProtocol(streamSetting); err != nil {
+			return nil, err
+		}
+	}
+	// Build TLS and XTLS settings
+	if certConfig := config.CertConfig; nodeInfo.EnableTLS && certConfig.CertMode != "none" {
+		streamSetting.Security = nodeInfo.TLSType
+		tlsCert, err := buildTLSCert(certConfig)
+		if err != nil {
+			return nil, err
+		}
+		minVersion, maxVersion, cipherSuites, err := buildTLSOptions(certConfig)
+		if err != nil {
+			return nil, err
+		}
+		if nodeInfo.TLSType == "tls" {
+			tlsSettings := &conf.TLSConfig{MinVersion: minVersion, MaxVersion: maxVersion, CipherSuites: cipherSuites}
+			tlsSettings.Certs = append(tlsSettings.Certs, tlsCert)
+
+			streamSetting.TLSSettings = tlsSettings
+		} else if nodeInfo.TLSType == "xtls" && (streamSetting.GRPCConfig != nil || streamSetting.HTTPSettings != nil) {
+			log.Printf("XTLS is not supported by the %s transport, fall back to tls", nodeInfo.TransportProtocol)
+			streamSetting.Security = "tls"
+			tlsSettings := &conf.TLSConfig{MinVersion: minVersion, MaxVersion: maxVersion, CipherSuites: cipherSuites}
+			tlsSettings.Certs = append(tlsSettings.Certs, tlsCert)
+			streamSetting.TLSSettings = tlsSettings
+		} else if nodeInfo.TLSType == "xtls" {
+			xtlsSettings := &conf.XTLSConfig{MinVersion: minVersion, MaxVersion: maxVersion, CipherSuites: cipherSuites}
+			xtlsSettings.Certs = append(xtlsSettings.Certs, &conf.XTLSCertConfig{
+				CertFile:     tlsCert.CertFile,
+				CertStr:      tlsCert.CertStr,
+				KeyFile:      tlsCert.KeyFile,
+				KeyStr:       tlsCert.KeyStr,
+				OcspStapling: tlsCert.OcspStapling,
+			})
+			streamSetting.XTLSSettings = xtlsSettings
+		}
+	}
+	// The HTTP/2 transport of xray-core is only served over TLS
+	if streamSetting.HTTPSettings != nil && streamSetting.Security != "tls" {
+		return nil, fmt.Errorf("HTTP/2 transport of node %d requires TLS, enable the TLS of the node and set a CertMode other than none", nodeInfo.NodeID)
+	}
+
+	inboundDetourConfig.Protocol = protocol
+	inboundDetourConfig.StreamSetting = streamSetting
+	inboundDetourConfig.Settings = &setting
+
+	return inboundDetourConfig.Build()
+}
+
+// buildTransportSettings build and validate the transport part of the streamSettings
+func buildTransportSettings(nodeInfo *api.NodeInfo) (*conf.StreamConfig, error) {
+	streamSetting := new(conf.StreamConfig)
 	transportProtocol := conf.TransportProtocol(nodeInfo.TransportProtocol)
 	networkType, err := transportProtocol.Build()
 	if err != nil {
 		return nil, fmt.Errorf("convert TransportProtocol failed: %s", err)
 	}
 	if networkType == "websocket" {
+		if nodeInfo.Path != "" && !strings.HasPrefix(nodeInfo.Path, "/") {
+			return nil, fmt.Errorf("Invalid websocket path: %s, the path must start with /", nodeInfo.Path)
+		}
 		headers := make(map[string]string)
-		headers["Host"] = nodeInfo.Host
+		// Accept any host if the panel does not provide one
+		if nodeInfo.Host != "" {
+			if !isValidHost(nodeInfo.Host) {
+				return nil, fmt.Errorf("Invalid websocket host: %s", nodeInfo.Host)
+			}
+			headers["Host"] = nodeInfo.Host
+		}
 		wsSettings := &conf.WebSocketConfig{
 			Path:    nodeInfo.Path,
 			Headers: headers,
 		}
+		if err := setWSConfig(wsSettings, nodeInfo.WSConfig); err != nil {
+			return nil, err
+		}
 		streamSetting.WSSettings = wsSettings
+	} else if networkType == "mkcp" {
+		kcpSettings, err := buildKCPSettings(nodeInfo.KCPConfig)
+		if err != nil {
+			return nil, err
+		}
+		streamSetting.KCPSettings = kcpSettings
+	} else if networkType == "grpc" {
+		if nodeInfo.NodeType == "Shadowsocks" {
+			log.Printf("gRPC transport is not supported by the Shadowsocks node, fall back to tcp")
+			transportProtocol = "tcp"
+		} else {
+			grpcSettings, err := buildGRPCSettings(nodeInfo.GRPCConfig)
+			if err != nil {
+				return nil, err
+			}
+			streamSetting.GRPCConfig = grpcSettings
+		}
+	} else if networkType == "http" {
+		if nodeInfo.NodeType == "Shadowsocks" {
+			log.Printf("HTTP/2 transport is not supported by the Shadowsocks node, fall back to tcp")
+			transportProtocol = "tcp"
+		} else {
+			httpSettings, err := buildHTTPSettings(nodeInfo)
+			if err != nil {
+				return nil, err
+			}
+			streamSetting.HTTPSettings = httpSettings
+		}
 	}
 
 	streamSetting.Network = &transportProtocol
-	// Build TLS and XTLS settings
-	if nodeInfo.EnableTLS && certConfig.CertMode != "none" {
-		streamSetting.Security = nodeInfo.TLSType
-		certFile, keyFile, err := getCertFile(certConfig)
+	return streamSetting, nil
+}
+
+// buildHTTPSettings builds the HTTP/2 transport, the Host of the node may list several hosts separated by commas
+func buildHTTPSettings(nodeInfo *api.NodeInfo) (*conf.HTTPConfig, error) {
+	if nodeInfo.Path != "" && !strings.HasPrefix(nodeInfo.Path, "/") {
+		return nil, fmt.Errorf("Invalid h2 path: %s, the path must start with /", nodeInfo.Path)
+	}
+	// The server matches the path of the request without its query
+	if strings.ContainsAny(nodeInfo.Path, "?# \t\r\n") {
+		return nil, fmt.Errorf("Invalid h2 path: %s, the path cannot have a query, fragment or spaces", nodeInfo.Path)
+	}
+	httpSettings := &conf.HTTPConfig{Path: nodeInfo.Path}
+	var hosts conf.StringList
+	for _, host := range strings.Split(nodeInfo.Host, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if !isValidHost(host) {
+			return nil, fmt.Errorf("Invalid h2 host: %s", host)
+		}
+		hosts = append(hosts, host)
+	}
+	// Accept any host if the panel does not provide one
+	if len(hosts) > 0 {
+		httpSettings.Host = &hosts
+	}
+	return httpSettings, nil
+}
+
+// wsEarlyDataHeader is the only request header xray-core reads the websocket early data from
+const wsEarlyDataHeader = "Sec-WebSocket-Protocol"
+
+// maxWSEarlyData is the max early data of the websocket, it is sent base64 encoded in a request header
+const maxWSEarlyData = 8192
+
+// headerNameRe matches the HTTP header names, which are tokens
+var headerNameRe = regexp.MustCompile(`^[a-zA-Z0-9!#$%&'*+.^_|~\-]+$`)
+
+// setWSConfig validates the extra websocket settings and sets them to the settings. The max early data is
+// given to xray-core by the ed parameter of the path
+func setWSConfig(wsSettings *conf.WebSocketConfig, wsConfig *api.WSConfig) error {
+	if wsConfig == nil {
+		return nil
+	}
+	for name, value := range wsConfig.Headers {
+		if !headerNameRe.MatchString(name) {
+			return fmt.Errorf("Invalid websocket header name: %s", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Invalid websocket header value of %s: %q", name, value)
+		}
+		if _, ok := wsSettings.Headers[http.CanonicalHeaderKey(name)]; ok {
+			return fmt.Errorf("websocket header %s is set by the node", name)
+		}
+		wsSettings.Headers[http.CanonicalHeaderKey(name)] = value
+	}
+	if wsConfig.EarlyDataHeaderName != "" {
+		if wsConfig.MaxEarlyData == 0 {
+			return fmt.Errorf("websocket early data header %s is set, but the max early data is not", wsConfig.EarlyDataHeaderName)
+		}
+		if !strings.EqualFold(wsConfig.EarlyDataHeaderName, wsEarlyDataHeader) {
+			return fmt.Errorf("websocket early data header %s is not supported, only %s is", wsConfig.EarlyDataHeaderName, wsEarlyDataHeader)
+		}
+	}
+	if wsConfig.MaxEarlyData == 0 {
+		return nil
+	}
+	if wsConfig.MaxEarlyData > maxWSEarlyData {
+		return fmt.Errorf("Invalid websocket max early data: %d, the max is %d", wsConfig.MaxEarlyData, maxWSEarlyData)
+	}
+	path, err := url.Parse(wsSettings.Path)
+	if err != nil {
+		return fmt.Errorf("Invalid websocket path: %s", wsSettings.Path)
+	}
+	query := path.Query()
+	query.Set("ed", strconv.FormatUint(uint64(wsConfig.MaxEarlyData), 10))
+	path.RawQuery = query.Encode()
+	wsSettings.Path = path.String()
+	return nil
+}
+
+// setAcceptProxyProtocol accepts the PROXY protocol v1 and v2 on the listener of the transport. The tcp and ws
+// listeners take it from their own settings, the others from the socket settings
+func setAcceptProxyProtocol(streamSetting *conf.StreamConfig) error {
+	network := "tcp"
+	if streamSetting.Network != nil {
+		network = strings.ToLower(string(*streamSetting.Network))
+	}
+	switch network {
+	case "tcp":
+		if streamSetting.TCPSettings == nil {
+			streamSetting.TCPSettings = &conf.TCPConfig{}
+		}
+		streamSetting.TCPSettings.AcceptProxyProtocol = true
+	case "ws", "websocket":
+		if streamSetting.WSSettings == nil {
+			streamSetting.WSSettings = &conf.WebSocketConfig{}
+		}
+		streamSetting.WSSettings.AcceptProxyProtocol = true
+	case "kcp", "mkcp":
+		return fmt.Errorf("PROXY protocol is not supported by the %s transport", network)
+	default:
+		if streamSetting.SocketSettings == nil {
+			streamSetting.SocketSettings = &conf.SocketConfig{}
+		}
+		streamSetting.SocketSettings.AcceptProxyProtocol = true
+	}
+	return nil
+}
+
+// buildSSPluginSettings builds the transport that serves the clients of the plugin,
+// an unsupported plugin returns nil, which leaves a plain Shadowsocks inbound
+func buildSSPluginSettings(pluginConfig *api.SSPluginConfig) (*conf.StreamConfig, error) {
+	path := pluginConfig.Path
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("Invalid %s path: %s, the path must start with /", pluginConfig.Plugin, path)
+	}
+	if pluginConfig.Host != "" && !isValidHost(pluginConfig.Host) {
+		return nil, fmt.Errorf("Invalid %s host: %s", pluginConfig.Plugin, pluginConfig.Host)
+	}
+	mode := strings.ToLower(pluginConfig.Mode)
+	streamSetting := new(conf.StreamConfig)
+	switch strings.ToLower(pluginConfig.Plugin) {
+	case "obfs", "simple-obfs", "obfs-local", "obfs-server":
+		if mode != "" && mode != "http" {
+			log.Printf("Mode %s of the obfs plugin is not supported, serve plain Shadowsocks", pluginConfig.Mode)
+			return nil, nil
+		}
+		// The HTTP obfuscation of the TCP transport answers the request of simple-obfs with a websocket upgrade like obfs-server
+		header := &conf.Authenticator{
+			Request: conf.AuthenticatorRequest{
+				Path: conf.StringList{path},
+			},
+			Response: conf.AuthenticatorResponse{
+				Status: "101",
+				Reason: "Switching Protocols",
+				Headers: map[string]*conf.StringList{
+					"Upgrade":    {"websocket"},
+					"Connection": {"Upgrade"},
+				},
+			},
+		}
+		if pluginConfig.Host != "" {
+			header.Request.Headers = map[string]*conf.StringList{"Host": {pluginConfig.Host}}
+		}
+		headerConfig, err := json.Marshal(struct {
+			Type string `json:"type"`
+			*conf.Authenticator
+		}{"http", header})
 		if err != nil {
 			return nil, err
 		}
-		if nodeInfo.TLSType == "tls" {
-			tlsSettings := &conf.TLSConfig{}
-			tlsSettings.Certs = append(tlsSettings.Certs, &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
+		transportProtocol := conf.TransportProtocol("tcp")
+		streamSetting.Network = &transportProtocol
+		streamSetting.TCPSettings = &conf.TCPConfig{HeaderConfig: headerConfig}
+	case "v2ray-plugin":
+		if mode != "" && mode != "websocket" {
+			log.Printf("Mode %s of v2ray-plugin is not supported, serve plain Shadowsocks", pluginConfig.Mode)
+			return nil, nil
+		}
+		headers := make(map[string]string)
+		if pluginConfig.Host != "" {
+			headers["Host"] = pluginConfig.Host
+		}
+		transportProtocol := conf.TransportProtocol("ws")
+		streamSetting.Network = &transportProtocol
+		streamSetting.WSSettings = &conf.WebSocketConfig{
+			Path:    path,
+			Headers: headers,
+		}
+	default:
+		log.Printf("Shadowsocks plugin %s is not supported, serve plain Shadowsocks", pluginConfig.Plugin)
+		return nil, nil
+	}
+	return streamSetting, nil
+}
 
-			streamSetting.TLSSettings = tlsSettings
-		} else if nodeInfo.TLSType == "xtls" {
-			xtlsSettings := &conf.XTLSConfig{}
-			xtlsSettings.Certs = append(xtlsSettings.Certs, &conf.XTLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
-			streamSetting.XTLSSettings = xtlsSettings
+// kcpHeaderTypes are the mKCP header obfuscations supported by xray-core
+var kcpHeaderTypes = map[string]bool{
+	"none":         true,
+	"srtp":         true,
+	"utp":          true,
+	"wechat-video": true,
+	"dtls":         true,
+	"wireguard":    true,
+}
+
+// buildKCPSettings build the mKCP settings, an unknown header type falls back to none
+func buildKCPSettings(kcpConfig *api.KCPConfig) (*conf.KCPConfig, error) {
+	kcpSettings := new(conf.KCPConfig)
+	if kcpConfig == nil {
+		return kcpSettings, nil
+	}
+	headerType := kcpConfig.HeaderType
+	if headerType == "" {
+		headerType = "none"
+	} else if !kcpHeaderTypes[headerType] {
+		log.Printf("Unknown kcp header type: %s, fall back to none", headerType)
+		headerType = "none"
+	}
+	header, err := json.Marshal(map[string]string{"type": headerType})
+	if err != nil {
+		return nil, err
+	}
+	kcpSettings.HeaderConfig = header
+	if kcpConfig.Seed != "" {
+		kcpSettings.Seed = &kcpConfig.Seed
+	}
+	if kcpConfig.MTU != 0 {
+		kcpSettings.Mtu = &kcpConfig.MTU
+	}
+	if kcpConfig.TTI != 0 {
+		kcpSettings.Tti = &kcpConfig.TTI
+	}
+	return kcpSettings, nil
+}
+
+// grpcServiceNameRe matches the gRPC service names like trojan or my.service_v2, which are a part of the request path
+var grpcServiceNameRe = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+
+// buildGRPCSettings build the gRPC settings, the service name is required
+func buildGRPCSettings(grpcConfig *api.GRPCConfig) (*conf.GRPCConfig, error) {
+	if grpcConfig == nil || grpcConfig.ServiceName == "" {
+		return nil, fmt.Errorf("gRPC service name is required")
+	}
+	if !grpcServiceNameRe.MatchString(grpcConfig.ServiceName) {
+		return nil, fmt.Errorf("Invalid gRPC service name: %s, only letters, digits, _, . and - are allowed", grpcConfig.ServiceName)
+	}
+	return &conf.GRPCConfig{ServiceName: grpcConfig.ServiceName, MultiMode: grpcConfig.MultiMode}, nil
+}
+
+// isValidHost checks if the host is a valid hostname or IP address
+func isValidHost(host string) bool {
+	if net.ParseAddress(host).Family().IsIP() {
+		return true
+	}
+	return len(host) <= 253 && hostnameRe.MatchString(host)
+}
+
+// buildTLSCert builds the cert of the TLS inbounds. The cert of the secret mode is served inline, so the key is
+// not written to the disk, and xray-core does not reload it
+func buildTLSCert(certConfig *CertConfig) (*conf.TLSCertConfig, error) {
+	if certConfig.CertMode == "secret" {
+		cert, key, err := readCertSecret(certConfig)
+		if err != nil {
+			return nil, err
 		}
+		return &conf.TLSCertConfig{CertStr: []string{string(cert)}, KeyStr: []string{string(key)}}, nil
 	}
+	certFile, keyFile, err := getCertFile(certConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Seconds between the OCSP response updates, 0 disables the stapling
+	ocspStapling := uint64(certHotReloadInterval / time.Second)
+	if certConfig.DisableOCSPStapling {
+		ocspStapling = 0
+	}
+	return &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: ocspStapling}, nil
+}
 
-	inboundDetourConfig.Protocol = protocol
-	inboundDetourConfig.StreamSetting = streamSetting
-	inboundDetourConfig.Settings = &setting
+// tlsVersions are the TLS versions accepted by the TLS settings of xray-core
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
-	return inboundDetourConfig.Build()
+// buildTLSOptions checks the TLS versions and the cipher suites of the cert config, and returns them in the form
+// of the TLS settings of xray-core. xray-core ignores the unknown values, so they are rejected here instead
+func buildTLSOptions(certConfig *CertConfig) (minVersion string, maxVersion string, cipherSuites string, err error) {
+	minVersion, maxVersion = certConfig.MinTLSVersion, certConfig.MaxTLSVersion
+	if _, ok := tlsVersions[minVersion]; minVersion != "" && !ok {
+		return "", "", "", fmt.Errorf("Invalid MinTLSVersion %s, should be one of 1.0, 1.1, 1.2, 1.3", minVersion)
+	}
+	if _, ok := tlsVersions[maxVersion]; maxVersion != "" && !ok {
+		return "", "", "", fmt.Errorf("Invalid MaxTLSVersion %s, should be one of 1.0, 1.1, 1.2, 1.3", maxVersion)
+	}
+	if minVersion != "" && maxVersion != "" && tlsVersions[minVersion] > tlsVersions[maxVersion] {
+		return "", "", "", fmt.Errorf("MinTLSVersion %s is higher than MaxTLSVersion %s", minVersion, maxVersion)
+	}
+	if len(certConfig.CipherSuites) == 0 {
+		return minVersion, maxVersion, "", nil
+	}
+	// The cipher suites of TLS 1.3 are not configurable in Go
+	if minVersion == "1.3" {
+		return "", "", "", fmt.Errorf("CipherSuites only apply to TLS 1.2 and below, but MinTLSVersion is 1.3")
+	}
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	for _, name := range certConfig.CipherSuites {
+		suite, ok := suites[name]
+		if !ok {
+			return "", "", "", fmt.Errorf("Invalid cipher suite %s, should be a secure cipher suite of Go like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return "", "", "", fmt.Errorf("Invalid cipher suite %s, the cipher suites of TLS 1.3 are not configurable", name)
+		}
+	}
+	return minVersion, maxVersion, strings.Join(certConfig.CipherSuites, ":"), nil
 }
 
 func getCertFile(certConfig *CertConfig) (certFile string, keyFile string, err error) {
@@ -123,6 +802,9 @@ func getCertFile(certConfig *CertConfig) (certFile string, keyFile string, err e
 		if certConfig.CertFile == "" || certConfig.KeyFile == "" {
 			return "", "", fmt.Errorf("Cert file path or key file path not exist")
 		}
+		if err := checkCertFile(certConfig.CertFile, certConfig.KeyFile); err != nil {
+			return "", "", err
+		}
 		return certConfig.CertFile, certConfig.KeyFile, nil
 	} else if certConfig.CertMode == "dns" {
 		lego, err := legocmd.New()
@@ -148,3 +830,11 @@ func getCertFile(certConfig *CertConfig) (certFile string, keyFile string, err e
 
 	return "", "", fmt.Errorf("Unsupported certmode: %s", certConfig.CertMode)
 }
+
+// checkCertFile checks if the cert file and key file exist and are a valid key pair
+func checkCertFile(certFile string, keyFile string) error {
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("Invalid cert file %s or key file %s: %s", certFile, keyFile, err)
+	}
+	return nil
+}
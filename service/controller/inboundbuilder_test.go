@@ -1,10 +1,32 @@
 package controller_test
 
 import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/XrayR-project/XrayR/api"
 	. "github.com/XrayR-project/XrayR/service/controller"
+	"github.com/xtls/xray-core/app/proxyman"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol/tls/cert"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/proxy/dokodemo"
+	"github.com/xtls/xray-core/proxy/shadowsocks"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/grpc"
+	"github.com/xtls/xray-core/transport/internet/headers/http"
+	"github.com/xtls/xray-core/transport/internet/headers/noop"
+	"github.com/xtls/xray-core/transport/internet/headers/wechat"
+	h2 "github.com/xtls/xray-core/transport/internet/http"
+	"github.com/xtls/xray-core/transport/internet/kcp"
+	"github.com/xtls/xray-core/transport/internet/tcp"
+	"github.com/xtls/xray-core/transport/internet/tls"
+	"github.com/xtls/xray-core/transport/internet/websocket"
+	"github.com/xtls/xray-core/transport/internet/xtls"
 )
 
 func TestBuildV2ray(t *testing.T) {
@@ -16,7 +38,7 @@ func TestBuildV2ray(t *testing.T) {
 		AlterID:           2,
 		TransportProtocol: "ws",
 		Host:              "test.test.tk",
-		Path:              "v2ray",
+		Path:              "/v2ray",
 		EnableTLS:         false,
 		TLSType:           "tls",
 	}
@@ -26,7 +48,7 @@ func TestBuildV2ray(t *testing.T) {
 		Provider:   "alidns",
 		Email:      "test@gmail.com",
 	}
-	_, err := InboundBuilder("0.0.0.0", nodeInfo, certConfig)
+	_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
 	if err != nil {
 		t.Error(err)
 	}
@@ -55,7 +77,7 @@ func TestBuildTrojan(t *testing.T) {
 		Email:      "test@gmail.com",
 		DNSEnv:     DNSEnv,
 	}
-	_, err := InboundBuilder("0.0.0.0", nodeInfo, certConfig)
+	_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
 	if err != nil {
 		t.Error(err)
 	}
@@ -84,8 +106,1053 @@ func TestBuildSS(t *testing.T) {
 		Email:      "test@me.com",
 		DNSEnv:     DNSEnv,
 	}
-	_, err := InboundBuilder("0.0.0.0", nodeInfo, certConfig)
+	_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestBuildV2rayInvalidPath(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "ws",
+		Host:              "test.test.tk",
+		Path:              "v2ray",
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err == nil {
+		t.Error("path without leading slash should be rejected")
+	}
+}
+
+func TestBuildV2rayInvalidHost(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "ws",
+		Host:              "test_test.tk/ws",
+		Path:              "/v2ray",
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err == nil {
+		t.Error("invalid host should be rejected")
+	}
+}
+
+func TestBuildV2rayEmptyHost(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "ws",
+		Path:              "/v2ray",
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := getStreamSettings(t, inboundConfig).TransportSettings[0].GetTypedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsSettings := settings.(*websocket.Config)
+	if wsSettings.Path != "/v2ray" {
+		t.Errorf("unexpected path: %s", wsSettings.Path)
+	}
+	if len(wsSettings.Header) != 0 {
+		t.Error("empty host should not set the Host header")
+	}
+}
+
+func TestBuildV2rayWSEarlyData(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "ws",
+		Host:              "test.test.tk",
+		Path:              "/v2ray",
+		WSConfig: &api.WSConfig{
+			MaxEarlyData:        2048,
+			EarlyDataHeaderName: "sec-websocket-protocol",
+			Headers:             map[string]string{"x-forwarded-proto": "https"},
+		},
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := getStreamSettings(t, inboundConfig).TransportSettings[0].GetTypedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsSettings := settings.(*websocket.Config)
+	if wsSettings.Path != "/v2ray" || wsSettings.Ed != 2048 {
+		t.Errorf("unexpected path %s and early data %d", wsSettings.Path, wsSettings.Ed)
+	}
+	headers := make(map[string]string)
+	for _, header := range wsSettings.Header {
+		headers[header.Key] = header.Value
+	}
+	if len(headers) != 2 || headers["Host"] != "test.test.tk" || headers["X-Forwarded-Proto"] != "https" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+}
+
+func TestBuildV2rayInvalidWSConfig(t *testing.T) {
+	for _, wsConfig := range []*api.WSConfig{
+		{MaxEarlyData: 1 << 20},
+		{EarlyDataHeaderName: "Sec-WebSocket-Protocol"},
+		{MaxEarlyData: 2048, EarlyDataHeaderName: "X-Early-Data"},
+		{Headers: map[string]string{"Bad Header": "value"}},
+		{Headers: map[string]string{"X-Injected": "value\r\nX-Other: value"}},
+		{Headers: map[string]string{"host": "other.test.tk"}},
+	} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "V2ray",
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: "ws",
+			Host:              "test.test.tk",
+			Path:              "/v2ray",
+			WSConfig:          wsConfig,
+		}
+		certConfig := &CertConfig{CertMode: "none"}
+		if _, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo); err == nil {
+			t.Errorf("invalid ws config should be rejected: %+v", wsConfig)
+		}
+	}
+}
+
+func getStreamSettings(t *testing.T, inboundConfig *core.InboundHandlerConfig) *internet.StreamConfig {
+	receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receiverSettings.(*proxyman.ReceiverConfig).StreamSettings
+}
+
+func TestBuildExtraPorts(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		ExtraPorts:        "1145,8443,10000-10100",
+		TransportProtocol: "tcp",
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfigs, err := ExtraInboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, inboundConfig := range inboundConfigs {
+		tags = append(tags, inboundConfig.Tag)
+	}
+	if want := "V2ray_8443,V2ray_10000-10100"; strings.Join(tags, ",") != want {
+		t.Errorf("unexpected extra inbound tags. want %s, but got %s", want, strings.Join(tags, ","))
+	}
+}
+
+func TestBuildExtraPortsInvalid(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		ExtraPorts:        "8443,abc",
+		TransportProtocol: "tcp",
+	}
+	if _, err := ExtraInboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: &CertConfig{CertMode: "none"}}, nodeInfo); err == nil {
+		t.Error("invalid extra ports should be rejected")
+	}
+}
+
+func TestBuildSniffExcludeDomains(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+	}
+	config := &Config{
+		CertConfig:          &CertConfig{CertMode: "none"},
+		SniffExcludeDomains: []string{"domain:corp.internal", "full:www.example.com"},
+	}
+	inboundConfig, err := InboundBuilder(config, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainsExcluded := receiverSettings.(*proxyman.ReceiverConfig).SniffingSettings.DomainsExcluded
+	if strings.Join(domainsExcluded, ",") != "domain:corp.internal,full:www.example.com" {
+		t.Errorf("unexpected excluded domains: %v", domainsExcluded)
+	}
+}
+
+func TestBuildSniffingConfig(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "Shadowsocks", NodeID: 1, Port: 1145, TransportProtocol: "tcp"}
+	testCases := []struct {
+		sniffingConfig *SniffingConfig
+		enabled        bool
+		destOverride   string
+	}{
+		// Without the config the connections are not sniffed
+		{nil, false, ""},
+		{&SniffingConfig{}, false, ""},
+		{&SniffingConfig{Enabled: true}, true, ""},
+		{&SniffingConfig{Enabled: true, DestOverride: []string{"TLS"}}, true, "tls"},
+	}
+	for _, testCase := range testCases {
+		config := &Config{
+			CertConfig:       &CertConfig{CertMode: "none"},
+			SniffingConfig:   testCase.sniffingConfig,
+			UDPInboundConfig: &UDPInboundConfig{Port: 1146},
+		}
+		inboundConfig, err := InboundBuilder(config, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		udpInboundConfig, err := UDPInboundBuilder(config, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The UDP inbound is sniffed as the node
+		for _, inbound := range []*core.InboundHandlerConfig{inboundConfig, udpInboundConfig} {
+			receiverSettings, err := inbound.ReceiverSettings.GetInstance()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sniffing := receiverSettings.(*proxyman.ReceiverConfig).GetSniffingSettings()
+			if sniffing.GetEnabled() != testCase.enabled || strings.Join(sniffing.GetDestinationOverride(), ",") != testCase.destOverride {
+				t.Errorf("%+v: unexpected sniffing of %s: %v", testCase.sniffingConfig, inbound.Tag, sniffing)
+			}
+		}
+	}
+	for _, sniffingConfig := range []*SniffingConfig{
+		{Enabled: true, DestOverride: []string{"bittorrent"}},
+		{DestOverride: []string{"http"}},
+	} {
+		if _, err := InboundBuilder(&Config{CertConfig: &CertConfig{CertMode: "none"}, SniffingConfig: sniffingConfig}, nodeInfo); err == nil {
+			t.Errorf("%+v: the sniffing config should be rejected", *sniffingConfig)
+		}
+	}
+}
+
+func TestBuildIPv6Listen(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+	}
+	for _, listenIP := range []string{"::1", "[::1]", "::"} {
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: listenIP, CertConfig: &CertConfig{CertMode: "none"}}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		listen := receiverSettings.(*proxyman.ReceiverConfig).Listen.AsAddress()
+		if !listen.Family().IsIPv6() || listen.IP().String() != strings.Trim(listenIP, "[]") {
+			t.Errorf("%s: unexpected listen address %s", listenIP, listen)
+		}
+	}
+	for _, listenIP := range []string{"localhost", "::1::2", "1.1.1.256"} {
+		if _, err := InboundBuilder(&Config{ListenIP: listenIP, CertConfig: &CertConfig{CertMode: "none"}}, nodeInfo); err == nil {
+			t.Errorf("invalid ListenIP %s should be rejected", listenIP)
+		}
+	}
+}
+
+func TestBuildDualStack(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		ExtraPorts:        "8443",
+		TransportProtocol: "tcp",
+	}
+	config := &Config{ListenIP: "0.0.0.0", ListenIP6: "[2001:db8::1]", CertConfig: &CertConfig{CertMode: "none"}}
+	inboundConfigs, err := IPv6InboundBuilder(config, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, inboundConfig := range inboundConfigs {
+		tags = append(tags, inboundConfig.Tag)
+		receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if listen := receiverSettings.(*proxyman.ReceiverConfig).Listen.AsAddress(); listen.IP().String() != "2001:db8::1" {
+			t.Errorf("%s: unexpected listen address %s", inboundConfig.Tag, listen)
+		}
+	}
+	if want := "V2ray_1145_v6,V2ray_8443_v6"; strings.Join(tags, ",") != want {
+		t.Errorf("unexpected IPv6 inbound tags. want %s, but got %s", want, strings.Join(tags, ","))
+	}
+	config.ListenIP6 = "127.0.0.1"
+	if _, err := IPv6InboundBuilder(config, nodeInfo); err == nil {
+		t.Error("IPv4 ListenIP6 should be rejected")
+	}
+}
+
+// writeCertFile generates a self signed cert of the common name, and writes it and its key to the dir
+func writeCertFile(t *testing.T, dir string, commonName string, opts ...cert.Option) (certFile string, keyFile string) {
+	certificate, err := cert.Generate(nil, append([]cert.Option{cert.CommonName(commonName), cert.DNSNames(commonName)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := certificate.ToPEM()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestBuildFileCert(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	certConfig := &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := getStreamSettings(t, inboundConfig).SecuritySettings[0].GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificates := settings.(*tls.Config).Certificate
+	certPEM, _ := ioutil.ReadFile(certFile)
+	if len(certificates) != 1 || string(certificates[0].Certificate) != string(certPEM) {
+		t.Errorf("the cert file should be used, got %v", certificates)
+	}
+}
+
+func TestBuildTLS13Only(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	for _, tlsType := range []string{"tls", "xtls"} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "V2ray",
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: "tcp",
+			EnableTLS:         true,
+			EnableVless:       true,
+			TLSType:           tlsType,
+		}
+		certConfig := &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile, MinTLSVersion: "1.3", MaxTLSVersion: "1.3"}
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, err := getStreamSettings(t, inboundConfig).SecuritySettings[0].GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var minVersion, maxVersion string
+		switch settings := settings.(type) {
+		case *tls.Config:
+			minVersion, maxVersion = settings.MinVersion, settings.MaxVersion
+		case *xtls.Config:
+			minVersion, maxVersion = settings.MinVersion, settings.MaxVersion
+		default:
+			t.Fatalf("unexpected security settings of %s: %T", tlsType, settings)
+		}
+		if minVersion != "1.3" || maxVersion != "1.3" {
+			t.Errorf("the %s settings should be TLS 1.3 only, got %s to %s", tlsType, minVersion, maxVersion)
+		}
+	}
+}
+
+func TestBuildTLSCipherSuites(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	certConfig := &CertConfig{
+		CertMode:      "file",
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		MinTLSVersion: "1.2",
+		CipherSuites:  []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"},
+	}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := getStreamSettings(t, inboundConfig).SecuritySettings[0].GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := settings.(*tls.Config)
+	if tlsConfig.MinVersion != "1.2" || tlsConfig.MaxVersion != "" {
+		t.Errorf("unexpected TLS versions: %s to %s", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+	if tlsConfig.CipherSuites != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256" {
+		t.Errorf("unexpected cipher suites: %s", tlsConfig.CipherSuites)
+	}
+
+	// The TLS settings are left to xray-core when unset
+	certConfig = &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile}
+	inboundConfig, err = InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, _ = getStreamSettings(t, inboundConfig).SecuritySettings[0].GetInstance()
+	if tlsConfig := settings.(*tls.Config); tlsConfig.MinVersion != "" || tlsConfig.MaxVersion != "" || tlsConfig.CipherSuites != "" {
+		t.Errorf("the TLS settings should be unset, got %v", tlsConfig)
+	}
+}
+
+func TestBuildTLSOptionsInvalid(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	for _, c := range []struct {
+		minVersion, maxVersion string
+		cipherSuites           []string
+		err                    string
+	}{
+		{minVersion: "1.4", err: "Invalid MinTLSVersion"},
+		{maxVersion: "TLS1.2", err: "Invalid MaxTLSVersion"},
+		{minVersion: "1.3", maxVersion: "1.2", err: "higher than MaxTLSVersion"},
+		{cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM"}, err: "Invalid cipher suite"},
+		{cipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}, err: "Invalid cipher suite"},
+		{cipherSuites: []string{"TLS_AES_128_GCM_SHA256"}, err: "not configurable"},
+		{minVersion: "1.3", cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, err: "MinTLSVersion is 1.3"},
+	} {
+		certConfig := &CertConfig{
+			CertMode:      "file",
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			MinTLSVersion: c.minVersion,
+			MaxTLSVersion: c.maxVersion,
+			CipherSuites:  c.cipherSuites,
+		}
+		_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%+v: expected the error %q, got %v", c, c.err, err)
+		}
+	}
+}
+
+func TestBuildFileCertInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFile(t, dir, "test.test.tk")
+	otherDir := t.TempDir()
+	_, otherKeyFile := writeCertFile(t, otherDir, "other.test.tk")
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	for name, certConfig := range map[string]*CertConfig{
+		"missing cert":     {CertMode: "file", CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile},
+		"missing key":      {CertMode: "file", CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")},
+		"not a cert":       {CertMode: "file", CertFile: keyFile, KeyFile: keyFile},
+		"mismatched key":   {CertMode: "file", CertFile: certFile, KeyFile: otherKeyFile},
+		"empty file paths": {CertMode: "file"},
+	} {
+		if _, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo); err == nil {
+			t.Errorf("%s should fail", name)
+		}
+	}
+}
+
+func TestBuildSecretCert(t *testing.T) {
+	certificate, err := cert.Generate(nil, cert.CommonName("secret.test.tk"), cert.DNSNames("secret.test.tk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := certificate.ToPEM()
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	for name, encode := range map[string]func([]byte) string{
+		"pem":         func(b []byte) string { return string(b) },
+		"escaped pem": func(b []byte) string { return strings.ReplaceAll(string(b), "\n", `\n`) },
+		"base64":      func(b []byte) string { return base64.StdEncoding.EncodeToString(b) },
+	} {
+		t.Setenv("XRAYR_TEST_CERT", encode(certPEM))
+		t.Setenv("XRAYR_TEST_KEY", encode(keyPEM))
+		certConfig := &CertConfig{CertMode: "secret", CertEnv: "XRAYR_TEST_CERT", KeyEnv: "XRAYR_TEST_KEY"}
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		settings, err := getStreamSettings(t, inboundConfig).SecuritySettings[0].GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificates := settings.(*tls.Config).Certificate
+		if len(certificates) != 1 || strings.TrimSpace(string(certificates[0].Certificate)) != strings.TrimSpace(string(certPEM)) ||
+			strings.TrimSpace(string(certificates[0].Key)) != strings.TrimSpace(string(keyPEM)) {
+			t.Errorf("%s: the key pair of the environment variables should be served, got %v", name, certificates)
+		}
+	}
+}
+
+func TestBuildSecretCertInvalid(t *testing.T) {
+	certificate, err := cert.Generate(nil, cert.CommonName("secret.test.tk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := certificate.ToPEM()
+	other, err := cert.Generate(nil, cert.CommonName("other.test.tk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeyPEM := other.ToPEM()
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	t.Setenv("XRAYR_TEST_CERT", string(certPEM))
+	t.Setenv("XRAYR_TEST_KEY", string(keyPEM))
+	t.Setenv("XRAYR_TEST_OTHER_KEY", string(otherKeyPEM))
+	t.Setenv("XRAYR_TEST_INVALID", "not a pem")
+	dir := t.TempDir()
+	invalidSecret := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalidSecret, []byte("cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, certConfig := range map[string]*CertConfig{
+		"unset env":         {CertMode: "secret", CertEnv: "XRAYR_TEST_UNSET", KeyEnv: "XRAYR_TEST_KEY"},
+		"invalid cert":      {CertMode: "secret", CertEnv: "XRAYR_TEST_INVALID", KeyEnv: "XRAYR_TEST_KEY"},
+		"mismatched key":    {CertMode: "secret", CertEnv: "XRAYR_TEST_CERT", KeyEnv: "XRAYR_TEST_OTHER_KEY"},
+		"no source":         {CertMode: "secret"},
+		"missing file":      {CertMode: "secret", SecretFile: filepath.Join(dir, "missing.json")},
+		"invalid file json": {CertMode: "secret", SecretFile: invalidSecret},
+	} {
+		if _, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo); err == nil {
+			t.Errorf("%s should fail", name)
+		}
+	}
+}
+
+func TestBuildDisableOCSPStapling(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		EnableTLS:         true,
+		TLSType:           "tls",
+	}
+	for _, disable := range []bool{false, true} {
+		certConfig := &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile, DisableOCSPStapling: disable}
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, err := getStreamSettings(t, inboundConfig).SecuritySettings[0].GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ocspStapling := settings.(*tls.Config).Certificate[0].OcspStapling
+		if disable && ocspStapling != 0 {
+			t.Errorf("OCSP stapling should be disabled, got interval %d", ocspStapling)
+		}
+		if !disable && ocspStapling != 3600 {
+			t.Errorf("OCSP stapling should be enabled by default, got interval %d", ocspStapling)
+		}
+	}
+
+	// The non TLS inbound has no cert to staple
+	nodeInfo.EnableTLS = false
+	certConfig := &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile, DisableOCSPStapling: true}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamSettings := getStreamSettings(t, inboundConfig); len(streamSettings.SecuritySettings) != 0 {
+		t.Errorf("non TLS inbound should have no security settings, got %v", streamSettings.SecuritySettings)
+	}
+}
+
+func TestBuildKCP(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "kcp",
+		KCPConfig:         &api.KCPConfig{HeaderType: "wechat-video", Seed: "secret", MTU: 1350, TTI: 20},
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamSettings := getStreamSettings(t, inboundConfig)
+	if streamSettings.ProtocolName != "mkcp" {
+		t.Fatalf("unexpected transport: %s", streamSettings.ProtocolName)
+	}
+	settings, err := streamSettings.TransportSettings[0].GetTypedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kcpSettings := settings.(*kcp.Config)
+	if kcpSettings.Mtu.GetValue() != 1350 || kcpSettings.Tti.GetValue() != 20 || kcpSettings.Seed.GetSeed() != "secret" {
+		t.Errorf("unexpected kcp settings: %v", kcpSettings)
+	}
+	header, err := kcpSettings.HeaderConfig.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := header.(*wechat.VideoConfig); !ok {
+		t.Errorf("header should be wechat-video, got %T", header)
+	}
+}
+
+func TestBuildKCPUnknownHeader(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "kcp",
+		KCPConfig:         &api.KCPConfig{HeaderType: "quic"},
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := getStreamSettings(t, inboundConfig).TransportSettings[0].GetTypedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := settings.(*kcp.Config).HeaderConfig.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := header.(*noop.Config); !ok {
+		t.Errorf("unknown header should fall back to none, got %T", header)
+	}
+}
+
+func TestBuildGRPC(t *testing.T) {
+	for _, nodeType := range []string{"V2ray", "Trojan"} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          nodeType,
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: "grpc",
+			GRPCConfig:        &api.GRPCConfig{ServiceName: "my.service_v2", MultiMode: true},
+		}
+		certConfig := &CertConfig{CertMode: "none"}
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamSettings := getStreamSettings(t, inboundConfig)
+		if streamSettings.ProtocolName != "grpc" {
+			t.Fatalf("%s: unexpected transport: %s", nodeType, streamSettings.ProtocolName)
+		}
+		settings, err := streamSettings.TransportSettings[0].GetTypedSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpcSettings := settings.(*grpc.Config)
+		if grpcSettings.ServiceName != "my.service_v2" || !grpcSettings.MultiMode {
+			t.Errorf("%s: unexpected grpc settings: %v", nodeType, grpcSettings)
+		}
+	}
+}
+
+func TestBuildGRPCInvalidServiceName(t *testing.T) {
+	for _, serviceName := range []string{"", "a/b", "a b"} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "V2ray",
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: "grpc",
+			GRPCConfig:        &api.GRPCConfig{ServiceName: serviceName},
+		}
+		certConfig := &CertConfig{CertMode: "none"}
+		if _, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo); err == nil {
+			t.Errorf("service name %q should be rejected", serviceName)
+		}
+	}
+}
+
+func TestBuildGRPCShadowsocks(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "Shadowsocks",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "grpc",
+		GRPCConfig:        &api.GRPCConfig{ServiceName: "ss"},
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol := getStreamSettings(t, inboundConfig).ProtocolName; protocol != "tcp" {
+		t.Errorf("Shadowsocks should fall back to tcp, got %s", protocol)
+	}
+}
+
+func TestBuildH2(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	for _, nodeInfo := range []*api.NodeInfo{
+		{NodeType: "V2ray", TLSType: "tls"},
+		{NodeType: "V2ray", EnableVless: true, TLSType: "xtls"},
+		{NodeType: "Trojan", TLSType: "tls"},
+	} {
+		nodeInfo.NodeID, nodeInfo.Port = 1, 1145
+		nodeInfo.TransportProtocol, nodeInfo.EnableTLS = "h2", true
+		nodeInfo.Host, nodeInfo.Path = "a.test.tk, b.test.tk", "/h2"
+		certConfig := &CertConfig{CertMode: "file", CertFile: certFile, KeyFile: keyFile}
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamSettings := getStreamSettings(t, inboundConfig)
+		if streamSettings.ProtocolName != "http" {
+			t.Fatalf("%s: unexpected transport: %s", nodeInfo.NodeType, streamSettings.ProtocolName)
+		}
+		settings, err := streamSettings.TransportSettings[0].GetTypedSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h2Settings := settings.(*h2.Config)
+		if h2Settings.Path != "/h2" || len(h2Settings.Host) != 2 || h2Settings.Host[0] != "a.test.tk" || h2Settings.Host[1] != "b.test.tk" {
+			t.Errorf("%s: unexpected h2 settings: %v", nodeInfo.NodeType, h2Settings)
+		}
+		// XTLS falls back to tls for h2
+		if security, err := streamSettings.SecuritySettings[0].GetInstance(); err != nil {
+			t.Fatal(err)
+		} else if _, ok := security.(*tls.Config); !ok {
+			t.Errorf("%s: h2 should be served over tls, got %T", nodeInfo.NodeType, security)
+		}
+	}
+}
+
+func TestBuildH2Invalid(t *testing.T) {
+	certFile, keyFile := writeCertFile(t, t.TempDir(), "test.test.tk")
+	for _, c := range []struct {
+		enableTLS  bool
+		certMode   string
+		host, path string
+		err        string
+	}{
+		{enableTLS: false, certMode: "file", err: "requires TLS"},
+		{enableTLS: true, certMode: "none", err: "requires TLS"},
+		{enableTLS: true, certMode: "file", path: "h2", err: "Invalid h2 path"},
+		{enableTLS: true, certMode: "file", path: "/h2?ed=2048", err: "Invalid h2 path"},
+		{enableTLS: true, certMode: "file", host: "a.test.tk,bad host", err: "Invalid h2 host"},
+	} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "V2ray",
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: "h2",
+			EnableTLS:         c.enableTLS,
+			TLSType:           "tls",
+			Host:              c.host,
+			Path:              c.path,
+		}
+		certConfig := &CertConfig{CertMode: c.certMode, CertFile: certFile, KeyFile: keyFile}
+		_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%+v: expected the error %q, got %v", c, c.err, err)
+		}
+	}
+}
+
+func TestBuildSSObfsHTTP(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "Shadowsocks",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		SSPluginConfig:    &api.SSPluginConfig{Plugin: "obfs", Mode: "http", Host: "www.bing.com"},
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamSettings := getStreamSettings(t, inboundConfig)
+	if streamSettings.ProtocolName != "tcp" {
+		t.Fatalf("unexpected transport: %s", streamSettings.ProtocolName)
+	}
+	settings, err := streamSettings.TransportSettings[0].GetTypedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := settings.(*tcp.Config).HeaderSettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpHeader, ok := header.(*http.Config)
+	if !ok {
+		t.Fatalf("header should be http, got %T", header)
+	}
+	if uri := httpHeader.Request.Uri; len(uri) != 1 || uri[0] != "/" {
+		t.Errorf("unexpected request path: %v", uri)
+	}
+	var host []string
+	for _, h := range httpHeader.Request.Header {
+		if h.Name == "Host" {
+			host = h.Value
+		}
+	}
+	if len(host) != 1 || host[0] != "www.bing.com" {
+		t.Errorf("unexpected request host: %v", host)
+	}
+	if httpHeader.Response.Status.Code != "101" {
+		t.Errorf("the response should upgrade like obfs-server, got %s", httpHeader.Response.Status.Code)
+	}
+}
+
+func TestBuildSSV2rayPlugin(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "Shadowsocks",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		SSPluginConfig:    &api.SSPluginConfig{Plugin: "v2ray-plugin", Mode: "websocket", Host: "ss.test.tk", Path: "/ws"},
+	}
+	certConfig := &CertConfig{CertMode: "none"}
+	inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamSettings := getStreamSettings(t, inboundConfig)
+	if streamSettings.ProtocolName != "websocket" {
+		t.Fatalf("unexpected transport: %s", streamSettings.ProtocolName)
+	}
+	settings, err := streamSettings.TransportSettings[0].GetTypedSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsSettings := settings.(*websocket.Config)
+	if wsSettings.Path != "/ws" || len(wsSettings.Header) != 1 || wsSettings.Header[0].Value != "ss.test.tk" {
+		t.Errorf("unexpected websocket settings: %v", wsSettings)
+	}
+}
+
+func TestBuildSSUnknownPlugin(t *testing.T) {
+	for _, pluginConfig := range []*api.SSPluginConfig{
+		{Plugin: "kcptun"},
+		{Plugin: "obfs", Mode: "tls"},
+		{Plugin: "v2ray-plugin", Mode: "quic"},
+	} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "Shadowsocks",
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: "tcp",
+			SSPluginConfig:    pluginConfig,
+		}
+		certConfig := &CertConfig{CertMode: "none"}
+		inboundConfig, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamSettings := getStreamSettings(t, inboundConfig)
+		if streamSettings.ProtocolName != "tcp" || len(streamSettings.TransportSettings) != 0 {
+			t.Errorf("%+v: the unsupported plugin should build a plain Shadowsocks inbound, got %v", *pluginConfig, streamSettings)
+		}
+	}
+}
+
+func TestBuildSSNodeMethod(t *testing.T) {
+	certConfig := &CertConfig{CertMode: "none"}
+	for method, valid := range map[string]bool{
+		"":                        true,
+		"aes-256-gcm":             true,
+		"aead_chacha20_poly1305":  true,
+		"aes-256-cfb":             false,
+		"rc4-md5":                 false,
+		"2022-blake3-aes-128-gcm": false,
+	} {
+		nodeInfo := &api.NodeInfo{NodeType: "Shadowsocks", NodeID: 1, Port: 1145, TransportProtocol: "tcp", Method: method}
+		_, err := InboundBuilder(&Config{ListenIP: "0.0.0.0", CertConfig: certConfig}, nodeInfo)
+		if valid && err != nil {
+			t.Errorf("%q: %s", method, err)
+		} else if !valid && err == nil {
+			t.Errorf("the node method %s should be an error", method)
+		}
+	}
+}
+
+func TestBuildUDPInbound(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "Shadowsocks", NodeID: 1, Port: 1145, TransportProtocol: "tcp"}
+	config := &Config{ListenIP: "127.0.0.1", UDPInboundConfig: &UDPInboundConfig{Port: 1146, DisableSniffing: true}}
+	inboundConfig, err := UDPInboundBuilder(config, nodeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inboundConfig.Tag != "Shadowsocks_1146_udp" {
+		t.Errorf("unexpected tag: %s", inboundConfig.Tag)
+	}
+	receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverConfig := receiverSettings.(*proxyman.ReceiverConfig)
+	if receiverConfig.PortRange.From != 1146 || receiverConfig.GetSniffingSettings().GetEnabled() {
+		t.Errorf("unexpected receiver settings: %v", receiverConfig)
+	}
+	proxySettings, err := inboundConfig.ProxySettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network := proxySettings.(*shadowsocks.ServerConfig).Network; len(network) != 1 || network[0] != xnet.Network_UDP {
+		t.Errorf("the UDP inbound should only serve the udp, got %v", network)
+	}
+	// The port of the node is the default
+	config.UDPInboundConfig.Port = 0
+	if inboundConfig, err = UDPInboundBuilder(config, nodeInfo); err != nil || inboundConfig.Tag != "Shadowsocks_1145_udp" {
+		t.Errorf("unexpected UDP inbound %v: %v", inboundConfig, err)
+	}
+	// The other protocols carry the UDP in their tcp connections
+	nodeInfo.NodeType = "Trojan"
+	if _, err := UDPInboundBuilder(config, nodeInfo); err == nil {
+		t.Error("UDP inbound of the Trojan node should be rejected")
+	}
+}
+
+func TestBuildTProxy(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if _, err := TProxyInboundBuilder(&Config{TProxyConfig: &TProxyConfig{Port: 12345}}); err == nil {
+			t.Error("transparent proxy should be rejected on the other platforms")
+		}
+		return
+	}
+	config := &Config{ListenIP: "127.0.0.1", TProxyConfig: &TProxyConfig{Port: 12345, Mark: 255}}
+	inboundConfig, err := TProxyInboundBuilder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inboundConfig.Tag != "TProxy_12345" {
+		t.Errorf("unexpected tag: %s", inboundConfig.Tag)
+	}
+	receiverSettings, err := inboundConfig.ReceiverSettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverConfig := receiverSettings.(*proxyman.ReceiverConfig)
+	if listen := receiverConfig.Listen.AsAddress(); listen.String() != "127.0.0.1" {
+		t.Errorf("unexpected listen address: %s", listen)
+	}
+	sockopt := receiverConfig.StreamSettings.SocketSettings
+	if sockopt.Tproxy != internet.SocketConfig_TProxy || sockopt.Mark != 255 {
+		t.Errorf("unexpected sockopt: %v", sockopt)
+	}
+	proxySettings, err := inboundConfig.ProxySettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dokodemoConfig := proxySettings.(*dokodemo.Config)
+	if !dokodemoConfig.FollowRedirect || len(dokodemoConfig.Networks) != 2 {
+		t.Errorf("unexpected dokodemo-door settings: %v", dokodemoConfig)
+	}
+
+	config.TProxyConfig.Mode = "redirect"
+	inboundConfig, err = TProxyInboundBuilder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getStreamSettings(t, inboundConfig).SocketSettings.Tproxy != internet.SocketConfig_Redirect {
+		t.Error("want the redirect sockopt")
+	}
+	for _, tproxyConfig := range []*TProxyConfig{{Port: 12345, Mode: "tun"}, {Mode: "tproxy"}} {
+		if _, err := TProxyInboundBuilder(&Config{TProxyConfig: tproxyConfig}); err == nil {
+			t.Errorf("invalid transparent proxy %+v should be rejected", tproxyConfig)
+		}
+	}
+	if inboundConfig, err := TProxyInboundBuilder(&Config{}); inboundConfig != nil || err != nil {
+		t.Error("no transparent proxy inbound without the config")
+	}
+}
+
+func TestBuildProxyProtocol(t *testing.T) {
+	config := &Config{ListenIP: "0.0.0.0", AcceptProxyProtocol: true, CertConfig: &CertConfig{CertMode: "none"}}
+	for _, transport := range []string{"tcp", "ws", "grpc"} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "V2ray",
+			NodeID:            1,
+			Port:              1145,
+			TransportProtocol: transport,
+			GRPCConfig:        &api.GRPCConfig{ServiceName: "grpc"},
+		}
+		inboundConfig, err := InboundBuilder(config, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamSettings := getStreamSettings(t, inboundConfig)
+		// The tcp and ws listeners override the socket settings with their own
+		accepted := streamSettings.GetSocketSettings().GetAcceptProxyProtocol()
+		for _, transportSettings := range streamSettings.TransportSettings {
+			settings, err := transportSettings.GetTypedSettings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch settings := settings.(type) {
+			case *tcp.Config:
+				accepted = settings.AcceptProxyProtocol
+			case *websocket.Config:
+				accepted = settings.AcceptProxyProtocol
+			}
+		}
+		if !accepted {
+			t.Errorf("%s: the PROXY protocol should be accepted", transport)
+		}
+	}
+	nodeInfo := &api.NodeInfo{NodeType: "V2ray", NodeID: 1, Port: 1145, TransportProtocol: "kcp"}
+	if _, err := InboundBuilder(config, nodeInfo); err == nil {
+		t.Error("the PROXY protocol should be rejected on kcp")
+	}
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// lastSeenTracker keeps the last time each user had traffic or was online on the node, for the panels pruning the
+// inactive users. Only the unix time of a user is kept, the users are dropped when they are removed from the node
+type lastSeenTracker struct {
+	access   sync.Mutex
+	lastSeen map[int]int64 // Key: UID
+}
+
+// update marks the users with traffic or online devices in the cycle as seen at now, and returns them.
+// The users without activity in the cycle are not returned, and their last seen time stays as it is
+func (t *lastSeenTracker) update(userTraffic []api.UserTraffic, onlineDevice *[]api.OnlineUser, now time.Time) []api.UserLastSeen {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.lastSeen == nil {
+		t.lastSeen = make(map[int]int64)
+	}
+	seen := make(map[int]bool)
+	var lastSeen []api.UserLastSeen
+	mark := func(uid int) {
+		if seen[uid] {
+			return
+		}
+		seen[uid] = true
+		t.lastSeen[uid] = now.Unix()
+		lastSeen = append(lastSeen, api.UserLastSeen{UID: uid, LastSeen: now.Unix()})
+	}
+	for _, traffic := range userTraffic {
+		mark(traffic.UID)
+	}
+	if onlineDevice != nil {
+		for _, device := range *onlineDevice {
+			mark(device.UID)
+		}
+	}
+	return lastSeen
+}
+
+// remove drops the users removed from the node
+func (t *lastSeenTracker) remove(users []api.UserInfo) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	for _, user := range users {
+		delete(t.lastSeen, user.UID)
+	}
+}
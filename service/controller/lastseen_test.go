@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestLastSeenTracker(t *testing.T) {
+	var tracker lastSeenTracker
+	start := time.Unix(1700000000, 0)
+	traffic := []api.UserTraffic{{UID: 1, Upload: 100}, {UID: 2, Download: 100}}
+	online := &[]api.OnlineUser{{UID: 2, IP: "1.1.1.1"}, {UID: 2, IP: "2.2.2.2"}, {UID: 3, IP: "3.3.3.3"}}
+	lastSeen := tracker.update(traffic, online, start)
+	want := []api.UserLastSeen{{UID: 1, LastSeen: start.Unix()}, {UID: 2, LastSeen: start.Unix()}, {UID: 3, LastSeen: start.Unix()}}
+	if !reflect.DeepEqual(lastSeen, want) {
+		t.Errorf("the active users should be reported once each, got %v, want %v", lastSeen, want)
+	}
+
+	// Only the active users are reported, the last seen time of the others stays
+	later := start.Add(time.Minute)
+	lastSeen = tracker.update([]api.UserTraffic{{UID: 3, Upload: 10}}, nil, later)
+	if want := []api.UserLastSeen{{UID: 3, LastSeen: later.Unix()}}; !reflect.DeepEqual(lastSeen, want) {
+		t.Errorf("only the active user should be reported, got %v, want %v", lastSeen, want)
+	}
+	if tracker.lastSeen[1] != start.Unix() || tracker.lastSeen[3] != later.Unix() {
+		t.Errorf("the last seen time should advance only on activity, got %v", tracker.lastSeen)
+	}
+	if lastSeen = tracker.update(nil, &[]api.OnlineUser{}, later.Add(time.Minute)); len(lastSeen) != 0 {
+		t.Errorf("no user should be reported without activity, got %v", lastSeen)
+	}
+	if tracker.lastSeen[3] != later.Unix() {
+		t.Errorf("the last seen time should not advance without activity, got %v", tracker.lastSeen[3])
+	}
+
+	tracker.remove([]api.UserInfo{{UID: 1}})
+	if _, ok := tracker.lastSeen[1]; ok {
+		t.Error("the removed user should be dropped")
+	}
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/XrayR-project/XrayR/common/serverstatus"
+)
+
+// The defaults of the LoadLimitConfig
+const (
+	defaultLoadInterval   = 10 * time.Second
+	defaultLoadHysteresis = 10
+)
+
+// loadCurve picks the tier of the load of the node. A tier is entered once the load reaches a threshold of it, and
+// left once the load drops the hysteresis below its thresholds, so a load around a threshold does not flap the limits
+type loadCurve struct {
+	tiers      []*LoadTier // From the mildest to the strictest
+	hysteresis float64     // Fraction of the thresholds the load has to drop by to leave a tier
+	tier       int         // Index of the current tier, -1 means the node is not under load
+}
+
+func newLoadCurve(config *LoadLimitConfig) (*loadCurve, error) {
+	if len(config.Tiers) == 0 {
+		return nil, fmt.Errorf("LoadLimitConfig requires at least one tier")
+	}
+	hysteresis := config.Hysteresis
+	if hysteresis == 0 {
+		hysteresis = defaultLoadHysteresis
+	}
+	if hysteresis < 0 || hysteresis >= 100 {
+		return nil, fmt.Errorf("Invalid hysteresis %g%% of the load tiers, it must be within [0, 100)", config.Hysteresis)
+	}
+	tiers := make([]*LoadTier, len(config.Tiers))
+	for i, tier := range config.Tiers {
+		if tier.Multiplier <= 0 || tier.Multiplier >= 1 {
+			return nil, fmt.Errorf("Invalid multiplier %g of the load tier, it must be within (0, 1)", tier.Multiplier)
+		}
+		if tier.CPU < 0 || tier.CPU > 100 {
+			return nil, fmt.Errorf("Invalid CPU threshold %g%% of the load tier", tier.CPU)
+		}
+		if tier.CPU == 0 && tier.Throughput == 0 {
+			return nil, fmt.Errorf("The load tier of the multiplier %g requires a CPU or Throughput threshold", tier.Multiplier)
+		}
+		tiers[i] = tier
+	}
+	// The tighter the multiplier, the stricter the tier
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].Multiplier > tiers[j].Multiplier })
+	return &loadCurve{tiers: tiers, hysteresis: hysteresis / 100, tier: -1}, nil
+}
+
+// reached reports whether the load reaches a threshold of the tier scaled by the factor
+func (t *LoadTier) reached(cpu float64, throughput uint64, factor float64) bool {
+	return (t.CPU > 0 && cpu >= t.CPU*factor) || (t.Throughput > 0 && float64(throughput) >= float64(t.Throughput)*factor)
+}
+
+// update moves to the tier of the load, and returns the multiplier of the speed limits in it. The strictest tier
+// reached is entered at once, while a stricter tier is only left once the load drops the hysteresis below it
+func (l *loadCurve) update(cpu float64, throughput uint64) float64 {
+	tier := -1
+	for i, t := range l.tiers {
+		if t.reached(cpu, throughput, 1) {
+			tier = i
+		}
+	}
+	if tier > l.tier {
+		l.tier = tier
+	}
+	for l.tier > tier && !l.tiers[l.tier].reached(cpu, throughput, 1-l.hysteresis) {
+		l.tier--
+	}
+	return l.multiplier()
+}
+
+// multiplier returns the multiplier of the speed limits in the current tier, 1 if the node is not under load
+func (l *loadCurve) multiplier() float64 {
+	if l.tier < 0 {
+		return 1
+	}
+	return l.tiers[l.tier].Multiplier
+}
+
+func (c *Controller) loadInterval() time.Duration {
+	if interval := c.config.LoadLimitConfig.Interval; interval > 0 {
+		return time.Duration(interval) * time.Second
+	}
+	return defaultLoadInterval
+}
+
+// loadLimitMonitor checks the CPU usage and the throughput of the users since the last report, and applies the
+// multiplier of the tier of the load to the speed limits of the users
+func (c *Controller) loadLimitMonitor() error {
+	cpu, err := serverstatus.GetCPUPercent()
+	if err != nil {
+		c.errorLog.Print(err)
+		return nil
+	}
+	var throughput uint64
+	for _, speed := range c.UserSpeed() {
+		throughput += uint64(speed.Upload + speed.Download)
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	last := c.loadCurve.multiplier()
+	if multiplier := c.loadCurve.update(cpu, throughput); multiplier != last {
+		log.Printf("Node %d is at %.1f%% CPU and %d Bps, multiply the speed limits of the users by %g", c.clientInfo.NodeID, cpu, throughput, multiplier)
+		if err := c.UpdateLoadMultiplier(c.tag, multiplier); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/limiter"
+)
+
+func TestLoadCurve(t *testing.T) {
+	curve, err := newLoadCurve(&LoadLimitConfig{
+		Hysteresis: 10,
+		Tiers: []*LoadTier{
+			{CPU: 90, Multiplier: 0.5},
+			{CPU: 70, Throughput: 1000000, Multiplier: 0.8},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := limiter.New()
+	userList := []api.UserInfo{{UID: 1, Email: "user@test.com", SpeedLimit: 1000000}}
+	if err := l.AddInboundLimiter("V2ray_1145", 0, &userList, nil); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		cpu        float64
+		throughput uint64
+		rate       float64
+	}{
+		{cpu: 50, rate: 1000000},
+		// The mild tier by the CPU or the throughput
+		{cpu: 75, rate: 800000},
+		{cpu: 50, throughput: 1200000, rate: 800000},
+		// Staying within the hysteresis keeps the tier
+		{cpu: 65, throughput: 950000, rate: 800000},
+		{cpu: 62, rate: 1000000},
+		// The strictest tier reached is entered at once
+		{cpu: 95, rate: 500000},
+		{cpu: 85, rate: 500000},
+		// Dropping below the hysteresis of the strict tier falls back to the mild one the load is still in
+		{cpu: 80, rate: 800000},
+		{cpu: 95, rate: 500000},
+		// And all the way down once the load is gone
+		{cpu: 20, rate: 1000000},
+	}
+	for i, step := range steps {
+		if err := l.UpdateLoadMultiplier("V2ray_1145", curve.update(step.cpu, step.throughput)); err != nil {
+			t.Fatal(err)
+		}
+		bucket, _, _ := l.GetUserBucket("V2ray_1145", "user@test.com", "1.1.1.1", "tcp")
+		if bucket.Rate() != step.rate {
+			t.Errorf("step %d at %g%% CPU and %d Bps: want the rate %g, got %g", i, step.cpu, step.throughput, step.rate, bucket.Rate())
+		}
+	}
+}
+
+func TestLoadCurveInvalid(t *testing.T) {
+	for _, config := range []*LoadLimitConfig{
+		{},
+		{Tiers: []*LoadTier{{CPU: 90, Multiplier: 1}}},
+		{Tiers: []*LoadTier{{CPU: 90, Multiplier: 0}}},
+		{Tiers: []*LoadTier{{CPU: 120, Multiplier: 0.5}}},
+		{Tiers: []*LoadTier{{Multiplier: 0.5}}},
+		{Hysteresis: 100, Tiers: []*LoadTier{{CPU: 90, Multiplier: 0.5}}},
+	} {
+		if _, err := newLoadCurve(config); err == nil {
+			t.Errorf("the load limit should be rejected: %+v", config)
+		}
+	}
+}
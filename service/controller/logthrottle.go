@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logThrottle collapses the repeated identical errors of the monitors, so a failing panel does not flood the logs.
+// The first occurrence of an error is logged at once, the repeats in the window after it are counted and logged
+// as one summary when the window ends. A window of 0 logs every error
+type logThrottle struct {
+	access  sync.Mutex
+	window  time.Duration
+	entries map[string]*throttledError // Key: the message
+	now     func() time.Time           // time.Now if nil
+	output  func(message string)       // log.Print if nil
+}
+
+type throttledError struct {
+	since   time.Time // The first occurrence, the window starts from it
+	repeats int       // The occurrences after the first one in the window
+}
+
+func (t *logThrottle) Print(v ...interface{}) {
+	t.log(fmt.Sprint(v...))
+}
+
+func (t *logThrottle) Printf(format string, v ...interface{}) {
+	t.log(fmt.Sprintf(format, v...))
+}
+
+func (t *logThrottle) log(message string) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.window <= 0 {
+		t.print(message)
+		return
+	}
+	t.flushLocked(false)
+	if entry, ok := t.entries[message]; ok {
+		entry.repeats++
+		return
+	}
+	if t.entries == nil {
+		t.entries = make(map[string]*throttledError)
+	}
+	t.entries[message] = &throttledError{since: t.timeNow()}
+	t.print(message)
+}
+
+// flush logs the summaries of the windows ended, the next occurrence of their errors is logged at once again
+func (t *logThrottle) flush() {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.flushLocked(false)
+}
+
+// flushLocked logs the summaries of the windows ended, or of all the windows if all is set
+func (t *logThrottle) flushLocked(all bool) {
+	now := t.timeNow()
+	var ended []string
+	for message, entry := range t.entries {
+		if all || now.Sub(entry.since) >= t.window {
+			ended = append(ended, message)
+		}
+	}
+	sort.Slice(ended, func(i, j int) bool {
+		if since := t.entries[ended[i]].since; !since.Equal(t.entries[ended[j]].since) {
+			return since.Before(t.entries[ended[j]].since)
+		}
+		return ended[i] < ended[j]
+	})
+	for _, message := range ended {
+		entry := t.entries[message]
+		if entry.repeats > 0 {
+			// The repeats are counted in the window, or until now for a window cut short
+			period := t.window
+			if elapsed := now.Sub(entry.since); elapsed < period {
+				period = elapsed.Round(time.Second)
+			}
+			t.print(fmt.Sprintf("%d occurrences of %q in the last %s", entry.repeats+1, message, period))
+		}
+		delete(t.entries, message)
+	}
+}
+
+// setWindow changes the window, the pending summaries are logged at once
+func (t *logThrottle) setWindow(window time.Duration) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if window == t.window {
+		return
+	}
+	t.flushLocked(true)
+	t.window = window
+}
+
+func (t *logThrottle) timeNow() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+func (t *logThrottle) print(message string) {
+	if t.output != nil {
+		t.output(message)
+		return
+	}
+	log.Print(message)
+}
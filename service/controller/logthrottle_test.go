@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogThrottle(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var logged []string
+	throttle := &logThrottle{
+		window: 10 * time.Minute,
+		now:    func() time.Time { return now },
+		output: func(message string) { logged = append(logged, message) },
+	}
+	advance := func(d time.Duration) { now = now.Add(d) }
+
+	// The first occurrence is logged at once, the repeats are counted
+	for i := 0; i < 5; i++ {
+		throttle.Print("panel is down")
+		advance(time.Minute)
+	}
+	// A distinct error is not collapsed into the other one
+	throttle.Printf("report failed: %s", "timeout")
+	throttle.Print("panel is down")
+	if want := []string{"panel is down", "report failed: timeout"}; !reflect.DeepEqual(logged, want) {
+		t.Fatalf("only the first occurrence of each error should be logged, got %q", logged)
+	}
+
+	// The summary is logged once the window ends, and the next occurrence is logged at once again
+	advance(5 * time.Minute)
+	throttle.flush()
+	if want := `6 occurrences of "panel is down" in the last 10m0s`; len(logged) != 3 || logged[2] != want {
+		t.Fatalf("the repeats should be summarized as %q, got %q", want, logged)
+	}
+	throttle.Print("panel is down")
+	if len(logged) != 4 || logged[3] != "panel is down" {
+		t.Errorf("the error should be logged at once in a new window, got %q", logged)
+	}
+	// An error without repeats has no summary
+	advance(11 * time.Minute)
+	throttle.flush()
+	if len(logged) != 4 {
+		t.Errorf("the errors without repeats should not be summarized, got %q", logged[4:])
+	}
+
+	// The pending repeats are summarized when the window changes, and a window of 0 logs every error
+	throttle.Print("panel is down")
+	throttle.Print("panel is down")
+	advance(90 * time.Second)
+	throttle.setWindow(0)
+	throttle.Print("panel is down")
+	throttle.Print("panel is down")
+	want := []string{"panel is down", `2 occurrences of "panel is down" in the last 1m30s`, "panel is down", "panel is down"}
+	if !reflect.DeepEqual(logged[4:], want) {
+		t.Errorf("unexpected logs after the window changed: %q, want %q", logged[4:], want)
+	}
+}
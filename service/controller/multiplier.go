@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"math"
+	"sync"
+)
+
+type trafficRemainder struct {
+	up, down float64
+}
+
+// trafficMultiplier applies the traffic multipliers of the users to their reported traffic. The fractional bytes
+// are carried to the next report of the user, so a small multiplier does not round the traffic away
+type trafficMultiplier struct {
+	access     sync.Mutex
+	remainders map[string]trafficRemainder // Key: Email
+}
+
+// apply returns the traffic of the user multiplied by the multiplier, nil means 1 and 0 means not counted
+func (m *trafficMultiplier) apply(email string, multiplier *float64, up, down int64) (int64, int64) {
+	if multiplier == nil || *multiplier == 1 {
+		return up, down
+	}
+	if *multiplier <= 0 {
+		return 0, 0
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	remainder := m.remainders[email]
+	up, remainder.up = multiplyBytes(up, *multiplier, remainder.up)
+	down, remainder.down = multiplyBytes(down, *multiplier, remainder.down)
+	if m.remainders == nil {
+		m.remainders = make(map[string]trafficRemainder)
+	}
+	m.remainders[email] = remainder
+	return up, down
+}
+
+// remove drops the remainders of the users removed from the node
+func (m *trafficMultiplier) remove(emails []string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for _, email := range emails {
+		delete(m.remainders, email)
+	}
+}
+
+func multiplyBytes(bytes int64, multiplier float64, remainder float64) (int64, float64) {
+	total := float64(bytes)*multiplier + remainder
+	// Tolerate the rounding error of the float, so the fractions adding up to a byte count it
+	whole := math.Floor(total + 1e-9)
+	return int64(whole), total - whole
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func multiplier(f float64) *float64 {
+	return &f
+}
+
+func TestTrafficMultiplier(t *testing.T) {
+	cases := []struct {
+		multiplier *float64
+		up, down   int64
+	}{
+		{nil, 1000, 3000},
+		{multiplier(1), 1000, 3000},
+		{multiplier(0.5), 500, 1500},
+		{multiplier(2), 2000, 6000},
+		{multiplier(0), 0, 0},
+	}
+	for _, c := range cases {
+		var m trafficMultiplier
+		up, down := m.apply("a@test.com", c.multiplier, 1000, 3000)
+		if up != c.up || down != c.down {
+			t.Errorf("want %d/%d, but got %d/%d", c.up, c.down, up, down)
+		}
+	}
+}
+
+func TestTrafficMultiplierFraction(t *testing.T) {
+	var m trafficMultiplier
+	// The fractional bytes are carried to the next reports of the user
+	var up, down int64
+	for i := 0; i < 10; i++ {
+		u, d := m.apply("a@test.com", multiplier(0.3), 1, 3)
+		up, down = up+u, down+d
+	}
+	if up != 3 || down != 9 {
+		t.Errorf("want 3/9 bytes in total, but got %d/%d", up, down)
+	}
+	// Each user has its own fraction
+	if up, _ := m.apply("b@test.com", multiplier(0.3), 1, 0); up != 0 {
+		t.Errorf("the fraction of another user should not be used, got %d", up)
+	}
+	m.remove([]string{"a@test.com"})
+	if _, ok := m.remainders["a@test.com"]; ok {
+		t.Error("the fraction of the removed user should be dropped")
+	}
+}
+
+func TestCompareUserListMultiplier(t *testing.T) {
+	old := &[]api.UserInfo{{UID: 1, Email: "a@test.com", TrafficMultiplier: multiplier(0.5)}, {UID: 2, Email: "b@test.com"}}
+	// A new fetch has new pointers to the same multipliers
+	new := &[]api.UserInfo{{UID: 1, Email: "a@test.com", TrafficMultiplier: multiplier(0.5)}, {UID: 2, Email: "b@test.com", TrafficMultiplier: multiplier(2)}}
+	deleted, added := compareUserList(old, new)
+	if len(deleted) != 1 || deleted[0].UID != 2 || deleted[0].TrafficMultiplier != nil {
+		t.Errorf("only the user with a changed multiplier should be deleted: %+v", deleted)
+	}
+	if len(added) != 1 || added[0].UID != 2 || *added[0].TrafficMultiplier != 2 {
+		t.Errorf("only the user with a changed multiplier should be added: %+v", added)
+	}
+}
+
+func TestSplitTraffic(t *testing.T) {
+	testCases := []struct {
+		total, tcp, udp  int64
+		wantTCP, wantUDP int64
+	}{
+		{300, 200, 100, 200, 100},
+		// The parts of the multiplied traffic add up to it
+		{150, 200, 100, 100, 50},
+		{101, 1, 1, 50, 51},
+		{0, 200, 100, 0, 0},
+		// Not counted by the network
+		{100, 0, 0, 0, 0},
+	}
+	for _, testCase := range testCases {
+		tcp, udp := splitTraffic(testCase.total, testCase.tcp, testCase.udp)
+		if tcp != testCase.wantTCP || udp != testCase.wantUDP {
+			t.Errorf("split %d by %d/%d: want %d/%d, but got %d/%d", testCase.total, testCase.tcp, testCase.udp, testCase.wantTCP, testCase.wantUDP, tcp, udp)
+		}
+	}
+}
@@ -3,14 +3,19 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
 
 	"github.com/XrayR-project/XrayR/api"
+	xnet "github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/infra/conf"
 )
 
 //OutboundBuilder build freedom outbund config for addoutbound
-func OutboundBuilder(nodeInfo *api.NodeInfo) (*core.OutboundHandlerConfig, error) {
+func OutboundBuilder(config *Config, nodeInfo *api.NodeInfo) (*core.OutboundHandlerConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	outboundDetourConfig.Protocol = "freedom"
 	outboundDetourConfig.Tag = fmt.Sprintf("%s_%d", nodeInfo.NodeType, nodeInfo.Port)
@@ -18,11 +23,220 @@ func OutboundBuilder(nodeInfo *api.NodeInfo) (*core.OutboundHandlerConfig, error
 	proxySetting := &conf.FreedomConfig{
 		DomainStrategy: "Asis",
 	}
+	// Resolve the domain destinations with the DoH server in the DNS of the core
+	if config.DoHConfig != nil {
+		proxySetting.DomainStrategy = "UseIP"
+	}
+	if config.DomainStrategy != "" {
+		domainStrategy, err := domainStrategyOf(config.DomainStrategy)
+		if err != nil {
+			return nil, err
+		}
+		proxySetting.DomainStrategy = domainStrategy
+	}
 	var setting json.RawMessage
 	setting, err := json.Marshal(proxySetting)
 	if err != nil {
 		return nil, fmt.Errorf("Marshal proxy %s config fialed: %s", nodeInfo.NodeType, err)
 	}
 	outboundDetourConfig.Settings = &setting
+	if config.SendThrough != "" {
+		if ip := sendThroughIP(config.SendThrough); ip != nil {
+			outboundDetourConfig.SendThrough = &conf.Address{Address: xnet.IPAddress(ip)}
+		} else {
+			log.Printf("SendThrough %s of node %d is not a local IP or interface, send the traffic from the default address", config.SendThrough, nodeInfo.NodeID)
+		}
+	}
 	return outboundDetourConfig.Build()
 }
+
+// domainStrategyOf returns the domain strategy of the freedom outbound. UseIPv4 and UseIPv6 query the DNS of the
+// core for the addresses of one family only, so the connections never fall back to the other one
+func domainStrategyOf(domainStrategy string) (string, error) {
+	switch strings.ToLower(domainStrategy) {
+	case "asis":
+		return "AsIs", nil
+	case "useip":
+		return "UseIP", nil
+	case "useipv4":
+		return "UseIPv4", nil
+	case "useipv6":
+		return "UseIPv6", nil
+	case "preferipv4", "preferipv6":
+		return "", fmt.Errorf("Domain strategy %s is not supported by the xray-core of this build, use UseIPv4 or UseIPv6", domainStrategy)
+	default:
+		return "", fmt.Errorf("Unsupported domain strategy %s, only AsIs, UseIP, UseIPv4 and UseIPv6 are supported", domainStrategy)
+	}
+}
+
+// sendThroughIP returns the local IP of the SendThrough, which is an IP or the name of an interface. It returns
+// nil if the IP is not bound on the host, or the interface has no IP
+func sendThroughIP(sendThrough string) net.IP {
+	if ip := net.ParseIP(sendThrough); ip != nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return ip
+			}
+		}
+		return nil
+	}
+	iface, err := net.InterfaceByName(sendThrough)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	// The IPv4 address is preferred, as most of the destinations are IPv4 only
+	var ip6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4
+		}
+		if ip6 == nil {
+			ip6 = ipNet.IP
+		}
+	}
+	return ip6
+}
+
+// OutboundChainsBuilder builds the outbounds of the chains of the node. The hops of a chain are copies of its relays,
+// each dials through the hop before it, and the last one is tagged with the name of the chain. So the traffic routed
+// to the name goes through all the relays in order. The relays themselves are not added
+func OutboundChainsBuilder(config *Config) ([]*core.OutboundHandlerConfig, error) {
+	if len(config.OutboundChains) == 0 {
+		return nil, nil
+	}
+	relays, err := loadRelays(config.RelayConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	chainRelays, err := expandOutboundChains(config.OutboundChains, relays)
+	if err != nil {
+		return nil, err
+	}
+	var outbounds []*core.OutboundHandlerConfig
+	for _, chain := range config.OutboundChains {
+		hops := chainRelays[chain.Name]
+		previousTag := ""
+		for i, hop := range hops {
+			relay := *relays[hop]
+			relay.Tag = fmt.Sprintf("%s_hop%d", chain.Name, i)
+			if i == len(hops)-1 {
+				relay.Tag = chain.Name
+			}
+			if previousTag != "" {
+				relay.ProxySettings = &conf.ProxyConfig{Tag: previousTag}
+			}
+			outbound, err := relay.Build()
+			if err != nil {
+				return nil, fmt.Errorf("Build relay %s of outbound chain %s failed: %s", hop, chain.Name, err)
+			}
+			outbounds = append(outbounds, outbound)
+			previousTag = relay.Tag
+		}
+	}
+	return outbounds, nil
+}
+
+// loadRelays reads the relays of the chains by their tags, the file is a JSON array of the outbounds of the xray config
+func loadRelays(path string) (map[string]*conf.OutboundDetourConfig, error) {
+	if path == "" {
+		return nil, fmt.Errorf("RelayConfigPath is required by the OutboundChains")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read relay config %s failed: %s", path, err)
+	}
+	var outbounds []*conf.OutboundDetourConfig
+	if err := json.Unmarshal(data, &outbounds); err != nil {
+		return nil, fmt.Errorf("Unmarshal relay config %s failed: %s", path, err)
+	}
+	relays := make(map[string]*conf.OutboundDetourConfig, len(outbounds))
+	for _, outbound := range outbounds {
+		switch {
+		case outbound.Tag == "":
+			return nil, fmt.Errorf("Relay of protocol %s in %s has no tag", outbound.Protocol, path)
+		case relays[outbound.Tag] != nil:
+			return nil, fmt.Errorf("Duplicated relay tag %s in %s", outbound.Tag, path)
+		case outbound.ProxySettings != nil || (outbound.StreamSetting != nil && outbound.StreamSetting.SocketSettings != nil && outbound.StreamSetting.SocketSettings.DialerProxy != ""):
+			// The hops are wired by the chains, a relay dialing through another outbound would leave the chain
+			return nil, fmt.Errorf("Relay %s dials through another outbound, chain them with the OutboundChains instead", outbound.Tag)
+		}
+		relays[outbound.Tag] = outbound
+	}
+	return relays, nil
+}
+
+// expandOutboundChains returns the relays each chain goes through in order, the chains in the hops are expanded into
+// their relays. A hop must be a relay or another chain, the chains must not form a cycle, and a chain goes through
+// a relay once at most
+func expandOutboundChains(chains []*OutboundChainConfig, relays map[string]*conf.OutboundDetourConfig) (map[string][]string, error) {
+	byName := make(map[string]*OutboundChainConfig, len(chains))
+	for _, chain := range chains {
+		switch {
+		case chain.Name == "":
+			return nil, fmt.Errorf("Outbound chain requires a Name: %+v", *chain)
+		case byName[chain.Name] != nil:
+			return nil, fmt.Errorf("Duplicated outbound chain %s", chain.Name)
+		case relays[chain.Name] != nil:
+			return nil, fmt.Errorf("Outbound chain %s has the tag of a relay", chain.Name)
+		case len(chain.Hops) == 0:
+			return nil, fmt.Errorf("Outbound chain %s has no hops", chain.Name)
+		}
+		byName[chain.Name] = chain
+	}
+	expanded := make(map[string][]string, len(chains))
+	var expand func(name string, path []string) ([]string, error)
+	expand = func(name string, path []string) ([]string, error) {
+		if hops, ok := expanded[name]; ok {
+			return hops, nil
+		}
+		for i, visiting := range path {
+			if visiting == name {
+				cycle := append(append([]string{}, path[i:]...), name)
+				return nil, fmt.Errorf("Outbound chains form a cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		path = append(path, name)
+		var hops []string
+		for _, hop := range byName[name].Hops {
+			switch {
+			case relays[hop] != nil:
+				hops = append(hops, hop)
+			case byName[hop] != nil:
+				chainHops, err := expand(hop, path)
+				if err != nil {
+					return nil, err
+				}
+				hops = append(hops, chainHops...)
+			default:
+				return nil, fmt.Errorf("Invalid hop %s of outbound chain %s, no such relay or chain", hop, name)
+			}
+		}
+		seen := make(map[string]bool, len(hops))
+		for _, hop := range hops {
+			if seen[hop] {
+				return nil, fmt.Errorf("Outbound chain %s goes through relay %s more than once", name, hop)
+			}
+			seen[hop] = true
+		}
+		expanded[name] = hops
+		return hops, nil
+	}
+	for _, chain := range chains {
+		if _, err := expand(chain.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,170 @@
+package controller_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	. "github.com/XrayR-project/XrayR/service/controller"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/proxy/freedom"
+)
+
+func TestBuildOutboundSendThrough(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "V2ray", NodeID: 1, Port: 1145}
+	testCases := map[string]net.IP{
+		"127.0.0.1": net.IPv4(127, 0, 0, 1),
+		// Not bound on the host, the default address is used
+		"192.0.2.1":       nil,
+		"not-a-interface": nil,
+	}
+	// The loopback interface is lo on Linux and lo0 on the BSDs
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			testCases[iface.Name] = net.IPv4(127, 0, 0, 1)
+		}
+	}
+	for sendThrough, want := range testCases {
+		outbound, err := OutboundBuilder(&Config{SendThrough: sendThrough}, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instance, err := outbound.SenderSettings.GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		via := instance.(*proxyman.SenderConfig).Via
+		if want == nil {
+			if via != nil {
+				t.Errorf("%s: the outbound should send through the default address, got %v", sendThrough, via.AsAddress())
+			}
+			continue
+		}
+		if via == nil || !net.IP(via.GetIp()).Equal(want) {
+			t.Errorf("%s: the outbound should send through %s, got %v", sendThrough, want, via)
+		}
+	}
+}
+
+func TestBuildOutboundDomainStrategy(t *testing.T) {
+	nodeInfo := &api.NodeInfo{NodeType: "V2ray", NodeID: 1, Port: 1145}
+	testCases := []struct {
+		config *Config
+		want   freedom.Config_DomainStrategy
+	}{
+		{&Config{}, freedom.Config_AS_IS},
+		{&Config{DomainStrategy: "UseIPv4"}, freedom.Config_USE_IP4},
+		{&Config{DomainStrategy: "useipv6"}, freedom.Config_USE_IP6},
+		// The strategy of the node overrides the one of the DoH server
+		{&Config{DoHConfig: &DoHConfig{URL: "https://dns.google/dns-query"}}, freedom.Config_USE_IP},
+		{&Config{DomainStrategy: "UseIPv4", DoHConfig: &DoHConfig{URL: "https://dns.google/dns-query"}}, freedom.Config_USE_IP4},
+		{&Config{DomainStrategy: "AsIs", DoHConfig: &DoHConfig{URL: "https://dns.google/dns-query"}}, freedom.Config_AS_IS},
+	}
+	for _, testCase := range testCases {
+		outbound, err := OutboundBuilder(testCase.config, nodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instance, err := outbound.ProxySettings.GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := instance.(*freedom.Config).DomainStrategy; got != testCase.want {
+			t.Errorf("%q: want the domain strategy %s, got %s", testCase.config.DomainStrategy, testCase.want, got)
+		}
+	}
+	for _, domainStrategy := range []string{"PreferIPv4", "UseIPv5", "ipv4"} {
+		if _, err := OutboundBuilder(&Config{DomainStrategy: domainStrategy}, nodeInfo); err == nil {
+			t.Errorf("the domain strategy %s should be an error", domainStrategy)
+		}
+	}
+}
+
+// writeRelays writes the relay config of the HTTP proxies at the ports by their tags
+func writeRelays(t *testing.T, ports map[string]int) string {
+	var relays []string
+	for tag, port := range ports {
+		relays = append(relays, fmt.Sprintf(`{"tag": "%s", "protocol": "http", "settings": {"servers": [{"address": "127.0.0.1", "port": %d}]}}`, tag, port))
+	}
+	path := filepath.Join(t.TempDir(), "relay.json")
+	if err := ioutil.WriteFile(path, []byte("["+strings.Join(relays, ",")+"]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuildOutboundChains(t *testing.T) {
+	config := &Config{
+		RelayConfigPath: writeRelays(t, map[string]int{"relayA": 1080, "relayB": 1081, "relayC": 1082}),
+		OutboundChains: []*OutboundChainConfig{
+			{Name: "chainAB", Hops: []string{"relayA", "relayB"}},
+			// The chains in the hops are expanded into their relays
+			{Name: "chainABC", Hops: []string{"chainAB", "relayC"}},
+		},
+	}
+	outbounds, err := OutboundChainsBuilder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each hop dials through the one before it
+	want := []struct{ tag, proxy string }{
+		{"chainAB_hop0", ""},
+		{"chainAB", "chainAB_hop0"},
+		{"chainABC_hop0", ""},
+		{"chainABC_hop1", "chainABC_hop0"},
+		{"chainABC", "chainABC_hop1"},
+	}
+	if len(outbounds) != len(want) {
+		t.Fatalf("unexpected outbounds of the chains: %v", outbounds)
+	}
+	for i, outbound := range outbounds {
+		instance, err := outbound.SenderSettings.GetInstance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := instance.(*proxyman.SenderConfig).ProxySettings.GetTag()
+		if outbound.Tag != want[i].tag || proxy != want[i].proxy {
+			t.Errorf("hop %d should be %s through %q, got %s through %q", i, want[i].tag, want[i].proxy, outbound.Tag, proxy)
+		}
+	}
+}
+
+func TestBuildOutboundChainsInvalid(t *testing.T) {
+	relayConfigPath := writeRelays(t, map[string]int{"relayA": 1080, "relayB": 1081})
+	proxiedPath := filepath.Join(t.TempDir(), "proxied.json")
+	if err := ioutil.WriteFile(proxiedPath, []byte(`[{"tag": "relayA", "protocol": "freedom", "proxySettings": {"tag": "relayB"}}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testCases := map[string]struct {
+		path   string
+		chains []*OutboundChainConfig
+		err    string
+	}{
+		"no relay config": {"", []*OutboundChainConfig{{Name: "chain", Hops: []string{"relayA"}}}, "RelayConfigPath is required"},
+		"proxied relay":   {proxiedPath, []*OutboundChainConfig{{Name: "chain", Hops: []string{"relayA"}}}, "dials through another outbound"},
+		"unknown hop":     {relayConfigPath, []*OutboundChainConfig{{Name: "chain", Hops: []string{"relayA", "relayC"}}}, "Invalid hop relayC"},
+		"no hops":         {relayConfigPath, []*OutboundChainConfig{{Name: "chain"}}, "has no hops"},
+		"relay name":      {relayConfigPath, []*OutboundChainConfig{{Name: "relayA", Hops: []string{"relayB"}}}, "tag of a relay"},
+		"duplicated":      {relayConfigPath, []*OutboundChainConfig{{Name: "chain", Hops: []string{"relayA"}}, {Name: "chain", Hops: []string{"relayB"}}}, "Duplicated outbound chain"},
+		"repeated relay":  {relayConfigPath, []*OutboundChainConfig{{Name: "chain", Hops: []string{"relayA", "relayB", "relayA"}}}, "more than once"},
+		"cycle": {relayConfigPath, []*OutboundChainConfig{
+			{Name: "chainX", Hops: []string{"relayA", "chainY"}},
+			{Name: "chainY", Hops: []string{"chainX", "relayB"}},
+		}, "cycle: chainX -> chainY -> chainX"},
+		"self": {relayConfigPath, []*OutboundChainConfig{{Name: "chain", Hops: []string{"chain"}}}, "cycle: chain -> chain"},
+	}
+	for name, testCase := range testCases {
+		_, err := OutboundChainsBuilder(&Config{RelayConfigPath: testCase.path, OutboundChains: testCase.chains})
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("%s: the chains should be rejected with %q, got %v", name, testCase.err, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// PolicyBuilder build the policy of the user level of the node, the timeouts not set keep the defaults of xray-core
+func PolicyBuilder(config *Config) *conf.Policy {
+	policy := &conf.Policy{
+		StatsUserUplink:   true,
+		StatsUserDownlink: true,
+	}
+	if config.TimeoutConfig == nil {
+		return policy
+	}
+	if t := config.TimeoutConfig.ConnIdle; t > 0 {
+		policy.ConnectionIdle = &t
+	}
+	if t := config.TimeoutConfig.UplinkOnly; t > 0 {
+		policy.UplinkOnly = &t
+	}
+	if t := config.TimeoutConfig.DownlinkOnly; t > 0 {
+		policy.DownlinkOnly = &t
+	}
+	return policy
+}
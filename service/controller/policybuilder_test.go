@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestBuildPolicyTimeout(t *testing.T) {
+	config := &Config{TimeoutConfig: &TimeoutConfig{ConnIdle: 60, DownlinkOnly: 3}}
+	policy, err := PolicyBuilder(config).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Timeout.ConnectionIdle.GetValue() != 60 || policy.Timeout.DownlinkOnly.GetValue() != 3 {
+		t.Errorf("unexpected timeouts: %v", policy.Timeout)
+	}
+	// The timeouts not set keep the defaults of xray-core
+	if policy.Timeout.UplinkOnly != nil || policy.Timeout.Handshake != nil {
+		t.Errorf("unset timeouts should be left to xray-core: %v", policy.Timeout)
+	}
+	if !policy.Stats.UserUplink || !policy.Stats.UserDownlink {
+		t.Error("the user traffic stats should be enabled")
+	}
+}
+
+func TestBuildPolicyDefault(t *testing.T) {
+	policy, err := PolicyBuilder(&Config{}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Timeout.ConnectionIdle != nil || policy.Timeout.UplinkOnly != nil || policy.Timeout.DownlinkOnly != nil {
+		t.Errorf("no timeout should be set without TimeoutConfig: %v", policy.Timeout)
+	}
+}
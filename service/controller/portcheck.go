@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+)
+
+// inboundPorts are the ports of the inbounds added by the controllers, one registry for each xray instance
+var inboundPorts sync.Map
+
+type boundPort struct {
+	tag  string
+	ip   net.Address
+	from uint32
+	to   uint32
+	tcp  bool // The inbound listens on the tcp of the ports
+	udp  bool // The inbound listens on the udp of the ports
+}
+
+// portRegistry records the listen addresses of the inbounds of an xray instance, which has no way to list them
+type portRegistry struct {
+	access sync.Mutex
+	ports  []boundPort
+}
+
+func getPortRegistry(server *core.Instance) *portRegistry {
+	registry, _ := inboundPorts.LoadOrStore(server, &portRegistry{})
+	return registry.(*portRegistry)
+}
+
+// reserve records the ports of the inbound, it fails if the tag or any of the ports is used by another inbound
+func (r *portRegistry) reserve(port boundPort) error {
+	r.access.Lock()
+	defer r.access.Unlock()
+	for _, bound := range r.ports {
+		if bound.tag == port.tag {
+			return fmt.Errorf("Inbound %s is already added by another node, the nodes of the same type can not share the port %s", port.tag, portString(port.from, port.to))
+		}
+		if bound.from <= port.to && port.from <= bound.to && sameListen(bound.ip, port.ip) && (bound.tcp && port.tcp || bound.udp && port.udp) {
+			return fmt.Errorf("Port %s of inbound %s is already used by inbound %s on %s", portString(port.from, port.to), port.tag, bound.tag, bound.ip)
+		}
+	}
+	r.ports = append(r.ports, port)
+	return nil
+}
+
+func (r *portRegistry) release(tag string) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	for i, bound := range r.ports {
+		if bound.tag == tag {
+			r.ports = append(r.ports[:i], r.ports[i+1:]...)
+			return
+		}
+	}
+}
+
+// sameListen reports whether the two listen addresses take the same port, the wildcard address takes it on all the addresses of its family
+func sameListen(a net.Address, b net.Address) bool {
+	if a.Family() != b.Family() {
+		return false
+	}
+	return a == b || a.IP().IsUnspecified() || b.IP().IsUnspecified() || a.IP().Equal(b.IP())
+}
+
+func portString(from uint32, to uint32) string {
+	if from == to {
+		return strconv.Itoa(int(from))
+	}
+	return fmt.Sprintf("%d-%d", from, to)
+}
+
+// inboundPort returns the listen address and the ports of the inbound
+func inboundPort(config *core.InboundHandlerConfig) (boundPort, error) {
+	receiverSettings, err := config.ReceiverSettings.GetInstance()
+	if err != nil {
+		return boundPort{}, err
+	}
+	receiverConfig, ok := receiverSettings.(*proxyman.ReceiverConfig)
+	if !ok || receiverConfig.PortRange == nil {
+		return boundPort{}, fmt.Errorf("Inbound %s has no port", config.Tag)
+	}
+	ip := net.AnyIP
+	if receiverConfig.Listen != nil {
+		ip = receiverConfig.Listen.AsAddress()
+	}
+	port := boundPort{tag: config.Tag, ip: ip, from: receiverConfig.PortRange.From, to: receiverConfig.PortRange.To, tcp: true}
+	// The Shadowsocks and dokodemo-door inbounds may listen on the udp too, or only on it
+	if proxySettings, err := config.ProxySettings.GetInstance(); err == nil {
+		var networks []net.Network
+		switch settings := proxySettings.(type) {
+		case interface{ GetNetwork() []net.Network }:
+			networks = settings.GetNetwork()
+		case interface{ GetNetworks() []net.Network }:
+			networks = settings.GetNetworks()
+		}
+		if len(networks) > 0 {
+			port.tcp = net.HasNetwork(networks, net.Network_TCP)
+			port.udp = net.HasNetwork(networks, net.Network_UDP)
+		}
+	}
+	// The mKCP transport carries the tcp connections of the proxy over the udp
+	if port.tcp && receiverConfig.StreamSettings.GetProtocolName() == "mkcp" {
+		port.tcp, port.udp = false, true
+	}
+	return port, nil
+}
+
+// checkPortFree checks the ports are not bound by another process, the other errors of listening are left to xray
+func checkPortFree(port boundPort) error {
+	for p := port.from; p <= port.to; p++ {
+		var err error
+		if port.tcp {
+			var listener net.Listener
+			if listener, err = net.Listen("tcp", net.TCPDestination(port.ip, net.Port(p)).NetAddr()); err == nil {
+				listener.Close()
+			}
+		}
+		if port.udp && !errors.Is(err, syscall.EADDRINUSE) {
+			var conn *net.UDPConn
+			if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: port.ip.IP(), Port: int(p)}); err == nil {
+				conn.Close()
+			}
+		}
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("Port %d of inbound %s is already in use by another process on %s, stop it or change the port of the node", p, port.tag, port.ip)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultReadyTimeout is how long the panel may be unreachable before the node is not ready
+const defaultReadyTimeout = 5 * time.Minute
+
+// missedRuns is how many runs a monitor may miss before the controller is not live
+const missedRuns = 3
+
+// NodeHealth is the liveness and the readiness of the node, for the probes of the orchestration
+type NodeHealth struct {
+	Live     bool      // The monitors of the node are running
+	Ready    bool      // The node is live and up, and the node info was fetched from the panel lately
+	Up       bool      // The inbounds of the node are serving
+	LastSync time.Time // The last successful fetch of the node info, zero if the node started from the cache and never reached the panel
+	Reason   string    `json:",omitempty"` // Why the node is not live or not ready
+}
+
+type monitorRun struct {
+	at       time.Time
+	interval time.Duration
+}
+
+// nodeProbe tracks the runs of the monitors and the syncs with the panel. It has a lock of its own, so the probes
+// are answered while a monitor is stuck with the lock of the controller, which is what they are to detect
+type nodeProbe struct {
+	access       sync.Mutex
+	started      time.Time
+	runs         map[string]monitorRun // Key: the monitor
+	lastSync     time.Time
+	up           bool
+	readyTimeout time.Duration
+}
+
+// ran records the run of the monitor, which runs again in the interval
+func (p *nodeProbe) ran(monitor string, interval time.Duration) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.runs == nil {
+		p.runs = make(map[string]monitorRun)
+	}
+	p.runs[monitor] = monitorRun{at: time.Now(), interval: interval}
+}
+
+// synced records the successful fetch of the node info
+func (p *nodeProbe) synced() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.lastSync = time.Now()
+}
+
+func (p *nodeProbe) setReadyTimeout(timeout time.Duration) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.readyTimeout = timeout
+}
+
+func (p *nodeProbe) setUp(up bool) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.up = up
+	if up && p.started.IsZero() {
+		p.started = time.Now()
+	}
+}
+
+// health returns the health of the node at the time. The node started from the cache has the ready timeout from its
+// start to reach the panel
+func (p *nodeProbe) health(now time.Time) NodeHealth {
+	p.access.Lock()
+	defer p.access.Unlock()
+	health := NodeHealth{Live: true, Up: p.up, LastSync: p.lastSync}
+	monitors := make([]string, 0, len(p.runs))
+	for monitor := range p.runs {
+		monitors = append(monitors, monitor)
+	}
+	sort.Strings(monitors)
+	for _, monitor := range monitors {
+		run := p.runs[monitor]
+		if stale := now.Sub(run.at); stale > missedRuns*run.interval {
+			health.Live = false
+			health.Reason = fmt.Sprintf("the %s monitor has not run for %s", monitor, stale.Round(time.Second))
+			return health
+		}
+	}
+	lastSync := p.lastSync
+	if lastSync.IsZero() {
+		lastSync = p.started
+	}
+	switch {
+	case !p.up:
+		health.Reason = "the inbounds of the node are not up"
+	case now.Sub(lastSync) > p.readyTimeout:
+		health.Reason = fmt.Sprintf("the node info has not been fetched from the panel for %s", now.Sub(lastSync).Round(time.Second))
+	default:
+		health.Ready = true
+	}
+	return health
+}
+
+// readyTimeout returns how long the panel may be unreachable before the node is not ready, at least 3 node info fetches
+func readyTimeout(config *Config, nodeInfoInterval time.Duration) time.Duration {
+	if config.ReadyTimeout > 0 {
+		return time.Duration(config.ReadyTimeout) * time.Second
+	}
+	if timeout := missedRuns * nodeInfoInterval; timeout > defaultReadyTimeout {
+		return timeout
+	}
+	return defaultReadyTimeout
+}
+
+// Health returns the liveness and the readiness of the node, it is answered while the monitors are stuck
+func (c *Controller) Health() NodeHealth {
+	return c.probe.health(time.Now())
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeProbe(t *testing.T) {
+	p := nodeProbe{readyTimeout: 5 * time.Minute}
+	p.setUp(true)
+	p.synced()
+	p.ran("node info", time.Minute)
+	p.ran("report", time.Minute)
+	now := time.Now()
+	if health := p.health(now); !health.Live || !health.Ready {
+		t.Errorf("the synced node should be ready, got %+v", health)
+	}
+	// The panel unreachable beyond the timeout, while the monitors keep running
+	p.lastSync = now.Add(-6 * time.Minute)
+	health := p.health(now)
+	if !health.Live || health.Ready || health.Reason != "the node info has not been fetched from the panel for 6m0s" {
+		t.Errorf("the node should be live but not ready with a stale sync, got %+v", health)
+	}
+	// A stuck monitor
+	p.lastSync = now
+	p.runs["report"] = monitorRun{at: now.Add(-4 * time.Minute), interval: time.Minute}
+	health = p.health(now)
+	if health.Live || health.Ready || health.Reason != "the report monitor has not run for 4m0s" {
+		t.Errorf("the node should not be live with a stuck monitor, got %+v", health)
+	}
+	// A monitor backing off is not stuck
+	p.runs["report"] = monitorRun{at: now.Add(-4 * time.Minute), interval: 10 * time.Minute}
+	if health := p.health(now); !health.Live || !health.Ready {
+		t.Errorf("the node should be ready within the interval of the monitors, got %+v", health)
+	}
+	p.setUp(false)
+	if health := p.health(now); !health.Live || health.Ready || health.Reason != "the inbounds of the node are not up" {
+		t.Errorf("the node should not be ready while down, got %+v", health)
+	}
+}
+
+func TestNodeProbeStartWithCache(t *testing.T) {
+	p := nodeProbe{readyTimeout: 5 * time.Minute}
+	p.setUp(true)
+	// The node started from the cache has the timeout to reach the panel
+	if health := p.health(p.started.Add(time.Minute)); !health.Ready || !health.LastSync.IsZero() {
+		t.Errorf("the node started from the cache should be ready within the timeout, got %+v", health)
+	}
+	if health := p.health(p.started.Add(6 * time.Minute)); health.Ready || !strings.Contains(health.Reason, "6m0s") {
+		t.Errorf("the node which never reached the panel should not be ready, got %+v", health)
+	}
+}
+
+func TestReadyTimeout(t *testing.T) {
+	for _, test := range []struct {
+		config   *Config
+		interval time.Duration
+		want     time.Duration
+	}{
+		{&Config{}, time.Minute, defaultReadyTimeout},
+		{&Config{}, 10 * time.Minute, 30 * time.Minute},
+		{&Config{ReadyTimeout: 120}, 10 * time.Minute, 2 * time.Minute},
+	} {
+		if timeout := readyTimeout(test.config, test.interval); timeout != test.want {
+			t.Errorf("want the ready timeout %s with the interval %s, but got %s", test.want, test.interval, timeout)
+		}
+	}
+}
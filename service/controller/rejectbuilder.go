@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The body of the reject response if none is configured
+const defaultRejectBody = "<html><body><h1>403 Forbidden</h1><p>The site is blocked by the rules of the node.</p></body></html>"
+
+// RejectResponseBuilder builds the raw HTTP response to the HTTP requests blocked by the rules, nil if none is configured
+func RejectResponseBuilder(config *RejectResponseConfig) ([]byte, error) {
+	if config == nil {
+		return nil, nil
+	}
+	statusCode := config.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusForbidden
+	}
+	if statusCode < 200 || statusCode > 599 || http.StatusText(statusCode) == "" {
+		return nil, fmt.Errorf("Invalid status %d of the reject response", statusCode)
+	}
+	header := make(http.Header)
+	redirect := statusCode >= 300 && statusCode < 400
+	if redirect {
+		location, err := url.Parse(config.Location)
+		if err != nil || !location.IsAbs() {
+			return nil, fmt.Errorf("Redirect of the reject response requires an absolute Location, got %q", config.Location)
+		}
+		header.Set("Location", config.Location)
+	} else if config.Location != "" {
+		return nil, fmt.Errorf("Location of the reject response requires a 3xx status, got %d", statusCode)
+	}
+	body := config.Body
+	if body == "" && !redirect {
+		body = defaultRejectBody
+	}
+	if body != "" {
+		contentType := config.ContentType
+		if contentType == "" {
+			contentType = "text/html; charset=utf-8"
+		}
+		header.Set("Content-Type", contentType)
+	}
+	response := &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	var b bytes.Buffer
+	if err := response.Write(&b); err != nil {
+		return nil, fmt.Errorf("Build the reject response failed: %s", err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package controller_test
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/XrayR-project/XrayR/service/controller"
+)
+
+func TestBuildRejectResponse(t *testing.T) {
+	testCases := map[string]struct {
+		config      *RejectResponseConfig
+		statusCode  int
+		location    string
+		contentType string
+		body        string
+	}{
+		"default":  {&RejectResponseConfig{}, 403, "", "text/html; charset=utf-8", "403 Forbidden"},
+		"custom":   {&RejectResponseConfig{StatusCode: 451, ContentType: "text/plain", Body: "blocked"}, 451, "", "text/plain", "blocked"},
+		"redirect": {&RejectResponseConfig{StatusCode: 302, Location: "https://example.com/blocked"}, 302, "https://example.com/blocked", "", ""},
+	}
+	for name, testCase := range testCases {
+		raw, err := RejectResponseBuilder(testCase.config)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+		if err != nil {
+			t.Fatalf("%s: the reject response should be valid HTTP: %s", name, err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != testCase.statusCode || response.Header.Get("Location") != testCase.location ||
+			response.Header.Get("Content-Type") != testCase.contentType || !strings.Contains(string(body), testCase.body) || !response.Close {
+			t.Errorf("%s: unexpected reject response %q", name, raw)
+		}
+	}
+	if raw, err := RejectResponseBuilder(nil); raw != nil || err != nil {
+		t.Errorf("no reject response should be built without the config, got %q", raw)
+	}
+}
+
+func TestBuildRejectResponseInvalid(t *testing.T) {
+	for _, config := range []*RejectResponseConfig{
+		{StatusCode: 99},
+		{StatusCode: 999},
+		{StatusCode: 301},
+		{StatusCode: 301, Location: "/blocked"},
+		{StatusCode: 403, Location: "https://example.com/blocked"},
+	} {
+		if _, err := RejectResponseBuilder(config); err == nil {
+			t.Errorf("the reject response should be rejected: %+v", *config)
+		}
+	}
+}
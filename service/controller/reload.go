@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/XrayR-project/XrayR/app/mydispatcher"
+	"github.com/XrayR-project/XrayR/common/limiter"
+	"github.com/XrayR-project/XrayR/common/rule"
+	"github.com/xtls/xray-core/common/task"
+)
+
+// reloadInPlace are the fields of the config applied to the running node, the inbounds and the connections stay up
+var reloadInPlace = map[string]bool{
+	"UpdatePeriodic":       true,
+	"NodeInfoPeriodic":     true,
+	"UserListPeriodic":     true,
+	"ReportPeriodic":       true,
+	"MaxBackoff":           true,
+	"ErrorLogWindow":       true,
+	"ReadyTimeout":         true,
+	"LimitConfig":          true,
+	"ReportBatchSize":      true,
+	"RequeueFailedTraffic": true,
+	"MinUserListRatio":     true,
+	"SniffIncludeDomains":  true,
+	"Sniffers":             true,
+	"BlockProtocols":       true,
+	"ReportSNI":            true,
+	"ReportLastSeen":       true,
+	"ReportFailures":       true,
+	"LogLevel":             true,
+	"OnlineIPLocation":     true,
+	"RemoteRuleConfig":     true,
+	"RejectResponseConfig": true,
+	"DNSHosts":             true,
+}
+
+// reloadRebuild are the fields of the config built into the inbounds, the inbounds of the node are rebuilt with them.
+// The changes of the other fields need the node restarted, as they are built into the core or started with the node.
+var reloadRebuild = map[string]bool{
+	"ListenIP":            true,
+	"ListenIP6":           true,
+	"SendThrough":         true,
+	"DomainStrategy":      true,
+	"VMessAEADOnly":       true,
+	"RejectVMessAlterID":  true,
+	"AcceptProxyProtocol": true,
+	"SniffExcludeDomains": true,
+	"SniffingConfig":      true,
+	"UDPInboundConfig":    true,
+	"OutboundChains":      true,
+	"RelayConfigPath":     true,
+}
+
+// configChange is the changed fields of the config by how they are applied
+type configChange struct {
+	inPlace []string
+	rebuild []string
+	restart []string
+}
+
+func classifyConfigChange(oldConfig *Config, newConfig *Config) *configChange {
+	change := &configChange{}
+	oldValue, newValue := reflect.ValueOf(oldConfig).Elem(), reflect.ValueOf(newConfig).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		switch {
+		case name == "LimitConfig" && !reflect.DeepEqual(deviceResetOf(oldConfig), deviceResetOf(newConfig)):
+			// The device reset schedule is started with the node
+			change.restart = append(change.restart, "LimitConfig.DeviceReset")
+		case reloadInPlace[name]:
+			change.inPlace = append(change.inPlace, name)
+		case reloadRebuild[name]:
+			change.rebuild = append(change.rebuild, name)
+		default:
+			change.restart = append(change.restart, name)
+		}
+	}
+	return change
+}
+
+func deviceResetOf(config *Config) *limiter.DeviceResetConfig {
+	if config.LimitConfig == nil {
+		return nil
+	}
+	return config.LimitConfig.DeviceReset
+}
+
+// CheckReload returns an error if a change of the config needs the node restarted, so the caller can restart
+// the node instead of reloading it
+func (c *Controller) CheckReload(config *Config) error {
+	_, _, err := c.reloadChange(config)
+	return err
+}
+
+// reloadChange classifies the change of the config, which is copied so the config of the caller is not changed
+func (c *Controller) reloadChange(newConfig *Config) (*Config, *configChange, error) {
+	config := *newConfig
+	// The policy level is given to the node by the panel at the start
+	config.PolicyLevel = c.config.PolicyLevel
+	change := classifyConfigChange(c.config, &config)
+	if len(change.restart) > 0 {
+		return nil, nil, fmt.Errorf("%s of node %d changed, restart the node to apply", strings.Join(change.restart, ", "), c.clientInfo.NodeID)
+	}
+	return &config, change, nil
+}
+
+// PreparedReload is a change of the config of a node which is checked and built, Apply applies it to the node
+type PreparedReload struct {
+	controller        *Controller
+	config            *Config
+	change            *configChange
+	remoteRuleFetcher *rule.RemoteFetcher
+	rejectResponse    []byte
+	hosts             *mydispatcher.StaticHosts
+}
+
+// PrepareReload checks and builds the changed local config without changing the node, so the panel can prepare
+// all its nodes before it applies the config to any of them. It returns an error if a change needs the node
+// restarted, or a part of the config cannot be built.
+func (c *Controller) PrepareReload(newConfig *Config) (*PreparedReload, error) {
+	config, change, err := c.reloadChange(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	r := &PreparedReload{controller: c, config: config, change: change}
+	if len(change.inPlace) == 0 && len(change.rebuild) == 0 {
+		return r, nil
+	}
+	if config.RemoteRuleConfig != nil && !reflect.DeepEqual(config.RemoteRuleConfig, c.config.RemoteRuleConfig) {
+		if r.remoteRuleFetcher, err = rule.NewRemoteFetcher(config.RemoteRuleConfig); err != nil {
+			return nil, err
+		}
+	}
+	if r.rejectResponse, err = RejectResponseBuilder(config.RejectResponseConfig); err != nil {
+		return nil, err
+	}
+	if r.hosts, err = StaticHostsBuilder(config.DNSHosts); err != nil {
+		return nil, err
+	}
+	if len(change.rebuild) > 0 {
+		c.access.Lock()
+		defer c.access.Unlock()
+		if c.nodeInfo.NodeType != "Hysteria2" {
+			if _, err := nodeInboundsBuilder(config, c.nodeInfo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// Apply applies the prepared config to the node. The inbounds are rebuilt if a change is built into them, the other
+// changes are applied in place, so the connections of the node stay up. It returns an error and leaves the node as
+// it is if the new inbounds cannot be started.
+func (r *PreparedReload) Apply() error {
+	c := r.controller
+	if len(r.change.inPlace) == 0 && len(r.change.rebuild) == 0 {
+		return nil
+	}
+	periodics, err := c.applyConfig(r)
+	if err != nil {
+		return err
+	}
+	// The new periodics run at once, out of the lock their tasks take
+	for _, periodic := range periodics {
+		if err := periodic.Start(); err != nil {
+			log.Print(err)
+		}
+	}
+	log.Printf("Reloaded the config of node %d: %s", c.clientInfo.NodeID, strings.Join(append(r.change.rebuild, r.change.inPlace...), ", "))
+	return nil
+}
+
+// Reload applies the changed local config to the running node, see PrepareReload and Apply
+func (c *Controller) Reload(config *Config) error {
+	r, err := c.PrepareReload(config)
+	if err != nil {
+		return err
+	}
+	return r.Apply()
+}
+
+// applyConfig swaps the config of the node, and returns the periodics replaced for the changed intervals to start
+func (c *Controller) applyConfig(r *PreparedReload) ([]*task.Periodic, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	config, change := r.config, r.change
+	oldConfig := c.config
+	if len(change.rebuild) > 0 && c.nodeInfo.NodeType != "Hysteria2" {
+		// The node info may have changed since the reload was prepared, build the new inbounds again before
+		// removing the running ones, so an invalid config leaves the node as it is
+		if _, err := nodeInboundsBuilder(config, c.nodeInfo); err != nil {
+			return nil, err
+		}
+		c.config = config
+		if err := c.rebuildInbounds(c.nodeInfo); err != nil {
+			log.Printf("Rebuild the inbounds of node %d failed: %s, restore the old config", c.clientInfo.NodeID, err)
+			c.config = oldConfig
+			if err := c.rebuildInbounds(c.nodeInfo); err != nil {
+				log.Print(err)
+				c.probe.setUp(false)
+			}
+			return nil, err
+		}
+	} else {
+		c.config = config
+		for _, tag := range c.inboundTags {
+			if err := c.UpdateProtocolRule(tag, config.BlockProtocols); err != nil {
+				log.Print(err)
+			}
+			c.UpdateSniffIncludeDomains(tag, config.SniffIncludeDomains)
+			c.UpdateSniffers(tag, c.sniffersOf(tag))
+			c.UpdateLogLevel(tag, config.LogLevel)
+			c.UpdateRejectResponse(tag, r.rejectResponse)
+			c.UpdateStaticHosts(tag, r.hosts)
+		}
+		if c.nodeInfo.NodeType != "Hysteria2" {
+			// The extra inbounds share the limiter of the main one
+			if err := c.UpdateInboundLimitConfig(c.tag); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	c.userListGuard.ratio = config.MinUserListRatio
+	c.errorLog.setWindow(time.Duration(config.ErrorLogWindow) * time.Second)
+	c.probe.setReadyTimeout(readyTimeout(config, c.interval(config.NodeInfoPeriodic)))
+	var periodics []*task.Periodic
+	if interval := c.interval(config.NodeInfoPeriodic); interval != c.nodeInfoBackoff.base || c.maxBackoff() != c.nodeInfoBackoff.max {
+		c.nodeInfoBackoff = pollBackoff{base: interval, max: c.maxBackoff()}
+		c.nodeInfoMonitorPeriodic = replacePeriodic(c.nodeInfoMonitorPeriodic, interval)
+		periodics = append(periodics, c.nodeInfoMonitorPeriodic)
+	}
+	if interval := c.interval(config.UserListPeriodic); interval != c.userListMonitorPeriodic.Interval {
+		c.userListMonitorPeriodic = replacePeriodic(c.userListMonitorPeriodic, interval)
+		periodics = append(periodics, c.userListMonitorPeriodic)
+	}
+	if interval := c.interval(config.ReportPeriodic); interval != c.userReportPeriodic.Interval {
+		c.userReportPeriodic = replacePeriodic(c.userReportPeriodic, interval)
+		periodics = append(periodics, c.userReportPeriodic)
+	}
+	if !reflect.DeepEqual(config.RemoteRuleConfig, oldConfig.RemoteRuleConfig) {
+		if c.remoteRulePeriodic != nil {
+			c.remoteRulePeriodic.Close()
+			c.remoteRulePeriodic = nil
+		}
+		c.remoteRuleFetcher = r.remoteRuleFetcher
+		if r.remoteRuleFetcher != nil {
+			c.remoteRulePeriodic = &task.Periodic{
+				Interval: config.RemoteRuleConfig.FetchInterval(),
+				Execute:  c.remoteRuleMonitor,
+			}
+			periodics = append(periodics, c.remoteRulePeriodic)
+		} else {
+			// The remote lists are removed from the config
+			c.remoteRules = nil
+			for _, tag := range c.inboundTags {
+				if err := c.UpdateRemoteRule(tag, nil); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+	return periodics, nil
+}
+
+// replacePeriodic closes the periodic, and returns one of its task at the interval. The task of the closed one
+// may be running, it is not scheduled again.
+func replacePeriodic(periodic *task.Periodic, interval time.Duration) *task.Periodic {
+	periodic.Close()
+	return &task.Periodic{Interval: interval, Execute: periodic.Execute}
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserSpeed is the live speed of a user
+type UserSpeed struct {
+	UID      int
+	Email    string
+	Upload   int64 // Bytes per second
+	Download int64 // Bytes per second
+}
+
+type trafficCount struct {
+	uid      int
+	up, down int64
+}
+
+// speedMeter measures the speed of the users from their traffic counters, against the counters at the last sample.
+// Hold the access while reading the counters, so a report resetting them is accounted for.
+type speedMeter struct {
+	access  sync.Mutex
+	base    map[string]trafficCount // Key: Email, the counters at the last sample less the traffic reported since
+	sampled time.Time
+}
+
+// measure returns the speed of the users with traffic since the last sample, and starts a new sample if roll is set
+func (m *speedMeter) measure(counters map[string]trafficCount, now time.Time, roll bool) []UserSpeed {
+	speed := make([]UserSpeed, 0)
+	if elapsed := now.Sub(m.sampled); !m.sampled.IsZero() && elapsed > 0 {
+		for email, count := range counters {
+			base := m.base[email]
+			up := (count.up - base.up) * int64(time.Second) / int64(elapsed)
+			down := (count.down - base.down) * int64(time.Second) / int64(elapsed)
+			if up > 0 || down > 0 {
+				speed = append(speed, UserSpeed{UID: count.uid, Email: email, Upload: up, Download: down})
+			}
+		}
+	}
+	sort.Slice(speed, func(i, j int) bool { return speed[i].Email < speed[j].Email })
+	if roll {
+		m.base = counters
+		m.sampled = now
+	}
+	return speed
+}
+
+// reported takes the traffic reset from the counters of the user off the last sample
+func (m *speedMeter) reported(email string, up int64, down int64) {
+	if m.base == nil {
+		return
+	}
+	base := m.base[email]
+	base.up -= up
+	base.down -= down
+	m.base[email] = base
+}
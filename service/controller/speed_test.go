@@ -0,0 +1,20 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeedMeterReported(t *testing.T) {
+	var m speedMeter
+	start := time.Unix(1600000000, 0)
+	if speed := m.measure(map[string]trafficCount{"a": {uid: 1, up: 100}}, start, true); len(speed) != 0 {
+		t.Errorf("want no speed without a sample, but got %+v", speed)
+	}
+	// 1000 bytes are counted, then 600 of them are reported and reset before the next sample
+	m.reported("a", 600, 0)
+	speed := m.measure(map[string]trafficCount{"a": {uid: 1, up: 500}}, start.Add(2*time.Second), true)
+	if len(speed) != 1 || speed[0] != (UserSpeed{UID: 1, Email: "a", Upload: 500}) {
+		t.Errorf("want 1000 bytes in 2 seconds, but got %+v", speed)
+	}
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/limiter"
+)
+
+// The live state of the node, read by the admin API. None of them changes the state.
+
+// Tag returns the tag of the node inbound
+func (c *Controller) Tag() string {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.tag
+}
+
+// NodeInfo returns the node info the inbounds are built from
+func (c *Controller) NodeInfo() *api.NodeInfo {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.nodeInfo
+}
+
+// OnlineUsers returns the online devices since the last report
+func (c *Controller) OnlineUsers() (*[]api.OnlineUser, error) {
+	return c.ListOnlineDevice(c.Tag())
+}
+
+// UserSpeed returns the speed of the users with traffic since the last sample, within 10 seconds
+func (c *Controller) UserSpeed() []UserSpeed {
+	c.access.Lock()
+	userList := c.userList
+	c.access.Unlock()
+	c.speed.access.Lock()
+	defer c.speed.access.Unlock()
+	return c.speed.measure(c.readUserTraffic(userList), time.Now(), false)
+}
+
+// BucketStatus returns the state of the speed limit buckets
+func (c *Controller) BucketStatus() ([]limiter.BucketStatus, error) {
+	return c.GetBucketStatus(c.Tag())
+}
+
+// sampleUserSpeed starts a new sample of the speed of the users
+func (c *Controller) sampleUserSpeed() {
+	c.access.Lock()
+	userList := c.userList
+	c.access.Unlock()
+	c.speed.access.Lock()
+	defer c.speed.access.Unlock()
+	c.speed.measure(c.readUserTraffic(userList), time.Now(), true)
+}
+
+// ConfigDump returns the xray config built for the node from the node info and the local config, with the secrets masked
+func (c *Controller) ConfigDump() (*ConfigDump, error) {
+	c.access.Lock()
+	nodeInfo := c.nodeInfo
+	c.access.Unlock()
+	return BuildConfigDump(c.config, nodeInfo)
+}
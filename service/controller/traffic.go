@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/features/stats"
+)
+
+// userTrafficCount is the traffic of a user in total and by the network
+type userTrafficCount struct {
+	up, down       int64
+	tcpUp, tcpDown int64
+	udpUp, udpDown int64
+}
+
+// counterVisitor is the stats manager of xray-core, which visits all the counters under one lock
+type counterVisitor interface {
+	VisitCounters(visitor func(string, stats.Counter) bool)
+}
+
+// takeUserTraffic gets and resets the traffic counters of the users, and reports the traffic to the speed meter
+func (c *Controller) takeUserTraffic(userList *[]api.UserInfo) map[string]userTrafficCount {
+	statsManager := c.server.GetFeature(stats.ManagerType()).(stats.Manager)
+	c.speed.access.Lock()
+	defer c.speed.access.Unlock()
+	traffic := takeTrafficCounters(statsManager, userList)
+	for email, count := range traffic {
+		c.speed.reported(email, count.up, count.down)
+	}
+	return traffic
+}
+
+// takeTrafficCounters gets and resets the traffic counters of the users. The counters are read in a single pass
+// if the manager can visit them, which is much cheaper than a lookup of each counter on a node of many users.
+// The counters of the users not in the list are left as they are.
+func takeTrafficCounters(statsManager stats.Manager, userList *[]api.UserInfo) map[string]userTrafficCount {
+	visitor, ok := statsManager.(counterVisitor)
+	if !ok {
+		return takeTrafficCountersByUser(statsManager, userList)
+	}
+	counts := make(map[string]*userTrafficCount, len(*userList))
+	for _, user := range *userList {
+		counts[user.Email] = &userTrafficCount{}
+	}
+	visitor.VisitCounters(func(name string, counter stats.Counter) bool {
+		email, kind, ok := parseUserTrafficCounter(name)
+		if !ok {
+			return true
+		}
+		count, ok := counts[email]
+		if !ok {
+			return true
+		}
+		switch kind {
+		case "uplink":
+			count.up = counter.Set(0)
+		case "downlink":
+			count.down = counter.Set(0)
+		case "tcp>>>uplink":
+			count.tcpUp = counter.Set(0)
+		case "tcp>>>downlink":
+			count.tcpDown = counter.Set(0)
+		case "udp>>>uplink":
+			count.udpUp = counter.Set(0)
+		case "udp>>>downlink":
+			count.udpDown = counter.Set(0)
+		}
+		return true
+	})
+	traffic := make(map[string]userTrafficCount, len(counts))
+	for email, count := range counts {
+		traffic[email] = *count
+	}
+	return traffic
+}
+
+// takeTrafficCountersByUser gets and resets the traffic counters of the users by a lookup of each counter
+func takeTrafficCountersByUser(statsManager stats.Manager, userList *[]api.UserInfo) map[string]userTrafficCount {
+	traffic := make(map[string]userTrafficCount, len(*userList))
+	take := func(name string) int64 {
+		if counter := statsManager.GetCounter(name); counter != nil {
+			return counter.Set(0)
+		}
+		return 0
+	}
+	for _, user := range *userList {
+		prefix := "user>>>" + user.Email + ">>>traffic>>>"
+		traffic[user.Email] = userTrafficCount{
+			up:      take(prefix + "uplink"),
+			down:    take(prefix + "downlink"),
+			tcpUp:   take(prefix + "tcp>>>uplink"),
+			tcpDown: take(prefix + "tcp>>>downlink"),
+			udpUp:   take(prefix + "udp>>>uplink"),
+			udpDown: take(prefix + "udp>>>downlink"),
+		}
+	}
+	return traffic
+}
+
+// parseUserTrafficCounter returns the email and the kind of the user traffic counter, like uplink or tcp>>>uplink
+func parseUserTrafficCounter(name string) (email string, kind string, ok bool) {
+	if !strings.HasPrefix(name, "user>>>") {
+		return "", "", false
+	}
+	name = strings.TrimPrefix(name, "user>>>")
+	i := strings.LastIndex(name, ">>>traffic>>>")
+	if i < 0 {
+		return "", "", false
+	}
+	return name[:i], name[i+len(">>>traffic>>>"):], true
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/app/stats"
+	featurestats "github.com/xtls/xray-core/features/stats"
+)
+
+// lookupManager hides the counter visitor of the manager, so the counters are looked up by the user
+type lookupManager struct {
+	featurestats.Manager
+}
+
+// newTrafficManager registers the traffic counters of the users, a user of an odd UID has only uplink traffic
+func newTrafficManager(t testing.TB, users int) (*stats.Manager, *[]api.UserInfo) {
+	m, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userList := make([]api.UserInfo, users)
+	for i := range userList {
+		email := fmt.Sprintf("%d|user%d@test.com|%d", i, i, i)
+		userList[i] = api.UserInfo{UID: i, Email: email}
+		names := map[string]int64{"uplink": int64(i + 100), "tcp>>>uplink": int64(i + 60), "udp>>>uplink": 40}
+		if i%2 == 0 {
+			names["downlink"] = int64(2*i + 10)
+			names["tcp>>>downlink"] = int64(2*i + 10)
+		}
+		for name, value := range names {
+			counter, err := m.RegisterCounter("user>>>" + email + ">>>traffic>>>" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter.Set(value)
+		}
+	}
+	return m, &userList
+}
+
+func TestTakeTrafficCounters(t *testing.T) {
+	m, userList := newTrafficManager(t, 10)
+	// The counters of a user not in the list are not taken
+	other, err := m.RegisterCounter("user>>>removed@test.com>>>traffic>>>uplink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Set(1000)
+	lookup, _ := newTrafficManager(t, 10)
+
+	traffic := takeTrafficCounters(m, userList)
+	want := takeTrafficCountersByUser(lookupManager{lookup}, userList)
+	if !reflect.DeepEqual(traffic, want) {
+		t.Errorf("the single pass should take the traffic of the lookups: %v, want %v", traffic, want)
+	}
+	if count := traffic["1|user1@test.com|1"]; count.up != 101 || count.down != 0 || count.tcpUp != 61 || count.udpUp != 40 {
+		t.Errorf("unexpected traffic of the user with only uplink: %+v", count)
+	}
+	if count := traffic["2|user2@test.com|2"]; count.up != 102 || count.down != 14 || count.tcpDown != 14 {
+		t.Errorf("unexpected traffic of the user with both directions: %+v", count)
+	}
+	if _, ok := traffic["removed@test.com"]; ok || other.Value() != 1000 {
+		t.Error("the counters of the users not in the list should be left as they are")
+	}
+	// The counters are reset on read
+	traffic = takeTrafficCounters(m, userList)
+	for email, count := range traffic {
+		if count != (userTrafficCount{}) {
+			t.Errorf("the traffic of %s should be reset, got %+v", email, count)
+		}
+	}
+}
+
+func TestTakeTrafficCountersByUser(t *testing.T) {
+	m, userList := newTrafficManager(t, 2)
+	traffic := takeTrafficCounters(lookupManager{m}, userList)
+	if count := traffic["0|user0@test.com|0"]; count.up != 100 || count.down != 10 {
+		t.Errorf("unexpected traffic: %+v", count)
+	}
+	if traffic = takeTrafficCounters(lookupManager{m}, userList); traffic["0|user0@test.com|0"] != (userTrafficCount{}) {
+		t.Errorf("the traffic should be reset, got %+v", traffic["0|user0@test.com|0"])
+	}
+}
+
+func BenchmarkTakeTrafficCounters(b *testing.B) {
+	m, userList := newTrafficManager(b, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		takeTrafficCounters(m, userList)
+	}
+}
+
+func BenchmarkTakeTrafficCountersByUser(b *testing.B) {
+	m, userList := newTrafficManager(b, 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		takeTrafficCountersByUser(m, userList)
+	}
+}
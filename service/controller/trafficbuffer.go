@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// trafficBuffer is the traffic taken from the counters and not reported to the panel yet
+type trafficBuffer struct {
+	NodeID   int               `json:"node_id"`
+	NodeType string            `json:"node_type"`
+	Traffic  []api.UserTraffic `json:"traffic"`
+}
+
+// saveTrafficBuffer replaces the buffered traffic atomically. The buffer holds the traffic of the current report
+// until each batch is reported, and the traffic of the failed batches until they are reported again, so the traffic
+// is not lost after a restart. It is reported at least once: a crash after the panel took a batch and before the
+// buffer is rewritten reports that batch again on the next start. There is no id to drop the repeated batch by, as
+// the panels take the traffic as a plain list of the users and their bytes
+func saveTrafficBuffer(path string, clientInfo api.ClientInfo, traffic []api.UserTraffic) error {
+	data, err := json.Marshal(&trafficBuffer{NodeID: clientInfo.NodeID, NodeType: clientInfo.NodeType, Traffic: traffic})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("Save traffic buffer failed: %s", err)
+	}
+	return nil
+}
+
+// loadTrafficBuffer reads the traffic not reported before the restart, nil if there is no buffer yet
+func loadTrafficBuffer(path string, clientInfo api.ClientInfo) ([]api.UserTraffic, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Load traffic buffer failed: %s", err)
+	}
+	buffer := new(trafficBuffer)
+	if err := json.Unmarshal(data, buffer); err != nil {
+		return nil, fmt.Errorf("Load traffic buffer %s failed: %s", path, err)
+	}
+	if buffer.NodeID != clientInfo.NodeID || buffer.NodeType != clientInfo.NodeType {
+		return nil, fmt.Errorf("Invalid traffic buffer %s: it is of %s node %d, but this is %s node %d",
+			path, buffer.NodeType, buffer.NodeID, clientInfo.NodeType, clientInfo.NodeID)
+	}
+	return buffer.Traffic, nil
+}
+
+// loadTrafficBuffer queues the traffic not reported before the restart to the first report
+func (c *Controller) loadTrafficBuffer() {
+	if c.config.TrafficBufferPath == "" {
+		return
+	}
+	traffic, err := loadTrafficBuffer(c.config.TrafficBufferPath, c.clientInfo)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if len(traffic) > 0 {
+		log.Printf("Loaded the traffic of %d users not reported before the restart", len(traffic))
+		c.pendingTraffic = traffic
+	}
+}
+
+// bufferTraffic replaces the buffered traffic with the traffic not reported yet
+func (c *Controller) bufferTraffic(traffic []api.UserTraffic) {
+	if c.config.TrafficBufferPath == "" {
+		return
+	}
+	if err := saveTrafficBuffer(c.config.TrafficBufferPath, c.clientInfo, traffic); err != nil {
+		c.errorLog.Print(err)
+	}
+}
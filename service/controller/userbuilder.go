@@ -1,11 +1,14 @@
 package controller
 
 import (
+	"fmt"
+	"log"
 	"strings"
 
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/common/uuid"
 	"github.com/xtls/xray-core/infra/conf"
 	"github.com/xtls/xray-core/proxy/shadowsocks"
 	"github.com/xtls/xray-core/proxy/trojan"
@@ -14,78 +17,129 @@ import (
 
 var AEADMethod = []shadowsocks.CipherType{shadowsocks.CipherType_AES_128_GCM, shadowsocks.CipherType_AES_256_GCM, shadowsocks.CipherType_CHACHA20_POLY1305}
 
+// vmessAlterID returns the AlterID to build the VMess users of the node with. The AEAD only node ignores the
+// AlterID of the panel, or is refused if RejectVMessAlterID is set
+func vmessAlterID(config *Config, nodeInfo *api.NodeInfo) (int, error) {
+	if !config.VMessAEADOnly || nodeInfo.AlterID == 0 {
+		return nodeInfo.AlterID, nil
+	}
+	if config.RejectVMessAlterID {
+		return 0, fmt.Errorf("The panel requests AlterID %d for VMess node %d, but only AEAD (AlterID 0) is allowed", nodeInfo.AlterID, nodeInfo.NodeID)
+	}
+	return 0, nil
+}
+
 func buildVmessUser(userInfo *[]api.UserInfo, serverAlterID int) (users []*protocol.User) {
-	users = make([]*protocol.User, len(*userInfo))
-	for i, user := range *userInfo {
+	users = make([]*protocol.User, 0, len(*userInfo))
+	for _, user := range *userInfo {
+		if _, err := uuid.ParseString(user.UUID); err != nil {
+			log.Printf("Skip user %s (UID %d): invalid UUID %s", user.Email, user.UID, user.UUID)
+			continue
+		}
 		vmessAccount := &conf.VMessAccount{
 			ID:       user.UUID,
 			AlterIds: uint16(serverAlterID),
 			Security: "auto",
 		}
-		users[i] = &protocol.User{
+		users = append(users, &protocol.User{
 			Level:   0,
 			Email:   user.Email,
 			Account: serial.ToTypedMessage(vmessAccount.Build()),
-		}
+		})
 	}
 	return users
 }
 
 func buildVlessUser(userInfo *[]api.UserInfo) (users []*protocol.User) {
-	users = make([]*protocol.User, len(*userInfo))
-	for i, user := range *userInfo {
+	users = make([]*protocol.User, 0, len(*userInfo))
+	for _, user := range *userInfo {
+		if _, err := uuid.ParseString(user.UUID); err != nil {
+			log.Printf("Skip user %s (UID %d): invalid UUID %s", user.Email, user.UID, user.UUID)
+			continue
+		}
 		vlessAccount := &vless.Account{
 			Id:   user.UUID,
 			Flow: "xtls-rprx-direct",
 		}
-		users[i] = &protocol.User{
+		users = append(users, &protocol.User{
 			Level:   0,
 			Email:   user.Email,
 			Account: serial.ToTypedMessage(vlessAccount),
-		}
+		})
 	}
 	return users
 }
 
 func buildTrojanUser(userInfo *[]api.UserInfo) (users []*protocol.User) {
-	users = make([]*protocol.User, len(*userInfo))
-	for i, user := range *userInfo {
+	users = make([]*protocol.User, 0, len(*userInfo))
+	for _, user := range *userInfo {
+		if user.UUID == "" {
+			log.Printf("Skip user %s (UID %d): empty password", user.Email, user.UID)
+			continue
+		}
 		trojanAccount := &trojan.Account{
 			Password: user.UUID,
 			Flow:     "xtls-rprx-direct",
 		}
-		users[i] = &protocol.User{
+		users = append(users, &protocol.User{
 			Level:   0,
 			Email:   user.Email,
 			Account: serial.ToTypedMessage(trojanAccount),
-		}
+		})
 	}
 	return users
 }
 
-func buildSSUser(userInfo *[]api.UserInfo) (users []*protocol.User) {
+// buildSSUser builds the users of the Shadowsocks node, each with its own cipher. The users of a single-port node
+// of the nodeMethod must use it, the users of another method are skipped and the ones without a method use it
+func buildSSUser(userInfo *[]api.UserInfo, nodeMethod string) (users []*protocol.User) {
 	users = make([]*protocol.User, 0)
 	for _, user := range *userInfo {
+		if user.Passwd == "" {
+			log.Printf("Skip user %s (UID %d): empty password", user.Email, user.UID)
+			continue
+		}
+		if nodeMethod != "" {
+			if user.Method == "" {
+				user.Method = nodeMethod
+			} else if !sameSSMethod(user.Method, nodeMethod) {
+				log.Printf("Skip user %s (UID %d): method %s does not match the method %s of the single-port node", user.Email, user.UID, user.Method, nodeMethod)
+				continue
+			}
+		}
 		// Check if the cypher method is AEAD
 		cypherMethod := cipherFromString(user.Method)
-		for _, aeadMethod := range AEADMethod {
-			if aeadMethod == cypherMethod {
-				ssAccount := &shadowsocks.Account{
-					Password:   user.Passwd,
-					CipherType: cypherMethod,
-				}
-				users = append(users, &protocol.User{
-					Level:   0,
-					Email:   user.Email,
-					Account: serial.ToTypedMessage(ssAccount),
-				})
-			}
+		if !isAEADMethod(cypherMethod) {
+			log.Printf("Skip user %s (UID %d): unsupported method %s, only AEAD methods are supported", user.Email, user.UID, user.Method)
+			continue
 		}
-
+		ssAccount := &shadowsocks.Account{
+			Password:   user.Passwd,
+			CipherType: cypherMethod,
+		}
+		users = append(users, &protocol.User{
+			Level:   0,
+			Email:   user.Email,
+			Account: serial.ToTypedMessage(ssAccount),
+		})
 	}
 	return users
 }
 
+func isAEADMethod(cypherMethod shadowsocks.CipherType) bool {
+	for _, aeadMethod := range AEADMethod {
+		if aeadMethod == cypherMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSSMethod reports whether the methods are the same cipher, like aes-128-gcm and aead_aes_128_gcm
+func sameSSMethod(a, b string) bool {
+	return cipherFromString(a) == cipherFromString(b)
+}
+
 func cipherFromString(c string) shadowsocks.CipherType {
 	switch strings.ToLower(c) {
 	case "aes-256-cfb":
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/xtls/xray-core/common/protocol"
+)
+
+type cachedAccount struct {
+	key     string // The type and the serialized account, which change with the UUID, password or method of the user
+	account protocol.Account
+}
+
+// memoryUserCache keeps the accounts built for the users, so rebuilding the inbounds with the same users
+// does not parse their UUIDs and derive their keys again
+type memoryUserCache struct {
+	access   sync.Mutex
+	accounts map[string]cachedAccount // Key: Email
+}
+
+// toMemoryUser builds the memory user with the cached account if the account of the user is unchanged
+func (m *memoryUserCache) toMemoryUser(user *protocol.User) (*protocol.MemoryUser, error) {
+	key := user.GetAccount().GetType() + string(user.GetAccount().GetValue())
+	m.access.Lock()
+	defer m.access.Unlock()
+	if cached, ok := m.accounts[user.Email]; ok && cached.key == key {
+		return &protocol.MemoryUser{
+			Account: cached.account,
+			Email:   user.Email,
+			Level:   user.Level,
+		}, nil
+	}
+	mUser, err := user.ToMemoryUser()
+	if err != nil {
+		return nil, err
+	}
+	if m.accounts == nil {
+		m.accounts = make(map[string]cachedAccount)
+	}
+	m.accounts[user.Email] = cachedAccount{key: key, account: mUser.Account}
+	return mUser, nil
+}
+
+// remove drops the accounts of the users removed from the node
+func (m *memoryUserCache) remove(emails []string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for _, email := range emails {
+		delete(m.accounts, email)
+	}
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+	"github.com/xtls/xray-core/common/uuid"
+)
+
+func TestMemoryUserCache(t *testing.T) {
+	var cache memoryUserCache
+	userList := []api.UserInfo{{UID: 1, Email: "a", UUID: newUUID()}}
+	first, err := cache.toMemoryUser(buildVmessUser(&userList, 0)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.toMemoryUser(buildVmessUser(&userList, 0)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || first.Account != second.Account {
+		t.Error("the unchanged user should be a new memory user with the cached account")
+	}
+	// A new UUID of the user builds a new account
+	userList[0].UUID = newUUID()
+	changed, err := cache.toMemoryUser(buildVmessUser(&userList, 0)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Account == first.Account || changed.Account.Equals(first.Account) {
+		t.Error("the changed user should not reuse the cached account")
+	}
+	cache.remove([]string{"a"})
+	if len(cache.accounts) != 0 {
+		t.Errorf("the removed user should be dropped from the cache, but got %d", len(cache.accounts))
+	}
+}
+
+func BenchmarkRebuildUsers(b *testing.B) {
+	userList := make([]api.UserInfo, 5000)
+	for i := range userList {
+		userList[i] = api.UserInfo{UID: i, Email: fmt.Sprintf("%d@test.com", i), UUID: newUUID()}
+	}
+	users := buildVmessUser(&userList, 0)
+	b.Run("Uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, user := range users {
+				if _, err := user.ToMemoryUser(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		var cache memoryUserCache
+		for _, user := range users {
+			if _, err := cache.toMemoryUser(user); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, user := range users {
+				if _, err := cache.toMemoryUser(user); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func newUUID() string {
+	id := uuid.New()
+	return id.String()
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"log"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// userListGuard holds off deleting the users missing from a user list which shrinks below the ratio of the last one,
+// as the panel may return a truncated list. The users are deleted if the next fetch confirms the shrink.
+type userListGuard struct {
+	ratio   float64 // 0 disables the guard
+	guarded bool    // The deletion of the last fetch was held off
+}
+
+// keep splits the deleted users into the ones to remove and the missing ones to keep for this cycle,
+// the users changed in the new list are always removed, as the new version of them is added
+func (g *userListGuard) keep(old, new *[]api.UserInfo, deleted []api.UserInfo) (removed, kept []api.UserInfo) {
+	if g.ratio <= 0 || old == nil || len(*old) == 0 || float64(len(*new)) >= g.ratio*float64(len(*old)) {
+		g.guarded = false
+		return deleted, nil
+	}
+	if g.guarded {
+		log.Printf("The user list shrinks from %d to %d users again, delete the missing users", len(*old), len(*new))
+		g.guarded = false
+		return deleted, nil
+	}
+	current := make(map[string]bool, len(*new))
+	for _, u := range *new {
+		current[u.Email] = true
+	}
+	for _, u := range deleted {
+		if current[u.Email] {
+			removed = append(removed, u)
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	log.Printf("The user list shrinks from %d to %d users, below the ratio %g. Keep the %d missing users until the next fetch confirms it",
+		len(*old), len(*new), g.ratio, len(kept))
+	g.guarded = true
+	return removed, kept
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func testUserList(n int) *[]api.UserInfo {
+	userList := make([]api.UserInfo, n)
+	for i := range userList {
+		userList[i] = api.UserInfo{UID: i + 1, Email: fmt.Sprintf("%d|%d@test.com|%d", i+1, i+1, i+1)}
+	}
+	return &userList
+}
+
+func TestUserListGuardDisabled(t *testing.T) {
+	g := &userListGuard{}
+	old, new := testUserList(100), testUserList(10)
+	deleted, _ := compareUserList(old, new)
+	// A large shrink is applied at once without the guard
+	if removed, kept := g.keep(old, new, deleted); len(removed) != 90 || len(kept) != 0 {
+		t.Errorf("want 90 users removed and none kept, but got %d and %d", len(removed), len(kept))
+	}
+}
+
+func TestUserListGuardSuspect(t *testing.T) {
+	g := &userListGuard{ratio: 0.5}
+	old, new := testUserList(100), testUserList(10)
+	// A user changed in the new list is replaced as usual
+	(*new)[0].SpeedLimit = 1000
+	deleted, added := compareUserList(old, new)
+	removed, kept := g.keep(old, new, deleted)
+	if len(removed) != 1 || removed[0].UID != 1 || len(kept) != 90 || len(added) != 1 {
+		t.Fatalf("want the changed user replaced and 90 users kept, but got %d removed, %d kept and %d added", len(removed), len(kept), len(added))
+	}
+	// The next fetch confirms the shrink
+	merged := append(append([]api.UserInfo{}, *new...), kept...)
+	deleted, _ = compareUserList(&merged, new)
+	if removed, kept := g.keep(&merged, new, deleted); len(removed) != 90 || len(kept) != 0 {
+		t.Errorf("want the confirmed shrink applied, but got %d removed and %d kept", len(removed), len(kept))
+	}
+	// A shrink above the ratio is not suspect
+	old, new = testUserList(100), testUserList(60)
+	deleted, _ = compareUserList(old, new)
+	if removed, kept := g.keep(old, new, deleted); len(removed) != 40 || len(kept) != 0 {
+		t.Errorf("want 40 users removed, but got %d removed and %d kept", len(removed), len(kept))
+	}
+}
+
+func TestUserListGuardRecovered(t *testing.T) {
+	g := &userListGuard{ratio: 0.5}
+	old, new := testUserList(100), testUserList(10)
+	deleted, _ := compareUserList(old, new)
+	_, kept := g.keep(old, new, deleted)
+	merged := append(append([]api.UserInfo{}, *new...), kept...)
+	// The full list is back, nothing is deleted and the guard is reset
+	deleted, added := compareUserList(&merged, old)
+	if removed, kept := g.keep(&merged, old, deleted); len(removed) != 0 || len(kept) != 0 || len(added) != 0 {
+		t.Errorf("want no change, but got %d removed, %d kept and %d added", len(removed), len(kept), len(added))
+	}
+	deleted, _ = compareUserList(old, new)
+	if _, kept := g.keep(old, new, deleted); len(kept) != 90 {
+		t.Errorf("want a new suspect shrink guarded again, but got %d kept", len(kept))
+	}
+}
+
+func TestUserListGuardEmpty(t *testing.T) {
+	g := &userListGuard{ratio: 0.5}
+	// The users of a node without users are all added, and the guard has nothing to keep
+	for _, old := range []*[]api.UserInfo{testUserList(0), nil} {
+		new := testUserList(10)
+		deleted, added := compareUserList(old, new)
+		if removed, kept := g.keep(old, new, deleted); len(removed) != 0 || len(kept) != 0 || len(added) != 10 {
+			t.Errorf("want 10 users added, but got %d removed, %d kept and %d added", len(removed), len(kept), len(added))
+		}
+	}
+	if deleted, added := compareUserList(testUserList(0), nil); len(deleted) != 0 || len(added) != 0 {
+		t.Errorf("want no change between the empty lists, but got %d deleted and %d added", len(deleted), len(added))
+	}
+	if users := deduplicateUserList(nil); users == nil || len(*users) != 0 {
+		t.Errorf("want the missing list deduplicated to an empty list, but got %v", users)
+	}
+}